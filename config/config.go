@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -18,8 +20,79 @@ type Config struct {
 	DBPassword    string
 	DBName        string
 	DBSSLMode     string
+	// DBAutoMigrate applies pending migrations at startup. Without it the
+	// app refuses to start until they are applied with the migrate command.
+	DBAutoMigrate bool
 	JWTSecret     string
 	JWTExpiration time.Duration
+
+	// JWTSigningKeyFile is a PEM RSA or Ed25519 private key access tokens are
+	// signed with. JWTVerifyKeyFiles are older keys whose tokens are still
+	// accepted while a key is rotated out. Without a signing key, tokens are
+	// signed with JWTSecret (HS256), which is only allowed in development.
+	JWTSigningKeyFile string
+	JWTVerifyKeyFiles []string
+
+	// JWTIssuer and JWTAudience are the iss and aud claims of access tokens,
+	// which services verifying tokens must check
+	JWTIssuer   string
+	JWTAudience string
+
+	// RefreshExpiration is how long a session can be kept alive with refresh
+	// tokens before the user has to log in again
+	RefreshExpiration time.Duration
+
+	// PasswordResetExpiration is how long a password reset token stays valid
+	PasswordResetExpiration time.Duration
+	// InviteExpiration is how long the token sent to an invited user to set
+	// their password stays valid
+	InviteExpiration time.Duration
+
+	// Failed logins allowed per username and per client IP before they are
+	// locked out. The lockout starts at LoginLockout and doubles with every
+	// further failure; failures are forgotten after LoginFailureWindow
+	// without one.
+	LoginMaxAttempts   int
+	LoginIPMaxAttempts int
+	LoginLockout       time.Duration
+	LoginFailureWindow time.Duration
+
+	// MFARequiredRoles lists the roles that must use two-factor
+	// authentication; users with other roles may enrol voluntarily.
+	// MFAIssuer is the name shown in authenticator apps.
+	MFARequiredRoles []string
+	MFAIssuer        string
+
+	// Notifier selects how messages such as reset tokens are delivered:
+	// "log" or "file" (appended to NotifierFile)
+	Notifier     string
+	NotifierFile string
+
+	// AllowRegistration enables public self-registration. Self-registered
+	// users always get the cashier role.
+	AllowRegistration bool
+
+	// IdempotencyKeyTTL is how long the response to a sale or purchase made
+	// with an Idempotency-Key header is replayed for retries with that key
+	IdempotencyKeyTTL time.Duration
+
+	// OpenID Connect login through an external identity provider, enabled
+	// when OIDCIssuer is set. OIDCRoleMapping entries are "group=role"; the
+	// first entry matching one of the user's groups gives their role, and
+	// users in no mapped group get OIDCDefaultRole or, if empty, are refused.
+	OIDCIssuer       string
+	OIDCClientID     string
+	OIDCClientSecret string
+	OIDCRedirectURL  string
+	OIDCScopes       []string
+	OIDCGroupsClaim  string
+	OIDCRoleMapping  []string
+	OIDCDefaultRole  string
+
+	// Initial administrator created at startup when no active admin exists
+	AdminUsername string
+	AdminEmail    string
+	AdminPassword string
 }
 
 func Load() *Config {
@@ -28,13 +101,6 @@ func Load() *Config {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	jwtExpStr := getEnv("JWT_EXPIRATION", "24h")
-	jwtExp, err := time.ParseDuration(jwtExpStr)
-	if err != nil {
-		log.Printf("Invalid JWT_EXPIRATION format, using default 24h: %v", err)
-		jwtExp = 24 * time.Hour
-	}
-
 	return &Config{
 		Port:          getEnv("PORT", "8080"),
 		AppEnv:        getEnv("APP_ENV", "development"),
@@ -44,8 +110,47 @@ func Load() *Config {
 		DBPassword:    getEnv("DB_PASSWORD", "postgres"),
 		DBName:        getEnv("DB_NAME", "pharmacy_db"),
 		DBSSLMode:     getEnv("DB_SSLMODE", "disable"),
+		DBAutoMigrate: getEnv("DB_AUTO_MIGRATE", "true") == "true",
 		JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-change-this"),
-		JWTExpiration: jwtExp,
+		JWTExpiration: getEnvDuration("JWT_EXPIRATION", 15*time.Minute),
+
+		JWTSigningKeyFile: getEnv("JWT_SIGNING_KEY_FILE", ""),
+		JWTVerifyKeyFiles: getEnvList("JWT_VERIFY_KEY_FILES", ""),
+		JWTIssuer:         getEnv("JWT_ISSUER", "pharmacy-api"),
+		JWTAudience:       getEnv("JWT_AUDIENCE", "pharmacy-api"),
+
+		RefreshExpiration: getEnvDuration("REFRESH_TOKEN_EXPIRATION", 720*time.Hour),
+
+		PasswordResetExpiration: getEnvDuration("PASSWORD_RESET_EXPIRATION", time.Hour),
+		InviteExpiration:        getEnvDuration("INVITE_EXPIRATION", 72*time.Hour),
+
+		LoginMaxAttempts:   getEnvInt("LOGIN_MAX_ATTEMPTS", 5),
+		LoginIPMaxAttempts: getEnvInt("LOGIN_IP_MAX_ATTEMPTS", 20),
+		LoginLockout:       getEnvDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		LoginFailureWindow: getEnvDuration("LOGIN_FAILURE_WINDOW", 24*time.Hour),
+
+		MFARequiredRoles: getEnvList("MFA_REQUIRED_ROLES", "admin,pharmacist"),
+		MFAIssuer:        getEnv("MFA_ISSUER", "Pharmacy"),
+
+		Notifier:     getEnv("NOTIFIER", "log"),
+		NotifierFile: getEnv("NOTIFIER_FILE", "notifications.log"),
+
+		AllowRegistration: getEnv("ALLOW_REGISTRATION", "true") == "true",
+
+		IdempotencyKeyTTL: getEnvDuration("IDEMPOTENCY_KEY_TTL", 24*time.Hour),
+
+		OIDCIssuer:       getEnv("OIDC_ISSUER", ""),
+		OIDCClientID:     getEnv("OIDC_CLIENT_ID", ""),
+		OIDCClientSecret: getEnv("OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:  getEnv("OIDC_REDIRECT_URL", ""),
+		OIDCScopes:       getEnvList("OIDC_SCOPES", "openid,profile,email"),
+		OIDCGroupsClaim:  getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		OIDCRoleMapping:  getEnvList("OIDC_ROLE_MAPPING", ""),
+		OIDCDefaultRole:  getEnv("OIDC_DEFAULT_ROLE", ""),
+
+		AdminUsername: getEnv("ADMIN_USERNAME", ""),
+		AdminEmail:    getEnv("ADMIN_EMAIL", ""),
+		AdminPassword: getEnv("ADMIN_PASSWORD", ""),
 	}
 }
 
@@ -56,9 +161,58 @@ func (c *Config) GetDBConnectionString() string {
 	)
 }
 
+// MFARequired reports whether users with the role must use two-factor
+// authentication
+func (c *Config) MFARequired(role string) bool {
+	for _, r := range c.MFARequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
 	}
 	return defaultValue
 }
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s format, using default %s: %v", key, defaultValue, err)
+		return defaultValue
+	}
+	return d
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s format, using default %d: %v", key, defaultValue, err)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvList reads a comma-separated list. Setting the variable to "none"
+// gives an empty list.
+func getEnvList(key, defaultValue string) []string {
+	var list []string
+	for _, item := range strings.Split(getEnv(key, defaultValue), ",") {
+		if item = strings.TrimSpace(item); item != "" && item != "none" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
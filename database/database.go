@@ -2,6 +2,7 @@ package database
 
 import (
 	"log"
+	"time"
 
 	"github.com/alfinkly/hci-golang-back/config"
 	"github.com/jmoiron/sqlx"
@@ -35,73 +36,21 @@ func Close() error {
 	return nil
 }
 
-// InitSchema creates the database schema
-func InitSchema() error {
-	schema := `
-	CREATE TABLE IF NOT EXISTS users (
-		id SERIAL PRIMARY KEY,
-		username VARCHAR(100) UNIQUE NOT NULL,
-		email VARCHAR(100) UNIQUE NOT NULL,
-		password_hash VARCHAR(255) NOT NULL,
-		role VARCHAR(50) DEFAULT 'user',
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS suppliers (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL,
-		contact_person VARCHAR(255),
-		phone VARCHAR(50),
-		email VARCHAR(100),
-		address TEXT,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS medicines (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(255) NOT NULL,
-		description TEXT,
-		manufacturer VARCHAR(255),
-		price DECIMAL(10, 2) NOT NULL,
-		quantity INTEGER DEFAULT 0,
-		expiry_date DATE,
-		category VARCHAR(100),
-		requires_prescription BOOLEAN DEFAULT false,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS purchases (
-		id SERIAL PRIMARY KEY,
-		medicine_id INTEGER REFERENCES medicines(id) ON DELETE CASCADE,
-		supplier_id INTEGER REFERENCES suppliers(id) ON DELETE CASCADE,
-		quantity INTEGER NOT NULL,
-		unit_price DECIMAL(10, 2) NOT NULL,
-		total_price DECIMAL(10, 2) NOT NULL,
-		purchase_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE TABLE IF NOT EXISTS sales (
-		id SERIAL PRIMARY KEY,
-		medicine_id INTEGER REFERENCES medicines(id) ON DELETE CASCADE,
-		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
-		quantity INTEGER NOT NULL,
-		unit_price DECIMAL(10, 2) NOT NULL,
-		total_price DECIMAL(10, 2) NOT NULL,
-		sale_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	);
-
-	CREATE INDEX IF NOT EXISTS idx_medicines_name ON medicines(name);
-	CREATE INDEX IF NOT EXISTS idx_medicines_category ON medicines(category);
-	CREATE INDEX IF NOT EXISTS idx_suppliers_name ON suppliers(name);
-	CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
-	CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
+// EnsureAdmin creates an administrator account when there is no active admin
+// yet, so a fresh installation can be managed without public registration.
+// It reports whether a user was created.
+func EnsureAdmin(username, email, passwordHash string) (bool, error) {
+	query := `
+		INSERT INTO users (username, email, password_hash, role, is_active, created_at, updated_at)
+		SELECT $1, $2, $3, 'admin', TRUE, $4, $4
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE role = 'admin' AND is_active)
+		ON CONFLICT DO NOTHING
 	`
 
-	_, err := DB.Exec(schema)
-	return err
+	result, err := DB.Exec(query, username, email, passwordHash, time.Now())
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows > 0, err
 }
@@ -0,0 +1,272 @@
+package database
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Migrations are SQL scripts named <version>_<name>.up.sql, with a
+// <version>_<name>.down.sql script that reverts them. They are applied in
+// version order, each in its own transaction.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the advisory lock held while migrating, so instances of
+// the app starting at the same time do not migrate concurrently
+const migrationLockID = 0x70686172_6d616379
+
+var migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is a versioned change of the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+	// Checksum of the up script. An applied migration must not change.
+	Checksum string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// MigrationStatus is a migration and when it was applied, if it was
+type MigrationStatus struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+// loadMigrations reads the migrations in a directory, ordered by version
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		match := migrationFileName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>.up.sql or .down.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: invalid version", entry.Name())
+		}
+
+		script, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", m, entry.Name())
+		}
+		if match[3] == "up" {
+			m.Up = string(script)
+			sum := sha256.Sum256(script)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(script)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %s needs both an up and a down script", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// appliedMigration is a row of schema_migrations
+type appliedMigration struct {
+	version   int
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// withMigrationLock runs fn on a connection holding the migration lock, once
+// the applied migrations are known to match the embedded ones
+func withMigrationLock(fn func(ctx context.Context, conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error) error {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Advisory locks belong to a session, so the lock, the migrations and
+	// the unlock all use the same connection
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockID); err != nil {
+		return fmt.Errorf("failed to take the migration lock: %w", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockID)
+
+	createQuery := `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version BIGINT PRIMARY KEY,
+			name VARCHAR(255) NOT NULL,
+			checksum VARCHAR(64) NOT NULL,
+			applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+		)
+	`
+	if _, err = conn.ExecContext(ctx, createQuery); err != nil {
+		return err
+	}
+
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := map[int]appliedMigration{}
+	for rows.Next() {
+		var a appliedMigration
+		if err = rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[a.version] = a
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if err = verifyMigrations(migrations, applied); err != nil {
+		return err
+	}
+	return fn(ctx, conn, migrations, applied)
+}
+
+// verifyMigrations checks that every applied migration is one of the
+// migrations, unchanged since it was applied
+func verifyMigrations(migrations []Migration, applied map[int]appliedMigration) error {
+	known := make(map[int]Migration, len(migrations))
+	for _, m := range migrations {
+		known[m.Version] = m
+	}
+
+	versions := make([]int, 0, len(applied))
+	for version := range applied {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	for _, version := range versions {
+		a := applied[version]
+		m, ok := known[version]
+		if !ok {
+			return fmt.Errorf("migration %04d_%s is applied but unknown to this build, which is older than the database", version, a.name)
+		}
+		if m.Checksum != a.checksum {
+			return fmt.Errorf("migration %s was changed after it was applied; add a new migration instead", m)
+		}
+	}
+	return nil
+}
+
+// MigrateUp applies the migrations that are not applied yet, in version
+// order, and returns them. Migrations applied before a failing one stay
+// applied.
+func MigrateUp() ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(func(ctx context.Context, conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+
+			insertQuery := `INSERT INTO schema_migrations (version, name, checksum, applied_at) VALUES ($1, $2, $3, $4)`
+			err := runMigration(ctx, conn, m.Up, insertQuery, m.Version, m.Name, m.Checksum, time.Now())
+			if err != nil {
+				return fmt.Errorf("migration %s failed: %w", m, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// MigrateDown reverts the last steps applied migrations, newest first, and
+// returns them
+func MigrateDown(steps int) ([]Migration, error) {
+	var done []Migration
+	err := withMigrationLock(func(ctx context.Context, conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+
+			deleteQuery := `DELETE FROM schema_migrations WHERE version = $1`
+			if err := runMigration(ctx, conn, m.Down, deleteQuery, m.Version); err != nil {
+				return fmt.Errorf("reverting migration %s failed: %w", m, err)
+			}
+			done = append(done, m)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// runMigration runs a migration script and records it in schema_migrations
+// in one transaction
+func runMigration(ctx context.Context, conn *sql.Conn, script, recordQuery string, args ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, recordQuery, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Migrations returns every migration and when it was applied
+func Migrations() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := withMigrationLock(func(ctx context.Context, conn *sql.Conn, migrations []Migration, applied map[int]appliedMigration) error {
+		for _, m := range migrations {
+			status := MigrationStatus{Migration: m}
+			if a, ok := applied[m.Version]; ok {
+				status.AppliedAt = &a.appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return nil
+	})
+	return statuses, err
+}
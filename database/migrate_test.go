@@ -0,0 +1,96 @@
+package database
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].String() != "0001_initial_schema" {
+		t.Fatalf("migrations = %v", migrations)
+	}
+	for i, m := range migrations {
+		if i > 0 && m.Version <= migrations[i-1].Version {
+			t.Errorf("migration %s is out of order", m)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_notes.up.sql":        {Data: []byte("ALTER TABLE medicines ADD COLUMN notes TEXT;")},
+		"m/0002_add_notes.down.sql":      {Data: []byte("ALTER TABLE medicines DROP COLUMN notes;")},
+		"m/0001_initial_schema.up.sql":   {Data: []byte("CREATE TABLE medicines (id SERIAL);")},
+		"m/0001_initial_schema.down.sql": {Data: []byte("DROP TABLE medicines;")},
+	}
+
+	migrations, err := loadMigrations(fsys, "m")
+	if err != nil {
+		t.Fatalf("loadMigrations: %v", err)
+	}
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].String() != "0002_add_notes" {
+		t.Fatalf("migrations = %v", migrations)
+	}
+	if migrations[1].Down != "ALTER TABLE medicines DROP COLUMN notes;" {
+		t.Errorf("Down = %q", migrations[1].Down)
+	}
+	if len(migrations[0].Checksum) != 64 || migrations[0].Checksum == migrations[1].Checksum {
+		t.Errorf("checksums %q, %q", migrations[0].Checksum, migrations[1].Checksum)
+	}
+}
+
+func TestLoadMigrationsRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name  string
+		files fstest.MapFS
+		err   string
+	}{
+		{"missing down", fstest.MapFS{
+			"m/0001_a.up.sql": {Data: []byte("SELECT 1;")},
+		}, "needs both"},
+		{"duplicate version", fstest.MapFS{
+			"m/0001_a.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_a.down.sql": {Data: []byte("SELECT 1;")},
+			"m/0001_b.up.sql":   {Data: []byte("SELECT 1;")},
+			"m/0001_b.down.sql": {Data: []byte("SELECT 1;")},
+		}, "same version"},
+		{"bad name", fstest.MapFS{
+			"m/add_notes.sql": {Data: []byte("SELECT 1;")},
+		}, "not named"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadMigrations(tt.files, "m")
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestVerifyMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Name: "initial_schema", Checksum: "aaa"},
+		{Version: 2, Name: "add_notes", Checksum: "bbb"},
+	}
+
+	applied := map[int]appliedMigration{1: {version: 1, name: "initial_schema", checksum: "aaa"}}
+	if err := verifyMigrations(migrations, applied); err != nil {
+		t.Errorf("pending migration: %v", err)
+	}
+
+	applied[2] = appliedMigration{version: 2, name: "add_notes", checksum: "changed"}
+	if err := verifyMigrations(migrations, applied); err == nil || !strings.Contains(err.Error(), "changed after it was applied") {
+		t.Errorf("changed migration: %v", err)
+	}
+
+	applied[2] = appliedMigration{version: 2, name: "add_notes", checksum: "bbb"}
+	applied[3] = appliedMigration{version: 3, name: "from_the_future", checksum: "ccc"}
+	if err := verifyMigrations(migrations, applied); err == nil || !strings.Contains(err.Error(), "unknown to this build") {
+		t.Errorf("unknown migration: %v", err)
+	}
+}
@@ -0,0 +1,25 @@
+-- Drops every table of the application, and all its data
+
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS oidc_states;
+DROP TABLE IF EXISTS api_keys;
+DROP TABLE IF EXISTS revoked_tokens;
+DROP TABLE IF EXISTS login_failures;
+DROP TABLE IF EXISTS mfa_recovery_codes;
+DROP TABLE IF EXISTS password_reset_tokens;
+DROP TABLE IF EXISTS refresh_tokens;
+DROP TABLE IF EXISTS auth_sessions;
+DROP TABLE IF EXISTS stock_take_lines;
+DROP TABLE IF EXISTS stock_takes;
+DROP TABLE IF EXISTS stock_adjustments;
+DROP TABLE IF EXISTS stock_movements;
+DROP TABLE IF EXISTS sale_return_items;
+DROP TABLE IF EXISTS sale_returns;
+DROP TABLE IF EXISTS sale_batches;
+DROP TABLE IF EXISTS medicine_batches;
+DROP TABLE IF EXISTS sale_items;
+DROP TABLE IF EXISTS sales;
+DROP TABLE IF EXISTS purchases;
+DROP TABLE IF EXISTS medicines;
+DROP TABLE IF EXISTS suppliers;
+DROP TABLE IF EXISTS users;
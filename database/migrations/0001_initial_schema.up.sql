@@ -0,0 +1,368 @@
+-- Baseline schema. Every statement is idempotent, so it also applies to
+-- databases created before migrations were introduced.
+
+-- Trigram similarity for fuzzy medicine search
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+CREATE TABLE IF NOT EXISTS users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(100) UNIQUE NOT NULL,
+	email VARCHAR(100) UNIQUE NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	role VARCHAR(50) DEFAULT 'cashier',
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Accounts created before role-based access control get the lowest role
+ALTER TABLE users ALTER COLUMN role SET DEFAULT 'cashier';
+UPDATE users SET role = 'cashier'
+WHERE role IS NULL OR role NOT IN ('admin', 'pharmacist', 'cashier', 'auditor');
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_active BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT;
+-- Users who log in through the identity provider, by its subject
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject VARCHAR(255) UNIQUE;
+
+CREATE TABLE IF NOT EXISTS suppliers (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	contact_person VARCHAR(255),
+	phone VARCHAR(50),
+	email VARCHAR(100),
+	address TEXT,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS medicines (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	description TEXT,
+	manufacturer VARCHAR(255),
+	price DECIMAL(10, 2) NOT NULL,
+	quantity INTEGER DEFAULT 0,
+	expiry_date DATE,
+	category VARCHAR(100),
+	requires_prescription BOOLEAN DEFAULT false,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Full-text search document of a medicine, weighted by field. The simple
+-- configuration does not stem, as medicine names are not words of any
+-- one language.
+ALTER TABLE medicines ADD COLUMN IF NOT EXISTS search_vector tsvector GENERATED ALWAYS AS (
+	setweight(to_tsvector('simple', coalesce(name, '')), 'A') ||
+	setweight(to_tsvector('simple', coalesce(manufacturer, '')), 'B') ||
+	setweight(to_tsvector('simple', coalesce(category, '')), 'B') ||
+	setweight(to_tsvector('simple', coalesce(description, '')), 'C')
+) STORED;
+
+CREATE TABLE IF NOT EXISTS purchases (
+	id SERIAL PRIMARY KEY,
+	medicine_id INTEGER REFERENCES medicines(id) ON DELETE CASCADE,
+	supplier_id INTEGER REFERENCES suppliers(id) ON DELETE CASCADE,
+	quantity INTEGER NOT NULL,
+	unit_price DECIMAL(10, 2) NOT NULL,
+	total_price DECIMAL(10, 2) NOT NULL,
+	purchase_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sales (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	receipt_number VARCHAR(50),
+	subtotal DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	discount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	total DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	sale_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS receipt_number VARCHAR(50);
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS subtotal DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS discount DECIMAL(10, 2) NOT NULL DEFAULT 0;
+ALTER TABLE sales ADD COLUMN IF NOT EXISTS total DECIMAL(10, 2) NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS sale_items (
+	id SERIAL PRIMARY KEY,
+	sale_id INTEGER NOT NULL REFERENCES sales(id) ON DELETE CASCADE,
+	medicine_id INTEGER REFERENCES medicines(id) ON DELETE CASCADE,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	unit_price DECIMAL(10, 2) NOT NULL,
+	total_price DECIMAL(10, 2) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS medicine_batches (
+	id SERIAL PRIMARY KEY,
+	medicine_id INTEGER NOT NULL REFERENCES medicines(id) ON DELETE CASCADE,
+	supplier_id INTEGER REFERENCES suppliers(id) ON DELETE SET NULL,
+	purchase_id INTEGER REFERENCES purchases(id) ON DELETE SET NULL,
+	batch_number VARCHAR(100) NOT NULL,
+	expiry_date DATE,
+	quantity INTEGER NOT NULL DEFAULT 0 CHECK (quantity >= 0),
+	received_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS batch_number VARCHAR(100) NOT NULL DEFAULT '';
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS expiry_date DATE;
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS voided_at TIMESTAMP;
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS voided_by INTEGER REFERENCES users(id);
+ALTER TABLE purchases ADD COLUMN IF NOT EXISTS void_reason TEXT;
+
+-- Stock recorded before batch tracking becomes a single legacy batch per medicine
+INSERT INTO medicine_batches (medicine_id, batch_number, expiry_date, quantity, received_at)
+SELECT m.id, 'LEGACY-' || m.id, m.expiry_date, m.quantity, m.created_at
+FROM medicines m
+WHERE m.quantity > 0
+  AND NOT EXISTS (SELECT 1 FROM medicine_batches b WHERE b.medicine_id = m.id);
+
+CREATE TABLE IF NOT EXISTS sale_batches (
+	id SERIAL PRIMARY KEY,
+	sale_id INTEGER NOT NULL REFERENCES sales(id) ON DELETE CASCADE,
+	sale_item_id INTEGER REFERENCES sale_items(id) ON DELETE CASCADE,
+	batch_id INTEGER NOT NULL REFERENCES medicine_batches(id) ON DELETE CASCADE,
+	quantity INTEGER NOT NULL CHECK (quantity > 0)
+);
+
+ALTER TABLE sale_batches ADD COLUMN IF NOT EXISTS sale_item_id INTEGER REFERENCES sale_items(id) ON DELETE CASCADE;
+
+-- Sales recorded before receipts had one medicine per row; each becomes a
+-- receipt with a single line item
+DO $$
+BEGIN
+	IF EXISTS (
+		SELECT 1 FROM information_schema.columns
+		WHERE table_name = 'sales' AND column_name = 'medicine_id'
+	) THEN
+		INSERT INTO sale_items (sale_id, medicine_id, quantity, unit_price, total_price)
+		SELECT s.id, s.medicine_id, s.quantity, s.unit_price, s.total_price
+		FROM sales s
+		WHERE NOT EXISTS (SELECT 1 FROM sale_items i WHERE i.sale_id = s.id);
+
+		UPDATE sales
+		SET subtotal = total_price,
+		    total = total_price,
+		    receipt_number = 'R' || to_char(sale_date, 'YYYYMMDD') || '-' || LPAD(id::text, 6, '0')
+		WHERE receipt_number IS NULL;
+
+		UPDATE sale_batches sb
+		SET sale_item_id = i.id
+		FROM sale_items i
+		WHERE i.sale_id = sb.sale_id AND sb.sale_item_id IS NULL;
+
+		ALTER TABLE sales
+			DROP COLUMN medicine_id,
+			DROP COLUMN quantity,
+			DROP COLUMN unit_price,
+			DROP COLUMN total_price;
+	END IF;
+END $$;
+
+CREATE TABLE IF NOT EXISTS sale_returns (
+	id SERIAL PRIMARY KEY,
+	sale_id INTEGER NOT NULL REFERENCES sales(id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	reason TEXT NOT NULL,
+	refund_amount DECIMAL(10, 2) NOT NULL DEFAULT 0,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS sale_return_items (
+	id SERIAL PRIMARY KEY,
+	return_id INTEGER NOT NULL REFERENCES sale_returns(id) ON DELETE CASCADE,
+	sale_item_id INTEGER NOT NULL REFERENCES sale_items(id) ON DELETE CASCADE,
+	batch_id INTEGER REFERENCES medicine_batches(id) ON DELETE SET NULL,
+	quantity INTEGER NOT NULL CHECK (quantity > 0),
+	disposition VARCHAR(20) NOT NULL,
+	refund_amount DECIMAL(10, 2) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS stock_movements (
+	id SERIAL PRIMARY KEY,
+	medicine_id INTEGER NOT NULL REFERENCES medicines(id) ON DELETE CASCADE,
+	batch_id INTEGER REFERENCES medicine_batches(id) ON DELETE SET NULL,
+	movement_type VARCHAR(20) NOT NULL,
+	quantity INTEGER NOT NULL,
+	balance_after INTEGER NOT NULL,
+	user_id INTEGER REFERENCES users(id),
+	reason TEXT NOT NULL DEFAULT '',
+	reference_type VARCHAR(50) NOT NULL DEFAULT '',
+	reference_id INTEGER,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stock_adjustments (
+	id SERIAL PRIMARY KEY,
+	medicine_id INTEGER NOT NULL REFERENCES medicines(id) ON DELETE CASCADE,
+	batch_id INTEGER REFERENCES medicine_batches(id) ON DELETE SET NULL,
+	delta INTEGER NOT NULL CHECK (delta <> 0),
+	reason_code VARCHAR(30) NOT NULL,
+	note TEXT NOT NULL DEFAULT '',
+	user_id INTEGER NOT NULL REFERENCES users(id),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stock_takes (
+	id SERIAL PRIMARY KEY,
+	status VARCHAR(20) NOT NULL DEFAULT 'open',
+	note TEXT NOT NULL DEFAULT '',
+	created_by INTEGER NOT NULL REFERENCES users(id),
+	posted_by INTEGER REFERENCES users(id),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	posted_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS stock_take_lines (
+	id SERIAL PRIMARY KEY,
+	stock_take_id INTEGER NOT NULL REFERENCES stock_takes(id) ON DELETE CASCADE,
+	medicine_id INTEGER NOT NULL REFERENCES medicines(id) ON DELETE CASCADE,
+	batch_id INTEGER REFERENCES medicine_batches(id) ON DELETE CASCADE,
+	counted_quantity INTEGER NOT NULL CHECK (counted_quantity >= 0),
+	expected_quantity INTEGER,
+	adjustment_id INTEGER REFERENCES stock_adjustments(id) ON DELETE SET NULL,
+	counted_by INTEGER NOT NULL REFERENCES users(id),
+	counted_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A session is one login; it is kept alive by rotating refresh tokens
+CREATE TABLE IF NOT EXISTS auth_sessions (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	user_agent TEXT,
+	ip_address VARCHAR(64),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+	id SERIAL PRIMARY KEY,
+	session_id INTEGER NOT NULL REFERENCES auth_sessions(id) ON DELETE CASCADE,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	used_at TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS password_reset_tokens (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Single-use codes for logging in without the authenticator app
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+	id SERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash VARCHAR(64) NOT NULL,
+	used_at TIMESTAMP,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Failed logins per username and per client IP, for lockout
+CREATE TABLE IF NOT EXISTS login_failures (
+	kind VARCHAR(20) NOT NULL,
+	key VARCHAR(255) NOT NULL,
+	failures INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMP NOT NULL,
+	locked_until TIMESTAMP,
+	PRIMARY KEY (kind, key)
+);
+
+-- Access tokens revoked before they expire, by jti
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+	jti VARCHAR(64) PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- API keys for machine clients. A key acts as its user, limited to its
+-- scopes; only a hash of the key is stored, the prefix identifies it.
+CREATE TABLE IF NOT EXISTS api_keys (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	prefix VARCHAR(16) UNIQUE NOT NULL,
+	key_hash VARCHAR(64) NOT NULL,
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	scopes TEXT[] NOT NULL,
+	expires_at TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at TIMESTAMP,
+	created_by INTEGER REFERENCES users(id),
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Identity provider logins in progress, by the hash of their state
+CREATE TABLE IF NOT EXISTS oidc_states (
+	state_hash VARCHAR(64) PRIMARY KEY,
+	nonce VARCHAR(64) NOT NULL,
+	code_verifier VARCHAR(128) NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Who changed what: one entry per mutating request, with the entity
+-- before and after the change and the changed fields
+CREATE TABLE IF NOT EXISTS audit_log (
+	id BIGSERIAL PRIMARY KEY,
+	occurred_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	username VARCHAR(100),
+	api_key_id INTEGER REFERENCES api_keys(id) ON DELETE SET NULL,
+	action VARCHAR(50) NOT NULL,
+	entity VARCHAR(50) NOT NULL,
+	entity_id INTEGER,
+	before JSONB,
+	after JSONB,
+	changes JSONB,
+	ip_address VARCHAR(64),
+	request_id VARCHAR(64)
+);
+
+-- Stock on hand before the ledger existed is recorded as an opening balance
+INSERT INTO stock_movements (medicine_id, batch_id, movement_type, quantity, balance_after, reason, created_at)
+SELECT b.medicine_id, b.id, 'adjustment', b.quantity,
+       SUM(b.quantity) OVER (PARTITION BY b.medicine_id ORDER BY b.id),
+       'Opening balance', CURRENT_TIMESTAMP
+FROM medicine_batches b
+WHERE b.quantity > 0
+  AND NOT EXISTS (SELECT 1 FROM stock_movements sm WHERE sm.medicine_id = b.medicine_id);
+
+CREATE INDEX IF NOT EXISTS idx_medicines_name ON medicines(name);
+CREATE INDEX IF NOT EXISTS idx_medicines_search ON medicines USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_medicines_name_trgm ON medicines USING GIN (name gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_medicines_manufacturer_trgm ON medicines USING GIN (manufacturer gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS idx_medicines_category ON medicines(category);
+CREATE INDEX IF NOT EXISTS idx_suppliers_name ON suppliers(name);
+CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
+CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
+CREATE INDEX IF NOT EXISTS idx_medicine_batches_medicine ON medicine_batches(medicine_id, expiry_date);
+CREATE INDEX IF NOT EXISTS idx_medicine_batches_number ON medicine_batches(batch_number);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_sales_receipt_number ON sales(receipt_number);
+CREATE INDEX IF NOT EXISTS idx_sale_items_sale ON sale_items(sale_id);
+CREATE INDEX IF NOT EXISTS idx_sale_batches_sale ON sale_batches(sale_id);
+CREATE INDEX IF NOT EXISTS idx_sale_batches_batch ON sale_batches(batch_id);
+CREATE INDEX IF NOT EXISTS idx_sale_returns_sale ON sale_returns(sale_id);
+CREATE INDEX IF NOT EXISTS idx_sale_return_items_item ON sale_return_items(sale_item_id);
+CREATE INDEX IF NOT EXISTS idx_stock_movements_medicine ON stock_movements(medicine_id, id);
+CREATE INDEX IF NOT EXISTS idx_stock_adjustments_medicine ON stock_adjustments(medicine_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_stock_take_lines_unique
+	ON stock_take_lines(stock_take_id, medicine_id, COALESCE(batch_id, 0));
+CREATE INDEX IF NOT EXISTS idx_auth_sessions_user ON auth_sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens(session_id);
+CREATE INDEX IF NOT EXISTS idx_password_reset_tokens_user ON password_reset_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_mfa_recovery_codes_user ON mfa_recovery_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_api_keys_user ON api_keys(user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_entity ON audit_log(entity, entity_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_user ON audit_log(user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_occurred ON audit_log(occurred_at);
+CREATE INDEX IF NOT EXISTS idx_audit_log_request ON audit_log(request_id);
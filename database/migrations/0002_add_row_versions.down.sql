@@ -0,0 +1,2 @@
+ALTER TABLE suppliers DROP COLUMN version;
+ALTER TABLE medicines DROP COLUMN version;
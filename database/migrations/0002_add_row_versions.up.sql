@@ -0,0 +1,4 @@
+-- Row versions for optimistic concurrency control. The version of a row goes
+-- up with every change to it and is sent to clients as its ETag.
+ALTER TABLE medicines ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE suppliers ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
@@ -0,0 +1,16 @@
+-- Responses to requests made with an Idempotency-Key header, per user, so
+-- retries replay the first response instead of repeating the request. The
+-- status is NULL while the first request is still being processed.
+CREATE TABLE idempotency_keys (
+	user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	key VARCHAR(255) NOT NULL,
+	request_hash VARCHAR(64) NOT NULL,
+	status INTEGER,
+	content_type VARCHAR(255),
+	body BYTEA,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
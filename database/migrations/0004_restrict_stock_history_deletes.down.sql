@@ -0,0 +1,22 @@
+ALTER TABLE stock_take_lines
+	DROP CONSTRAINT stock_take_lines_batch_id_fkey,
+	ADD CONSTRAINT stock_take_lines_batch_id_fkey
+		FOREIGN KEY (batch_id) REFERENCES medicine_batches(id) ON DELETE CASCADE,
+	DROP CONSTRAINT stock_take_lines_medicine_id_fkey,
+	ADD CONSTRAINT stock_take_lines_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
+
+ALTER TABLE stock_adjustments
+	DROP CONSTRAINT stock_adjustments_medicine_id_fkey,
+	ADD CONSTRAINT stock_adjustments_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
+
+ALTER TABLE stock_movements
+	DROP CONSTRAINT stock_movements_medicine_id_fkey,
+	ADD CONSTRAINT stock_movements_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
+
+ALTER TABLE medicine_batches
+	DROP CONSTRAINT medicine_batches_medicine_id_fkey,
+	ADD CONSTRAINT medicine_batches_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
@@ -0,0 +1,25 @@
+-- The batches, ledger, adjustments and counts of a medicine are its stock
+-- history, so a medicine that has any can no longer be deleted instead of
+-- taking its history with it.
+ALTER TABLE medicine_batches
+	DROP CONSTRAINT medicine_batches_medicine_id_fkey,
+	ADD CONSTRAINT medicine_batches_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT;
+
+ALTER TABLE stock_movements
+	DROP CONSTRAINT stock_movements_medicine_id_fkey,
+	ADD CONSTRAINT stock_movements_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT;
+
+ALTER TABLE stock_adjustments
+	DROP CONSTRAINT stock_adjustments_medicine_id_fkey,
+	ADD CONSTRAINT stock_adjustments_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT;
+
+ALTER TABLE stock_take_lines
+	DROP CONSTRAINT stock_take_lines_medicine_id_fkey,
+	ADD CONSTRAINT stock_take_lines_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT,
+	DROP CONSTRAINT stock_take_lines_batch_id_fkey,
+	ADD CONSTRAINT stock_take_lines_batch_id_fkey
+		FOREIGN KEY (batch_id) REFERENCES medicine_batches(id) ON DELETE RESTRICT;
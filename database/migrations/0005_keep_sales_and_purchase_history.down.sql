@@ -0,0 +1,27 @@
+ALTER TABLE purchases
+	DROP CONSTRAINT purchases_supplier_id_fkey,
+	ADD CONSTRAINT purchases_supplier_id_fkey
+		FOREIGN KEY (supplier_id) REFERENCES suppliers(id) ON DELETE CASCADE,
+	DROP CONSTRAINT purchases_medicine_id_fkey,
+	ADD CONSTRAINT purchases_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
+
+ALTER TABLE sale_return_items
+	DROP CONSTRAINT sale_return_items_sale_item_id_fkey,
+	ADD CONSTRAINT sale_return_items_sale_item_id_fkey
+		FOREIGN KEY (sale_item_id) REFERENCES sale_items(id) ON DELETE CASCADE;
+
+ALTER TABLE sale_batches
+	DROP CONSTRAINT sale_batches_batch_id_fkey,
+	ADD CONSTRAINT sale_batches_batch_id_fkey
+		FOREIGN KEY (batch_id) REFERENCES medicine_batches(id) ON DELETE CASCADE,
+	DROP CONSTRAINT sale_batches_sale_item_id_fkey,
+	ADD CONSTRAINT sale_batches_sale_item_id_fkey
+		FOREIGN KEY (sale_item_id) REFERENCES sale_items(id) ON DELETE CASCADE;
+
+ALTER TABLE sale_items
+	DROP CONSTRAINT sale_items_medicine_id_fkey,
+	ADD CONSTRAINT sale_items_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE CASCADE;
+
+ALTER TABLE sale_items DROP COLUMN medicine_name;
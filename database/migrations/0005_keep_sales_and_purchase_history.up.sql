@@ -0,0 +1,33 @@
+-- Receipts and purchases are records of what happened, so the medicines,
+-- suppliers and batches they refer to can no longer be deleted from under
+-- them. Sale lines also keep the name of the medicine as it was sold, next to
+-- the unit price they already keep.
+ALTER TABLE sale_items ADD COLUMN medicine_name VARCHAR(255) NOT NULL DEFAULT '';
+UPDATE sale_items si SET medicine_name = m.name FROM medicines m WHERE m.id = si.medicine_id;
+ALTER TABLE sale_items ALTER COLUMN medicine_name DROP DEFAULT;
+
+ALTER TABLE sale_items
+	DROP CONSTRAINT sale_items_medicine_id_fkey,
+	ADD CONSTRAINT sale_items_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT;
+
+ALTER TABLE sale_batches
+	DROP CONSTRAINT sale_batches_sale_item_id_fkey,
+	ADD CONSTRAINT sale_batches_sale_item_id_fkey
+		FOREIGN KEY (sale_item_id) REFERENCES sale_items(id) ON DELETE RESTRICT,
+	DROP CONSTRAINT sale_batches_batch_id_fkey,
+	ADD CONSTRAINT sale_batches_batch_id_fkey
+		FOREIGN KEY (batch_id) REFERENCES medicine_batches(id) ON DELETE RESTRICT;
+
+ALTER TABLE sale_return_items
+	DROP CONSTRAINT sale_return_items_sale_item_id_fkey,
+	ADD CONSTRAINT sale_return_items_sale_item_id_fkey
+		FOREIGN KEY (sale_item_id) REFERENCES sale_items(id) ON DELETE RESTRICT;
+
+ALTER TABLE purchases
+	DROP CONSTRAINT purchases_medicine_id_fkey,
+	ADD CONSTRAINT purchases_medicine_id_fkey
+		FOREIGN KEY (medicine_id) REFERENCES medicines(id) ON DELETE RESTRICT,
+	DROP CONSTRAINT purchases_supplier_id_fkey,
+	ADD CONSTRAINT purchases_supplier_id_fkey
+		FOREIGN KEY (supplier_id) REFERENCES suppliers(id) ON DELETE RESTRICT;
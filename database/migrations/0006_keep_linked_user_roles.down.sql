@@ -0,0 +1 @@
+ALTER TABLE users DROP COLUMN oidc_manages_role;
@@ -0,0 +1,5 @@
+-- Users created by the identity provider take their role from its groups at
+-- every login. Existing accounts it was linked to by email keep the role
+-- they were given here, so linking cannot promote or demote them.
+ALTER TABLE users ADD COLUMN oidc_manages_role BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE users SET oidc_manages_role = TRUE WHERE oidc_subject IS NOT NULL AND password_hash = '';
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/middleware"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// APIKeyHandler manages API keys of machine clients such as POS terminals
+type APIKeyHandler struct {
+	apiKeys repository.APIKeyRepository
+	users   repository.UserRepository
+}
+
+func NewAPIKeyHandler(apiKeys repository.APIKeyRepository, users repository.UserRepository) *APIKeyHandler {
+	return &APIKeyHandler{apiKeys: apiKeys, users: users}
+}
+
+// GetAll returns a page of API keys
+func (h *APIKeyHandler) GetAll(c fiber.Ctx) error {
+	q, err := parseList(c, repository.APIKeyList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.apiKeys.List(q)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch API keys",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// Create issues an API key acting as a user, limited to scopes the user's
+// role is granted. The key is returned only in this response.
+func (h *APIKeyHandler) Create(c fiber.Ctx) error {
+	var req models.CreateAPIKeyRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate input
+	if req.Name == "" || req.UserID == 0 || len(req.Scopes) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name, user ID, and at least one scope are required",
+		})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Expiry must be in the future",
+		})
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	user, err := h.users.Get(req.UserID)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+	if !user.IsActive {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "User is deactivated",
+		})
+	}
+
+	scopes := []string{}
+	for _, scope := range req.Scopes {
+		if !middleware.IsAPIKeyScope(user.Role, middleware.Permission(scope)) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Scope " + scope + " cannot be granted to a key of a " + user.Role,
+			})
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	key, prefix, err := utils.GenerateAPIKey()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate API key",
+		})
+	}
+
+	apiKey, err := h.apiKeys.Create(actor(c), models.APIKey{
+		Name:      req.Name,
+		Prefix:    prefix,
+		UserID:    user.ID,
+		Username:  user.Username,
+		Scopes:    scopes,
+		ExpiresAt: req.ExpiresAt,
+	}, utils.HashToken(key))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create API key",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.CreateAPIKeyResponse{
+		APIKey: apiKey,
+		Key:    key,
+	})
+}
+
+// Revoke stops an API key from being accepted. Revoking a revoked key keeps
+// the original revocation time.
+func (h *APIKeyHandler) Revoke(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid API key ID",
+		})
+	}
+
+	apiKey, err := h.apiKeys.Revoke(actor(c), id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API key not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke API key",
+		})
+	}
+
+	return c.JSON(apiKey)
+}
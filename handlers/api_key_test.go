@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	repos := repository.NewMemory()
+	app := newTestApp(repos)
+
+	cashier, err := repos.Users.Invite(repository.Actor{}, "till-1", "till-1@example.com", models.RoleCashier, "hash", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	req := models.CreateAPIKeyRequest{Name: "Till 1", UserID: cashier.ID, Scopes: []string{"users:manage"}}
+	if msg := errorMessage(t, app, "POST", "/api-keys", req, fiber.StatusBadRequest); msg != "Scope users:manage cannot be granted to a key of a cashier" {
+		t.Errorf("scope beyond role = %q", msg)
+	}
+	req.UserID = 99
+	if msg := errorMessage(t, app, "POST", "/api-keys", req, fiber.StatusNotFound); msg != "User not found" {
+		t.Errorf("missing user = %q", msg)
+	}
+
+	req = models.CreateAPIKeyRequest{Name: "Till 1", UserID: cashier.ID, Scopes: []string{"sales:create", "sales:create"}}
+	var created models.CreateAPIKeyResponse
+	do(t, app, "POST", "/api-keys", req, fiber.StatusCreated, &created)
+	if created.Key == "" || created.APIKey.Username != "till-1" || len(created.APIKey.Scopes) != 1 {
+		t.Errorf("created key = %+v", created)
+	}
+
+	var keys models.Page[models.APIKey]
+	do(t, app, "GET", "/api-keys?user_id=99", nil, fiber.StatusOK, &keys)
+	if keys.Total != 0 {
+		t.Errorf("keys of another user = %d", keys.Total)
+	}
+
+	var revoked, again models.APIKey
+	do(t, app, "DELETE", "/api-keys/1", nil, fiber.StatusOK, &revoked)
+	do(t, app, "DELETE", "/api-keys/1", nil, fiber.StatusOK, &again)
+	if revoked.RevokedAt == nil || again.RevokedAt == nil || !again.RevokedAt.Equal(*revoked.RevokedAt) {
+		t.Errorf("revocation time changed: %v, then %v", revoked.RevokedAt, again.RevokedAt)
+	}
+	if msg := errorMessage(t, app, "DELETE", "/api-keys/2", nil, fiber.StatusNotFound); msg != "API key not found" {
+		t.Errorf("missing key = %q", msg)
+	}
+}
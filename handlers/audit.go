@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// actor returns who makes the current request, for the audit log
+func actor(c fiber.Ctx) repository.Actor {
+	a := repository.Actor{IP: c.IP()}
+	if id, ok := c.Locals("user_id").(int); ok {
+		a.UserID = &id
+	}
+	if id, ok := c.Locals("api_key_id").(int); ok {
+		a.APIKeyID = &id
+	}
+	a.Username, _ = c.Locals("username").(string)
+	a.RequestID, _ = c.Locals("request_id").(string)
+	return a
+}
+
+// AuditHandler exposes the audit log
+type AuditHandler struct {
+	audit repository.AuditRepository
+}
+
+func NewAuditHandler(audit repository.AuditRepository) *AuditHandler {
+	return &AuditHandler{audit: audit}
+}
+
+// GetAll returns a page of the audit log, newest first
+func (h *AuditHandler) GetAll(c fiber.Ctx) error {
+	q, err := parseList(c, repository.AuditList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.audit.List(q)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch audit log",
+		})
+	}
+
+	return c.JSON(page)
+}
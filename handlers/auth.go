@@ -1,26 +1,38 @@
 package handlers
 
 import (
-	"database/sql"
+	"log"
+	"strconv"
 	"time"
 
 	"github.com/alfinkly/hci-golang-back/config"
-	"github.com/alfinkly/hci-golang-back/database"
 	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
 	"github.com/alfinkly/hci-golang-back/utils"
 	"github.com/gofiber/fiber/v3"
 )
 
 type AuthHandler struct {
-	cfg *config.Config
+	auth     repository.AuthRepository
+	cfg      *config.Config
+	keys     *utils.KeySet
+	notifier notifier.Notifier
 }
 
-func NewAuthHandler(cfg *config.Config) *AuthHandler {
-	return &AuthHandler{cfg: cfg}
+func NewAuthHandler(auth repository.AuthRepository, cfg *config.Config, keys *utils.KeySet, n notifier.Notifier) *AuthHandler {
+	return &AuthHandler{auth: auth, cfg: cfg, keys: keys, notifier: n}
 }
 
-// Register creates a new user
+// Register creates a new user with the cashier role. Higher roles can only be
+// granted by an admin through the user administration endpoints.
 func (h *AuthHandler) Register(c fiber.Ctx) error {
+	if !h.cfg.AllowRegistration {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Registration is disabled, ask an administrator for an account",
+		})
+	}
+
 	var req models.RegisterRequest
 	if err := c.Bind().JSON(&req); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -35,9 +47,10 @@ func (h *AuthHandler) Register(c fiber.Ctx) error {
 		})
 	}
 
-	// Set default role if not provided
-	if req.Role == "" {
-		req.Role = "user"
+	if err := utils.ValidatePassword(req.Password, req.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Weak password: " + err.Error(),
+		})
 	}
 
 	// Hash password
@@ -49,48 +62,20 @@ func (h *AuthHandler) Register(c fiber.Ctx) error {
 	}
 
 	// Create user
-	query := `
-		INSERT INTO users (username, email, password_hash, role, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, username, email, role, created_at, updated_at
-	`
-
-	var user models.User
-	err = database.DB.QueryRow(
-		query,
-		req.Username,
-		req.Email,
-		hashedPassword,
-		req.Role,
-		time.Now(),
-		time.Now(),
-	).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Role,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create user: " + err.Error(),
+	user, err := h.auth.Register(actor(c), req.Username, req.Email, hashedPassword, models.RoleCashier)
+	if err == repository.ErrConflict {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username or email is already taken",
 		})
 	}
-
-	// Generate token
-	token, err := utils.GenerateToken(&user, h.cfg.JWTSecret, h.cfg.JWTExpiration)
 	if err != nil {
+		log.Printf("Failed to create user: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate token",
+			"error": "Failed to create user",
 		})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(models.LoginResponse{
-		Token: token,
-		User:  user,
-	})
+	return h.completeLogin(c, user, fiber.StatusCreated)
 }
 
 // Login authenticates a user
@@ -109,55 +94,99 @@ func (h *AuthHandler) Login(c fiber.Ctx) error {
 		})
 	}
 
+	// Refuse while the username or client IP is locked out
+	lockedUntil, err := h.auth.LoginLockedUntil(req.Username, c.IP())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !lockedUntil.IsZero() {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many failed login attempts, try again later",
+		})
+	}
+
 	// Get user from database
-	query := `
-		SELECT id, username, email, password_hash, role, created_at, updated_at
-		FROM users
-		WHERE username = $1
-	`
-
-	var user models.User
-	err := database.DB.QueryRow(query, req.Username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.PasswordHash,
-		&user.Role,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	user, err := h.auth.UserByUsername(req.Username)
+	if err != nil && err != repository.ErrNotFound {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// Check password. Unknown usernames and users without a local password
+	// go through a dummy check so they take as long as wrong passwords.
+	valid := false
+	if err == repository.ErrNotFound || !utils.IsPasswordHash(user.PasswordHash) {
+		checkDummyPassword(req.Password)
+	} else {
+		valid = utils.CheckPasswordHash(req.Password, user.PasswordHash)
+	}
+	if !valid {
+		if err = h.recordLoginFailure(req.Username, c.IP()); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid username or password",
 		})
 	}
 
-	if err != nil {
+	if err = h.auth.ClearLoginFailures(user.Username); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Database error",
 		})
 	}
 
-	// Check password
-	if !utils.CheckPasswordHash(req.Password, user.PasswordHash) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid username or password",
+	if !user.IsActive {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account is deactivated",
 		})
 	}
 
-	// Generate token
-	token, err := utils.GenerateToken(&user, h.cfg.JWTSecret, h.cfg.JWTExpiration)
+	return h.completeLogin(c, user, fiber.StatusOK)
+}
+
+// completeLogin finishes a login whose password has been checked. Users with
+// two-factor authentication get a challenge token instead of a session, and
+// users whose role requires it but who have not enrolled yet get a token
+// that only allows enrolment.
+func (h *AuthHandler) completeLogin(c fiber.Ctx, user models.User, status int) error {
+	purpose, expiration := "", time.Duration(0)
+	switch {
+	case user.TOTPEnabled:
+		purpose, expiration = utils.TokenPurposeMFA, mfaChallengeExpiration
+	case h.cfg.MFARequired(user.Role):
+		purpose, expiration = utils.TokenPurposeMFAEnrol, mfaEnrolmentExpiration
+	}
+
+	if purpose != "" {
+		token, err := utils.GeneratePurposeToken(&user, purpose, h.keys, expiration)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+		return c.Status(status).JSON(models.MFAChallengeResponse{
+			MFARequired:       true,
+			EnrolmentRequired: purpose == utils.TokenPurposeMFAEnrol,
+			ChallengeToken:    token,
+			ExpiresAt:         time.Now().Add(expiration),
+		})
+	}
+
+	// Start a session
+	resp, err := h.startSession(c, user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	return c.JSON(models.LoginResponse{
-		Token: token,
-		User:  user,
-	})
+	return c.Status(status).JSON(resp)
 }
 
 // GetProfile returns the current user's profile
@@ -169,22 +198,7 @@ func (h *AuthHandler) GetProfile(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		SELECT id, username, email, role, created_at, updated_at
-		FROM users
-		WHERE id = $1
-	`
-
-	var user models.User
-	err := database.DB.QueryRow(query, userID).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.Role,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
-
+	user, err := h.auth.User(userID)
 	if err != nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "User not found",
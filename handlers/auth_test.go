@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/middleware"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+const testPassword = "Till-Password-2026!"
+
+// newAuthTestApp returns the login routes backed by in-memory repositories
+func newAuthTestApp(repos repository.Repositories) *fiber.App {
+	cfg := &config.Config{
+		JWTExpiration:      time.Hour,
+		RefreshExpiration:  24 * time.Hour,
+		LoginMaxAttempts:   3,
+		LoginIPMaxAttempts: 100,
+		LoginLockout:       time.Minute,
+		LoginFailureWindow: time.Hour,
+		AllowRegistration:  true,
+	}
+	keys := utils.NewHMACKeySet("test-secret")
+	h := NewAuthHandler(repos.Auth, cfg, keys, notifier.LogNotifier{})
+
+	app := fiber.New()
+	app.Post("/auth/register", h.Register)
+	app.Post("/auth/login", h.Login)
+	app.Post("/auth/refresh", h.Refresh)
+	app.Post("/auth/logout", middleware.JWTMiddleware(keys, repos.Auth), h.Logout)
+	app.Post("/auth/mfa/setup", middleware.MFAEnrolmentMiddleware(keys, repos.Auth), h.SetupMFA)
+	app.Post("/auth/mfa/confirm", middleware.MFAEnrolmentMiddleware(keys, repos.Auth), h.ConfirmMFA)
+	app.Post("/auth/mfa/verify", h.VerifyMFA)
+	app.Get("/profile", middleware.JWTMiddleware(keys, repos.Auth), h.GetProfile)
+	return app
+}
+
+// bearer returns the header of a request made with an access token
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+// register signs up a user through the API and returns their session
+func register(t *testing.T, app *fiber.App, username string) models.LoginResponse {
+	t.Helper()
+
+	var resp models.LoginResponse
+	req := models.RegisterRequest{Username: username, Email: username + "@example.com", Password: testPassword}
+	do(t, app, "POST", "/auth/register", req, fiber.StatusCreated, &resp)
+	return resp
+}
+
+func TestLoginLocksOutAfterFailures(t *testing.T) {
+	app := newAuthTestApp(repository.NewMemory())
+	register(t, app, "till-1")
+
+	wrong := models.LoginRequest{Username: "till-1", Password: "wrong-password"}
+	for range 3 {
+		if msg := errorMessage(t, app, "POST", "/auth/login", wrong, fiber.StatusUnauthorized); msg != "Invalid username or password" {
+			t.Errorf("wrong password = %q", msg)
+		}
+	}
+
+	// Even the right password is refused until the lockout ends
+	right := models.LoginRequest{Username: "till-1", Password: testPassword}
+	if msg := errorMessage(t, app, "POST", "/auth/login", right, fiber.StatusTooManyRequests); msg != "Too many failed login attempts, try again later" {
+		t.Errorf("locked out login = %q", msg)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	repos := repository.NewMemory()
+	app := newAuthTestApp(repos)
+	login := register(t, app, "till-1")
+
+	var refreshed models.LoginResponse
+	do(t, app, "POST", "/auth/refresh", models.RefreshRequest{RefreshToken: login.RefreshToken}, fiber.StatusOK, &refreshed)
+	if refreshed.RefreshToken == login.RefreshToken || refreshed.User.Username != "till-1" {
+		t.Fatalf("refreshed = %+v", refreshed)
+	}
+
+	// Presenting the rotated token again ends the session for both holders
+	reused := models.RefreshRequest{RefreshToken: login.RefreshToken}
+	if msg := errorMessage(t, app, "POST", "/auth/refresh", reused, fiber.StatusUnauthorized); msg != "Refresh token has already been used, session revoked" {
+		t.Errorf("reused token = %q", msg)
+	}
+	current := models.RefreshRequest{RefreshToken: refreshed.RefreshToken}
+	if msg := errorMessage(t, app, "POST", "/auth/refresh", current, fiber.StatusUnauthorized); msg != "Session has expired or been revoked" {
+		t.Errorf("token of revoked session = %q", msg)
+	}
+	unknown := models.RefreshRequest{RefreshToken: "unknown"}
+	if msg := errorMessage(t, app, "POST", "/auth/refresh", unknown, fiber.StatusUnauthorized); msg != "Invalid refresh token" {
+		t.Errorf("unknown token = %q", msg)
+	}
+
+	page, err := repos.Audit.List(repository.ListQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("list audit log: %v", err)
+	}
+	if !slices.ContainsFunc(page.Data, func(e models.AuditEntry) bool { return e.Action == repository.AuditRevoke }) {
+		t.Errorf("audit log = %+v, want the session revoked", page.Data)
+	}
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	app := newAuthTestApp(repository.NewMemory())
+	login := register(t, app, "till-1")
+
+	var user models.User
+	doWithHeader(t, app, "GET", "/profile", bearer(login.Token), nil, fiber.StatusOK, &user)
+	if user.Username != "till-1" {
+		t.Errorf("profile = %+v", user)
+	}
+
+	doWithHeader(t, app, "POST", "/auth/logout", bearer(login.Token), nil, fiber.StatusNoContent, nil)
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	doWithHeader(t, app, "GET", "/profile", bearer(login.Token), nil, fiber.StatusUnauthorized, &e)
+	if e.Error != "Token has been revoked" {
+		t.Errorf("profile after logout = %q", e.Error)
+	}
+}
+
+func TestMFALoginWithRecoveryCode(t *testing.T) {
+	app := newAuthTestApp(repository.NewMemory())
+	login := register(t, app, "till-1")
+
+	var setup models.MFASetupResponse
+	doWithHeader(t, app, "POST", "/auth/mfa/setup", bearer(login.Token), nil, fiber.StatusOK, &setup)
+	code, err := utils.TOTPCode(setup.Secret, time.Now())
+	if err != nil {
+		t.Fatalf("totp code: %v", err)
+	}
+	var confirmed models.MFAConfirmResponse
+	doWithHeader(t, app, "POST", "/auth/mfa/confirm", bearer(login.Token), models.MFACodeRequest{Code: code}, fiber.StatusOK, &confirmed)
+	if len(confirmed.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(confirmed.RecoveryCodes), recoveryCodeCount)
+	}
+
+	// Logging in now needs a second factor
+	var challenge models.MFAChallengeResponse
+	do(t, app, "POST", "/auth/login", models.LoginRequest{Username: "till-1", Password: testPassword}, fiber.StatusOK, &challenge)
+	if !challenge.MFARequired || challenge.ChallengeToken == "" {
+		t.Fatalf("login = %+v, want a challenge", challenge)
+	}
+
+	// The code confirming enrolment cannot be used again
+	reusedCode := models.MFAVerifyRequest{ChallengeToken: challenge.ChallengeToken, Code: code}
+	if msg := errorMessage(t, app, "POST", "/auth/mfa/verify", reusedCode, fiber.StatusUnauthorized); msg != "Invalid two-factor code" {
+		t.Errorf("reused code = %q", msg)
+	}
+
+	// Recovery codes work once, whatever their case
+	recovery := models.MFAVerifyRequest{ChallengeToken: challenge.ChallengeToken, RecoveryCode: strings.ToLower(confirmed.RecoveryCodes[0])}
+	var session models.LoginResponse
+	do(t, app, "POST", "/auth/mfa/verify", recovery, fiber.StatusOK, &session)
+	if session.Token == "" || !session.User.TOTPEnabled {
+		t.Errorf("session = %+v", session)
+	}
+	if msg := errorMessage(t, app, "POST", "/auth/mfa/verify", recovery, fiber.StatusUnauthorized); msg != "Invalid recovery code" {
+		t.Errorf("used recovery code = %q", msg)
+	}
+}
+
+func TestLoginWithoutLocalPassword(t *testing.T) {
+	repos := repository.NewMemory()
+	app := newAuthTestApp(repos)
+	invited, err := repos.Users.Invite(repository.Actor{}, "till-1", "till-1@example.com", models.RoleCashier, "token-hash", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("invite: %v", err)
+	}
+
+	// Users who have not set a password fail like a wrong password, and the
+	// failure counts towards the lockout
+	req := models.LoginRequest{Username: invited.Username, Password: "any-password"}
+	for range 3 {
+		if msg := errorMessage(t, app, "POST", "/auth/login", req, fiber.StatusUnauthorized); msg != "Invalid username or password" {
+			t.Errorf("login without password = %q", msg)
+		}
+	}
+	if msg := errorMessage(t, app, "POST", "/auth/login", req, fiber.StatusTooManyRequests); msg != "Too many failed login attempts, try again later" {
+		t.Errorf("locked out login = %q", msg)
+	}
+}
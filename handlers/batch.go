@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// BatchHandler handles medicine batch (lot) operations
+type BatchHandler struct {
+	stock repository.StockRepository
+}
+
+func NewBatchHandler(stock repository.StockRepository) *BatchHandler {
+	return &BatchHandler{stock: stock}
+}
+
+// GetAll returns a page of batches, e.g. every batch with a batch number for
+// a recall
+func (h *BatchHandler) GetAll(c fiber.Ctx) error {
+	q, err := parseList(c, repository.BatchList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.stock.Batches(q)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch batches",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// GetByID returns a batch by ID
+func (h *BatchHandler) GetByID(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid batch ID",
+		})
+	}
+
+	batch, err := h.stock.Batch(id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Batch not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch batch",
+		})
+	}
+
+	return c.JSON(batch)
+}
+
+// GetByMedicine returns a page of the batches of a medicine
+func (h *BatchHandler) GetByMedicine(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medicine ID",
+		})
+	}
+
+	q, err := parseList(c, repository.BatchList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.stock.Batches(withFilter(q, "medicine_id", id))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch batches",
+		})
+	}
+
+	return c.JSON(page)
+}
@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// etag returns the entity tag of a version of an entity
+func etag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the
+// entity tag of a version, or is *. If-Match compares tags strongly, so weak
+// tags never match it; If-None-Match compares them weakly.
+func etagMatches(header string, version int, weak bool) bool {
+	tag := etag(version)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// sendVersioned sends an entity with its version as the ETag. A conditional
+// GET for the version the client already has gets 304 Not Modified instead.
+func sendVersioned(c fiber.Ctx, version int, entity any) error {
+	c.Set(fiber.HeaderETag, etag(version))
+	if c.Method() == fiber.MethodGet && etagMatches(c.Get(fiber.HeaderIfNoneMatch), version, true) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+	return c.JSON(entity)
+}
+
+// ifMatch returns the version of an entity a change is conditional on. It is
+// 0 without an If-Match header. Otherwise the header must name the current
+// version, which current fetches, or the error is
+// repository.ErrVersionMismatch.
+func ifMatch(c fiber.Ctx, current func() (int, error)) (int, error) {
+	header := c.Get(fiber.HeaderIfMatch)
+	if header == "" {
+		return 0, nil
+	}
+
+	version, err := current()
+	if err != nil {
+		return 0, err
+	}
+	if !etagMatches(header, version, false) {
+		return 0, repository.ErrVersionMismatch
+	}
+	return version, nil
+}
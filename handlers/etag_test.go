@@ -0,0 +1,28 @@
+package handlers
+
+import "testing"
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{``, false, false},
+		{`"3"`, false, true},
+		{`"2", "3"`, false, true},
+		{`*`, false, true},
+		{`"4"`, false, false},
+		{`3`, false, false},
+		// Only If-None-Match accepts weak tags
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`W/"2", W/"3"`, true, true},
+	}
+
+	for _, tt := range tests {
+		if got := etagMatches(tt.header, 3, tt.weak); got != tt.want {
+			t.Errorf("etagMatches(%q, 3, %v) = %v, want %v", tt.header, tt.weak, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// testUserID is the user every test request is made by
+const testUserID = 1
+
+// newTestApp returns the resource routes backed by in-memory repositories,
+// with every request made by an admin
+func newTestApp(repos repository.Repositories) *fiber.App {
+	app := fiber.New()
+	app.Use(func(c fiber.Ctx) error {
+		c.Locals("user_id", testUserID)
+		c.Locals("username", "admin")
+		c.Locals("role", models.RoleAdmin)
+		return c.Next()
+	})
+
+	medicineHandler := NewMedicineHandler(repos.Medicines)
+	app.Get("/medicines/search", medicineHandler.Search)
+	app.Get("/medicines/:id", medicineHandler.GetByID)
+	app.Post("/medicines", medicineHandler.Create)
+	app.Put("/medicines/:id", medicineHandler.Update)
+	app.Delete("/medicines/:id", medicineHandler.Delete)
+
+	supplierHandler := NewSupplierHandler(repos.Suppliers)
+	app.Post("/suppliers", supplierHandler.Create)
+
+	purchaseHandler := NewPurchaseHandler(repos.Purchases)
+	app.Get("/purchases", purchaseHandler.GetAll)
+	app.Post("/purchases", purchaseHandler.Create)
+	app.Post("/purchases/:id/void", purchaseHandler.Void)
+
+	saleHandler := NewSaleHandler(repos.Sales)
+	app.Post("/sales", saleHandler.Create)
+	app.Get("/sales/:id/returns", saleHandler.GetReturns)
+	app.Post("/sales/:id/returns", saleHandler.CreateReturn)
+
+	batchHandler := NewBatchHandler(repos.Stock)
+	app.Get("/medicines/:id/batches", batchHandler.GetByMedicine)
+	app.Get("/batches", batchHandler.GetAll)
+
+	stockHandler := NewStockHandler(repos.Stock)
+	app.Get("/medicines/:id/movements", stockHandler.GetMovements)
+	app.Get("/medicines/:id/adjustments", stockHandler.GetAdjustments)
+	app.Post("/medicines/:id/adjustments", stockHandler.CreateAdjustment)
+	app.Get("/stock/reconciliation", stockHandler.Reconcile)
+
+	stockTakeHandler := NewStockTakeHandler(repos.StockTakes)
+	app.Get("/stock-takes/:id", stockTakeHandler.GetByID)
+	app.Post("/stock-takes", stockTakeHandler.Create)
+	app.Post("/stock-takes/:id/counts", stockTakeHandler.SubmitCounts)
+	app.Post("/stock-takes/:id/post", stockTakeHandler.Post)
+	app.Post("/stock-takes/:id/cancel", stockTakeHandler.Cancel)
+
+	userHandler := NewUserHandler(repos.Users, &config.Config{InviteExpiration: time.Hour}, notifier.LogNotifier{})
+	app.Put("/users/:id/role", userHandler.UpdateRole)
+
+	apiKeyHandler := NewAPIKeyHandler(repos.APIKeys, repos.Users)
+	app.Get("/api-keys", apiKeyHandler.GetAll)
+	app.Post("/api-keys", apiKeyHandler.Create)
+	app.Delete("/api-keys/:id", apiKeyHandler.Revoke)
+
+	auditHandler := NewAuditHandler(repos.Audit)
+	app.Get("/audit-log", auditHandler.GetAll)
+
+	return app
+}
+
+// do sends a request with a JSON body to app, checks its status and decodes
+// the response into out, if given
+func do(t *testing.T, app *fiber.App, method, path string, body any, wantStatus int, out any) {
+	t.Helper()
+	doWithHeader(t, app, method, path, nil, body, wantStatus, out)
+}
+
+// doWithHeader is do with extra request headers. It returns the response
+// headers.
+func doWithHeader(t *testing.T, app *fiber.App, method, path string, header map[string]string, body any, wantStatus int, out any) http.Header {
+	t.Helper()
+
+	var reader *bytes.Reader
+	if body == nil {
+		reader = bytes.NewReader(nil)
+	} else {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatalf("marshal body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != wantStatus {
+		var e map[string]any
+		json.NewDecoder(resp.Body).Decode(&e)
+		t.Fatalf("%s %s: status %d, want %d (%v)", method, path, resp.StatusCode, wantStatus, e["error"])
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, path, err)
+		}
+	}
+	return resp.Header
+}
+
+// errorMessage sends a request that fails with wantStatus and returns its
+// error message
+func errorMessage(t *testing.T, app *fiber.App, method, path string, body any, wantStatus int) string {
+	t.Helper()
+
+	var e struct {
+		Error string `json:"error"`
+	}
+	do(t, app, method, path, body, wantStatus, &e)
+	return e.Error
+}
@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v3"
+)
+
+// JWKS publishes the public keys access tokens are signed with, so other
+// services can verify tokens without sharing a secret. Keys still accepted
+// during a rotation are included; a development setup signing with
+// JWT_SECRET publishes no keys.
+func (h *AuthHandler) JWKS(c fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(h.keys.JWKS())
+}
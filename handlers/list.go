@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// Page size of list endpoints when no limit is given, and the largest
+// allowed
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// parseList reads the filters, sort order and page of a list request. The
+// error is a message for the client.
+//
+// Lists are sorted with sort=field or sort=-field for descending order, and
+// can be sorted by several fields separated by commas. Ties are broken by ID
+// so pages do not overlap.
+func parseList(c fiber.Ctx, spec repository.ListSpec) (repository.ListQuery, error) {
+	q := repository.ListQuery{Limit: defaultPageLimit}
+
+	for _, f := range spec.Filters {
+		raw := c.Query(f.Param)
+		if raw == "" {
+			continue
+		}
+		value, err := parseFilter(f, raw)
+		if err != nil {
+			return q, err
+		}
+		q.Filters = append(q.Filters, repository.FilterValue{Param: f.Param, Value: value})
+	}
+
+	sort := c.Query("sort", spec.DefaultSort)
+	for _, field := range strings.Split(sort, ",") {
+		rest, desc := strings.CutPrefix(field, "-")
+		if _, ok := spec.Sorts[rest]; !ok {
+			return q, fmt.Errorf("Cannot sort by %q, use one of: %s", rest, strings.Join(spec.SortFields(), ", "))
+		}
+		q.Sort = append(q.Sort, repository.SortField{Field: rest, Desc: desc})
+	}
+
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			return q, fmt.Errorf("Limit must be between 1 and %d", maxPageLimit)
+		}
+		q.Limit = n
+	}
+	if value := c.Query("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return q, errors.New("Offset must be a non-negative number")
+		}
+		q.Offset = n
+	}
+
+	return q, nil
+}
+
+// withFilter sets a filter of a list query, replacing any value given in the
+// request. It narrows a list nested under another resource, such as the
+// batches of a medicine.
+func withFilter(q repository.ListQuery, param string, value any) repository.ListQuery {
+	q.Filters = slices.DeleteFunc(q.Filters, func(f repository.FilterValue) bool { return f.Param == param })
+	q.Filters = append(q.Filters, repository.FilterValue{Param: param, Value: value})
+	return q
+}
+
+func parseFilter(f repository.Filter, raw string) (any, error) {
+	switch f.Kind {
+	case repository.FilterInt:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s, must be a whole number", f.Param)
+		}
+		return n, nil
+	case repository.FilterMoney:
+		m, err := models.ParseMoney(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s, must be an amount with at most two decimal places", f.Param)
+		}
+		return m, nil
+	case repository.FilterBool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s, must be true or false", f.Param)
+		}
+		return b, nil
+	case repository.FilterTime:
+		if t, err := time.Parse(time.RFC3339, raw); err == nil {
+			return t, nil
+		}
+		t, err := time.Parse(time.DateOnly, raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s, use a date (2024-01-31) or RFC 3339 (2024-01-31T00:00:00Z)", f.Param)
+		}
+		if f.Upper {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return raw, nil
+}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// parseListRequest runs parseList on a request with the query string
+func parseListRequest(t *testing.T, spec repository.ListSpec, query string) (repository.ListQuery, error) {
+	t.Helper()
+
+	var q repository.ListQuery
+	var parseErr error
+	app := fiber.New()
+	app.Get("/", func(c fiber.Ctx) error {
+		q, parseErr = parseList(c, spec)
+		return nil
+	})
+
+	req, _ := http.NewRequest("GET", "/?"+query, nil)
+	if _, err := app.Test(req); err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	return q, parseErr
+}
+
+func TestParseList(t *testing.T) {
+	q, err := parseListRequest(t, repository.MedicineList, "")
+	if err != nil {
+		t.Fatalf("parseList: %v", err)
+	}
+	wantSort := []repository.SortField{{Field: "created_at", Desc: true}}
+	if len(q.Filters) != 0 || !reflect.DeepEqual(q.Sort, wantSort) || q.Limit != defaultPageLimit || q.Offset != 0 {
+		t.Errorf("defaults: %+v", q)
+	}
+
+	q, err = parseListRequest(t, repository.MedicineList,
+		"category=Painkillers&price_min=1.5&expiry_date_to=2024-01-31&requires_prescription=false&sort=name,-price&limit=20&offset=40")
+	if err != nil {
+		t.Fatalf("parseList: %v", err)
+	}
+	// A date as the end of a range includes that day
+	wantFilters := []repository.FilterValue{
+		{Param: "category", Value: "Painkillers"},
+		{Param: "requires_prescription", Value: false},
+		{Param: "price_min", Value: models.Money(150)},
+		{Param: "expiry_date_to", Value: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(q.Filters, wantFilters) {
+		t.Errorf("filters = %v, want %v", q.Filters, wantFilters)
+	}
+	wantSort = []repository.SortField{{Field: "name"}, {Field: "price", Desc: true}}
+	if !reflect.DeepEqual(q.Sort, wantSort) {
+		t.Errorf("sort = %v, want %v", q.Sort, wantSort)
+	}
+	if q.Limit != 20 || q.Offset != 40 {
+		t.Errorf("limit, offset = %d, %d", q.Limit, q.Offset)
+	}
+}
+
+func TestParseListRejectsInvalidQueries(t *testing.T) {
+	for _, query := range []string{
+		"sort=password_hash",
+		"sort=name;DROP TABLE medicines",
+		"limit=0",
+		"limit=501",
+		"offset=-1",
+		"price_min=cheap",
+		"price_max=9.999",
+		"supplier_id=1.5",
+		"requires_prescription=maybe",
+		"expiry_date_from=31.01.2024",
+	} {
+		if _, err := parseListRequest(t, repository.MedicineList, query); err == nil {
+			t.Errorf("%s: accepted", query)
+		}
+	}
+}
+
+func TestNestedListsArePaginated(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, _ := receiveStock(t, app, 10)
+	other, _ := receiveStock(t, app, 5)
+	for range 3 {
+		do(t, app, "POST", "/sales", models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 1}},
+		}, fiber.StatusCreated, nil)
+	}
+
+	// The medicine in the path wins over a medicine_id filter
+	var page models.Page[models.StockMovement]
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID)+"/movements?limit=2&offset=1&medicine_id="+strconv.Itoa(other.ID), nil, fiber.StatusOK, &page)
+	if page.Total != 4 || len(page.Data) != 2 || page.Limit != 2 || page.Offset != 1 {
+		t.Fatalf("movements page = %+v", page)
+	}
+	for _, m := range page.Data {
+		if m.MedicineID != medicine.ID || m.MovementType != models.MovementOutbound {
+			t.Errorf("movement = %+v", m)
+		}
+	}
+
+	var batches models.Page[models.MedicineBatch]
+	do(t, app, "GET", "/batches?batch_number=LOT-1&sort=-quantity", nil, fiber.StatusOK, &batches)
+	if batches.Total != 2 || batches.Data[0].Quantity != 7 {
+		t.Errorf("batches page = %+v", batches)
+	}
+
+	if msg := errorMessage(t, app, "GET", "/medicines/1/adjustments?sort=name", nil, fiber.StatusBadRequest); msg != `Cannot sort by "name", use one of: created_at, delta` {
+		t.Errorf("unknown sort = %q", msg)
+	}
+}
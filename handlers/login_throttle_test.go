@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	base := 15 * time.Minute
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, 15 * time.Minute},
+		{6, 30 * time.Minute},
+		{7, time.Hour},
+		{10, 8 * time.Hour},
+		{11, 16 * time.Hour},
+		{12, maxLockout},
+		{1000, maxLockout},
+	}
+
+	for _, tt := range tests {
+		if got := lockoutDuration(tt.failures, 5, base); got != tt.want {
+			t.Errorf("lockoutDuration(%d, 5, %s) = %s, want %s", tt.failures, base, got, tt.want)
+		}
+	}
+
+	if got := lockoutDuration(100, 0, base); got != 0 {
+		t.Errorf("lockoutDuration with no limit = %s, want 0", got)
+	}
+}
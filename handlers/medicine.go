@@ -1,42 +1,42 @@
 package handlers
 
 import (
-	"database/sql"
 	"strconv"
-	"time"
 
-	"github.com/alfinkly/hci-golang-back/database"
 	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
 	"github.com/gofiber/fiber/v3"
 )
 
-type MedicineHandler struct{}
+type MedicineHandler struct {
+	medicines repository.MedicineRepository
+}
 
-func NewMedicineHandler() *MedicineHandler {
-	return &MedicineHandler{}
+func NewMedicineHandler(medicines repository.MedicineRepository) *MedicineHandler {
+	return &MedicineHandler{medicines: medicines}
 }
 
-// GetAll returns all medicines
+// GetAll returns a page of medicines
 func (h *MedicineHandler) GetAll(c fiber.Ctx) error {
-	query := `
-		SELECT id, name, description, manufacturer, price, quantity, expiry_date, 
-		       category, requires_prescription, created_at, updated_at
-		FROM medicines
-		ORDER BY created_at DESC
-	`
+	q, err := parseList(c, repository.MedicineList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	var medicines []models.Medicine
-	err := database.DB.Select(&medicines, query)
+	page, err := h.medicines.List(q)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch medicines",
 		})
 	}
 
-	return c.JSON(medicines)
+	return c.JSON(page)
 }
 
-// GetByID returns a medicine by ID
+// GetByID returns a medicine by ID, with its version as the ETag. With
+// If-None-Match naming that version it returns 304 Not Modified.
 func (h *MedicineHandler) GetByID(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -45,16 +45,8 @@ func (h *MedicineHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		SELECT id, name, description, manufacturer, price, quantity, expiry_date, 
-		       category, requires_prescription, created_at, updated_at
-		FROM medicines
-		WHERE id = $1
-	`
-
-	var medicine models.Medicine
-	err = database.DB.Get(&medicine, query, id)
-	if err == sql.ErrNoRows {
+	medicine, err := h.medicines.Get(id)
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Medicine not found",
 		})
@@ -65,7 +57,7 @@ func (h *MedicineHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(medicine)
+	return sendVersioned(c, medicine.Version, medicine)
 }
 
 // Create creates a new medicine
@@ -83,52 +75,32 @@ func (h *MedicineHandler) Create(c fiber.Ctx) error {
 			"error": "Name and price are required",
 		})
 	}
+	if req.Quantity < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Quantity cannot be negative",
+		})
+	}
 
-	query := `
-		INSERT INTO medicines (name, description, manufacturer, price, quantity, expiry_date, 
-		                      category, requires_prescription, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
-		RETURNING id, name, description, manufacturer, price, quantity, expiry_date, 
-		          category, requires_prescription, created_at, updated_at
-	`
-
-	var medicine models.Medicine
-	err := database.DB.QueryRow(
-		query,
-		req.Name,
-		req.Description,
-		req.Manufacturer,
-		req.Price,
-		req.Quantity,
-		req.ExpiryDate,
-		req.Category,
-		req.RequiresPrescription,
-		time.Now(),
-		time.Now(),
-	).Scan(
-		&medicine.ID,
-		&medicine.Name,
-		&medicine.Description,
-		&medicine.Manufacturer,
-		&medicine.Price,
-		&medicine.Quantity,
-		&medicine.ExpiryDate,
-		&medicine.Category,
-		&medicine.RequiresPrescription,
-		&medicine.CreatedAt,
-		&medicine.UpdatedAt,
-	)
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
 
+	medicine, err := h.medicines.Create(actor(c), req)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create medicine: " + err.Error(),
 		})
 	}
 
+	c.Set(fiber.HeaderETag, etag(medicine.Version))
 	return c.Status(fiber.StatusCreated).JSON(medicine)
 }
 
-// Update updates a medicine
+// Update updates a medicine. With If-Match it only updates the version named
+// there, and returns 412 Precondition Failed if the medicine has changed since.
 func (h *MedicineHandler) Update(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -144,106 +116,55 @@ func (h *MedicineHandler) Update(c fiber.Ctx) error {
 		})
 	}
 
-	// Build dynamic update query
-	updates := []string{}
-	args := []interface{}{}
-	argCount := 1
-
-	if req.Name != nil {
-		updates = append(updates, "name = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Name)
-		argCount++
-	}
-	if req.Description != nil {
-		updates = append(updates, "description = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Description)
-		argCount++
-	}
-	if req.Manufacturer != nil {
-		updates = append(updates, "manufacturer = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Manufacturer)
-		argCount++
-	}
-	if req.Price != nil {
-		updates = append(updates, "price = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Price)
-		argCount++
-	}
+	// Stock can only change through purchases, sales, returns and adjustments
 	if req.Quantity != nil {
-		updates = append(updates, "quantity = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Quantity)
-		argCount++
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Quantity cannot be updated directly, use POST /api/medicines/:id/adjustments",
+		})
 	}
+	// The expiry date follows the batches in stock
 	if req.ExpiryDate != nil {
-		updates = append(updates, "expiry_date = $"+strconv.Itoa(argCount))
-		args = append(args, *req.ExpiryDate)
-		argCount++
-	}
-	if req.Category != nil {
-		updates = append(updates, "category = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Category)
-		argCount++
-	}
-	if req.RequiresPrescription != nil {
-		updates = append(updates, "requires_prescription = $"+strconv.Itoa(argCount))
-		args = append(args, *req.RequiresPrescription)
-		argCount++
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Expiry date cannot be updated directly, it is the nearest expiry date of the batches in stock",
+		})
 	}
 
-	if len(updates) == 0 {
+	if req == (models.UpdateMedicineRequest{}) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "No fields to update",
 		})
 	}
 
-	updates = append(updates, "updated_at = $"+strconv.Itoa(argCount))
-	args = append(args, time.Now())
-	argCount++
-
-	args = append(args, id)
-
-	query := `
-		UPDATE medicines 
-		SET ` + updates[0]
-	for i := 1; i < len(updates); i++ {
-		query += ", " + updates[i]
-	}
-	query += `
-		WHERE id = $` + strconv.Itoa(argCount) + `
-		RETURNING id, name, description, manufacturer, price, quantity, expiry_date, 
-		          category, requires_prescription, created_at, updated_at
-	`
-
+	// A conditional update only applies to the version the client has
+	version, err := ifMatch(c, func() (int, error) {
+		medicine, err := h.medicines.Get(id)
+		return medicine.Version, err
+	})
 	var medicine models.Medicine
-	err = database.DB.QueryRow(query, args...).Scan(
-		&medicine.ID,
-		&medicine.Name,
-		&medicine.Description,
-		&medicine.Manufacturer,
-		&medicine.Price,
-		&medicine.Quantity,
-		&medicine.ExpiryDate,
-		&medicine.Category,
-		&medicine.RequiresPrescription,
-		&medicine.CreatedAt,
-		&medicine.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	if err == nil {
+		medicine, err = h.medicines.Update(actor(c), id, version, req)
+	}
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Medicine not found",
 		})
 	}
+	if err == repository.ErrVersionMismatch {
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Medicine has been changed since it was fetched",
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update medicine: " + err.Error(),
 		})
 	}
 
-	return c.JSON(medicine)
+	return sendVersioned(c, medicine.Version, medicine)
 }
 
-// Delete deletes a medicine
+// Delete deletes a medicine. With If-Match it only deletes the version named
+// there, like Update.
 func (h *MedicineHandler) Delete(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -252,20 +173,33 @@ func (h *MedicineHandler) Delete(c fiber.Ctx) error {
 		})
 	}
 
-	query := `DELETE FROM medicines WHERE id = $1`
-	result, err := database.DB.Exec(query, id)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete medicine",
-		})
+	version, err := ifMatch(c, func() (int, error) {
+		medicine, err := h.medicines.Get(id)
+		return medicine.Version, err
+	})
+	if err == nil {
+		err = h.medicines.Delete(actor(c), id, version)
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Medicine not found",
 		})
 	}
+	if err == repository.ErrVersionMismatch {
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Medicine has been changed since it was fetched",
+		})
+	}
+	if err == repository.ErrInUse {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Medicine has stock or sales history and cannot be deleted",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete medicine",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Medicine deleted successfully",
@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestMedicineErrors(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+
+	if msg := errorMessage(t, app, "GET", "/medicines/42", nil, fiber.StatusNotFound); msg != "Medicine not found" {
+		t.Errorf("missing medicine = %q", msg)
+	}
+	if msg := errorMessage(t, app, "POST", "/medicines", models.CreateMedicineRequest{Name: "Aspirin"}, fiber.StatusBadRequest); msg != "Name and price are required" {
+		t.Errorf("medicine without price = %q", msg)
+	}
+
+	var medicine models.Medicine
+	do(t, app, "POST", "/medicines", models.CreateMedicineRequest{Name: "Aspirin", Price: 250, Quantity: 3}, fiber.StatusCreated, &medicine)
+	if medicine.Quantity != 3 {
+		t.Errorf("opening stock = %d, want 3", medicine.Quantity)
+	}
+
+	if msg := errorMessage(t, app, "PUT", "/medicines/1", models.UpdateMedicineRequest{}, fiber.StatusBadRequest); msg != "No fields to update" {
+		t.Errorf("empty update = %q", msg)
+	}
+	name := "Paracetamol"
+	if msg := errorMessage(t, app, "PUT", "/medicines/42", models.UpdateMedicineRequest{Name: &name}, fiber.StatusNotFound); msg != "Medicine not found" {
+		t.Errorf("update of a missing medicine = %q", msg)
+	}
+
+	// The opening stock is history, so the medicine is kept
+	if msg := errorMessage(t, app, "DELETE", "/medicines/1", nil, fiber.StatusConflict); msg != "Medicine has stock or sales history and cannot be deleted" {
+		t.Errorf("delete of a medicine with stock = %q", msg)
+	}
+}
+
+func TestMedicineSearch(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	for _, req := range []models.CreateMedicineRequest{
+		{Name: "Ibuprofen 200mg", Manufacturer: "Acme", Price: 300},
+		{Name: "Aspirin", Manufacturer: "Ibex Labs", Price: 250},
+		{Name: "Paracetamol", Price: 150},
+	} {
+		do(t, app, "POST", "/medicines", req, fiber.StatusCreated, nil)
+	}
+
+	if msg := errorMessage(t, app, "GET", "/medicines/search?q=%20-", nil, fiber.StatusBadRequest); msg != "Search query q is required" {
+		t.Errorf("empty search = %q", msg)
+	}
+
+	// A match on the name ranks above one on the manufacturer
+	var results []models.MedicineSearchResult
+	do(t, app, "GET", "/medicines/search?q=ib", nil, fiber.StatusOK, &results)
+	if len(results) != 2 || results[0].Name != "Ibuprofen 200mg" || results[1].Name != "Aspirin" {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestMedicineConditionalRequests(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+
+	var medicine models.Medicine
+	header := doWithHeader(t, app, "POST", "/medicines", nil, models.CreateMedicineRequest{Name: "Aspirin", Price: 250}, fiber.StatusCreated, &medicine)
+	tag := header.Get("ETag")
+	if tag != `"1"` || medicine.Version != 1 {
+		t.Fatalf("ETag, version = %s, %d", tag, medicine.Version)
+	}
+
+	// The client already has the current version
+	doWithHeader(t, app, "GET", "/medicines/1", map[string]string{"If-None-Match": "W/" + tag}, nil, fiber.StatusNotModified, nil)
+
+	// Two clients edit the version they fetched; the second one loses
+	name := "Aspirin 500"
+	header = doWithHeader(t, app, "PUT", "/medicines/1", map[string]string{"If-Match": tag}, models.UpdateMedicineRequest{Name: &name}, fiber.StatusOK, &medicine)
+	if medicine.Name != name || header.Get("ETag") != `"2"` {
+		t.Errorf("updated medicine = %+v, ETag %s", medicine, header.Get("ETag"))
+	}
+	name = "Aspirin 300"
+	doWithHeader(t, app, "PUT", "/medicines/1", map[string]string{"If-Match": tag}, models.UpdateMedicineRequest{Name: &name}, fiber.StatusPreconditionFailed, nil)
+	doWithHeader(t, app, "DELETE", "/medicines/1", map[string]string{"If-Match": tag}, nil, fiber.StatusPreconditionFailed, nil)
+
+	// A weak tag never matches If-Match
+	doWithHeader(t, app, "DELETE", "/medicines/1", map[string]string{"If-Match": `W/"2"`}, nil, fiber.StatusPreconditionFailed, nil)
+
+	var fresh models.Medicine
+	doWithHeader(t, app, "GET", "/medicines/1", map[string]string{"If-None-Match": tag}, nil, fiber.StatusOK, &fresh)
+	if fresh.Name != "Aspirin 500" {
+		t.Errorf("name = %q, the losing update was applied", fresh.Name)
+	}
+	doWithHeader(t, app, "DELETE", "/medicines/1", map[string]string{"If-Match": `"1", "2"`}, nil, fiber.StatusOK, nil)
+}
+
+func TestStockMovementsKeepMedicineVersion(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, _ := receiveStock(t, app, 10)
+	if medicine.Version != 1 {
+		t.Fatalf("version after purchase = %d, want 1", medicine.Version)
+	}
+	tag := `"1"`
+
+	// A sale made while the medicine is being edited does not make the edit fail
+	do(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 2}},
+	}, fiber.StatusCreated, nil)
+	price := models.Money(300)
+	path := "/medicines/" + strconv.Itoa(medicine.ID)
+	header := doWithHeader(t, app, "PUT", path, map[string]string{"If-Match": tag}, models.UpdateMedicineRequest{Price: &price}, fiber.StatusOK, &medicine)
+	if medicine.Price != price || medicine.Quantity != 8 || header.Get("ETag") != `"2"` {
+		t.Errorf("updated medicine = %+v, ETag %s", medicine, header.Get("ETag"))
+	}
+}
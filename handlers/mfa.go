@@ -0,0 +1,354 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+const (
+	// mfaChallengeExpiration is how long a user has to enter the second factor
+	mfaChallengeExpiration = 5 * time.Minute
+	// mfaEnrolmentExpiration is how long a user has to enrol when their
+	// role requires two-factor authentication
+	mfaEnrolmentExpiration = 15 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+// SetupMFA generates a new TOTP secret for the current user. Two-factor
+// authentication is only enabled once a code from it is confirmed.
+func (h *AuthHandler) SetupMFA(c fiber.Ctx) error {
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	user, err := h.auth.User(userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if user.TOTPEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate secret",
+		})
+	}
+
+	err = h.auth.SetMFASecret(userID, secret)
+	if err == repository.ErrMFAEnabled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store secret",
+		})
+	}
+
+	return c.JSON(models.MFASetupResponse{
+		Secret:          secret,
+		ProvisioningURI: utils.TOTPProvisioningURI(h.cfg.MFAIssuer, user.Username, secret),
+	})
+}
+
+// ConfirmMFA enables two-factor authentication once the user proves their
+// authenticator app works, and returns recovery codes. When enrolment was
+// required to log in, the response also starts the session.
+func (h *AuthHandler) ConfirmMFA(c fiber.Ctx) error {
+	var req models.MFACodeRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	codes, codeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	user, err := h.auth.EnableMFA(actor(c), userID, req.Code, codeHashes)
+	switch err {
+	case nil:
+	case repository.ErrNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	case repository.ErrMFAEnabled:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Two-factor authentication is already enabled",
+		})
+	case repository.ErrMFANotSetUp:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Call POST /api/auth/mfa/setup first",
+		})
+	case repository.ErrInvalidCode:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid two-factor code",
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to enable two-factor authentication",
+		})
+	}
+
+	resp := models.MFAConfirmResponse{RecoveryCodes: codes}
+	if enrolment, _ := c.Locals("mfa_enrolment").(bool); enrolment {
+		resp.Login, err = h.startSession(c, user)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+	}
+
+	return c.JSON(resp)
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the current user
+func (h *AuthHandler) RegenerateRecoveryCodes(c fiber.Ctx) error {
+	var req models.MFACodeRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	codes, codeHashes, err := generateRecoveryCodes()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	err = h.auth.ReplaceRecoveryCodes(actor(c), userID, req.Code, codeHashes)
+	if status, msg := mfaCodeStatus(err); status != fiber.StatusOK {
+		if status == fiber.StatusInternalServerError {
+			msg = "Failed to generate recovery codes"
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	return c.JSON(models.MFAConfirmResponse{RecoveryCodes: codes})
+}
+
+// DisableMFA turns off two-factor authentication for the current user, unless
+// their role requires it
+func (h *AuthHandler) DisableMFA(c fiber.Ctx) error {
+	var req models.MFADisableRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	role, _ := c.Locals("role").(string)
+	if h.cfg.MFARequired(role) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Two-factor authentication is required for your role",
+		})
+	}
+
+	user, err := h.auth.User(userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if status, msg := h.checkCurrentPassword(c, user.Username, req.Password, user.PasswordHash); status != fiber.StatusOK {
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	err = h.auth.DisableMFA(actor(c), userID, req.Code)
+	if status, msg := mfaCodeStatus(err); status != fiber.StatusOK {
+		if status == fiber.StatusInternalServerError {
+			msg = "Failed to disable two-factor authentication"
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// VerifyMFA completes a two-factor login: it exchanges the challenge token
+// from POST /api/auth/login and a TOTP or recovery code for a session.
+// Wrong codes count as failed logins.
+func (h *AuthHandler) VerifyMFA(c fiber.Ctx) error {
+	var req models.MFAVerifyRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.ChallengeToken == "" || (req.Code == "") == (req.RecoveryCode == "") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Challenge token and either a code or a recovery code are required",
+		})
+	}
+
+	claims, err := utils.ValidatePurposeToken(req.ChallengeToken, utils.TokenPurposeMFA, h.keys)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired challenge token",
+		})
+	}
+
+	// Refuse while the username or client IP is locked out
+	lockedUntil, err := h.auth.LoginLockedUntil(claims.Username, c.IP())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+	if !lockedUntil.IsZero() {
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many failed login attempts, try again later",
+		})
+	}
+
+	user, err := h.auth.User(claims.UserID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid or expired challenge token",
+		})
+	}
+	if !user.IsActive {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account is deactivated",
+		})
+	}
+
+	status, msg := fiber.StatusOK, ""
+	if req.Code != "" {
+		status, msg = mfaCodeStatus(h.auth.UseMFACode(user.ID, req.Code))
+	} else {
+		err = h.auth.UseRecoveryCode(user.ID, recoveryCodeHash(req.RecoveryCode))
+		if status, msg = mfaCodeStatus(err); err == repository.ErrInvalidCode {
+			msg = "Invalid recovery code"
+		}
+	}
+	if status == fiber.StatusInternalServerError {
+		return c.Status(status).JSON(fiber.Map{
+			"error": "Failed to check two-factor code",
+		})
+	}
+	if status != fiber.StatusOK {
+		if err = h.recordLoginFailure(user.Username, c.IP()); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+
+	if err = h.auth.ClearLoginFailures(user.Username); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// Start a session
+	resp, err := h.startSession(c, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	return c.JSON(resp)
+}
+
+// mfaCodeStatus returns the status and message to respond with when checking
+// a two-factor code of the current user failed with err, or fiber.StatusOK
+func mfaCodeStatus(err error) (int, string) {
+	switch err {
+	case nil:
+		return fiber.StatusOK, ""
+	case repository.ErrMFANotEnabled:
+		return fiber.StatusBadRequest, "Two-factor authentication is not enabled"
+	case repository.ErrInvalidCode:
+		return fiber.StatusUnauthorized, "Invalid two-factor code"
+	default:
+		return fiber.StatusInternalServerError, "Database error"
+	}
+}
+
+// generateRecoveryCodes returns a new set of recovery codes and the hashes
+// to store in place of them
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	codeHashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		// 5 random bytes encode to exactly 8 base32 characters
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := base32.StdEncoding.EncodeToString(b)
+		codes[i] = code[:4] + "-" + code[4:]
+		codeHashes[i] = recoveryCodeHash(code)
+	}
+
+	return codes, codeHashes, nil
+}
+
+// recoveryCodeHash returns the hash a recovery code is stored as. Dashes,
+// spaces and case are ignored.
+func recoveryCodeHash(code string) string {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return utils.HashToken(normalized)
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/oidc"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// oidcStateExpiration is how long a user has to log in at the identity
+// provider
+const oidcStateExpiration = 10 * time.Minute
+
+// roleMapping gives users in an identity provider group a role
+type roleMapping struct {
+	group string
+	role  string
+}
+
+// OIDCHandler logs users in through an external OpenID Connect identity
+// provider and issues the application's own tokens
+type OIDCHandler struct {
+	auth        *AuthHandler
+	provider    *oidc.Provider
+	mapping     []roleMapping
+	defaultRole string
+}
+
+// NewOIDCHandler returns a handler for the provider. Role mapping entries
+// are "group=role" and must name known roles.
+func NewOIDCHandler(auth *AuthHandler, provider *oidc.Provider) (*OIDCHandler, error) {
+	h := &OIDCHandler{auth: auth, provider: provider, defaultRole: auth.cfg.OIDCDefaultRole}
+
+	if h.defaultRole != "" && !models.IsValidRole(h.defaultRole) {
+		return nil, fmt.Errorf("unknown default role %q", h.defaultRole)
+	}
+	for _, entry := range auth.cfg.OIDCRoleMapping {
+		group, role, ok := strings.Cut(entry, "=")
+		if !ok || group == "" || !models.IsValidRole(role) {
+			return nil, fmt.Errorf("invalid role mapping %q, use group=role", entry)
+		}
+		h.mapping = append(h.mapping, roleMapping{group: group, role: role})
+	}
+
+	return h, nil
+}
+
+// role returns the role of a user in the groups: the role of the first
+// mapping that matches, else the default role
+func (h *OIDCHandler) role(groups []string) string {
+	for _, m := range h.mapping {
+		for _, g := range groups {
+			if g == m.group {
+				return m.role
+			}
+		}
+	}
+	return h.defaultRole
+}
+
+// Login sends the user to the identity provider. The state, nonce and PKCE
+// code verifier of the login are kept until the callback.
+func (h *OIDCHandler) Login(c fiber.Ctx) error {
+	state, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+	nonce, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+	verifier, err := oidc.NewCodeVerifier()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+
+	authURL, err := h.provider.AuthCodeURL(c.Context(), state, nonce, verifier)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Identity provider is unavailable",
+		})
+	}
+
+	err = h.auth.auth.SaveOIDCState(utils.HashToken(state), repository.OIDCState{
+		Nonce:        nonce,
+		CodeVerifier: verifier,
+		ExpiresAt:    time.Now().Add(oidcStateExpiration),
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to start login",
+		})
+	}
+
+	return c.Redirect().To(authURL)
+}
+
+// Callback completes a login at the identity provider. The authorization
+// code is exchanged for an ID token, whose user is matched to a local user
+// (created on first login) with the role mapped from their groups.
+func (h *OIDCHandler) Callback(c fiber.Ctx) error {
+	if idpError := c.Query("error"); idpError != "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Identity provider login failed: " + idpError,
+		})
+	}
+
+	state, code := c.Query("state"), c.Query("code")
+	if state == "" || code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "State and code are required",
+		})
+	}
+
+	// A state can only be used once
+	saved, err := h.auth.auth.TakeOIDCState(utils.HashToken(state))
+	if err == repository.ErrInvalidToken {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired login state",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	identity, err := h.provider.Exchange(c.Context(), code, saved.CodeVerifier, saved.Nonce)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Identity provider login failed",
+		})
+	}
+
+	role := h.role(identity.Groups)
+	if role == "" {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "No pharmacy role is assigned to your account",
+		})
+	}
+
+	// The local user is matched by subject, then by verified email, and
+	// created without a local password on first login
+	user, err := h.auth.auth.LinkOIDCUser(actor(c), *identity, role)
+	if err == repository.ErrUsernameTaken {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username is already taken by another account",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to link user: " + err.Error(),
+		})
+	}
+
+	if !user.IsActive {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account is deactivated",
+		})
+	}
+
+	// Two-factor authentication is left to the identity provider
+	resp, err := h.auth.startSession(c, user)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	return c.JSON(resp)
+}
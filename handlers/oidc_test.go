@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestOIDCRoleMapping(t *testing.T) {
+	cfg := &config.Config{
+		OIDCRoleMapping: []string{
+			"pharmacy-admins=admin",
+			"pharmacy-pharmacists=pharmacist",
+			"pharmacy-tills=cashier",
+		},
+	}
+	h, err := NewOIDCHandler(NewAuthHandler(nil, cfg, nil, nil), nil)
+	if err != nil {
+		t.Fatalf("NewOIDCHandler: %v", err)
+	}
+
+	tests := []struct {
+		groups []string
+		want   string
+	}{
+		{[]string{"pharmacy-tills"}, models.RoleCashier},
+		{[]string{"staff", "pharmacy-pharmacists"}, models.RolePharmacist},
+		// The first matching mapping wins, whatever the order of the groups
+		{[]string{"pharmacy-tills", "pharmacy-admins"}, models.RoleAdmin},
+		{[]string{"staff"}, ""},
+		{nil, ""},
+	}
+
+	for _, tt := range tests {
+		if got := h.role(tt.groups); got != tt.want {
+			t.Errorf("role(%v) = %q, want %q", tt.groups, got, tt.want)
+		}
+	}
+
+	cfg.OIDCDefaultRole = models.RoleAuditor
+	h, err = NewOIDCHandler(NewAuthHandler(nil, cfg, nil, nil), nil)
+	if err != nil {
+		t.Fatalf("NewOIDCHandler: %v", err)
+	}
+	if got := h.role([]string{"staff"}); got != models.RoleAuditor {
+		t.Errorf("role of an unmapped group = %q, want the default %q", got, models.RoleAuditor)
+	}
+}
+
+func TestOIDCRoleMappingRejectsInvalidEntries(t *testing.T) {
+	for _, cfg := range []*config.Config{
+		{OIDCRoleMapping: []string{"pharmacy-admins"}},
+		{OIDCRoleMapping: []string{"=admin"}},
+		{OIDCRoleMapping: []string{"pharmacy-admins=superuser"}},
+		{OIDCDefaultRole: "superuser"},
+	} {
+		if _, err := NewOIDCHandler(NewAuthHandler(nil, cfg, nil, nil), nil); err == nil {
+			t.Errorf("NewOIDCHandler accepted mapping %v, default role %q", cfg.OIDCRoleMapping, cfg.OIDCDefaultRole)
+		}
+	}
+}
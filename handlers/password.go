@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// ChangePassword changes the current user's password after checking the
+// current one. All other sessions of the user are ended.
+func (h *AuthHandler) ChangePassword(c fiber.Ctx) error {
+	var req models.ChangePasswordRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate input
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Current and new password are required",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+	sessionID, _ := c.Locals("session_id").(int)
+
+	user, err := h.auth.User(userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if status, msg := h.checkCurrentPassword(c, user.Username, req.CurrentPassword, user.PasswordHash); status != fiber.StatusOK {
+		if status == fiber.StatusUnauthorized {
+			msg = "Current password is incorrect"
+		}
+		return c.Status(status).JSON(fiber.Map{
+			"error": msg,
+		})
+	}
+	if req.NewPassword == req.CurrentPassword {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "New password must differ from the current password",
+		})
+	}
+	if err = utils.ValidatePassword(req.NewPassword, user.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Weak password: " + err.Error(),
+		})
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	// Keep the session used for the change, end the others
+	if err = h.auth.ChangePassword(actor(c), userID, sessionID, hashedPassword); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ForgotPassword sends a single-use password reset token to the user with
+// the given email. The response is the same whether or not the account
+// exists, so it cannot be used to discover accounts.
+func (h *AuthHandler) ForgotPassword(c fiber.Ctx) error {
+	var req models.ForgotPasswordRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Email is required",
+		})
+	}
+
+	accepted := fiber.Map{
+		"message": "If an account with this email exists, a reset token has been sent",
+	}
+
+	user, err := h.auth.PasswordResetUser(req.Email)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusAccepted).JSON(accepted)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	// The token is created and sent after responding, so that the response
+	// takes as long whether or not the account exists
+	go h.sendResetToken(user.ID, user.Username, req.Email)
+
+	return c.Status(fiber.StatusAccepted).JSON(accepted)
+}
+
+// sendResetToken creates a password reset token for the user and sends it to
+// their email. It runs after ForgotPassword has responded, so failures are
+// only logged.
+func (h *AuthHandler) sendResetToken(userID int, username, email string) {
+	token, err := utils.GenerateRandomString(32)
+	if err != nil {
+		log.Printf("Failed to generate password reset token for user %d: %v", userID, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(h.cfg.PasswordResetExpiration)
+	if err = h.auth.CreateResetToken(userID, utils.HashToken(token), expiresAt); err != nil {
+		log.Printf("Failed to create password reset token for user %d: %v", userID, err)
+		return
+	}
+
+	msg := notifier.Message{
+		To:      email,
+		Subject: "Pharmacy password reset",
+		Body: "Hello " + username + ",\n\n" +
+			"Use this token to reset your password: " + token + "\n" +
+			"It expires at " + expiresAt.Format(time.RFC1123) + " and can be used once.\n" +
+			"If you did not ask for a password reset, ignore this message.",
+	}
+	if err = h.notifier.Send(msg); err != nil {
+		log.Printf("Failed to send password reset token to user %d: %v", userID, err)
+	}
+}
+
+// ResetPassword sets a new password using a reset token. The token can only
+// be used once, and all sessions of the user are ended.
+func (h *AuthHandler) ResetPassword(c fiber.Ctx) error {
+	var req models.ResetPasswordRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Token == "" || req.NewPassword == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Token and new password are required",
+		})
+	}
+
+	tokenHash := utils.HashToken(req.Token)
+	user, err := h.auth.ResetTokenUser(tokenHash)
+	if err == repository.ErrInvalidToken {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired reset token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	if err = utils.ValidatePassword(req.NewPassword, user.Username); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Weak password: " + err.Error(),
+		})
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to hash password",
+		})
+	}
+
+	// The token is checked again as it is used, in case it was used or
+	// replaced meanwhile. All sessions of the user are ended.
+	_, err = h.auth.ResetPassword(actor(c), tokenHash, hashedPassword)
+	if err == repository.ErrInvalidToken {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid or expired reset token",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
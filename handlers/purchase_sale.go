@@ -1,39 +1,40 @@
 package handlers
 
 import (
-	"database/sql"
+	"errors"
+	"log"
 	"strconv"
-	"time"
 
-	"github.com/alfinkly/hci-golang-back/database"
 	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
 	"github.com/gofiber/fiber/v3"
 )
 
-type PurchaseHandler struct{}
+type PurchaseHandler struct {
+	purchases repository.PurchaseRepository
+}
 
-func NewPurchaseHandler() *PurchaseHandler {
-	return &PurchaseHandler{}
+func NewPurchaseHandler(purchases repository.PurchaseRepository) *PurchaseHandler {
+	return &PurchaseHandler{purchases: purchases}
 }
 
-// GetAll returns all purchases
+// GetAll returns a page of purchases
 func (h *PurchaseHandler) GetAll(c fiber.Ctx) error {
-	query := `
-		SELECT id, medicine_id, supplier_id, quantity, unit_price, total_price, 
-		       purchase_date, created_at
-		FROM purchases
-		ORDER BY purchase_date DESC
-	`
+	q, err := parseList(c, repository.PurchaseList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	var purchases []models.Purchase
-	err := database.DB.Select(&purchases, query)
+	page, err := h.purchases.List(q)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch purchases",
 		})
 	}
 
-	return c.JSON(purchases)
+	return c.JSON(page)
 }
 
 // GetByID returns a purchase by ID
@@ -45,16 +46,8 @@ func (h *PurchaseHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		SELECT id, medicine_id, supplier_id, quantity, unit_price, total_price, 
-		       purchase_date, created_at
-		FROM purchases
-		WHERE id = $1
-	`
-
-	var purchase models.Purchase
-	err = database.DB.Get(&purchase, query, id)
-	if err == sql.ErrNoRows {
+	purchase, err := h.purchases.Get(id)
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Purchase not found",
 		})
@@ -68,7 +61,7 @@ func (h *PurchaseHandler) GetByID(c fiber.Ctx) error {
 	return c.JSON(purchase)
 }
 
-// Create creates a new purchase and updates medicine quantity
+// Create creates a new purchase, receives it as a batch and updates medicine quantity
 func (h *PurchaseHandler) Create(c fiber.Ctx) error {
 	var req models.CreatePurchaseRequest
 	if err := c.Bind().JSON(&req); err != nil {
@@ -83,79 +76,43 @@ func (h *PurchaseHandler) Create(c fiber.Ctx) error {
 			"error": "Medicine ID, supplier ID, quantity, and unit price are required",
 		})
 	}
-
-	totalPrice := float64(req.Quantity) * req.UnitPrice
-
-	// Start transaction
-	tx, err := database.DB.Begin()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to start transaction",
+	if req.BatchNumber == "" || req.ExpiryDate.IsZero() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Batch number and expiry date are required",
 		})
 	}
-	defer tx.Rollback()
-
-	// Insert purchase
-	query := `
-		INSERT INTO purchases (medicine_id, supplier_id, quantity, unit_price, total_price, 
-		                      purchase_date, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, medicine_id, supplier_id, quantity, unit_price, total_price, 
-		          purchase_date, created_at
-	`
-
-	var purchase models.Purchase
-	err = tx.QueryRow(
-		query,
-		req.MedicineID,
-		req.SupplierID,
-		req.Quantity,
-		req.UnitPrice,
-		totalPrice,
-		time.Now(),
-		time.Now(),
-	).Scan(
-		&purchase.ID,
-		&purchase.MedicineID,
-		&purchase.SupplierID,
-		&purchase.Quantity,
-		&purchase.UnitPrice,
-		&purchase.TotalPrice,
-		&purchase.PurchaseDate,
-		&purchase.CreatedAt,
-	)
 
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create purchase: " + err.Error(),
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
 		})
 	}
 
-	// Update medicine quantity
-	updateQuery := `
-		UPDATE medicines 
-		SET quantity = quantity + $1, updated_at = $2
-		WHERE id = $3
-	`
-	_, err = tx.Exec(updateQuery, req.Quantity, time.Now(), req.MedicineID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update medicine quantity",
+	purchase, err := h.purchases.Create(actor(c), req)
+	var medicineErr *repository.MedicineError
+	switch {
+	case err == nil:
+		return c.Status(fiber.StatusCreated).JSON(purchase)
+	case errors.As(err, &medicineErr) && medicineErr.Err == repository.ErrNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medicine not found: " + strconv.Itoa(medicineErr.MedicineID),
 		})
-	}
-
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to commit transaction",
+	case err == repository.ErrSupplierNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Supplier not found: " + strconv.Itoa(req.SupplierID),
 		})
 	}
-
-	return c.Status(fiber.StatusCreated).JSON(purchase)
+	log.Printf("Failed to create purchase: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to create purchase",
+	})
 }
 
-// Delete deletes a purchase
-func (h *PurchaseHandler) Delete(c fiber.Ctx) error {
+// Void reverses a purchase: the received quantity is taken back out of the
+// purchase's batch and the purchase is marked as voided. The purchase record
+// itself is kept.
+func (h *PurchaseHandler) Void(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
@@ -163,54 +120,82 @@ func (h *PurchaseHandler) Delete(c fiber.Ctx) error {
 		})
 	}
 
-	query := `DELETE FROM purchases WHERE id = $1`
-	result, err := database.DB.Exec(query, id)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete purchase",
+	var req models.VoidPurchaseRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.Reason == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Reason is required",
+		})
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
 		})
 	}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	purchase, err := h.purchases.Void(actor(c), id, req.Reason)
+	var stockLeft *repository.StockLeftError
+	switch {
+	case err == nil:
+		return c.JSON(purchase)
+	case err == repository.ErrNotFound:
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Purchase not found",
 		})
+	case err == repository.ErrAlreadyVoided:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Purchase is already voided",
+		})
+	case err == repository.ErrPurchaseBatchGone:
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The batch received with this purchase no longer exists",
+		})
+	case errors.As(err, &stockLeft):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": stockLeft.Error(),
+		})
 	}
-
-	return c.JSON(fiber.Map{
-		"message": "Purchase deleted successfully",
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to void purchase",
 	})
 }
 
 // SaleHandler handles sale operations
-type SaleHandler struct{}
+type SaleHandler struct {
+	sales repository.SaleRepository
+}
 
-func NewSaleHandler() *SaleHandler {
-	return &SaleHandler{}
+func NewSaleHandler(sales repository.SaleRepository) *SaleHandler {
+	return &SaleHandler{sales: sales}
 }
 
-// GetAll returns all sales
+// GetAll returns a page of sales
 func (h *SaleHandler) GetAll(c fiber.Ctx) error {
-	query := `
-		SELECT id, medicine_id, user_id, quantity, unit_price, total_price, 
-		       sale_date, created_at
-		FROM sales
-		ORDER BY sale_date DESC
-	`
+	q, err := parseList(c, repository.SaleList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
 
-	var sales []models.Sale
-	err := database.DB.Select(&sales, query)
+	page, err := h.sales.List(q)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch sales",
 		})
 	}
 
-	return c.JSON(sales)
+	return c.JSON(page)
 }
 
-// GetByID returns a sale by ID
+// GetByID returns a sale by ID with its line items and consumed batches
 func (h *SaleHandler) GetByID(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -219,16 +204,8 @@ func (h *SaleHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		SELECT id, medicine_id, user_id, quantity, unit_price, total_price, 
-		       sale_date, created_at
-		FROM sales
-		WHERE id = $1
-	`
-
-	var sale models.Sale
-	err = database.DB.Get(&sale, query, id)
-	if err == sql.ErrNoRows {
+	sale, err := h.sales.Get(id)
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Sale not found",
 		})
@@ -242,7 +219,8 @@ func (h *SaleHandler) GetByID(c fiber.Ctx) error {
 	return c.JSON(sale)
 }
 
-// Create creates a new sale and updates medicine quantity
+// Create creates a new sale (receipt) with one or more line items in a single
+// transaction, consuming stock from batches first-expiry-first-out
 func (h *SaleHandler) Create(c fiber.Ctx) error {
 	var req models.CreateSaleRequest
 	if err := c.Bind().JSON(&req); err != nil {
@@ -252,138 +230,51 @@ func (h *SaleHandler) Create(c fiber.Ctx) error {
 	}
 
 	// Validate required fields
-	if req.MedicineID == 0 || req.Quantity <= 0 {
+	if len(req.Items) == 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Medicine ID and quantity are required",
+			"error": "At least one item is required",
 		})
 	}
-
-	// Get user ID from context
-	userID, ok := c.Locals("user_id").(int)
-	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "User ID not found in context",
-		})
-	}
-
-	// Start transaction
-	tx, err := database.DB.Begin()
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to start transaction",
-		})
-	}
-	defer tx.Rollback()
-
-	// Get medicine price and check quantity
-	var price float64
-	var availableQuantity int
-	medicineQuery := `SELECT price, quantity FROM medicines WHERE id = $1`
-	err = tx.QueryRow(medicineQuery, req.MedicineID).Scan(&price, &availableQuantity)
-	if err == sql.ErrNoRows {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Medicine not found",
-		})
+	for _, item := range req.Items {
+		if item.MedicineID == 0 || item.Quantity <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Medicine ID and quantity are required for every item",
+			})
+		}
 	}
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch medicine",
-		})
-	}
-
-	// Check if enough quantity is available
-	if availableQuantity < req.Quantity {
+	if req.Discount < 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Insufficient quantity available",
-		})
-	}
-
-	totalPrice := float64(req.Quantity) * price
-
-	// Insert sale
-	query := `
-		INSERT INTO sales (medicine_id, user_id, quantity, unit_price, total_price, 
-		                  sale_date, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, medicine_id, user_id, quantity, unit_price, total_price, 
-		          sale_date, created_at
-	`
-
-	var sale models.Sale
-	err = tx.QueryRow(
-		query,
-		req.MedicineID,
-		userID,
-		req.Quantity,
-		price,
-		totalPrice,
-		time.Now(),
-		time.Now(),
-	).Scan(
-		&sale.ID,
-		&sale.MedicineID,
-		&sale.UserID,
-		&sale.Quantity,
-		&sale.UnitPrice,
-		&sale.TotalPrice,
-		&sale.SaleDate,
-		&sale.CreatedAt,
-	)
-
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to create sale: " + err.Error(),
+			"error": "Discount cannot be negative",
 		})
 	}
 
-	// Update medicine quantity
-	updateQuery := `
-		UPDATE medicines 
-		SET quantity = quantity - $1, updated_at = $2
-		WHERE id = $3
-	`
-	_, err = tx.Exec(updateQuery, req.Quantity, time.Now(), req.MedicineID)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to update medicine quantity",
-		})
-	}
-
-	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to commit transaction",
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
 		})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(sale)
-}
-
-// Delete deletes a sale
-func (h *SaleHandler) Delete(c fiber.Ctx) error {
-	id, err := strconv.Atoi(c.Params("id"))
-	if err != nil {
+	sale, err := h.sales.Create(actor(c), req)
+	var medicineErr *repository.MedicineError
+	switch {
+	case err == nil:
+		return c.Status(fiber.StatusCreated).JSON(sale)
+	case err == repository.ErrDiscountTooLarge:
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid sale ID",
-		})
-	}
-
-	query := `DELETE FROM sales WHERE id = $1`
-	result, err := database.DB.Exec(query, id)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete sale",
+			"error": "Discount cannot exceed the subtotal",
 		})
-	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	case errors.As(err, &medicineErr) && medicineErr.Err == repository.ErrNotFound:
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "Sale not found",
+			"error": "Medicine not found: " + strconv.Itoa(medicineErr.MedicineID),
+		})
+	case errors.As(err, &medicineErr) && medicineErr.Err == repository.ErrInsufficientStock:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Insufficient quantity available for medicine " + strconv.Itoa(medicineErr.MedicineID),
 		})
 	}
-
-	return c.JSON(fiber.Map{
-		"message": "Sale deleted successfully",
+	log.Printf("Failed to create sale: %v", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to create sale",
 	})
 }
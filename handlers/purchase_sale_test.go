@@ -0,0 +1,169 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// receiveStock creates a medicine priced at 2.50 and receives quantity units
+// of it in a purchase
+func receiveStock(t *testing.T, app *fiber.App, quantity int) (models.Medicine, models.Purchase) {
+	t.Helper()
+
+	var medicine models.Medicine
+	do(t, app, "POST", "/medicines", models.CreateMedicineRequest{Name: "Aspirin", Price: 250}, fiber.StatusCreated, &medicine)
+	var supplier models.Supplier
+	do(t, app, "POST", "/suppliers", models.CreateSupplierRequest{Name: "Pharma Co"}, fiber.StatusCreated, &supplier)
+
+	var purchase models.Purchase
+	do(t, app, "POST", "/purchases", models.CreatePurchaseRequest{
+		MedicineID:  medicine.ID,
+		SupplierID:  supplier.ID,
+		Quantity:    quantity,
+		UnitPrice:   100,
+		BatchNumber: "LOT-1",
+		ExpiryDate:  time.Now().AddDate(1, 0, 0),
+	}, fiber.StatusCreated, &purchase)
+
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID), nil, fiber.StatusOK, &medicine)
+	return medicine, purchase
+}
+
+func TestSaleLifecycle(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, purchase := receiveStock(t, app, 10)
+	if medicine.Quantity != 10 {
+		t.Fatalf("quantity = %d, want 10", medicine.Quantity)
+	}
+
+	items := []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 4}}
+	msg := errorMessage(t, app, "POST", "/sales", models.CreateSaleRequest{Items: items, Discount: 1001}, fiber.StatusBadRequest)
+	if msg != "Discount cannot exceed the subtotal" {
+		t.Errorf("discount error = %q", msg)
+	}
+	msg = errorMessage(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 11}},
+	}, fiber.StatusBadRequest)
+	if msg != "Insufficient quantity available for medicine "+strconv.Itoa(medicine.ID) {
+		t.Errorf("stock error = %q", msg)
+	}
+	msg = errorMessage(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: 99, Quantity: 1}},
+	}, fiber.StatusNotFound)
+	if msg != "Medicine not found: 99" {
+		t.Errorf("missing medicine error = %q", msg)
+	}
+
+	var sale models.Sale
+	do(t, app, "POST", "/sales", models.CreateSaleRequest{Items: items}, fiber.StatusCreated, &sale)
+	if sale.Total != 1000 || sale.UserID != testUserID || len(sale.Items) != 1 {
+		t.Fatalf("sale = %+v", sale)
+	}
+
+	// Part of the purchase has been sold, so it cannot be voided
+	msg = errorMessage(t, app, "POST", "/purchases/"+strconv.Itoa(purchase.ID)+"/void",
+		models.VoidPurchaseRequest{Reason: "Wrong delivery"}, fiber.StatusConflict)
+	if msg != "Cannot void purchase: 4 of 10 received units have already left stock" {
+		t.Errorf("void error = %q", msg)
+	}
+
+	returnPath := "/sales/" + strconv.Itoa(sale.ID) + "/returns"
+	msg = errorMessage(t, app, "POST", returnPath, models.CreateSaleReturnRequest{
+		Reason: "Not needed",
+		Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID, Quantity: 5}},
+	}, fiber.StatusBadRequest)
+	if msg != "Only 4 of sale item "+strconv.Itoa(sale.Items[0].ID)+" can be returned" {
+		t.Errorf("over-return error = %q", msg)
+	}
+	var saleReturn models.SaleReturn
+	do(t, app, "POST", returnPath, models.CreateSaleReturnRequest{
+		Reason: "Not needed",
+		Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID}},
+	}, fiber.StatusCreated, &saleReturn)
+	if saleReturn.RefundAmount != 1000 {
+		t.Errorf("refund = %v, want 10.00", saleReturn.RefundAmount)
+	}
+	var returns []models.SaleReturn
+	do(t, app, "GET", returnPath, nil, fiber.StatusOK, &returns)
+	if len(returns) != 1 {
+		t.Errorf("returns = %+v", returns)
+	}
+	if msg = errorMessage(t, app, "GET", "/sales/99/returns", nil, fiber.StatusNotFound); msg != "Sale not found" {
+		t.Errorf("unknown sale error = %q", msg)
+	}
+
+	// With everything returned the purchase can be voided, once
+	voidPath := "/purchases/" + strconv.Itoa(purchase.ID) + "/void"
+	do(t, app, "POST", voidPath, models.VoidPurchaseRequest{Reason: "Wrong delivery"}, fiber.StatusOK, &purchase)
+	if purchase.VoidedAt == nil || purchase.VoidedBy == nil || *purchase.VoidedBy != testUserID {
+		t.Errorf("voided purchase = %+v", purchase)
+	}
+	msg = errorMessage(t, app, "POST", voidPath, models.VoidPurchaseRequest{Reason: "Again"}, fiber.StatusConflict)
+	if msg != "Purchase is already voided" {
+		t.Errorf("second void error = %q", msg)
+	}
+
+	var page models.Page[models.Purchase]
+	do(t, app, "GET", "/purchases?voided=true", nil, fiber.StatusOK, &page)
+	if page.Total != 1 || page.Data[0].ID != purchase.ID {
+		t.Errorf("voided purchases = %+v", page)
+	}
+
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID), nil, fiber.StatusOK, &medicine)
+	if medicine.Quantity != 0 {
+		t.Errorf("quantity = %d, want 0", medicine.Quantity)
+	}
+}
+
+func TestPurchaseOfUnknownMedicineOrSupplier(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, purchase := receiveStock(t, app, 10)
+
+	req := models.CreatePurchaseRequest{
+		MedicineID:  99,
+		SupplierID:  purchase.SupplierID,
+		Quantity:    1,
+		UnitPrice:   100,
+		BatchNumber: "LOT-2",
+		ExpiryDate:  time.Now().AddDate(1, 0, 0),
+	}
+	msg := errorMessage(t, app, "POST", "/purchases", req, fiber.StatusNotFound)
+	if msg != "Medicine not found: 99" {
+		t.Errorf("missing medicine error = %q", msg)
+	}
+
+	req.MedicineID, req.SupplierID = medicine.ID, 99
+	msg = errorMessage(t, app, "POST", "/purchases", req, fiber.StatusNotFound)
+	if msg != "Supplier not found: 99" {
+		t.Errorf("missing supplier error = %q", msg)
+	}
+}
+
+func TestAuditLogRecordsRequestActor(t *testing.T) {
+	repos := repository.NewMemory()
+	app := newTestApp(repos)
+	medicine, _ := receiveStock(t, app, 5)
+
+	name := "Aspirin 500"
+	do(t, app, "PUT", "/medicines/"+strconv.Itoa(medicine.ID), models.UpdateMedicineRequest{Name: &name}, fiber.StatusOK, nil)
+
+	var page models.Page[models.AuditEntry]
+	do(t, app, "GET", "/audit-log?entity=medicine&action=update", nil, fiber.StatusOK, &page)
+	if page.Total != 1 {
+		t.Fatalf("audit entries = %+v", page)
+	}
+	entry := page.Data[0]
+	if entry.UserID == nil || *entry.UserID != testUserID || entry.Username == nil || *entry.Username != "admin" {
+		t.Errorf("audit actor = %v, %v", entry.UserID, entry.Username)
+	}
+	var changes map[string]struct{ From, To any }
+	if err := json.Unmarshal(entry.Changes, &changes); err != nil || changes["name"].To != name {
+		t.Errorf("audit changes = %s", entry.Changes)
+	}
+}
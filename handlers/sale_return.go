@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// GetReturns returns all returns recorded against a sale
+func (h *SaleHandler) GetReturns(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid sale ID",
+		})
+	}
+
+	returns, err := h.sales.Returns(id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Sale not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch returns",
+		})
+	}
+
+	return c.JSON(returns)
+}
+
+// CreateReturn records a full or partial return of sale lines. Returned stock
+// is put back into the batches it was sold from, or written off as damaged.
+// The original sale is left untouched.
+func (h *SaleHandler) CreateReturn(c fiber.Ctx) error {
+	saleID, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid sale ID",
+		})
+	}
+
+	var req models.CreateSaleReturnRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate required fields
+	if req.Reason == "" || len(req.Items) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Reason and at least one item are required",
+		})
+	}
+	seen := make(map[int]bool, len(req.Items))
+	for i, line := range req.Items {
+		if line.SaleItemID == 0 || line.Quantity < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Sale item ID is required and quantity cannot be negative",
+			})
+		}
+		if seen[line.SaleItemID] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Each sale item may only appear once in a return",
+			})
+		}
+		seen[line.SaleItemID] = true
+		if line.Disposition == "" {
+			req.Items[i].Disposition = models.ReturnRestock
+		} else if line.Disposition != models.ReturnRestock && line.Disposition != models.ReturnDamaged {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Disposition must be 'restock' or 'damaged'",
+			})
+		}
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	saleReturn, err := h.sales.CreateReturn(actor(c), saleID, req)
+	var returnErr *repository.ReturnError
+	switch {
+	case err == nil:
+		return c.Status(fiber.StatusCreated).JSON(saleReturn)
+	case err == repository.ErrNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Sale not found",
+		})
+	case errors.As(err, &returnErr):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": returnErr.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to create return: " + err.Error(),
+	})
+}
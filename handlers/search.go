@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// Number of search results when no limit is given, and the largest allowed
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// Search finds medicines by name, manufacturer, category and description.
+// Full-text matches of every word are combined with trigram similarity of the
+// name and manufacturer, so misspelled names are found too. Results are
+// ranked by relevance.
+func (h *MedicineHandler) Search(c fiber.Ctx) error {
+	q := strings.TrimSpace(c.Query("q"))
+	if len(repository.SearchWords(q)) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Search query q is required",
+		})
+	}
+
+	limit := defaultSearchLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Limit must be between 1 and " + strconv.Itoa(maxSearchLimit),
+			})
+		}
+		limit = n
+	}
+
+	results, err := h.medicines.Search(q, limit)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to search medicines",
+		})
+	}
+
+	return c.JSON(results)
+}
@@ -0,0 +1,140 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// startSession opens a new login session for a user and returns its access
+// and refresh tokens
+func (h *AuthHandler) startSession(c fiber.Ctx, user models.User) (*models.LoginResponse, error) {
+	refreshToken, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	sessionID, err := h.auth.StartSession(user.ID, c.Get("User-Agent"), c.IP(), now.Add(h.cfg.RefreshExpiration), utils.HashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := utils.GenerateToken(&user, sessionID, h.keys, h.cfg.JWTExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.LoginResponse{
+		Token:        token,
+		ExpiresAt:    now.Add(h.cfg.JWTExpiration),
+		RefreshToken: refreshToken,
+		User:         user,
+	}, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can be used once; presenting a used one again
+// means it was stolen, so the whole session is revoked.
+func (h *AuthHandler) Refresh(c fiber.Ctx) error {
+	var req models.RefreshRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Refresh token is required",
+		})
+	}
+
+	refreshToken, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to issue refresh token",
+		})
+	}
+
+	// Rotate the refresh token. Reuse of a rotated token revokes the session
+	// so neither the thief nor the legitimate client can continue with it.
+	user, sessionID, err := h.auth.Refresh(actor(c), utils.HashToken(req.RefreshToken), utils.HashToken(refreshToken))
+	switch err {
+	case nil:
+	case repository.ErrInvalidToken:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid refresh token",
+		})
+	case repository.ErrTokenReused:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Refresh token has already been used, session revoked",
+		})
+	case repository.ErrSessionEnded:
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session has expired or been revoked",
+		})
+	case repository.ErrUserInactive:
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Account is deactivated",
+		})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate refresh token",
+		})
+	}
+
+	token, err := utils.GenerateToken(&user, sessionID, h.keys, h.cfg.JWTExpiration)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+
+	return c.JSON(models.LoginResponse{
+		Token:        token,
+		ExpiresAt:    time.Now().Add(h.cfg.JWTExpiration),
+		RefreshToken: refreshToken,
+		User:         user,
+	})
+}
+
+// Logout revokes the current access token and ends its session
+func (h *AuthHandler) Logout(c fiber.Ctx) error {
+	return h.logout(c, false)
+}
+
+// LogoutAll revokes the current access token and ends every session of the
+// current user
+func (h *AuthHandler) LogoutAll(c fiber.Ctx) error {
+	return h.logout(c, true)
+}
+
+func (h *AuthHandler) logout(c fiber.Ctx, allSessions bool) error {
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+	sessionID, _ := c.Locals("session_id").(int)
+	tokenID, _ := c.Locals("token_id").(string)
+	tokenExpiresAt, _ := c.Locals("token_expires_at").(time.Time)
+
+	var err error
+	if allSessions {
+		err = h.auth.LogoutAll(actor(c), tokenID, tokenExpiresAt)
+	} else {
+		err = h.auth.Logout(actor(c), sessionID, tokenID, tokenExpiresAt)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
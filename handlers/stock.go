@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// StockHandler exposes the stock movement ledger
+type StockHandler struct {
+	stock repository.StockRepository
+}
+
+func NewStockHandler(stock repository.StockRepository) *StockHandler {
+	return &StockHandler{stock: stock}
+}
+
+// GetMovements returns a page of the stock movement ledger of a medicine
+func (h *StockHandler) GetMovements(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medicine ID",
+		})
+	}
+
+	q, err := parseList(c, repository.MovementList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.stock.Movements(withFilter(q, "medicine_id", id))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch stock movements",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// Reconcile lists medicines whose quantity does not match the sum of their
+// stock movements
+func (h *StockHandler) Reconcile(c fiber.Ctx) error {
+	discrepancies, err := h.stock.Reconcile()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reconcile stock",
+		})
+	}
+
+	return c.JSON(discrepancies)
+}
+
+// GetAdjustments returns a page of the stock adjustments of a medicine
+func (h *StockHandler) GetAdjustments(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medicine ID",
+		})
+	}
+
+	q, err := parseList(c, repository.AdjustmentList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.stock.Adjustments(withFilter(q, "medicine_id", id))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch stock adjustments",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// CreateAdjustment applies a signed stock change with a reason code
+func (h *StockHandler) CreateAdjustment(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid medicine ID",
+		})
+	}
+
+	var req models.CreateStockAdjustmentRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate required fields
+	if req.Delta == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Delta is required and cannot be zero",
+		})
+	}
+	switch req.ReasonCode {
+	case models.AdjustmentCountCorrection:
+	case models.AdjustmentDamaged, models.AdjustmentExpired, models.AdjustmentTheft:
+		if req.Delta > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Damaged, expired and theft adjustments must decrease stock",
+			})
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Reason code must be one of: damaged, expired, theft, count_correction",
+		})
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	adjustment, err := h.stock.Adjust(actor(c), id, req)
+	switch {
+	case err == repository.ErrNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medicine not found",
+		})
+	case err == repository.ErrBatchNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Batch not found for this medicine",
+		})
+	case err == repository.ErrInsufficientStock:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Adjustment would make stock negative",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to apply adjustment",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(adjustment)
+}
@@ -0,0 +1,230 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// StockTakeHandler handles physical inventory count sessions
+type StockTakeHandler struct {
+	stockTakes repository.StockTakeRepository
+}
+
+func NewStockTakeHandler(stockTakes repository.StockTakeRepository) *StockTakeHandler {
+	return &StockTakeHandler{stockTakes: stockTakes}
+}
+
+// GetAll returns a page of stock-take sessions
+func (h *StockTakeHandler) GetAll(c fiber.Ctx) error {
+	q, err := parseList(c, repository.StockTakeList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.stockTakes.List(q)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch stock takes",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// GetByID returns a stock-take session with its counted lines and variances
+func (h *StockTakeHandler) GetByID(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid stock take ID",
+		})
+	}
+
+	stockTake, err := h.stockTakes.Get(id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Stock take not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch stock take",
+		})
+	}
+
+	return c.JSON(stockTake)
+}
+
+// Create opens a new stock-take session
+func (h *StockTakeHandler) Create(c fiber.Ctx) error {
+	var req models.CreateStockTakeRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	stockTake, err := h.stockTakes.Create(actor(c), req.Note)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create stock take",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(stockTake)
+}
+
+// SubmitCounts records counted quantities in an open session. Counting the
+// same medicine (and batch) again replaces the earlier count.
+func (h *StockTakeHandler) SubmitCounts(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid stock take ID",
+		})
+	}
+
+	var req models.SubmitStockCountsRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate required fields
+	if len(req.Counts) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least one count is required",
+		})
+	}
+	for _, count := range req.Counts {
+		if count.MedicineID == 0 || count.CountedQuantity < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Medicine ID is required and counted quantity cannot be negative",
+			})
+		}
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	stockTake, err := h.stockTakes.SubmitCounts(actor(c), id, req.Counts)
+	var medicineErr *repository.MedicineError
+	var countErr *repository.CountError
+	switch {
+	case errors.As(err, &medicineErr):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Medicine not found: " + strconv.Itoa(medicineErr.MedicineID),
+		})
+	case errors.As(err, &countErr):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": countErr.Error(),
+		})
+	case err != nil:
+		return stockTakeError(c, err, "Failed to record counts")
+	}
+
+	return c.JSON(stockTake)
+}
+
+// Post applies the variances of an open session as count-correction
+// adjustments in a single transaction and closes the session
+func (h *StockTakeHandler) Post(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid stock take ID",
+		})
+	}
+
+	// Get user ID from context
+	if _, ok := c.Locals("user_id").(int); !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+
+	stockTake, err := h.stockTakes.Post(actor(c), id)
+	var medicineErr *repository.MedicineError
+	switch {
+	case err == repository.ErrNoCounts:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Stock take has no counts",
+		})
+	case errors.As(err, &medicineErr) && medicineErr.Err == repository.ErrInsufficientStock:
+		// Stock fell below the counted quantity after the count, so the
+		// shelf has to be counted again
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Stock of medicine " + strconv.Itoa(medicineErr.MedicineID) + " changed since it was counted, count it again",
+		})
+	case errors.As(err, &medicineErr):
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to apply adjustment for medicine " + strconv.Itoa(medicineErr.MedicineID),
+		})
+	case err != nil:
+		return stockTakeError(c, err, "Failed to post stock take")
+	}
+
+	return c.JSON(stockTake)
+}
+
+// Cancel closes an open session without touching stock
+func (h *StockTakeHandler) Cancel(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid stock take ID",
+		})
+	}
+
+	stockTake, err := h.stockTakes.Cancel(actor(c), id)
+	var statusErr *repository.StockTakeStatusError
+	switch {
+	case err == repository.ErrNotFound, errors.As(err, &statusErr):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Stock take not found or not open",
+		})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cancel stock take",
+		})
+	}
+
+	return c.JSON(stockTake)
+}
+
+// stockTakeError responds to an error changing a stock take that is missing
+// or no longer open
+func stockTakeError(c fiber.Ctx, err error, message string) error {
+	var statusErr *repository.StockTakeStatusError
+	switch {
+	case err == repository.ErrNotFound:
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Stock take not found",
+		})
+	case errors.As(err, &statusErr):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": statusErr.Error(),
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": message,
+	})
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestStockTakeLifecycle(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, purchase := receiveStock(t, app, 10)
+
+	var stockTake models.StockTake
+	do(t, app, "POST", "/stock-takes", models.CreateStockTakeRequest{Note: "Monthly count"}, fiber.StatusCreated, &stockTake)
+	path := "/stock-takes/" + strconv.Itoa(stockTake.ID)
+
+	msg := errorMessage(t, app, "POST", path+"/post", nil, fiber.StatusBadRequest)
+	if msg != "Stock take has no counts" {
+		t.Errorf("empty post error = %q", msg)
+	}
+
+	msg = errorMessage(t, app, "POST", path+"/counts", models.SubmitStockCountsRequest{
+		Counts: []models.StockCountRequest{{MedicineID: 99, CountedQuantity: 1}},
+	}, fiber.StatusNotFound)
+	if msg != "Medicine not found: 99" {
+		t.Errorf("unknown medicine error = %q", msg)
+	}
+
+	batchID := purchase.Batch.ID
+	do(t, app, "POST", path+"/counts", models.SubmitStockCountsRequest{
+		Counts: []models.StockCountRequest{{MedicineID: medicine.ID, BatchID: &batchID, CountedQuantity: 9}},
+	}, fiber.StatusOK, &stockTake)
+	if len(stockTake.Lines) != 1 || stockTake.Lines[0].ExpectedQuantity != 10 || stockTake.Lines[0].Variance != -1 {
+		t.Fatalf("lines = %+v", stockTake.Lines)
+	}
+
+	msg = errorMessage(t, app, "POST", path+"/counts", models.SubmitStockCountsRequest{
+		Counts: []models.StockCountRequest{{MedicineID: medicine.ID, CountedQuantity: 9}},
+	}, fiber.StatusBadRequest)
+	if msg != "Medicine "+strconv.Itoa(medicine.ID)+" cannot be counted both as a whole and by batch" {
+		t.Errorf("conflicting count error = %q", msg)
+	}
+
+	// A sale between counting and posting is not reversed by the post
+	do(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 2}},
+	}, fiber.StatusCreated, nil)
+	do(t, app, "POST", path+"/post", nil, fiber.StatusOK, &stockTake)
+	if stockTake.Status != models.StockTakePosted || stockTake.Lines[0].Variance != -1 {
+		t.Errorf("posted stock take = %+v", stockTake)
+	}
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID), nil, fiber.StatusOK, &medicine)
+	if medicine.Quantity != 7 {
+		t.Errorf("quantity = %d, want 7", medicine.Quantity)
+	}
+
+	msg = errorMessage(t, app, "POST", path+"/post", nil, fiber.StatusConflict)
+	if msg != "Stock take is posted" {
+		t.Errorf("second post error = %q", msg)
+	}
+	errorMessage(t, app, "POST", path+"/cancel", nil, fiber.StatusConflict)
+	errorMessage(t, app, "POST", "/stock-takes/99/post", nil, fiber.StatusNotFound)
+}
+
+func TestStockTakePostAfterStockFell(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, _ := receiveStock(t, app, 10)
+
+	var stockTake models.StockTake
+	do(t, app, "POST", "/stock-takes", models.CreateStockTakeRequest{}, fiber.StatusCreated, &stockTake)
+	path := "/stock-takes/" + strconv.Itoa(stockTake.ID)
+	do(t, app, "POST", path+"/counts", models.SubmitStockCountsRequest{
+		Counts: []models.StockCountRequest{{MedicineID: medicine.ID, CountedQuantity: 2}},
+	}, fiber.StatusOK, nil)
+	do(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 5}},
+	}, fiber.StatusCreated, nil)
+
+	msg := errorMessage(t, app, "POST", path+"/post", nil, fiber.StatusConflict)
+	if msg != "Stock of medicine "+strconv.Itoa(medicine.ID)+" changed since it was counted, count it again" {
+		t.Errorf("post error = %q", msg)
+	}
+	do(t, app, "GET", path, nil, fiber.StatusOK, &stockTake)
+	if stockTake.Status != models.StockTakeOpen {
+		t.Errorf("status = %q", stockTake.Status)
+	}
+}
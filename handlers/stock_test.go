@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestStockLedger(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, _ := receiveStock(t, app, 10)
+	do(t, app, "POST", "/sales", models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 4}},
+	}, fiber.StatusCreated, nil)
+
+	var movements models.Page[models.StockMovement]
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID)+"/movements?sort=id", nil, fiber.StatusOK, &movements)
+	if movements.Total != 2 ||
+		movements.Data[0].MovementType != models.MovementInbound || movements.Data[0].BalanceAfter != 10 ||
+		movements.Data[1].MovementType != models.MovementOutbound || movements.Data[1].BalanceAfter != 6 {
+		t.Errorf("movements = %+v", movements.Data)
+	}
+
+	// Every quantity matches its ledger, which is an empty list rather than null
+	var discrepancies []models.StockDiscrepancy
+	do(t, app, "GET", "/stock/reconciliation", nil, fiber.StatusOK, &discrepancies)
+	if discrepancies == nil || len(discrepancies) != 0 {
+		t.Errorf("discrepancies = %#v", discrepancies)
+	}
+}
+
+func TestStockAdjustments(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+	medicine, purchase := receiveStock(t, app, 10)
+	path := "/medicines/" + strconv.Itoa(medicine.ID) + "/adjustments"
+
+	for _, tt := range []struct {
+		req        models.CreateStockAdjustmentRequest
+		wantStatus int
+		want       string
+	}{
+		{models.CreateStockAdjustmentRequest{ReasonCode: models.AdjustmentDamaged}, fiber.StatusBadRequest,
+			"Delta is required and cannot be zero"},
+		{models.CreateStockAdjustmentRequest{Delta: 1, ReasonCode: models.AdjustmentDamaged}, fiber.StatusBadRequest,
+			"Damaged, expired and theft adjustments must decrease stock"},
+		{models.CreateStockAdjustmentRequest{Delta: -1, ReasonCode: "lost"}, fiber.StatusBadRequest,
+			"Reason code must be one of: damaged, expired, theft, count_correction"},
+		{models.CreateStockAdjustmentRequest{Delta: -11, ReasonCode: models.AdjustmentTheft}, fiber.StatusBadRequest,
+			"Adjustment would make stock negative"},
+		{models.CreateStockAdjustmentRequest{BatchID: new(int), Delta: -1, ReasonCode: models.AdjustmentTheft}, fiber.StatusNotFound,
+			"Batch not found for this medicine"},
+	} {
+		if msg := errorMessage(t, app, "POST", path, tt.req, tt.wantStatus); msg != tt.want {
+			t.Errorf("adjust %+v: %q, want %q", tt.req, msg, tt.want)
+		}
+	}
+	msg := errorMessage(t, app, "POST", "/medicines/99/adjustments", models.CreateStockAdjustmentRequest{
+		Delta: -1, ReasonCode: models.AdjustmentTheft,
+	}, fiber.StatusNotFound)
+	if msg != "Medicine not found" {
+		t.Errorf("unknown medicine error = %q", msg)
+	}
+
+	// Stock is only changed through adjustments
+	quantity := 3
+	msg = errorMessage(t, app, "PUT", "/medicines/"+strconv.Itoa(medicine.ID), models.UpdateMedicineRequest{Quantity: &quantity}, fiber.StatusBadRequest)
+	if msg != "Quantity cannot be updated directly, use POST /api/medicines/:id/adjustments" {
+		t.Errorf("quantity update error = %q", msg)
+	}
+	expiry := time.Now().AddDate(2, 0, 0)
+	msg = errorMessage(t, app, "PUT", "/medicines/"+strconv.Itoa(medicine.ID), models.UpdateMedicineRequest{ExpiryDate: &expiry}, fiber.StatusBadRequest)
+	if msg != "Expiry date cannot be updated directly, it is the nearest expiry date of the batches in stock" {
+		t.Errorf("expiry update error = %q", msg)
+	}
+
+	var adjustment models.StockAdjustment
+	do(t, app, "POST", path, models.CreateStockAdjustmentRequest{
+		BatchID: &purchase.Batch.ID, Delta: -2, ReasonCode: models.AdjustmentDamaged, Note: "Dropped",
+	}, fiber.StatusCreated, &adjustment)
+	if adjustment.Delta != -2 || adjustment.BatchID == nil || *adjustment.BatchID != purchase.Batch.ID || adjustment.UserID != testUserID {
+		t.Errorf("adjustment = %+v", adjustment)
+	}
+	do(t, app, "GET", "/medicines/"+strconv.Itoa(medicine.ID), nil, fiber.StatusOK, &medicine)
+	if medicine.Quantity != 8 {
+		t.Errorf("quantity = %d, want 8", medicine.Quantity)
+	}
+
+	var adjustments models.Page[models.StockAdjustment]
+	do(t, app, "GET", path, nil, fiber.StatusOK, &adjustments)
+	if adjustments.Total != 1 || adjustments.Data[0].ID != adjustment.ID {
+		t.Errorf("adjustments = %+v", adjustments)
+	}
+}
@@ -1,41 +1,42 @@
 package handlers
 
 import (
-	"database/sql"
 	"strconv"
-	"time"
 
-	"github.com/alfinkly/hci-golang-back/database"
 	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/repository"
 	"github.com/gofiber/fiber/v3"
 )
 
-type SupplierHandler struct{}
+type SupplierHandler struct {
+	suppliers repository.SupplierRepository
+}
 
-func NewSupplierHandler() *SupplierHandler {
-	return &SupplierHandler{}
+func NewSupplierHandler(suppliers repository.SupplierRepository) *SupplierHandler {
+	return &SupplierHandler{suppliers: suppliers}
 }
 
-// GetAll returns all suppliers
+// GetAll returns a page of suppliers
 func (h *SupplierHandler) GetAll(c fiber.Ctx) error {
-	query := `
-		SELECT id, name, contact_person, phone, email, address, created_at, updated_at
-		FROM suppliers
-		ORDER BY created_at DESC
-	`
-
-	var suppliers []models.Supplier
-	err := database.DB.Select(&suppliers, query)
+	q, err := parseList(c, repository.SupplierList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.suppliers.List(q)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch suppliers",
 		})
 	}
 
-	return c.JSON(suppliers)
+	return c.JSON(page)
 }
 
-// GetByID returns a supplier by ID
+// GetByID returns a supplier by ID, with its version as the ETag. With
+// If-None-Match naming that version it returns 304 Not Modified.
 func (h *SupplierHandler) GetByID(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -44,15 +45,8 @@ func (h *SupplierHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		SELECT id, name, contact_person, phone, email, address, created_at, updated_at
-		FROM suppliers
-		WHERE id = $1
-	`
-
-	var supplier models.Supplier
-	err = database.DB.Get(&supplier, query, id)
-	if err == sql.ErrNoRows {
+	supplier, err := h.suppliers.Get(id)
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Supplier not found",
 		})
@@ -63,7 +57,7 @@ func (h *SupplierHandler) GetByID(c fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(supplier)
+	return sendVersioned(c, supplier.Version, supplier)
 }
 
 // Create creates a new supplier
@@ -82,43 +76,19 @@ func (h *SupplierHandler) Create(c fiber.Ctx) error {
 		})
 	}
 
-	query := `
-		INSERT INTO suppliers (name, contact_person, phone, email, address, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, name, contact_person, phone, email, address, created_at, updated_at
-	`
-
-	var supplier models.Supplier
-	err := database.DB.QueryRow(
-		query,
-		req.Name,
-		req.ContactPerson,
-		req.Phone,
-		req.Email,
-		req.Address,
-		time.Now(),
-		time.Now(),
-	).Scan(
-		&supplier.ID,
-		&supplier.Name,
-		&supplier.ContactPerson,
-		&supplier.Phone,
-		&supplier.Email,
-		&supplier.Address,
-		&supplier.CreatedAt,
-		&supplier.UpdatedAt,
-	)
-
+	supplier, err := h.suppliers.Create(actor(c), req)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create supplier: " + err.Error(),
 		})
 	}
 
+	c.Set(fiber.HeaderETag, etag(supplier.Version))
 	return c.Status(fiber.StatusCreated).JSON(supplier)
 }
 
-// Update updates a supplier
+// Update updates a supplier. With If-Match it only updates the version named
+// there, and returns 412 Precondition Failed if the supplier has changed since.
 func (h *SupplierHandler) Update(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -134,87 +104,42 @@ func (h *SupplierHandler) Update(c fiber.Ctx) error {
 		})
 	}
 
-	// Build dynamic update query
-	updates := []string{}
-	args := []interface{}{}
-	argCount := 1
-
-	if req.Name != nil {
-		updates = append(updates, "name = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Name)
-		argCount++
-	}
-	if req.ContactPerson != nil {
-		updates = append(updates, "contact_person = $"+strconv.Itoa(argCount))
-		args = append(args, *req.ContactPerson)
-		argCount++
-	}
-	if req.Phone != nil {
-		updates = append(updates, "phone = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Phone)
-		argCount++
-	}
-	if req.Email != nil {
-		updates = append(updates, "email = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Email)
-		argCount++
-	}
-	if req.Address != nil {
-		updates = append(updates, "address = $"+strconv.Itoa(argCount))
-		args = append(args, *req.Address)
-		argCount++
-	}
-
-	if len(updates) == 0 {
+	if req == (models.UpdateSupplierRequest{}) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "No fields to update",
 		})
 	}
 
-	updates = append(updates, "updated_at = $"+strconv.Itoa(argCount))
-	args = append(args, time.Now())
-	argCount++
-
-	args = append(args, id)
-
-	query := `
-		UPDATE suppliers 
-		SET ` + updates[0]
-	for i := 1; i < len(updates); i++ {
-		query += ", " + updates[i]
-	}
-	query += `
-		WHERE id = $` + strconv.Itoa(argCount) + `
-		RETURNING id, name, contact_person, phone, email, address, created_at, updated_at
-	`
-
+	// A conditional update only applies to the version the client has
+	version, err := ifMatch(c, func() (int, error) {
+		supplier, err := h.suppliers.Get(id)
+		return supplier.Version, err
+	})
 	var supplier models.Supplier
-	err = database.DB.QueryRow(query, args...).Scan(
-		&supplier.ID,
-		&supplier.Name,
-		&supplier.ContactPerson,
-		&supplier.Phone,
-		&supplier.Email,
-		&supplier.Address,
-		&supplier.CreatedAt,
-		&supplier.UpdatedAt,
-	)
-
-	if err == sql.ErrNoRows {
+	if err == nil {
+		supplier, err = h.suppliers.Update(actor(c), id, version, req)
+	}
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Supplier not found",
 		})
 	}
+	if err == repository.ErrVersionMismatch {
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Supplier has been changed since it was fetched",
+		})
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update supplier: " + err.Error(),
 		})
 	}
 
-	return c.JSON(supplier)
+	return sendVersioned(c, supplier.Version, supplier)
 }
 
-// Delete deletes a supplier
+// Delete deletes a supplier. With If-Match it only deletes the version named
+// there, like Update.
 func (h *SupplierHandler) Delete(c fiber.Ctx) error {
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
@@ -223,20 +148,33 @@ func (h *SupplierHandler) Delete(c fiber.Ctx) error {
 		})
 	}
 
-	query := `DELETE FROM suppliers WHERE id = $1`
-	result, err := database.DB.Exec(query, id)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to delete supplier",
-		})
+	version, err := ifMatch(c, func() (int, error) {
+		supplier, err := h.suppliers.Get(id)
+		return supplier.Version, err
+	})
+	if err == nil {
+		err = h.suppliers.Delete(actor(c), id, version)
 	}
-
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
+	if err == repository.ErrNotFound {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Supplier not found",
 		})
 	}
+	if err == repository.ErrVersionMismatch {
+		return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+			"error": "Supplier has been changed since it was fetched",
+		})
+	}
+	if err == repository.ErrInUse {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Supplier has purchases and cannot be deleted",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete supplier",
+		})
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "Supplier deleted successfully",
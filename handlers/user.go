@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// UserHandler handles admin-managed user administration
+type UserHandler struct {
+	users    repository.UserRepository
+	cfg      *config.Config
+	notifier notifier.Notifier
+}
+
+func NewUserHandler(users repository.UserRepository, cfg *config.Config, n notifier.Notifier) *UserHandler {
+	return &UserHandler{users: users, cfg: cfg, notifier: n}
+}
+
+// GetAll returns a page of users
+func (h *UserHandler) GetAll(c fiber.Ctx) error {
+	q, err := parseList(c, repository.UserList)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	page, err := h.users.List(q)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch users",
+		})
+	}
+
+	return c.JSON(page)
+}
+
+// GetByID returns a user by ID
+func (h *UserHandler) GetByID(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	user, err := h.users.Get(id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch user",
+		})
+	}
+
+	return c.JSON(user)
+}
+
+// Invite creates a user with the given role and no password, and sends them a
+// single-use token to set one with POST /api/auth/password/reset. Neither the
+// token nor a password is returned to the admin.
+func (h *UserHandler) Invite(c fiber.Ctx) error {
+	var req models.InviteUserRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	// Validate input
+	if req.Username == "" || req.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username and email are required",
+		})
+	}
+	if req.Role == "" {
+		req.Role = models.RoleCashier
+	}
+	if !models.IsValidRole(req.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be one of: admin, pharmacist, cashier, auditor",
+		})
+	}
+
+	token, err := utils.GenerateRandomString(32)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate invite token",
+		})
+	}
+
+	expiresAt := time.Now().Add(h.cfg.InviteExpiration)
+	user, err := h.users.Invite(actor(c), req.Username, req.Email, req.Role, utils.HashToken(token), expiresAt)
+	if err == repository.ErrConflict {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Username or email is already taken",
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to create user: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create user",
+		})
+	}
+
+	msg := notifier.Message{
+		To:      user.Email,
+		Subject: "Pharmacy account invitation",
+		Body: "Hello " + user.Username + ",\n\n" +
+			"An account has been created for you. Use this token to set your password: " + token + "\n" +
+			"It expires at " + expiresAt.Format(time.RFC1123) + " and can be used once.",
+	}
+	if err = h.notifier.Send(msg); err != nil {
+		// The user exists, so they can still get a token with a password reset
+		log.Printf("Failed to send invite token to user %d: %v", user.ID, err)
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(models.InviteUserResponse{
+		User:            user,
+		InviteExpiresAt: expiresAt,
+	})
+}
+
+// UpdateRole changes the role of a user. Admins cannot change their own role,
+// so there is always at least one active admin left.
+func (h *UserHandler) UpdateRole(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var req models.UpdateUserRoleRequest
+	if err := c.Bind().JSON(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if !models.IsValidRole(req.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Role must be one of: admin, pharmacist, cashier, auditor",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+	if id == userID {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You cannot change your own role",
+		})
+	}
+
+	user, err := h.users.UpdateRole(actor(c), id, req.Role)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update user",
+		})
+	}
+
+	return c.JSON(user)
+}
+
+// Deactivate blocks a user from logging in or using existing tokens
+func (h *UserHandler) Deactivate(c fiber.Ctx) error {
+	return h.setActive(c, false)
+}
+
+// Reactivate lets a deactivated user log in again
+func (h *UserHandler) Reactivate(c fiber.Ctx) error {
+	return h.setActive(c, true)
+}
+
+func (h *UserHandler) setActive(c fiber.Ctx, active bool) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	// Get user ID from context
+	userID, ok := c.Locals("user_id").(int)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User ID not found in context",
+		})
+	}
+	if id == userID && !active {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "You cannot deactivate your own account",
+		})
+	}
+
+	user, err := h.users.SetActive(actor(c), id, active)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update user",
+		})
+	}
+
+	return c.JSON(user)
+}
+
+// Unlock lifts a login lockout of a user caused by failed login attempts
+func (h *UserHandler) Unlock(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	err = h.users.Unlock(actor(c), id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlock user",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ResetMFA removes two-factor authentication from a user who lost their
+// authenticator and recovery codes. If their role requires it, they have to
+// enrol again at their next login.
+func (h *UserHandler) ResetMFA(c fiber.Ctx) error {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	user, err := h.users.ResetMFA(actor(c), id)
+	if err == repository.ErrNotFound {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset two-factor authentication",
+		})
+	}
+
+	return c.JSON(user)
+}
@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// sentMessages keeps the messages sent through it
+type sentMessages []notifier.Message
+
+func (s *sentMessages) Send(msg notifier.Message) error {
+	*s = append(*s, msg)
+	return nil
+}
+
+func TestUserCannotChangeOwnRole(t *testing.T) {
+	app := newTestApp(repository.NewMemory())
+
+	req := models.UpdateUserRoleRequest{Role: models.RoleCashier}
+	if msg := errorMessage(t, app, "PUT", "/users/1/role", req, fiber.StatusConflict); msg != "You cannot change your own role" {
+		t.Errorf("own role change = %q", msg)
+	}
+	if msg := errorMessage(t, app, "PUT", "/users/2/role", req, fiber.StatusNotFound); msg != "User not found" {
+		t.Errorf("missing user = %q", msg)
+	}
+}
+
+func TestInviteSendsTokenInsteadOfPassword(t *testing.T) {
+	repos := repository.NewMemory()
+	var sent sentMessages
+	app := fiber.New()
+	app.Post("/users", NewUserHandler(repos.Users, &config.Config{InviteExpiration: 72 * time.Hour}, &sent).Invite)
+
+	var resp models.InviteUserResponse
+	do(t, app, "POST", "/users", models.InviteUserRequest{Username: "till-1", Email: "till-1@example.com"}, fiber.StatusCreated, &resp)
+	if resp.User.Role != models.RoleCashier || time.Until(resp.InviteExpiresAt) < 71*time.Hour {
+		t.Errorf("invite = %+v", resp)
+	}
+
+	// The token only goes to the invited user
+	if len(sent) != 1 || sent[0].To != "till-1@example.com" || !strings.Contains(sent[0].Body, "set your password") {
+		t.Fatalf("sent = %+v", sent)
+	}
+	if _, err := repos.Users.Get(resp.User.ID); err != nil {
+		t.Errorf("get user: %v", err)
+	}
+}
+
+func TestInviteTakenUsernameOrEmail(t *testing.T) {
+	repos := repository.NewMemory()
+	var sent sentMessages
+	app := fiber.New()
+	app.Post("/users", NewUserHandler(repos.Users, &config.Config{InviteExpiration: 72 * time.Hour}, &sent).Invite)
+
+	do(t, app, "POST", "/users", models.InviteUserRequest{Username: "till-1", Email: "till-1@example.com"}, fiber.StatusCreated, nil)
+	for _, req := range []models.InviteUserRequest{
+		{Username: "till-1", Email: "other@example.com"},
+		{Username: "till-2", Email: "till-1@example.com"},
+	} {
+		if msg := errorMessage(t, app, "POST", "/users", req, fiber.StatusConflict); msg != "Username or email is already taken" {
+			t.Errorf("invite %+v = %q", req, msg)
+		}
+	}
+	if len(sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sent))
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/alfinkly/hci-golang-back/config"
 	"github.com/alfinkly/hci-golang-back/database"
 	"github.com/alfinkly/hci-golang-back/handlers"
 	"github.com/alfinkly/hci-golang-back/middleware"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/oidc"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
 	"github.com/gofiber/fiber/v3"
 )
 
@@ -23,26 +30,98 @@ func main() {
 	}
 	defer database.Close()
 
-	// Initialize database schema
-	if err := database.InitSchema(); err != nil {
-		log.Fatalf("Failed to initialize database schema: %v", err)
+	// Run a migration command instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
+	}
+
+	// Bring the database schema up to date
+	if cfg.DBAutoMigrate {
+		applied, err := database.MigrateUp()
+		if err != nil {
+			log.Fatalf("Failed to migrate database: %v", err)
+		}
+		for _, m := range applied {
+			log.Printf("Applied migration %s", m)
+		}
+	} else {
+		statuses, err := database.Migrations()
+		if err != nil {
+			log.Fatalf("Failed to check database migrations: %v", err)
+		}
+		for _, status := range statuses {
+			if status.AppliedAt == nil {
+				log.Fatalf("Migration %s is not applied, run the migrate command first", status.Migration)
+			}
+		}
+	}
+
+	// Create the initial administrator if configured
+	if cfg.AdminUsername != "" && cfg.AdminPassword != "" {
+		hashedPassword, err := utils.HashPassword(cfg.AdminPassword)
+		if err != nil {
+			log.Fatalf("Failed to hash admin password: %v", err)
+		}
+		created, err := database.EnsureAdmin(cfg.AdminUsername, cfg.AdminEmail, hashedPassword)
+		if err != nil {
+			log.Fatalf("Failed to create admin user: %v", err)
+		}
+		if created {
+			log.Printf("Created admin user %s", cfg.AdminUsername)
+		}
 	}
 
+	// Keys access tokens are signed and verified with
+	var keys *utils.KeySet
+	if cfg.JWTSigningKeyFile != "" {
+		var err error
+		keys, err = utils.LoadKeySet(cfg.JWTSigningKeyFile, cfg.JWTVerifyKeyFiles)
+		if err != nil {
+			log.Fatalf("Failed to load JWT keys: %v", err)
+		}
+	} else {
+		if cfg.AppEnv == "production" {
+			log.Fatal("JWT_SIGNING_KEY_FILE must be set in production")
+		}
+		log.Println("JWT_SIGNING_KEY_FILE not set, signing tokens with JWT_SECRET")
+		keys = utils.NewHMACKeySet(cfg.JWTSecret)
+	}
+	keys.SetIssuer(cfg.JWTIssuer, cfg.JWTAudience)
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName: "Pharmacy Backend API",
 	})
 
 	// Global middleware
+	app.Use(middleware.RequestIDMiddleware())
 	app.Use(middleware.CORSMiddleware())
 	app.Use(middleware.LoggingMiddleware())
 
+	// Notifier for messages such as password reset tokens
+	notify, err := notifier.New(cfg.Notifier, cfg.NotifierFile)
+	if err != nil {
+		log.Fatalf("Failed to create notifier: %v", err)
+	}
+
+	// Initialize repositories
+	repos := repository.NewPostgres(database.DB)
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(cfg)
-	medicineHandler := handlers.NewMedicineHandler()
-	supplierHandler := handlers.NewSupplierHandler()
-	purchaseHandler := handlers.NewPurchaseHandler()
-	saleHandler := handlers.NewSaleHandler()
+	authHandler := handlers.NewAuthHandler(repos.Auth, cfg, keys, notify)
+	medicineHandler := handlers.NewMedicineHandler(repos.Medicines)
+	supplierHandler := handlers.NewSupplierHandler(repos.Suppliers)
+	purchaseHandler := handlers.NewPurchaseHandler(repos.Purchases)
+	saleHandler := handlers.NewSaleHandler(repos.Sales)
+	batchHandler := handlers.NewBatchHandler(repos.Stock)
+	stockHandler := handlers.NewStockHandler(repos.Stock)
+	stockTakeHandler := handlers.NewStockTakeHandler(repos.StockTakes)
+	userHandler := handlers.NewUserHandler(repos.Users, cfg, notify)
+	apiKeyHandler := handlers.NewAPIKeyHandler(repos.APIKeys, repos.Users)
+	auditHandler := handlers.NewAuditHandler(repos.Audit)
 
 	// Public routes
 	api := app.Group("/api")
@@ -51,42 +130,128 @@ func main() {
 	auth := api.Group("/auth")
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
+	auth.Post("/refresh", authHandler.Refresh)
+	auth.Post("/logout", middleware.JWTMiddleware(keys, repos.Auth), authHandler.Logout)
+	auth.Post("/logout-all", middleware.JWTMiddleware(keys, repos.Auth), authHandler.LogoutAll)
+	auth.Post("/password", middleware.JWTMiddleware(keys, repos.Auth), authHandler.ChangePassword)
+	auth.Post("/password/forgot", authHandler.ForgotPassword)
+	auth.Post("/password/reset", authHandler.ResetPassword)
+
+	// Login through the identity provider, if configured
+	if cfg.OIDCIssuer != "" {
+		provider := oidc.NewProvider(oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+			Scopes:       cfg.OIDCScopes,
+			GroupsClaim:  cfg.OIDCGroupsClaim,
+		})
+		oidcHandler, err := handlers.NewOIDCHandler(authHandler, provider)
+		if err != nil {
+			log.Fatalf("Invalid OIDC configuration: %v", err)
+		}
+		auth.Get("/oidc/login", oidcHandler.Login)
+		auth.Get("/oidc/callback", oidcHandler.Callback)
+	}
+
+	// Two-factor authentication. Setup and confirm also accept the enrolment
+	// token given by login when the user's role requires two-factor.
+	auth.Post("/login/mfa", authHandler.VerifyMFA)
+	mfa := auth.Group("/mfa")
+	mfa.Post("/setup", middleware.MFAEnrolmentMiddleware(keys, repos.Auth), authHandler.SetupMFA)
+	mfa.Post("/confirm", middleware.MFAEnrolmentMiddleware(keys, repos.Auth), authHandler.ConfirmMFA)
+	mfa.Post("/recovery-codes", middleware.JWTMiddleware(keys, repos.Auth), authHandler.RegenerateRecoveryCodes)
+	mfa.Post("/disable", middleware.JWTMiddleware(keys, repos.Auth), authHandler.DisableMFA)
 
-	// Protected routes - all require JWT authentication
-	protected := api.Group("/", middleware.JWTMiddleware(cfg))
+	// Protected routes - all require a JWT access token or an API key
+	protected := api.Group("/", middleware.AuthMiddleware(keys, repos.Auth))
 
 	// User profile
 	protected.Get("/profile", authHandler.GetProfile)
 
+	// Every protected route requires a permission; the role/permission matrix
+	// lives in middleware/permissions.go
+	perm := middleware.RequirePermission
+
+	// Sales and purchases can be retried safely with an Idempotency-Key
+	idempotent := middleware.IdempotencyMiddleware(repos.Idempotency, cfg.IdempotencyKeyTTL)
+
 	// Medicine routes
 	medicines := protected.Group("/medicines")
-	medicines.Get("/", medicineHandler.GetAll)
-	medicines.Get("/:id", medicineHandler.GetByID)
-	medicines.Post("/", medicineHandler.Create)
-	medicines.Put("/:id", medicineHandler.Update)
-	medicines.Delete("/:id", medicineHandler.Delete)
+	medicines.Get("/", perm(middleware.PermMedicinesRead), medicineHandler.GetAll)
+	medicines.Get("/search", perm(middleware.PermMedicinesRead), medicineHandler.Search)
+	medicines.Get("/:id", perm(middleware.PermMedicinesRead), medicineHandler.GetByID)
+	medicines.Post("/", perm(middleware.PermMedicinesWrite), medicineHandler.Create)
+	medicines.Put("/:id", perm(middleware.PermMedicinesWrite), medicineHandler.Update)
+	medicines.Delete("/:id", perm(middleware.PermMedicinesDelete), medicineHandler.Delete)
+	medicines.Get("/:id/batches", perm(middleware.PermStockRead), batchHandler.GetByMedicine)
+	medicines.Get("/:id/movements", perm(middleware.PermStockRead), stockHandler.GetMovements)
+	medicines.Get("/:id/adjustments", perm(middleware.PermStockRead), stockHandler.GetAdjustments)
+	medicines.Post("/:id/adjustments", perm(middleware.PermStockAdjust), stockHandler.CreateAdjustment)
+
+	// Batch routes
+	batches := protected.Group("/batches")
+	batches.Get("/", perm(middleware.PermStockRead), batchHandler.GetAll)
+	batches.Get("/:id", perm(middleware.PermStockRead), batchHandler.GetByID)
+
+	// Stock ledger routes
+	protected.Get("/stock/reconciliation", perm(middleware.PermStockRead), stockHandler.Reconcile)
+
+	// Stock-take routes
+	stockTakes := protected.Group("/stock-takes")
+	stockTakes.Get("/", perm(middleware.PermStockTakesRead), stockTakeHandler.GetAll)
+	stockTakes.Get("/:id", perm(middleware.PermStockTakesRead), stockTakeHandler.GetByID)
+	stockTakes.Post("/", perm(middleware.PermStockTakesWrite), stockTakeHandler.Create)
+	stockTakes.Post("/:id/counts", perm(middleware.PermStockTakesWrite), stockTakeHandler.SubmitCounts)
+	stockTakes.Post("/:id/post", perm(middleware.PermStockTakesWrite), stockTakeHandler.Post)
+	stockTakes.Post("/:id/cancel", perm(middleware.PermStockTakesWrite), stockTakeHandler.Cancel)
 
 	// Supplier routes
 	suppliers := protected.Group("/suppliers")
-	suppliers.Get("/", supplierHandler.GetAll)
-	suppliers.Get("/:id", supplierHandler.GetByID)
-	suppliers.Post("/", supplierHandler.Create)
-	suppliers.Put("/:id", supplierHandler.Update)
-	suppliers.Delete("/:id", supplierHandler.Delete)
+	suppliers.Get("/", perm(middleware.PermSuppliersRead), supplierHandler.GetAll)
+	suppliers.Get("/:id", perm(middleware.PermSuppliersRead), supplierHandler.GetByID)
+	suppliers.Post("/", perm(middleware.PermSuppliersWrite), supplierHandler.Create)
+	suppliers.Put("/:id", perm(middleware.PermSuppliersWrite), supplierHandler.Update)
+	suppliers.Delete("/:id", perm(middleware.PermSuppliersDelete), supplierHandler.Delete)
 
 	// Purchase routes
 	purchases := protected.Group("/purchases")
-	purchases.Get("/", purchaseHandler.GetAll)
-	purchases.Get("/:id", purchaseHandler.GetByID)
-	purchases.Post("/", purchaseHandler.Create)
-	purchases.Delete("/:id", purchaseHandler.Delete)
+	purchases.Get("/", perm(middleware.PermPurchasesRead), purchaseHandler.GetAll)
+	purchases.Get("/:id", perm(middleware.PermPurchasesRead), purchaseHandler.GetByID)
+	purchases.Post("/", perm(middleware.PermPurchasesCreate), idempotent, purchaseHandler.Create)
+	purchases.Post("/:id/void", perm(middleware.PermPurchasesVoid), purchaseHandler.Void)
 
 	// Sale routes
 	sales := protected.Group("/sales")
-	sales.Get("/", saleHandler.GetAll)
-	sales.Get("/:id", saleHandler.GetByID)
-	sales.Post("/", saleHandler.Create)
-	sales.Delete("/:id", saleHandler.Delete)
+	sales.Get("/", perm(middleware.PermSalesRead), saleHandler.GetAll)
+	sales.Get("/:id", perm(middleware.PermSalesRead), saleHandler.GetByID)
+	sales.Post("/", perm(middleware.PermSalesCreate), idempotent, saleHandler.Create)
+	sales.Get("/:id/returns", perm(middleware.PermSalesRead), saleHandler.GetReturns)
+	sales.Post("/:id/returns", perm(middleware.PermSalesReturn), saleHandler.CreateReturn)
+
+	// User administration routes
+	users := protected.Group("/users", perm(middleware.PermUsersManage))
+	users.Get("/", userHandler.GetAll)
+	users.Get("/:id", userHandler.GetByID)
+	users.Post("/", userHandler.Invite)
+	users.Put("/:id/role", userHandler.UpdateRole)
+	users.Post("/:id/deactivate", userHandler.Deactivate)
+	users.Post("/:id/reactivate", userHandler.Reactivate)
+	users.Post("/:id/unlock", userHandler.Unlock)
+	users.Post("/:id/mfa/reset", userHandler.ResetMFA)
+
+	// API key routes
+	apiKeys := protected.Group("/api-keys", perm(middleware.PermUsersManage))
+	apiKeys.Get("/", apiKeyHandler.GetAll)
+	apiKeys.Post("/", apiKeyHandler.Create)
+	apiKeys.Post("/:id/revoke", apiKeyHandler.Revoke)
+
+	// Audit log
+	protected.Get("/audit-log", perm(middleware.PermAuditRead), auditHandler.GetAll)
+
+	// Public keys for verifying access tokens
+	app.Get("/.well-known/jwks.json", authHandler.JWKS)
 
 	// Health check endpoint
 	app.Get("/health", func(c fiber.Ctx) error {
@@ -114,3 +279,58 @@ func main() {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
+
+// runMigrate runs the migrate command: "up" applies pending migrations,
+// "down [N]" reverts the last N (default 1) and "status" lists them
+func runMigrate(args []string) error {
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "up":
+		applied, err := database.MigrateUp()
+		for _, m := range applied {
+			log.Printf("Applied migration %s", m)
+		}
+		if err == nil && len(applied) == 0 {
+			log.Println("Database is up to date")
+		}
+		return err
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations %q", args[1])
+			}
+			steps = n
+		}
+		reverted, err := database.MigrateDown(steps)
+		for _, m := range reverted {
+			log.Printf("Reverted migration %s", m)
+		}
+		if err == nil && len(reverted) == 0 {
+			log.Println("No migrations are applied")
+		}
+		return err
+
+	case "status":
+		statuses, err := database.Migrations()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != nil {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%-40s %s\n", status.Migration, applied)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown migrate command %q, use up, down [N] or status", command)
+}
@@ -14,6 +14,9 @@ import (
 	"github.com/alfinkly/hci-golang-back/handlers"
 	"github.com/alfinkly/hci-golang-back/middleware"
 	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/notifier"
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
 	"github.com/gofiber/fiber/v3"
 )
 
@@ -29,22 +32,24 @@ func setupTestApp() {
 	}
 	
 	// Initialize schema
-	if err := database.InitSchema(); err != nil {
+	if _, err := database.MigrateUp(); err != nil {
 		log.Fatalf("Failed to initialize schema: %v", err)
 	}
 
 	testApp = fiber.New()
 	testApp.Use(middleware.CORSMiddleware())
 
-	authHandler := handlers.NewAuthHandler(cfg)
-	medicineHandler := handlers.NewMedicineHandler()
+	keys := utils.NewHMACKeySet(cfg.JWTSecret)
+	repos := repository.NewPostgres(database.DB)
+	authHandler := handlers.NewAuthHandler(repos.Auth, cfg, keys, notifier.LogNotifier{})
+	medicineHandler := handlers.NewMedicineHandler(repos.Medicines)
 	
 	api := testApp.Group("/api")
 	auth := api.Group("/auth")
 	auth.Post("/register", authHandler.Register)
 	auth.Post("/login", authHandler.Login)
 	
-	protected := api.Group("/", middleware.JWTMiddleware(cfg))
+	protected := api.Group("/", middleware.JWTMiddleware(keys, repos.Auth))
 	protected.Get("/profile", authHandler.GetProfile)
 	
 	medicines := protected.Group("/medicines")
@@ -81,7 +86,6 @@ func TestRegisterEndpoint(t *testing.T) {
 		Username: "testuser",
 		Email:    "test@example.com",
 		Password: "password123",
-		Role:     "user",
 	}
 	
 	jsonData, _ := json.Marshal(registerData)
@@ -141,7 +145,7 @@ func TestCreateMedicine(t *testing.T) {
 		Name:                 "Test Medicine",
 		Description:          "Test Description",
 		Manufacturer:         "Test Manufacturer",
-		Price:                100.50,
+		Price:                10050, // 100.50
 		Quantity:             50,
 		ExpiryDate:           time.Now().AddDate(1, 0, 0),
 		Category:             "Test Category",
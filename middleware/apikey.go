@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// apiKeyUsageInterval is how often the last-used time of an API key is
+// updated, so busy clients do not write on every request
+const apiKeyUsageInterval = time.Minute
+
+// apiKey authenticates a request made with an API key. The request acts as
+// the key's user with the user's current role, limited to the key's scopes.
+func apiKey(c fiber.Ctx, auth repository.AuthRepository, key string) error {
+	prefix, ok := utils.ParseAPIKey(key)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid API key",
+		})
+	}
+
+	creds, err := auth.APIKey(prefix)
+	if err == repository.ErrNotFound || (err == nil && subtle.ConstantTimeCompare([]byte(creds.KeyHash), []byte(utils.HashToken(key))) != 1) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid API key",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	now := time.Now()
+	if creds.Key.RevokedAt != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key has been revoked",
+		})
+	}
+	if creds.Key.ExpiresAt != nil && !creds.Key.ExpiresAt.After(now) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "API key has expired",
+		})
+	}
+	if !creds.User.IsActive {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Account is deactivated",
+		})
+	}
+
+	if err = auth.RecordAPIKeyUse(creds.Key.ID, now, now.Add(-apiKeyUsageInterval)); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	granted := make([]Permission, len(creds.Key.Scopes))
+	for i, scope := range creds.Key.Scopes {
+		granted[i] = Permission(scope)
+	}
+
+	// Store user info in context
+	c.Locals("user_id", creds.User.ID)
+	c.Locals("username", creds.User.Username)
+	c.Locals("role", creds.User.Role)
+	c.Locals("api_key_id", creds.Key.ID)
+	c.Locals("scopes", granted)
+
+	return c.Next()
+}
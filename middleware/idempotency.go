@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"log"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// HeaderIdempotencyKey lets a client retry a request without repeating it
+const HeaderIdempotencyKey = "Idempotency-Key"
+
+// HeaderIdempotentReplayed marks a response replayed for a retried request
+const HeaderIdempotentReplayed = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength limits idempotency keys taken from clients
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyMiddleware makes a request sent with an Idempotency-Key header
+// safe to retry. The first response to a key is stored per user for ttl and
+// replayed to retries of the same request; reusing the key for a different
+// request is refused. Server errors are not stored, so the request can be
+// retried with the same key. Requests without the header are passed on.
+func IdempotencyMiddleware(store repository.IdempotencyRepository, ttl time.Duration) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		key := c.Get(HeaderIdempotencyKey)
+		userID, ok := c.Locals("user_id").(int)
+		if key == "" || !ok {
+			return c.Next()
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Idempotency-Key must be at most 255 characters",
+			})
+		}
+
+		requestHash := utils.HashToken(c.Method() + " " + c.Path() + "\n" + string(c.Body()))
+		claim, err := store.Claim(userID, key, requestHash, time.Now().Add(ttl))
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check idempotency key",
+			})
+		}
+		if claim != nil {
+			if claim.RequestHash != requestHash {
+				return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+					"error": "Idempotency-Key has already been used for a different request",
+				})
+			}
+			if claim.Response == nil {
+				return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+					"error": "A request with this Idempotency-Key is still being processed",
+				})
+			}
+			c.Set(HeaderIdempotentReplayed, "true")
+			c.Set(fiber.HeaderContentType, claim.Response.ContentType)
+			return c.Status(claim.Response.Status).Send(claim.Response.Body)
+		}
+
+		err = c.Next()
+		status := c.Response().StatusCode()
+		if err != nil || status >= fiber.StatusInternalServerError {
+			if releaseErr := store.Release(userID, key); releaseErr != nil {
+				log.Printf("Failed to release idempotency key of user %d: %v", userID, releaseErr)
+			}
+			return err
+		}
+
+		response := repository.IdempotentResponse{
+			Status:      status,
+			ContentType: string(c.Response().Header.ContentType()),
+			Body:        c.Response().Body(),
+		}
+		if err := store.Complete(userID, key, response); err != nil {
+			log.Printf("Failed to store response for idempotency key of user %d: %v", userID, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/repository"
+	"github.com/gofiber/fiber/v3"
+)
+
+// idempotencyTestApp counts the sales it creates; a sale of "fail" is a
+// server error
+func idempotencyTestApp(ttl time.Duration) (*fiber.App, *int) {
+	sales := 0
+	app := fiber.New()
+	app.Use(func(c fiber.Ctx) error {
+		c.Locals("user_id", 1)
+		return c.Next()
+	})
+	app.Post("/sales", IdempotencyMiddleware(repository.NewMemory().Idempotency, ttl), func(c fiber.Ctx) error {
+		if string(c.Body()) == "fail" {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Database error"})
+		}
+		sales++
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{"id": sales})
+	})
+	return app, &sales
+}
+
+// postSale returns the status, body and Idempotent-Replayed header of a sale
+func postSale(t *testing.T, app *fiber.App, key, body string) (int, string, string) {
+	t.Helper()
+
+	req, _ := http.NewRequest("POST", "/sales", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(HeaderIdempotencyKey, key)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatalf("app.Test: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(data), resp.Header.Get(HeaderIdempotentReplayed)
+}
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	app, sales := idempotencyTestApp(time.Hour)
+
+	status, first, replayed := postSale(t, app, "key-1", "aspirin")
+	if status != fiber.StatusCreated || replayed != "" {
+		t.Fatalf("first request: %d %s, replayed %q", status, first, replayed)
+	}
+
+	// A retry gets the first response without creating another sale
+	status, body, replayed := postSale(t, app, "key-1", "aspirin")
+	if status != fiber.StatusCreated || body != first || replayed != "true" || *sales != 1 {
+		t.Errorf("retry: %d %s, replayed %q, %d sales", status, body, replayed, *sales)
+	}
+
+	// The key cannot be reused for a different request
+	if status, _, _ = postSale(t, app, "key-1", "ibuprofen"); status != fiber.StatusUnprocessableEntity {
+		t.Errorf("reuse for another request: %d", status)
+	}
+
+	// Requests without a key are never replayed
+	postSale(t, app, "", "aspirin")
+	postSale(t, app, "", "aspirin")
+	if *sales != 3 {
+		t.Errorf("sales without a key = %d, want 3", *sales)
+	}
+
+	if status, _, _ = postSale(t, app, strings.Repeat("k", maxIdempotencyKeyLength+1), "aspirin"); status != fiber.StatusBadRequest {
+		t.Errorf("long key: %d", status)
+	}
+}
+
+func TestIdempotencyMiddlewareDoesNotStoreServerErrors(t *testing.T) {
+	app, _ := idempotencyTestApp(time.Hour)
+
+	for i := range 2 {
+		if status, _, replayed := postSale(t, app, "key-1", "fail"); status != fiber.StatusInternalServerError || replayed != "" {
+			t.Errorf("attempt %d: %d, replayed %q", i+1, status, replayed)
+		}
+	}
+}
+
+func TestIdempotencyMiddlewareKeysExpire(t *testing.T) {
+	app, sales := idempotencyTestApp(-time.Second)
+
+	postSale(t, app, "key-1", "aspirin")
+	status, body, replayed := postSale(t, app, "key-1", "ibuprofen")
+	if status != fiber.StatusCreated || replayed != "" || body != `{"id":`+strconv.Itoa(*sales)+`}` || *sales != 2 {
+		t.Errorf("request after expiry: %d %s, replayed %q", status, body, replayed)
+	}
+}
@@ -3,13 +3,30 @@ package middleware
 import (
 	"strings"
 
-	"github.com/alfinkly/hci-golang-back/config"
+	"github.com/alfinkly/hci-golang-back/repository"
 	"github.com/alfinkly/hci-golang-back/utils"
 	"github.com/gofiber/fiber/v3"
 )
 
-// JWTMiddleware validates JWT tokens
-func JWTMiddleware(cfg *config.Config) fiber.Handler {
+// JWTMiddleware validates JWT access tokens
+func JWTMiddleware(keys *utils.KeySet, auth repository.AuthRepository) fiber.Handler {
+	return authenticate(keys, auth, false, false)
+}
+
+// AuthMiddleware accepts a JWT access token or an API key. Requests made with
+// an API key set "api_key_id" and "scopes" in the context.
+func AuthMiddleware(keys *utils.KeySet, auth repository.AuthRepository) fiber.Handler {
+	return authenticate(keys, auth, false, true)
+}
+
+// MFAEnrolmentMiddleware accepts an access token or the enrolment token given
+// by a login of a user who must enrol in two-factor authentication first.
+// Enrolment tokens set "mfa_enrolment" in the context.
+func MFAEnrolmentMiddleware(keys *utils.KeySet, auth repository.AuthRepository) fiber.Handler {
+	return authenticate(keys, auth, true, false)
+}
+
+func authenticate(keys *utils.KeySet, auth repository.AuthRepository, allowEnrolment, allowAPIKeys bool) fiber.Handler {
 	return func(c fiber.Ctx) error {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
@@ -27,22 +44,85 @@ func JWTMiddleware(cfg *config.Config) fiber.Handler {
 		}
 
 		token := parts[1]
-		claims, err := utils.ValidateToken(token, cfg.JWTSecret)
+		if strings.HasPrefix(token, utils.APIKeyPrefix) {
+			if !allowAPIKeys {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "API keys cannot be used for this request",
+				})
+			}
+			return apiKey(c, auth, token)
+		}
+
+		claims, err := utils.ValidateToken(token, keys)
 		if err != nil {
+			// Tokens from an unfinished login are only accepted where allowed
+			if enrolClaims, err := utils.ValidatePurposeToken(token, utils.TokenPurposeMFAEnrol, keys); err == nil {
+				if !allowEnrolment {
+					return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+						"error": "Token cannot be used for this request",
+					})
+				}
+				return enrolment(c, auth, enrolClaims)
+			}
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid or expired token",
 			})
 		}
 
+		// Use the current role and status rather than the ones in the token,
+		// so role changes and deactivation take effect immediately. Tokens of
+		// ended sessions and individually revoked tokens are rejected.
+		user, err := auth.Session(claims.UserID, claims.SessionID, claims.ID)
+		if err == repository.ErrSessionEnded {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Token has been revoked",
+			})
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Database error",
+			})
+		}
+		if !user.IsActive {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Account is deactivated",
+			})
+		}
+
 		// Store user info in context
 		c.Locals("user_id", claims.UserID)
 		c.Locals("username", claims.Username)
-		c.Locals("role", claims.Role)
+		c.Locals("role", user.Role)
+		c.Locals("session_id", claims.SessionID)
+		c.Locals("token_id", claims.ID)
+		c.Locals("token_expires_at", claims.ExpiresAt.Time)
 
 		return c.Next()
 	}
 }
 
+// enrolment authenticates a request made with an enrolment token
+func enrolment(c fiber.Ctx, auth repository.AuthRepository, claims *utils.Claims) error {
+	user, err := auth.User(claims.UserID)
+	if err == repository.ErrNotFound || (err == nil && !user.IsActive) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Account is deactivated",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Database error",
+		})
+	}
+
+	c.Locals("user_id", claims.UserID)
+	c.Locals("username", claims.Username)
+	c.Locals("role", claims.Role)
+	c.Locals("mfa_enrolment", true)
+
+	return c.Next()
+}
+
 // RoleMiddleware checks if user has required role
 func RoleMiddleware(allowedRoles ...string) fiber.Handler {
 	return func(c fiber.Ctx) error {
@@ -78,7 +158,8 @@ func CORSMiddleware() fiber.Handler {
 	return func(c fiber.Ctx) error {
 		c.Set("Access-Control-Allow-Origin", "*")
 		c.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Request-ID, If-Match, If-None-Match, Idempotency-Key")
+		c.Set("Access-Control-Expose-Headers", "X-Request-ID, ETag, Idempotent-Replayed")
 
 		if c.Method() == "OPTIONS" {
 			return c.SendStatus(fiber.StatusOK)
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"slices"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/gofiber/fiber/v3"
+)
+
+// Permission is a single action a role may be allowed to perform
+type Permission string
+
+const (
+	PermMedicinesRead   Permission = "medicines:read"
+	PermMedicinesWrite  Permission = "medicines:write"
+	PermMedicinesDelete Permission = "medicines:delete"
+
+	PermStockRead       Permission = "stock:read"
+	PermStockAdjust     Permission = "stock:adjust"
+	PermStockTakesRead  Permission = "stock_takes:read"
+	PermStockTakesWrite Permission = "stock_takes:write"
+
+	PermSuppliersRead   Permission = "suppliers:read"
+	PermSuppliersWrite  Permission = "suppliers:write"
+	PermSuppliersDelete Permission = "suppliers:delete"
+
+	PermPurchasesRead   Permission = "purchases:read"
+	PermPurchasesCreate Permission = "purchases:create"
+	PermPurchasesVoid   Permission = "purchases:void"
+
+	PermSalesRead   Permission = "sales:read"
+	PermSalesCreate Permission = "sales:create"
+	PermSalesReturn Permission = "sales:return"
+
+	PermUsersManage Permission = "users:manage"
+
+	PermAuditRead Permission = "audit:read"
+)
+
+// rolePermissions is the permission matrix: the only place that decides
+// which role may do what
+var rolePermissions = map[string][]Permission{
+	models.RoleAdmin: {
+		PermMedicinesRead, PermMedicinesWrite, PermMedicinesDelete,
+		PermStockRead, PermStockAdjust, PermStockTakesRead, PermStockTakesWrite,
+		PermSuppliersRead, PermSuppliersWrite, PermSuppliersDelete,
+		PermPurchasesRead, PermPurchasesCreate, PermPurchasesVoid,
+		PermSalesRead, PermSalesCreate, PermSalesReturn,
+		PermUsersManage,
+		PermAuditRead,
+	},
+	models.RolePharmacist: {
+		PermMedicinesRead, PermMedicinesWrite,
+		PermStockRead, PermStockAdjust, PermStockTakesRead, PermStockTakesWrite,
+		PermSuppliersRead, PermSuppliersWrite,
+		PermPurchasesRead, PermPurchasesCreate,
+		PermSalesRead, PermSalesCreate, PermSalesReturn,
+	},
+	models.RoleCashier: {
+		PermMedicinesRead,
+		PermStockRead,
+		PermSalesRead, PermSalesCreate,
+	},
+	models.RoleAuditor: {
+		PermMedicinesRead,
+		PermStockRead, PermStockTakesRead,
+		PermSuppliersRead,
+		PermPurchasesRead,
+		PermSalesRead,
+	},
+}
+
+// HasPermission reports whether a role is granted a permission. Unknown roles
+// have no permissions.
+func HasPermission(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAPIKeyScope reports whether an API key of a user with the role may be
+// given the permission as a scope. Keys never manage users, so a leaked key
+// cannot create further keys.
+func IsAPIKeyScope(role string, permission Permission) bool {
+	return permission != PermUsersManage && HasPermission(role, permission)
+}
+
+// RequirePermission allows the request only if the user's role is granted
+// the permission and, for requests made with an API key, the key has it as a
+// scope
+func RequirePermission(permission Permission) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		role, ok := c.Locals("role").(string)
+		if !ok {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Role not found in context",
+			})
+		}
+
+		if !HasPermission(role, permission) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Insufficient permissions",
+			})
+		}
+
+		if scopes, ok := c.Locals("scopes").([]Permission); ok && !slices.Contains(scopes, permission) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "API key is missing the " + string(permission) + " scope",
+			})
+		}
+
+		return c.Next()
+	}
+}
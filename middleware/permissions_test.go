@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/gofiber/fiber/v3"
+)
+
+var allPermissions = []Permission{
+	PermMedicinesRead, PermMedicinesWrite, PermMedicinesDelete,
+	PermStockRead, PermStockAdjust, PermStockTakesRead, PermStockTakesWrite,
+	PermSuppliersRead, PermSuppliersWrite, PermSuppliersDelete,
+	PermPurchasesRead, PermPurchasesCreate, PermPurchasesVoid,
+	PermSalesRead, PermSalesCreate, PermSalesReturn,
+	PermUsersManage,
+	PermAuditRead,
+}
+
+func TestRolePermissionMatrix(t *testing.T) {
+	expected := map[string][]Permission{
+		models.RoleAdmin: allPermissions,
+		models.RolePharmacist: {
+			PermMedicinesRead, PermMedicinesWrite,
+			PermStockRead, PermStockAdjust, PermStockTakesRead, PermStockTakesWrite,
+			PermSuppliersRead, PermSuppliersWrite,
+			PermPurchasesRead, PermPurchasesCreate,
+			PermSalesRead, PermSalesCreate, PermSalesReturn,
+		},
+		models.RoleCashier: {
+			PermMedicinesRead, PermStockRead, PermSalesRead, PermSalesCreate,
+		},
+		models.RoleAuditor: {
+			PermMedicinesRead, PermStockRead, PermStockTakesRead,
+			PermSuppliersRead, PermPurchasesRead, PermSalesRead,
+		},
+		"user": {},
+		"":     {},
+	}
+
+	for role, allowed := range expected {
+		granted := make(map[Permission]bool, len(allowed))
+		for _, p := range allowed {
+			granted[p] = true
+		}
+		for _, p := range allPermissions {
+			if got := HasPermission(role, p); got != granted[p] {
+				t.Errorf("HasPermission(%q, %q) = %v, want %v", role, p, got, granted[p])
+			}
+		}
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	tests := []struct {
+		role       any
+		permission Permission
+		wantStatus int
+	}{
+		{models.RoleAdmin, PermMedicinesDelete, http.StatusOK},
+		{models.RolePharmacist, PermMedicinesDelete, http.StatusForbidden},
+		{models.RolePharmacist, PermStockAdjust, http.StatusOK},
+		{models.RoleCashier, PermSalesCreate, http.StatusOK},
+		{models.RoleCashier, PermSalesReturn, http.StatusForbidden},
+		{models.RoleCashier, PermPurchasesRead, http.StatusForbidden},
+		{models.RoleAuditor, PermSalesRead, http.StatusOK},
+		{models.RoleAuditor, PermSalesCreate, http.StatusForbidden},
+		{models.RoleAdmin, PermUsersManage, http.StatusOK},
+		{models.RolePharmacist, PermUsersManage, http.StatusForbidden},
+		{models.RoleAdmin, PermAuditRead, http.StatusOK},
+		{models.RoleAuditor, PermAuditRead, http.StatusForbidden},
+		{nil, PermMedicinesRead, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		app := fiber.New()
+		app.Get("/", func(c fiber.Ctx) error {
+			if tt.role != nil {
+				c.Locals("role", tt.role)
+			}
+			return c.Next()
+		}, RequirePermission(tt.permission), func(c fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to test role %v: %v", tt.role, err)
+		}
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("role %v, permission %q: expected status %d, got %d", tt.role, tt.permission, tt.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestRequirePermissionChecksAPIKeyScopes(t *testing.T) {
+	tests := []struct {
+		role       string
+		scopes     []Permission
+		permission Permission
+		wantStatus int
+	}{
+		{models.RoleCashier, []Permission{PermSalesCreate}, PermSalesCreate, http.StatusOK},
+		{models.RoleCashier, []Permission{PermMedicinesRead}, PermSalesCreate, http.StatusForbidden},
+		{models.RoleCashier, []Permission{}, PermMedicinesRead, http.StatusForbidden},
+		// A scope does not grant more than the user's role
+		{models.RoleCashier, []Permission{PermPurchasesCreate}, PermPurchasesCreate, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		app := fiber.New()
+		app.Get("/", func(c fiber.Ctx) error {
+			c.Locals("role", tt.role)
+			c.Locals("scopes", tt.scopes)
+			return c.Next()
+		}, RequirePermission(tt.permission), func(c fiber.Ctx) error {
+			return c.SendStatus(http.StatusOK)
+		})
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("Failed to test scopes %v: %v", tt.scopes, err)
+		}
+		if resp.StatusCode != tt.wantStatus {
+			t.Errorf("role %s, scopes %v, permission %q: expected status %d, got %d", tt.role, tt.scopes, tt.permission, tt.wantStatus, resp.StatusCode)
+		}
+	}
+}
+
+func TestIsAPIKeyScope(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission Permission
+		want       bool
+	}{
+		{models.RoleCashier, PermSalesCreate, true},
+		{models.RoleCashier, PermPurchasesCreate, false},
+		{models.RoleAdmin, PermPurchasesVoid, true},
+		{models.RoleAdmin, PermUsersManage, false},
+		{models.RoleAdmin, "unknown:scope", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsAPIKeyScope(tt.role, tt.permission); got != tt.want {
+			t.Errorf("IsAPIKeyScope(%q, %q) = %v, want %v", tt.role, tt.permission, got, tt.want)
+		}
+	}
+}
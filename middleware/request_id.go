@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"github.com/alfinkly/hci-golang-back/utils"
+	"github.com/gofiber/fiber/v3"
+)
+
+// HeaderRequestID carries the ID of a request, so it can be traced through
+// logs and the audit log
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength limits request IDs taken from clients
+const maxRequestIDLength = 64
+
+// RequestIDMiddleware gives every request an ID, stored as "request_id" in
+// the context and returned in the X-Request-ID response header. A well-formed
+// ID sent by the client or a proxy is kept.
+func RequestIDMiddleware() fiber.Handler {
+	return func(c fiber.Ctx) error {
+		id := c.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			var err error
+			if id, err = utils.GenerateRandomString(16); err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to generate request ID",
+				})
+			}
+		}
+
+		c.Locals("request_id", id)
+		c.Set(HeaderRequestID, id)
+
+		return c.Next()
+	}
+}
+
+// validRequestID accepts IDs of letters, digits and -_.: up to
+// maxRequestIDLength, which covers UUIDs and common tracing IDs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	app := fiber.New()
+	app.Use(RequestIDMiddleware())
+	app.Get("/", func(c fiber.Ctx) error {
+		id, _ := c.Locals("request_id").(string)
+		return c.SendString(id)
+	})
+
+	tests := []struct {
+		header string
+		keep   bool
+	}{
+		{"", false},
+		{"3f1c2a9e-7b4d-4e2a-9c1f-0d8e6b5a4c3b", true},
+		{"trace-123:span-4", true},
+		{"bad id with spaces", false},
+		{"<script>", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set(HeaderRequestID, tt.header)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatalf("app.Test: %v", err)
+		}
+
+		got := resp.Header.Get(HeaderRequestID)
+		if got == "" {
+			t.Errorf("header %q: no request ID in the response", tt.header)
+			continue
+		}
+		if (got == tt.header) != tt.keep {
+			t.Errorf("header %q: response request ID %q, want kept = %v", tt.header, got, tt.keep)
+		}
+
+		body := make([]byte, 128)
+		n, _ := resp.Body.Read(body)
+		if string(body[:n]) != got {
+			t.Errorf("header %q: context request ID %q, response header %q", tt.header, body[:n], got)
+		}
+	}
+}
@@ -1,15 +1,37 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
+
+	"github.com/lib/pq"
+)
+
+// User roles
+const (
+	RoleAdmin      = "admin"
+	RolePharmacist = "pharmacist"
+	RoleCashier    = "cashier"
+	RoleAuditor    = "auditor"
 )
 
+// IsValidRole reports whether role is one of the known user roles
+func IsValidRole(role string) bool {
+	switch role {
+	case RoleAdmin, RolePharmacist, RoleCashier, RoleAuditor:
+		return true
+	}
+	return false
+}
+
 type User struct {
 	ID           int       `json:"id" db:"id"`
 	Username     string    `json:"username" db:"username"`
 	Email        string    `json:"email" db:"email"`
 	PasswordHash string    `json:"-" db:"password_hash"`
 	Role         string    `json:"role" db:"role"`
+	IsActive     bool      `json:"is_active" db:"is_active"`
+	TOTPEnabled  bool      `json:"totp_enabled" db:"totp_enabled"`
 	CreatedAt    time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
 }
@@ -19,13 +41,38 @@ type Medicine struct {
 	Name                 string    `json:"name" db:"name"`
 	Description          string    `json:"description" db:"description"`
 	Manufacturer         string    `json:"manufacturer" db:"manufacturer"`
-	Price                float64   `json:"price" db:"price"`
+	Price                Money     `json:"price" db:"price"`
 	Quantity             int       `json:"quantity" db:"quantity"`
 	ExpiryDate           time.Time `json:"expiry_date" db:"expiry_date"`
 	Category             string    `json:"category" db:"category"`
 	RequiresPrescription bool      `json:"requires_prescription" db:"requires_prescription"`
 	CreatedAt            time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt            time.Time `json:"updated_at" db:"updated_at"`
+	// Version goes up with every change, stock included, and is the ETag
+	Version int `json:"version" db:"version"`
+}
+
+// MedicineSearchResult is a medicine found by a search, with its relevance
+// and the parts of its fields that matched highlighted
+type MedicineSearchResult struct {
+	Medicine
+	Rank       float64           `json:"rank" db:"rank"`
+	Highlights map[string]string `json:"highlights" db:"-"`
+}
+
+// MedicineBatch is a single received lot of a medicine. Medicine.Quantity is
+// the sum of the quantities of its batches.
+type MedicineBatch struct {
+	ID          int        `json:"id" db:"id"`
+	MedicineID  int        `json:"medicine_id" db:"medicine_id"`
+	SupplierID  *int       `json:"supplier_id" db:"supplier_id"`
+	PurchaseID  *int       `json:"purchase_id" db:"purchase_id"`
+	BatchNumber string     `json:"batch_number" db:"batch_number"`
+	ExpiryDate  *time.Time `json:"expiry_date" db:"expiry_date"`
+	Quantity    int        `json:"quantity" db:"quantity"`
+	ReceivedAt  time.Time  `json:"received_at" db:"received_at"`
+	CreatedAt   time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at" db:"updated_at"`
 }
 
 type Supplier struct {
@@ -37,30 +84,190 @@ type Supplier struct {
 	Address       string    `json:"address" db:"address"`
 	CreatedAt     time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt     time.Time `json:"updated_at" db:"updated_at"`
+	// Version goes up with every change and is the ETag
+	Version int `json:"version" db:"version"`
 }
 
 type Purchase struct {
-	ID           int       `json:"id" db:"id"`
-	MedicineID   int       `json:"medicine_id" db:"medicine_id"`
-	SupplierID   int       `json:"supplier_id" db:"supplier_id"`
-	Quantity     int       `json:"quantity" db:"quantity"`
-	UnitPrice    float64   `json:"unit_price" db:"unit_price"`
-	TotalPrice   float64   `json:"total_price" db:"total_price"`
-	PurchaseDate time.Time `json:"purchase_date" db:"purchase_date"`
-	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	ID           int            `json:"id" db:"id"`
+	MedicineID   int            `json:"medicine_id" db:"medicine_id"`
+	SupplierID   int            `json:"supplier_id" db:"supplier_id"`
+	Quantity     int            `json:"quantity" db:"quantity"`
+	UnitPrice    Money          `json:"unit_price" db:"unit_price"`
+	TotalPrice   Money          `json:"total_price" db:"total_price"`
+	BatchNumber  string         `json:"batch_number" db:"batch_number"`
+	ExpiryDate   *time.Time     `json:"expiry_date" db:"expiry_date"`
+	PurchaseDate time.Time      `json:"purchase_date" db:"purchase_date"`
+	CreatedAt    time.Time      `json:"created_at" db:"created_at"`
+	VoidedAt     *time.Time     `json:"voided_at" db:"voided_at"`
+	VoidedBy     *int           `json:"voided_by" db:"voided_by"`
+	VoidReason   *string        `json:"void_reason" db:"void_reason"`
+	Batch        *MedicineBatch `json:"batch,omitempty" db:"-"`
 }
 
+// Sale is a receipt made up of one or more line items
 type Sale struct {
+	ID            int        `json:"id" db:"id"`
+	UserID        int        `json:"user_id" db:"user_id"`
+	ReceiptNumber string     `json:"receipt_number" db:"receipt_number"`
+	Subtotal      Money      `json:"subtotal" db:"subtotal"`
+	Discount      Money      `json:"discount" db:"discount"`
+	Total         Money      `json:"total" db:"total"`
+	SaleDate      time.Time  `json:"sale_date" db:"sale_date"`
+	CreatedAt     time.Time  `json:"created_at" db:"created_at"`
+	Items         []SaleItem `json:"items,omitempty" db:"-"`
+}
+
+// SaleItem is a single medicine line on a sale receipt. The medicine name and
+// unit price are kept as they were when sold.
+type SaleItem struct {
+	ID           int         `json:"id" db:"id"`
+	SaleID       int         `json:"sale_id" db:"sale_id"`
+	MedicineID   int         `json:"medicine_id" db:"medicine_id"`
+	MedicineName string      `json:"medicine_name" db:"medicine_name"`
+	Quantity     int         `json:"quantity" db:"quantity"`
+	UnitPrice    Money       `json:"unit_price" db:"unit_price"`
+	TotalPrice   Money       `json:"total_price" db:"total_price"`
+	Batches      []SaleBatch `json:"batches,omitempty" db:"-"`
+}
+
+// SaleBatch records how much of a sale line was taken from a batch
+type SaleBatch struct {
+	ID          int        `json:"id" db:"id"`
+	SaleID      int        `json:"sale_id" db:"sale_id"`
+	SaleItemID  int        `json:"sale_item_id" db:"sale_item_id"`
+	BatchID     int        `json:"batch_id" db:"batch_id"`
+	BatchNumber string     `json:"batch_number" db:"batch_number"`
+	ExpiryDate  *time.Time `json:"expiry_date" db:"expiry_date"`
+	Quantity    int        `json:"quantity" db:"quantity"`
+}
+
+// Return dispositions
+const (
+	ReturnRestock = "restock"
+	ReturnDamaged = "damaged"
+)
+
+// SaleReturn is a full or partial return against a sale
+type SaleReturn struct {
+	ID           int              `json:"id" db:"id"`
+	SaleID       int              `json:"sale_id" db:"sale_id"`
+	UserID       int              `json:"user_id" db:"user_id"`
+	Reason       string           `json:"reason" db:"reason"`
+	RefundAmount Money            `json:"refund_amount" db:"refund_amount"`
+	CreatedAt    time.Time        `json:"created_at" db:"created_at"`
+	Items        []SaleReturnItem `json:"items,omitempty" db:"-"`
+}
+
+// SaleReturnItem is the quantity of a sale line returned from a single batch
+type SaleReturnItem struct {
+	ID           int    `json:"id" db:"id"`
+	ReturnID     int    `json:"return_id" db:"return_id"`
+	SaleItemID   int    `json:"sale_item_id" db:"sale_item_id"`
+	BatchID      *int   `json:"batch_id" db:"batch_id"`
+	Quantity     int    `json:"quantity" db:"quantity"`
+	Disposition  string `json:"disposition" db:"disposition"`
+	RefundAmount Money  `json:"refund_amount" db:"refund_amount"`
+}
+
+// Stock movement types
+const (
+	MovementInbound    = "inbound"
+	MovementOutbound   = "outbound"
+	MovementAdjustment = "adjustment"
+	MovementReturn     = "return"
+	MovementWriteOff   = "write_off"
+	MovementReversal   = "reversal"
+)
+
+// StockMovement is an append-only ledger entry for a change in stock of a
+// single batch. Quantity is signed and BalanceAfter is the medicine quantity
+// after the change.
+type StockMovement struct {
+	ID            int       `json:"id" db:"id"`
+	MedicineID    int       `json:"medicine_id" db:"medicine_id"`
+	BatchID       *int      `json:"batch_id" db:"batch_id"`
+	MovementType  string    `json:"movement_type" db:"movement_type"`
+	Quantity      int       `json:"quantity" db:"quantity"`
+	BalanceAfter  int       `json:"balance_after" db:"balance_after"`
+	UserID        *int      `json:"user_id" db:"user_id"`
+	Reason        string    `json:"reason" db:"reason"`
+	ReferenceType string    `json:"reference_type" db:"reference_type"`
+	ReferenceID   *int      `json:"reference_id" db:"reference_id"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+}
+
+// Stock adjustment reason codes
+const (
+	AdjustmentDamaged         = "damaged"
+	AdjustmentExpired         = "expired"
+	AdjustmentTheft           = "theft"
+	AdjustmentCountCorrection = "count_correction"
+)
+
+// StockAdjustment is a manual, signed change in the stock of a medicine
+type StockAdjustment struct {
 	ID         int       `json:"id" db:"id"`
 	MedicineID int       `json:"medicine_id" db:"medicine_id"`
+	BatchID    *int      `json:"batch_id" db:"batch_id"`
+	Delta      int       `json:"delta" db:"delta"`
+	ReasonCode string    `json:"reason_code" db:"reason_code"`
+	Note       string    `json:"note" db:"note"`
 	UserID     int       `json:"user_id" db:"user_id"`
-	Quantity   int       `json:"quantity" db:"quantity"`
-	UnitPrice  float64   `json:"unit_price" db:"unit_price"`
-	TotalPrice float64   `json:"total_price" db:"total_price"`
-	SaleDate   time.Time `json:"sale_date" db:"sale_date"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
 }
 
+// Stock-take session statuses
+const (
+	StockTakeOpen      = "open"
+	StockTakePosted    = "posted"
+	StockTakeCancelled = "cancelled"
+)
+
+// StockTake is a physical inventory count session
+type StockTake struct {
+	ID        int             `json:"id" db:"id"`
+	Status    string          `json:"status" db:"status"`
+	Note      string          `json:"note" db:"note"`
+	CreatedBy int             `json:"created_by" db:"created_by"`
+	PostedBy  *int            `json:"posted_by" db:"posted_by"`
+	CreatedAt time.Time       `json:"created_at" db:"created_at"`
+	PostedAt  *time.Time      `json:"posted_at" db:"posted_at"`
+	Lines     []StockTakeLine `json:"lines,omitempty" db:"-"`
+}
+
+// StockTakeLine is the counted quantity of a medicine, or of one of its
+// batches, within a stock-take session
+type StockTakeLine struct {
+	ID               int       `json:"id" db:"id"`
+	StockTakeID      int       `json:"stock_take_id" db:"stock_take_id"`
+	MedicineID       int       `json:"medicine_id" db:"medicine_id"`
+	BatchID          *int      `json:"batch_id" db:"batch_id"`
+	CountedQuantity  int       `json:"counted_quantity" db:"counted_quantity"`
+	ExpectedQuantity int       `json:"expected_quantity" db:"expected_quantity"`
+	Variance         int       `json:"variance" db:"variance"`
+	AdjustmentID     *int      `json:"adjustment_id" db:"adjustment_id"`
+	CountedBy        int       `json:"counted_by" db:"counted_by"`
+	CountedAt        time.Time `json:"counted_at" db:"counted_at"`
+}
+
+// StockDiscrepancy is a medicine whose quantity differs from its ledger
+type StockDiscrepancy struct {
+	MedicineID     int    `json:"medicine_id" db:"medicine_id"`
+	Name           string `json:"name" db:"name"`
+	Quantity       int    `json:"quantity" db:"quantity"`
+	LedgerQuantity int    `json:"ledger_quantity" db:"ledger_quantity"`
+}
+
+// Page is one page of a list endpoint and the number of items in the whole
+// list
+type Page[T any] struct {
+	Data   []T `json:"data"`
+	Total  int `json:"total"`
+	Limit  int `json:"limit"`
+	Offset int `json:"offset"`
+}
+
 // Request/Response DTOs
 type LoginRequest struct {
 	Username string `json:"username"`
@@ -71,36 +278,184 @@ type RegisterRequest struct {
 	Username string `json:"username"`
 	Email    string `json:"email"`
 	Password string `json:"password"`
+}
+
+// InviteUserRequest creates a user on behalf of an admin. The user sets
+// their password with a single-use token sent to their email.
+type InviteUserRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
 	Role     string `json:"role"`
 }
 
+type InviteUserResponse struct {
+	User            User      `json:"user"`
+	InviteExpiresAt time.Time `json:"invite_expires_at"`
+}
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// LoginResponse carries a short-lived access token and the refresh token
+// that keeps the session alive
 type LoginResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	RefreshToken string    `json:"refresh_token"`
+	User         User      `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// MFAChallengeResponse is returned by login instead of a session when a
+// second factor is needed. The challenge token is either exchanged for a
+// session at POST /api/auth/login/mfa, or, when enrolment is required, used
+// to enrol in two-factor authentication.
+type MFAChallengeResponse struct {
+	MFARequired       bool      `json:"mfa_required"`
+	EnrolmentRequired bool      `json:"mfa_enrolment_required"`
+	ChallengeToken    string    `json:"challenge_token"`
+	ExpiresAt         time.Time `json:"expires_at"`
+}
+
+type MFAVerifyRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type MFASetupResponse struct {
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"provisioning_uri"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+// MFAConfirmResponse carries recovery codes, shown only once. When enrolment
+// was part of a login, Login holds the new session.
+type MFAConfirmResponse struct {
+	RecoveryCodes []string       `json:"recovery_codes"`
+	Login         *LoginResponse `json:"login,omitempty"`
+}
+
+type MFADisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+// APIKey is a key a machine client authenticates with. It acts as its user,
+// limited to its scopes. The key itself is only returned when created.
+type APIKey struct {
+	ID         int            `json:"id" db:"id"`
+	Name       string         `json:"name" db:"name"`
+	Prefix     string         `json:"prefix" db:"prefix"`
+	UserID     int            `json:"user_id" db:"user_id"`
+	Username   string         `json:"username" db:"username"`
+	Scopes     pq.StringArray `json:"scopes" db:"scopes"`
+	ExpiresAt  *time.Time     `json:"expires_at" db:"expires_at"`
+	LastUsedAt *time.Time     `json:"last_used_at" db:"last_used_at"`
+	RevokedAt  *time.Time     `json:"revoked_at" db:"revoked_at"`
+	CreatedBy  *int           `json:"created_by" db:"created_by"`
+	CreatedAt  time.Time      `json:"created_at" db:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	UserID    int        `json:"user_id"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreateAPIKeyResponse struct {
+	APIKey APIKey `json:"api_key"`
+	Key    string `json:"key"`
+}
+
+// AuditEntry records one change made through the API. Before is empty for
+// creations and After for deletions; Changes lists the fields an update
+// changed as {"field": {"from": old, "to": new}}.
+type AuditEntry struct {
+	ID         int64           `json:"id" db:"id"`
+	OccurredAt time.Time       `json:"occurred_at" db:"occurred_at"`
+	UserID     *int            `json:"user_id" db:"user_id"`
+	Username   *string         `json:"username" db:"username"`
+	APIKeyID   *int            `json:"api_key_id" db:"api_key_id"`
+	Action     string          `json:"action" db:"action"`
+	Entity     string          `json:"entity" db:"entity"`
+	EntityID   *int            `json:"entity_id" db:"entity_id"`
+	Before     json.RawMessage `json:"before" db:"before"`
+	After      json.RawMessage `json:"after" db:"after"`
+	Changes    json.RawMessage `json:"changes" db:"changes"`
+	IPAddress  *string         `json:"ip_address" db:"ip_address"`
+	RequestID  *string         `json:"request_id" db:"request_id"`
 }
 
 type CreateMedicineRequest struct {
 	Name                 string    `json:"name"`
 	Description          string    `json:"description"`
 	Manufacturer         string    `json:"manufacturer"`
-	Price                float64   `json:"price"`
+	Price                Money     `json:"price"`
 	Quantity             int       `json:"quantity"`
 	ExpiryDate           time.Time `json:"expiry_date"`
+	BatchNumber          string    `json:"batch_number"`
 	Category             string    `json:"category"`
 	RequiresPrescription bool      `json:"requires_prescription"`
 }
 
+// UpdateMedicineRequest changes the fields of a medicine that are not derived
+// from its batches. Quantity and ExpiryDate are only read to reject requests
+// that try to set them.
 type UpdateMedicineRequest struct {
 	Name                 *string    `json:"name,omitempty"`
 	Description          *string    `json:"description,omitempty"`
 	Manufacturer         *string    `json:"manufacturer,omitempty"`
-	Price                *float64   `json:"price,omitempty"`
+	Price                *Money     `json:"price,omitempty"`
 	Quantity             *int       `json:"quantity,omitempty"`
 	ExpiryDate           *time.Time `json:"expiry_date,omitempty"`
 	Category             *string    `json:"category,omitempty"`
 	RequiresPrescription *bool      `json:"requires_prescription,omitempty"`
 }
 
+type CreateStockAdjustmentRequest struct {
+	BatchID    *int   `json:"batch_id"`
+	Delta      int    `json:"delta"`
+	ReasonCode string `json:"reason_code"`
+	Note       string `json:"note"`
+}
+
+type CreateStockTakeRequest struct {
+	Note string `json:"note"`
+}
+
+type SubmitStockCountsRequest struct {
+	Counts []StockCountRequest `json:"counts"`
+}
+
+type StockCountRequest struct {
+	MedicineID      int  `json:"medicine_id"`
+	BatchID         *int `json:"batch_id"`
+	CountedQuantity int  `json:"counted_quantity"`
+}
+
 type CreateSupplierRequest struct {
 	Name          string `json:"name"`
 	ContactPerson string `json:"contact_person"`
@@ -118,13 +473,35 @@ type UpdateSupplierRequest struct {
 }
 
 type CreatePurchaseRequest struct {
-	MedicineID int     `json:"medicine_id"`
-	SupplierID int     `json:"supplier_id"`
-	Quantity   int     `json:"quantity"`
-	UnitPrice  float64 `json:"unit_price"`
+	MedicineID  int       `json:"medicine_id"`
+	SupplierID  int       `json:"supplier_id"`
+	Quantity    int       `json:"quantity"`
+	UnitPrice   Money     `json:"unit_price"`
+	BatchNumber string    `json:"batch_number"`
+	ExpiryDate  time.Time `json:"expiry_date"`
+}
+
+type VoidPurchaseRequest struct {
+	Reason string `json:"reason"`
 }
 
 type CreateSaleRequest struct {
+	Items    []CreateSaleItemRequest `json:"items"`
+	Discount Money                   `json:"discount"`
+}
+
+type CreateSaleItemRequest struct {
 	MedicineID int `json:"medicine_id"`
 	Quantity   int `json:"quantity"`
 }
+
+type CreateSaleReturnRequest struct {
+	Reason string                        `json:"reason"`
+	Items  []CreateSaleReturnItemRequest `json:"items"`
+}
+
+type CreateSaleReturnItemRequest struct {
+	SaleItemID  int    `json:"sale_item_id"`
+	Quantity    int    `json:"quantity"`
+	Disposition string `json:"disposition"`
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Money is an amount in cents, so prices and totals add up exactly. It is
+// written to JSON as a number with two decimal places and stored as
+// DECIMAL(10, 2).
+//
+// Amounts are never rounded when read: an amount with more than two decimal
+// places is rejected. Only amounts that are divided, such as a discount
+// spread over the lines of a sale, are rounded, to the nearest cent with
+// halves rounded away from zero.
+type Money int64
+
+var errMoneyFormat = errors.New("amount must be a number with at most two decimal places")
+
+// ParseMoney reads a decimal amount such as "12.5" or "-0.99"
+func ParseMoney(s string) (Money, error) {
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+
+	whole, frac, _ := strings.Cut(s, ".")
+	if whole == "" || len(frac) > 2 || !isDigits(whole) || !isDigits(frac) {
+		return 0, errMoneyFormat
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+
+	units, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil || units > (math.MaxInt64-99)/100 {
+		return 0, errMoneyFormat
+	}
+	cents, _ := strconv.ParseInt(frac, 10, 64)
+
+	m := Money(units*100 + cents)
+	if negative {
+		m = -m
+	}
+	return m, nil
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// String formats the amount with two decimal places
+func (m Money) String() string {
+	sign := ""
+	cents := int64(m)
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+// Times returns the amount multiplied by a quantity
+func (m Money) Times(quantity int) Money {
+	return m * Money(quantity)
+}
+
+// MulDiv returns the amount multiplied by num/den, rounded to the nearest
+// cent with halves rounded away from zero. It is used to spread an amount in
+// proportion, such as the total paid for a sale over its lines.
+func (m Money) MulDiv(num, den Money) Money {
+	if den == 0 {
+		panic("models: Money.MulDiv by zero")
+	}
+
+	// The product can overflow int64
+	product := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(int64(num)))
+	divisor := big.NewInt(int64(den))
+	negative := product.Sign()*divisor.Sign() < 0
+	product.Abs(product)
+	divisor.Abs(divisor)
+
+	quotient, remainder := new(big.Int).QuoRem(product, divisor, new(big.Int))
+	if remainder.Lsh(remainder, 1).Cmp(divisor) >= 0 {
+		quotient.Add(quotient, big.NewInt(1))
+	}
+	if negative {
+		quotient.Neg(quotient)
+	}
+	return Money(quotient.Int64())
+}
+
+// MarshalJSON writes the amount as a JSON number
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON reads a JSON number, or a string holding one
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := string(data)
+	if s == "null" {
+		return nil
+	}
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// Scan reads a DECIMAL column
+func (m *Money) Scan(src any) error {
+	var s string
+	switch v := src.(type) {
+	case []byte:
+		s = string(v)
+	case string:
+		s = v
+	case int64:
+		*m = Money(v * 100)
+		return nil
+	case nil:
+		return errors.New("cannot scan NULL into Money")
+	default:
+		return fmt.Errorf("cannot scan %T into Money", src)
+	}
+
+	parsed, err := ParseMoney(s)
+	if err != nil {
+		return fmt.Errorf("cannot scan %q into Money: %w", s, err)
+	}
+	*m = parsed
+	return nil
+}
+
+// Value stores the amount as a decimal string, which PostgreSQL converts to
+// DECIMAL exactly
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
@@ -0,0 +1,159 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMoney(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Money
+	}{
+		{"0", 0},
+		{"12", 1200},
+		{"12.5", 1250},
+		{"12.50", 1250},
+		{"0.01", 1},
+		{"-0.99", -99},
+		{"99999999.99", 9999999999},
+		{"7.", 700},
+	}
+	for _, tt := range tests {
+		got, err := ParseMoney(tt.s)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseMoney(%q) = %d, %v, want %d", tt.s, got, err, tt.want)
+		}
+	}
+
+	for _, s := range []string{"", "-", ".5", "1.234", "1e2", "1,50", "+1", "abc", "1.2.3", "99999999999999999999"} {
+		if got, err := ParseMoney(s); err == nil {
+			t.Errorf("ParseMoney(%q) = %d, want an error", s, got)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{1250, "12.50"},
+		{-99, "-0.99"},
+		{-1250, "-12.50"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.String(); got != tt.want {
+			t.Errorf("Money(%d).String() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyJSON(t *testing.T) {
+	var req struct {
+		Price    Money  `json:"price"`
+		Discount *Money `json:"discount"`
+		Total    Money  `json:"total"`
+	}
+	err := json.Unmarshal([]byte(`{"price": 150.5, "discount": null, "total": "19.99"}`), &req)
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if req.Price != 15050 || req.Discount != nil || req.Total != 1999 {
+		t.Errorf("unmarshalled %+v", req)
+	}
+
+	// Amounts are never rounded silently
+	if err := json.Unmarshal([]byte(`{"price": 0.125}`), &req); err == nil {
+		t.Error("amount with three decimal places accepted")
+	}
+
+	data, err := json.Marshal(Sale{Subtotal: 42100, Discount: 100, Total: 42000})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var sale map[string]any
+	if err := json.Unmarshal(data, &sale); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if sale["subtotal"] != 421.0 || sale["discount"] != 1.0 || sale["total"] != 420.0 {
+		t.Errorf("marshalled %s", data)
+	}
+}
+
+func TestMoneyScanAndValue(t *testing.T) {
+	var m Money
+	for _, src := range []any{[]byte("150.50"), "150.50", "150.5"} {
+		if err := m.Scan(src); err != nil || m != 15050 {
+			t.Errorf("Scan(%v) = %d, %v", src, m, err)
+		}
+	}
+	if err := m.Scan(int64(3)); err != nil || m != 300 {
+		t.Errorf("Scan(int64) = %d, %v", m, err)
+	}
+	if err := m.Scan(nil); err == nil {
+		t.Error("Scan(nil) succeeded")
+	}
+	if err := m.Scan(1.5); err == nil {
+		t.Error("Scan(float64) succeeded")
+	}
+
+	v, err := Money(-1250).Value()
+	if err != nil || v != "-12.50" {
+		t.Errorf("Value() = %v, %v", v, err)
+	}
+}
+
+func TestMoneyMulDiv(t *testing.T) {
+	tests := []struct {
+		m, num, den Money
+		want        Money
+	}{
+		{1000, 9000, 10000, 900},
+		// Halves are rounded away from zero
+		{5, 1, 2, 3},
+		{-5, 1, 2, -3},
+		{1, 1, 3, 0},
+		{2, 1, 3, 1},
+		// The product does not overflow
+		{1 << 40, 1 << 40, 1 << 40, 1 << 40},
+	}
+	for _, tt := range tests {
+		if got := tt.m.MulDiv(tt.num, tt.den); got != tt.want {
+			t.Errorf("Money(%d).MulDiv(%d, %d) = %d, want %d", tt.m, tt.num, tt.den, got, tt.want)
+		}
+	}
+}
+
+func TestMoneyTotalsAcrossManyLines(t *testing.T) {
+	// A thousand lines of 0.10 add up to 99.9999999999986 in float64
+	price, _ := ParseMoney("0.10")
+	var total Money
+	for range 1000 {
+		total += price.Times(1)
+	}
+	if total.String() != "100.00" {
+		t.Errorf("total of 1000 lines of 0.10 = %s, want 100.00", total)
+	}
+
+	// Lines of a receipt with various quantities and prices
+	lines := []struct {
+		price    string
+		quantity int
+	}{
+		{"19.99", 3}, {"0.35", 17}, {"149.90", 1}, {"2.01", 333}, {"0.07", 1000},
+	}
+	var subtotal Money
+	for _, line := range lines {
+		p, err := ParseMoney(line.price)
+		if err != nil {
+			t.Fatalf("ParseMoney(%q): %v", line.price, err)
+		}
+		subtotal += p.Times(line.quantity)
+	}
+	if subtotal.String() != "955.15" {
+		t.Errorf("subtotal = %s, want 955.15", subtotal)
+	}
+}
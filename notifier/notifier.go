@@ -0,0 +1,71 @@
+// Package notifier delivers messages such as password reset tokens to users.
+package notifier
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Message is a notification for a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Notifier sends messages to users. Implementations must be safe for
+// concurrent use.
+type Notifier interface {
+	Send(msg Message) error
+}
+
+// New returns the notifier selected by kind ("log" or "file"). The file
+// notifier appends messages to path.
+func New(kind, path string) (Notifier, error) {
+	switch kind {
+	case "", "log":
+		return LogNotifier{}, nil
+	case "file":
+		if path == "" {
+			return nil, fmt.Errorf("notifier: file notifier needs a path")
+		}
+		return &FileNotifier{Path: path}, nil
+	}
+	return nil, fmt.Errorf("notifier: unknown notifier %q", kind)
+}
+
+// LogNotifier writes messages to the application log. It is meant for local
+// development only, since message bodies may contain secrets.
+type LogNotifier struct{}
+
+func (LogNotifier) Send(msg Message) error {
+	log.Printf("Notification to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// FileNotifier appends messages to a file, one block per message
+type FileNotifier struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func (n *FileNotifier) Send(msg Message) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	f, err := os.OpenFile(n.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(f, "Date: %s\nTo: %s\nSubject: %s\n\n%s\n\n",
+		time.Now().Format(time.RFC3339), msg.To, msg.Subject, msg.Body)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
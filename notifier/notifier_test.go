@@ -0,0 +1,45 @@
+package notifier
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.txt")
+	n, err := New("file", path)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		if err := n.Send(Message{To: to, Subject: "Reset", Body: "token-" + to}); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	out := string(data)
+	for _, want := range []string{"To: a@example.com", "token-a@example.com", "To: b@example.com", "Subject: Reset"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("outbox is missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("log", ""); err != nil {
+		t.Errorf("New(log): %v", err)
+	}
+	if _, err := New("file", ""); err == nil {
+		t.Error("New(file) without a path succeeded")
+	}
+	if _, err := New("smtp", ""); err == nil {
+		t.Error("New(smtp) succeeded")
+	}
+}
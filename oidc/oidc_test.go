@@ -0,0 +1,290 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockProvider is a minimal OpenID Connect provider. Codes are registered
+// with the PKCE challenge and nonce of the authorization request, as a real
+// provider does when the user logs in.
+type mockProvider struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu     sync.Mutex
+	key    *rsa.PrivateKey
+	kid    string
+	codes  map[string]mockCode
+	claims jwt.MapClaims
+}
+
+type mockCode struct {
+	challenge string
+	nonce     string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	m := &mockProvider{t: t, codes: map[string]mockCode{}}
+	m.rotateKey()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.server.URL,
+			"authorization_endpoint": m.server.URL + "/authorize",
+			"token_endpoint":         m.server.URL + "/token",
+			"jwks_uri":               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": m.kid,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(m.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(m.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", m.token)
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+
+	m.claims = jwt.MapClaims{
+		"sub":                "idp-user-1",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+		"preferred_username": "alice",
+		"name":               "Alice Smith",
+		"groups":             []string{"staff", "pharmacy-pharmacists"},
+	}
+	return m
+}
+
+func (m *mockProvider) rotateKey() {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		m.t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	kid, err := NewCodeVerifier()
+	if err != nil {
+		m.t.Fatalf("NewCodeVerifier: %v", err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.key, m.kid = key, kid
+}
+
+// authorize stands in for the user logging in at the provider: it registers
+// a code for the authorization URL
+func (m *mockProvider) authorize(authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		m.t.Fatalf("url.Parse: %v", err)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("response_type") != "code" {
+		m.t.Fatalf("unexpected authorization request: %s", authURL)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code := "code-" + q.Get("state")
+	m.codes[code] = mockCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+	return code
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	code, ok := m.codes[r.FormValue("code")]
+	delete(m.codes, r.FormValue("code"))
+	m.mu.Unlock()
+
+	if !ok || CodeChallenge(r.FormValue("code_verifier")) != code.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{
+		"access_token": "idp-access-token",
+		"token_type":   "Bearer",
+		"id_token":     m.idToken(code.nonce, nil),
+	})
+}
+
+// idToken signs an ID token for the mock user, with overrides applied
+func (m *mockProvider) idToken(nonce string, overrides jwt.MapClaims) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	claims := jwt.MapClaims{
+		"iss":   m.server.URL,
+		"aud":   "pharmacy",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"nonce": nonce,
+	}
+	for k, v := range m.claims {
+		claims[k] = v
+	}
+	for k, v := range overrides {
+		claims[k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = m.kid
+	signed, err := token.SignedString(m.key)
+	if err != nil {
+		m.t.Fatalf("SignedString: %v", err)
+	}
+	return signed
+}
+
+func (m *mockProvider) provider() *Provider {
+	return NewProvider(Config{
+		Issuer:      m.server.URL,
+		ClientID:    "pharmacy",
+		RedirectURL: "http://localhost:8080/api/auth/oidc/callback",
+	})
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	verifier, err := NewCodeVerifier()
+	if err != nil {
+		t.Fatalf("NewCodeVerifier: %v", err)
+	}
+	authURL, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code := m.authorize(authURL)
+
+	id, err := p.Exchange(ctx, code, verifier, "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if id.Subject != "idp-user-1" || id.Username != "alice" || id.Email != "alice@example.com" || !id.EmailVerified {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+	if len(id.Groups) != 2 || id.Groups[1] != "pharmacy-pharmacists" {
+		t.Errorf("Groups = %v", id.Groups)
+	}
+
+	// Codes are single use
+	if _, err := p.Exchange(ctx, code, verifier, "nonce-1"); err == nil {
+		t.Error("code redeemed twice")
+	}
+}
+
+func TestExchangeRequiresCodeVerifier(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	verifier, _ := NewCodeVerifier()
+	authURL, err := p.AuthCodeURL(ctx, "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL: %v", err)
+	}
+	code := m.authorize(authURL)
+
+	other, _ := NewCodeVerifier()
+	if _, err := p.Exchange(ctx, code, other, "nonce-1"); err == nil {
+		t.Error("code redeemed with the wrong verifier")
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		overrides jwt.MapClaims
+		nonce     string
+	}{
+		{"wrong nonce", nil, "other-nonce"},
+		{"wrong audience", jwt.MapClaims{"aud": "other-client"}, "nonce-1"},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com"}, "nonce-1"},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, "nonce-1"},
+		{"no subject", jwt.MapClaims{"sub": ""}, "nonce-1"},
+	}
+
+	for _, tt := range tests {
+		token := m.idToken("nonce-1", tt.overrides)
+		if _, err := p.Verify(ctx, token, tt.nonce); err == nil {
+			t.Errorf("%s: token accepted", tt.name)
+		}
+	}
+
+	// A token signed with a key the provider does not publish
+	m.mu.Lock()
+	published := m.key
+	m.mu.Unlock()
+	m.rotateKey()
+	forged := m.idToken("nonce-1", nil)
+	m.mu.Lock()
+	m.key = published
+	m.mu.Unlock()
+	if _, err := p.Verify(ctx, forged, "nonce-1"); err == nil {
+		t.Error("token signed with an unpublished key accepted")
+	}
+}
+
+func TestVerifyFetchesRotatedKeys(t *testing.T) {
+	m := newMockProvider(t)
+	p := m.provider()
+	ctx := context.Background()
+
+	if _, err := p.Verify(ctx, m.idToken("n", nil), "n"); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	m.rotateKey()
+	rotated := m.idToken("n", nil)
+
+	// Keys are not fetched again more than once per interval
+	if _, err := p.Verify(ctx, rotated, "n"); err == nil {
+		t.Fatal("token of an unknown key accepted without fetching keys")
+	}
+
+	p.mu.Lock()
+	p.keysFetchedAt = time.Now().Add(-keyRefreshInterval)
+	p.mu.Unlock()
+	if _, err := p.Verify(ctx, rotated, "n"); err != nil {
+		t.Errorf("token of the rotated key rejected: %v", err)
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	m := newMockProvider(t)
+	p := NewProvider(Config{Issuer: m.server.URL + "/", ClientID: "pharmacy"})
+
+	if _, err := p.AuthCodeURL(context.Background(), "s", "n", "v"); err == nil {
+		t.Error("discovery document of another issuer accepted")
+	}
+}
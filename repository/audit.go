@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Audited actions
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditVoid       = "void"
+	AuditPost       = "post"
+	AuditCancel     = "cancel"
+	AuditCount      = "count"
+	AuditRoleChange = "role_change"
+	AuditDeactivate = "deactivate"
+	AuditReactivate = "reactivate"
+	AuditUnlock     = "unlock"
+	AuditMFAReset   = "mfa_reset"
+	AuditRevoke     = "revoke"
+
+	// Account security of a user's own account
+	AuditRegister              = "register"
+	AuditPasswordChange        = "password_change"
+	AuditPasswordReset         = "password_reset"
+	AuditMFAEnable             = "mfa_enable"
+	AuditMFADisable            = "mfa_disable"
+	AuditMFARecoveryRegenerate = "mfa_recovery_regenerate"
+	AuditOIDCLink              = "oidc_link"
+	AuditLogout                = "logout"
+	AuditLogoutAll             = "logout_all"
+)
+
+// auditHiddenColumns are left out of entity snapshots so secrets never end
+// up in the audit log, nor derived columns such as search documents
+const auditHiddenColumns = `ARRAY['password_hash', 'totp_secret', 'totp_last_step', 'key_hash', 'search_vector']`
+
+// auditChange is the old and new value of a changed field
+type auditChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// AuditSnapshot returns a row of a table as JSON, for the before or after
+// value of an audit entry. Lock the row with forUpdate when taking the
+// before value, so it cannot change until the transaction ends.
+func AuditSnapshot(q rowQueryer, table string, id int, forUpdate bool) (json.RawMessage, error) {
+	query := `SELECT to_jsonb(t) - ` + auditHiddenColumns + ` FROM ` + table + ` t WHERE t.id = $1`
+	if forUpdate {
+		query += ` FOR UPDATE`
+	}
+
+	var snapshot json.RawMessage
+	err := q.QueryRow(query, id).Scan(&snapshot)
+	return snapshot, err
+}
+
+// RecordAudit writes an audit entry for a change made by actor. It should
+// run in the transaction that makes the change, so the entry is written if
+// and only if the change is. before and after are values that encode to JSON
+// objects; nil means the entity did not exist.
+func RecordAudit(exec sqlx.Execer, actor Actor, action, entity string, entityID int, before, after any) error {
+	beforeJSON, afterJSON, changesJSON, err := auditValues(before, after)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_log (occurred_at, user_id, username, api_key_id, action, entity, entity_id,
+		                       before, after, changes, ip_address, request_id)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10, NULLIF($11, ''), NULLIF($12, ''))
+	`
+	_, err = exec.Exec(
+		query,
+		time.Now(),
+		actor.UserID,
+		actor.Username,
+		actor.APIKeyID,
+		action,
+		entity,
+		entityID,
+		nullJSON(beforeJSON),
+		nullJSON(afterJSON),
+		nullJSON(changesJSON),
+		actor.IP,
+		actor.RequestID,
+	)
+	return err
+}
+
+// auditValues encodes the before and after values of an audit entry and
+// the changes between them
+func auditValues(before, after any) (beforeJSON, afterJSON, changesJSON []byte, err error) {
+	if beforeJSON, err = auditJSON(before); err != nil {
+		return nil, nil, nil, err
+	}
+	if afterJSON, err = auditJSON(after); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if beforeJSON != nil && afterJSON != nil {
+		if changes := auditChanges(beforeJSON, afterJSON); len(changes) > 0 {
+			if changesJSON, err = json.Marshal(changes); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	return beforeJSON, afterJSON, changesJSON, nil
+}
+
+func auditJSON(v any) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if raw, ok := v.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(v)
+}
+
+// nullJSON stores missing JSON as NULL rather than an empty string
+func nullJSON(b []byte) any {
+	if b == nil {
+		return nil
+	}
+	return string(b)
+}
+
+// auditChanges compares the top-level fields of two JSON objects and returns
+// those that differ
+func auditChanges(before, after []byte) map[string]auditChange {
+	var from, to map[string]any
+	if json.Unmarshal(before, &from) != nil || json.Unmarshal(after, &to) != nil {
+		return nil
+	}
+
+	changes := map[string]auditChange{}
+	for field, old := range from {
+		if value, ok := to[field]; !ok || !reflect.DeepEqual(old, value) {
+			changes[field] = auditChange{From: old, To: to[field]}
+		}
+	}
+	for field, value := range to {
+		if _, ok := from[field]; !ok {
+			changes[field] = auditChange{From: nil, To: value}
+		}
+	}
+	return changes
+}
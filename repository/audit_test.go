@@ -0,0 +1,35 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAuditChanges(t *testing.T) {
+	before := []byte(`{"id": 7, "name": "Aspirin", "price": 5.5, "quantity": 10, "description": null}`)
+	after := []byte(`{"id": 7, "name": "Aspirin", "price": 6, "quantity": 10, "description": "Pain relief", "version": 2}`)
+
+	got := auditChanges(before, after)
+	want := map[string]auditChange{
+		"price":       {From: 5.5, To: float64(6)},
+		"description": {From: nil, To: "Pain relief"},
+		"version":     {From: nil, To: float64(2)},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("auditChanges = %#v, want %#v", got, want)
+	}
+
+	if got := auditChanges(before, before); len(got) != 0 {
+		t.Errorf("auditChanges of identical objects = %#v, want none", got)
+	}
+
+	// Removed fields change to null
+	got = auditChanges([]byte(`{"a": [1, 2]}`), []byte(`{}`))
+	if !reflect.DeepEqual(got, map[string]auditChange{"a": {From: []any{float64(1), float64(2)}, To: nil}}) {
+		t.Errorf("auditChanges of a removed field = %#v", got)
+	}
+
+	if got := auditChanges([]byte(`not json`), after); got != nil {
+		t.Errorf("auditChanges of invalid JSON = %#v, want nil", got)
+	}
+}
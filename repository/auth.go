@@ -0,0 +1,29 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/utils"
+)
+
+// Kinds of login failure counters
+const (
+	LoginFailureUsername = "username"
+	LoginFailureIP       = "ip"
+)
+
+// as returns the actor acting as a user, for changes a user makes without
+// being signed in, such as registering or resetting their password
+func (a Actor) as(user models.User) Actor {
+	a.UserID = &user.ID
+	a.Username = user.Username
+	return a
+}
+
+// acceptTOTP checks a TOTP code against a secret and returns its time step.
+// A code is accepted only once: its time step must be newer than lastStep.
+func acceptTOTP(secret string, lastStep *int64, code string) (int64, bool) {
+	step, valid := utils.ValidateTOTP(secret, code, time.Now())
+	return step, valid && (lastStep == nil || step > *lastStep)
+}
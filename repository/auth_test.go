@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/oidc"
+	"github.com/alfinkly/hci-golang-back/utils"
+)
+
+// registerUser registers a cashier with a placeholder password hash
+func registerUser(t *testing.T, repos Repositories, username string) models.User {
+	t.Helper()
+
+	user, err := repos.Auth.Register(Actor{}, username, username+"@example.com", "hash", models.RoleCashier)
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	return user
+}
+
+// userAuditActions returns the actions recorded in the audit log for a user
+func userAuditActions(t *testing.T, repos Repositories, userID int) []string {
+	t.Helper()
+
+	page, err := repos.Audit.List(ListQuery{Limit: 100})
+	if err != nil {
+		t.Fatalf("list audit log: %v", err)
+	}
+	var actions []string
+	for _, entry := range page.Data {
+		if entry.Entity == "user" && entry.EntityID != nil && *entry.EntityID == userID {
+			actions = append(actions, entry.Action)
+		}
+	}
+	slices.Sort(actions)
+	return actions
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		user := registerUser(t, repos, "till-1")
+		sessionID, err := repos.Auth.StartSession(user.ID, "test", "127.0.0.1", time.Now().Add(time.Hour), "token-1")
+		if err != nil {
+			t.Fatalf("start session: %v", err)
+		}
+
+		refreshed, id, err := repos.Auth.Refresh(Actor{}, "token-1", "token-2")
+		if err != nil || id != sessionID || refreshed.ID != user.ID {
+			t.Fatalf("refresh = user %d, session %d, %v", refreshed.ID, id, err)
+		}
+		if _, err = repos.Auth.Session(user.ID, sessionID, "jti-1"); err != nil {
+			t.Errorf("session after refresh: %v", err)
+		}
+
+		// Reusing a rotated token ends the session
+		if _, _, err = repos.Auth.Refresh(Actor{}, "token-1", "token-3"); err != ErrTokenReused {
+			t.Errorf("reuse = %v, want ErrTokenReused", err)
+		}
+		if _, _, err = repos.Auth.Refresh(Actor{}, "token-2", "token-4"); err != ErrSessionEnded {
+			t.Errorf("refresh of revoked session = %v, want ErrSessionEnded", err)
+		}
+		if _, _, err = repos.Auth.Refresh(Actor{}, "unknown", "token-5"); err != ErrInvalidToken {
+			t.Errorf("unknown token = %v, want ErrInvalidToken", err)
+		}
+		if _, err = repos.Auth.Session(user.ID, sessionID, "jti-1"); err != ErrSessionEnded {
+			t.Errorf("revoked session = %v, want ErrSessionEnded", err)
+		}
+	})
+}
+
+func TestUsernameOrEmailTaken(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		registerUser(t, repos, "till-1")
+
+		if _, err := repos.Auth.Register(Actor{}, "till-1", "other@example.com", "hash", models.RoleCashier); err != ErrConflict {
+			t.Errorf("register taken username = %v, want ErrConflict", err)
+		}
+		_, err := repos.Users.Invite(Actor{}, "till-2", "till-1@example.com", models.RoleCashier, "token-hash", time.Now().Add(time.Hour))
+		if err != ErrConflict {
+			t.Errorf("invite taken email = %v, want ErrConflict", err)
+		}
+	})
+}
+
+func TestLogoutRevokesToken(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		user := registerUser(t, repos, "till-1")
+		first, err := repos.Auth.StartSession(user.ID, "test", "127.0.0.1", time.Now().Add(time.Hour), "token-1")
+		if err != nil {
+			t.Fatalf("start session: %v", err)
+		}
+		second, err := repos.Auth.StartSession(user.ID, "test", "127.0.0.1", time.Now().Add(time.Hour), "token-2")
+		if err != nil {
+			t.Fatalf("start session: %v", err)
+		}
+
+		actor := Actor{UserID: &user.ID, Username: user.Username}
+		if err = repos.Auth.Logout(actor, first, "jti-1", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("logout: %v", err)
+		}
+		if _, err = repos.Auth.Session(user.ID, first, "jti-2"); err != ErrSessionEnded {
+			t.Errorf("ended session = %v, want ErrSessionEnded", err)
+		}
+		if _, err = repos.Auth.Session(user.ID, second, "jti-1"); err != ErrSessionEnded {
+			t.Errorf("revoked token = %v, want ErrSessionEnded", err)
+		}
+		if _, err = repos.Auth.Session(user.ID, second, "jti-2"); err != nil {
+			t.Errorf("other session: %v", err)
+		}
+
+		if err = repos.Auth.LogoutAll(actor, "jti-2", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("logout all: %v", err)
+		}
+		if _, err = repos.Auth.Session(user.ID, second, "jti-3"); err != ErrSessionEnded {
+			t.Errorf("session after logout all = %v, want ErrSessionEnded", err)
+		}
+	})
+}
+
+func TestLoginFailures(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		since := time.Now().Add(-time.Hour)
+		for want := 1; want <= 3; want++ {
+			failures, err := repos.Auth.RecordLoginFailure(LoginFailureUsername, "till-1", since)
+			if err != nil || failures != want {
+				t.Fatalf("failures = %d, %v, want %d", failures, err, want)
+			}
+		}
+
+		// Failures before the window start counting again
+		failures, err := repos.Auth.RecordLoginFailure(LoginFailureUsername, "till-1", time.Now().Add(time.Minute))
+		if err != nil || failures != 1 {
+			t.Errorf("failures after window = %d, %v, want 1", failures, err)
+		}
+
+		until := time.Now().Add(time.Hour).Truncate(time.Second)
+		if err = repos.Auth.LockLogin(LoginFailureUsername, "till-1", until); err != nil {
+			t.Fatalf("lock: %v", err)
+		}
+		if lockedUntil, err := repos.Auth.LoginLockedUntil("till-1", "127.0.0.1"); err != nil || !lockedUntil.Equal(until) {
+			t.Errorf("locked until %v, %v, want %v", lockedUntil, err, until)
+		}
+		if lockedUntil, err := repos.Auth.LoginLockedUntil("till-2", "127.0.0.1"); err != nil || !lockedUntil.IsZero() {
+			t.Errorf("other user locked until %v, %v", lockedUntil, err)
+		}
+
+		if err = repos.Auth.ClearLoginFailures("till-1"); err != nil {
+			t.Fatalf("clear: %v", err)
+		}
+		if lockedUntil, err := repos.Auth.LoginLockedUntil("till-1", "127.0.0.1"); err != nil || !lockedUntil.IsZero() {
+			t.Errorf("cleared user locked until %v, %v", lockedUntil, err)
+		}
+	})
+}
+
+func TestRecoveryCodeUsedOnce(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		user := registerUser(t, repos, "till-1")
+		if err := repos.Auth.UseRecoveryCode(user.ID, "code-1"); err != ErrInvalidCode {
+			t.Errorf("recovery code without MFA = %v, want ErrInvalidCode", err)
+		}
+		if err := repos.Auth.UseMFACode(user.ID, "123456"); err != ErrMFANotEnabled {
+			t.Errorf("code without MFA = %v, want ErrMFANotEnabled", err)
+		}
+		if _, err := repos.Auth.EnableMFA(Actor{}, user.ID, "123456", nil); err != ErrMFANotSetUp {
+			t.Errorf("enable without secret = %v, want ErrMFANotSetUp", err)
+		}
+	})
+}
+
+func TestLinkOIDCUserByVerifiedEmail(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		local := registerUser(t, repos, "till-1")
+
+		// An unverified email is not enough to take over an account
+		unverified := oidc.Identity{Subject: "sub-1", Email: local.Email, Username: "till-1"}
+		if _, err := repos.Auth.LinkOIDCUser(Actor{}, unverified, models.RoleCashier); err != ErrUsernameTaken {
+			t.Errorf("unverified email = %v, want ErrUsernameTaken", err)
+		}
+
+		// The linked account keeps its role, at linking and at later logins
+		verified := oidc.Identity{Subject: "sub-1", Email: local.Email, EmailVerified: true}
+		linked, err := repos.Auth.LinkOIDCUser(Actor{}, verified, models.RoleAdmin)
+		if err != nil || linked.ID != local.ID || linked.Role != models.RoleCashier {
+			t.Fatalf("link = user %d as %s, %v, want %d as cashier", linked.ID, linked.Role, err, local.ID)
+		}
+		if linked, err = repos.Auth.LinkOIDCUser(Actor{}, verified, models.RolePharmacist); err != nil || linked.Role != models.RoleCashier {
+			t.Fatalf("login = %s, %v, want cashier", linked.Role, err)
+		}
+		want := []string{AuditOIDCLink, AuditRegister}
+		if got := userAuditActions(t, repos, local.ID); !slices.Equal(got, want) {
+			t.Errorf("audit actions = %v, want %v", got, want)
+		}
+
+		// Linked users no longer reset a local password
+		if _, err = repos.Auth.PasswordResetUser(local.Email); err != ErrNotFound {
+			t.Errorf("password reset of linked user = %v, want ErrNotFound", err)
+		}
+
+		identity := oidc.Identity{Subject: "sub-2", Email: "new@example.com"}
+		created, err := repos.Auth.LinkOIDCUser(Actor{}, identity, models.RoleCashier)
+		if err != nil || created.ID == local.ID || created.Username != "new" {
+			t.Fatalf("create = %+v, %v", created, err)
+		}
+
+		// Created users change role only when their groups do
+		if _, err = repos.Auth.LinkOIDCUser(Actor{}, identity, models.RoleCashier); err != nil {
+			t.Fatalf("login: %v", err)
+		}
+		if created, err = repos.Auth.LinkOIDCUser(Actor{}, identity, models.RolePharmacist); err != nil || created.Role != models.RolePharmacist {
+			t.Fatalf("login with new role = %s, %v, want pharmacist", created.Role, err)
+		}
+		want = []string{AuditCreate, AuditRoleChange}
+		if got := userAuditActions(t, repos, created.ID); !slices.Equal(got, want) {
+			t.Errorf("audit actions of created user = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestRegenerateRecoveryCodes(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		user := registerUser(t, repos, "till-1")
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			t.Fatalf("generate secret: %v", err)
+		}
+		if err = repos.Auth.SetMFASecret(user.ID, secret); err != nil {
+			t.Fatalf("set secret: %v", err)
+		}
+		now := time.Now()
+		code, _ := utils.TOTPCode(secret, now)
+		if _, err = repos.Auth.EnableMFA(Actor{}, user.ID, code, []string{"old"}); err != nil {
+			t.Fatalf("enable: %v", err)
+		}
+
+		// The next code is accepted within the allowed clock drift
+		next, _ := utils.TOTPCode(secret, now.Add(30*time.Second))
+		if err = repos.Auth.ReplaceRecoveryCodes(Actor{}, user.ID, code, []string{"new"}); err != ErrInvalidCode {
+			t.Errorf("replace with a used code = %v, want ErrInvalidCode", err)
+		}
+		if err = repos.Auth.ReplaceRecoveryCodes(Actor{}, user.ID, next, []string{"new"}); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+
+		if err = repos.Auth.UseRecoveryCode(user.ID, "old"); err != ErrInvalidCode {
+			t.Errorf("replaced code = %v, want ErrInvalidCode", err)
+		}
+		if err = repos.Auth.UseRecoveryCode(user.ID, "new"); err != nil {
+			t.Errorf("new code: %v", err)
+		}
+		want := []string{AuditMFAEnable, AuditMFARecoveryRegenerate, AuditRegister}
+		if got := userAuditActions(t, repos, user.ID); !slices.Equal(got, want) {
+			t.Errorf("audit actions = %v, want %v", got, want)
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package repository
+
+import (
+	"slices"
+)
+
+// FilterKind is the type of the value of a list filter
+type FilterKind int
+
+const (
+	FilterText FilterKind = iota
+	FilterInt
+	FilterMoney
+	FilterBool
+	FilterTime
+)
+
+// Filter is a query parameter that narrows a list
+type Filter struct {
+	Param string
+	Kind  FilterKind
+	// Upper marks the end of a time range. A date alone as the end of a
+	// range includes that whole day.
+	Upper bool
+	// condition is the SQL condition with $? in place of the value
+	condition string
+}
+
+// ListSpec describes a list: how it can be filtered and which fields it can
+// be sorted by, and the rows it selects from the database
+type ListSpec struct {
+	Filters []Filter
+	// Sorts maps the fields a list can be sorted by to their columns
+	Sorts       map[string]string
+	DefaultSort string
+	columns     string
+	from        string
+}
+
+// SortFields returns the fields a list can be sorted by, in order
+func (s ListSpec) SortFields() []string {
+	fields := make([]string, 0, len(s.Sorts))
+	for field := range s.Sorts {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// FilterValue is the parsed value of a filter of a list request
+type FilterValue struct {
+	Param string
+	Value any
+}
+
+// SortField is a field a list is sorted by
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ListQuery is a list request parsed against its spec. Lists are sorted by
+// the fields of Sort, then by ID in the direction of the first field so
+// pages do not overlap.
+type ListQuery struct {
+	Filters []FilterValue
+	Sort    []SortField
+	Limit   int
+	Offset  int
+}
+
+// rangeFilters returns the filters of a numeric range, field_min and
+// field_max, or of a time range, field_from and field_to. Both ends are
+// inclusive, except the end of a time range given as a timestamp.
+func rangeFilters(field string, kind FilterKind, column string) []Filter {
+	if kind == FilterTime {
+		return []Filter{
+			{Param: field + "_from", Kind: kind, condition: column + " >= $?"},
+			{Param: field + "_to", Kind: kind, condition: column + " < $?", Upper: true},
+		}
+	}
+	return []Filter{
+		{Param: field + "_min", Kind: kind, condition: column + " >= $?"},
+		{Param: field + "_max", Kind: kind, condition: column + " <= $?"},
+	}
+}
+
+// MedicineList is the list of medicines, filtered by category,
+// manufacturer, prescription, price, stock, expiry and supplier
+var MedicineList = ListSpec{
+	columns: medicineColumns,
+	from:    `medicines`,
+	Filters: slices.Concat(
+		[]Filter{
+			{Param: "category", Kind: FilterText, condition: "category = $?"},
+			{Param: "manufacturer", Kind: FilterText, condition: "manufacturer = $?"},
+			{Param: "requires_prescription", Kind: FilterBool, condition: "requires_prescription = $?"},
+			{Param: "supplier_id", Kind: FilterInt, condition: "EXISTS (SELECT 1 FROM purchases p WHERE p.medicine_id = medicines.id AND p.supplier_id = $?)"},
+		},
+		rangeFilters("price", FilterMoney, "price"),
+		rangeFilters("quantity", FilterInt, "quantity"),
+		rangeFilters("expiry_date", FilterTime, "expiry_date"),
+	),
+	Sorts: map[string]string{
+		"name":         "name",
+		"category":     "category",
+		"manufacturer": "manufacturer",
+		"price":        "price",
+		"quantity":     "quantity",
+		"expiry_date":  "expiry_date",
+		"created_at":   "created_at",
+		"updated_at":   "updated_at",
+	},
+	DefaultSort: "-created_at",
+}
+
+// SupplierList is the list of suppliers, filtered by the medicines they
+// supplied
+var SupplierList = ListSpec{
+	columns: supplierColumns,
+	from:    `suppliers`,
+	Filters: []Filter{
+		{Param: "medicine_id", Kind: FilterInt, condition: "EXISTS (SELECT 1 FROM purchases p WHERE p.supplier_id = suppliers.id AND p.medicine_id = $?)"},
+	},
+	Sorts: map[string]string{
+		"name":           "name",
+		"contact_person": "contact_person",
+		"created_at":     "created_at",
+		"updated_at":     "updated_at",
+	},
+	DefaultSort: "-created_at",
+}
+
+// PurchaseList is the list of purchases, filtered by medicine, supplier,
+// void status, date, expiry and total
+var PurchaseList = ListSpec{
+	columns: purchaseColumns,
+	from:    `purchases`,
+	Filters: slices.Concat(
+		[]Filter{
+			{Param: "medicine_id", Kind: FilterInt, condition: "medicine_id = $?"},
+			{Param: "supplier_id", Kind: FilterInt, condition: "supplier_id = $?"},
+			{Param: "voided", Kind: FilterBool, condition: "(voided_at IS NOT NULL) = $?"},
+		},
+		rangeFilters("purchase_date", FilterTime, "purchase_date"),
+		rangeFilters("expiry_date", FilterTime, "expiry_date"),
+		rangeFilters("total_price", FilterMoney, "total_price"),
+	),
+	Sorts: map[string]string{
+		"purchase_date": "purchase_date",
+		"expiry_date":   "expiry_date",
+		"quantity":      "quantity",
+		"total_price":   "total_price",
+		"created_at":    "created_at",
+	},
+	DefaultSort: "-purchase_date",
+}
+
+// SaleList is the list of sales (receipt headers without line items),
+// filtered by cashier, medicine sold, receipt number, date and total
+var SaleList = ListSpec{
+	columns: saleColumns,
+	from:    `sales`,
+	Filters: slices.Concat(
+		[]Filter{
+			{Param: "user_id", Kind: FilterInt, condition: "user_id = $?"},
+			{Param: "medicine_id", Kind: FilterInt, condition: "EXISTS (SELECT 1 FROM sale_items si WHERE si.sale_id = sales.id AND si.medicine_id = $?)"},
+			{Param: "receipt_number", Kind: FilterText, condition: "receipt_number = $?"},
+		},
+		rangeFilters("sale_date", FilterTime, "sale_date"),
+		rangeFilters("total", FilterMoney, "total"),
+	),
+	Sorts: map[string]string{
+		"sale_date":  "sale_date",
+		"total":      "total",
+		"created_at": "created_at",
+	},
+	DefaultSort: "-sale_date",
+}
+
+// AuditList is the audit log, filtered by entity, entity ID, user, action,
+// request ID and time
+var AuditList = ListSpec{
+	columns: `id, occurred_at, user_id, username, api_key_id, action, entity, entity_id,
+	          before, after, changes, ip_address, request_id`,
+	from: `audit_log`,
+	Filters: append(
+		[]Filter{
+			{Param: "entity", Kind: FilterText, condition: "entity = $?"},
+			{Param: "entity_id", Kind: FilterInt, condition: "entity_id = $?"},
+			{Param: "user_id", Kind: FilterInt, condition: "user_id = $?"},
+			{Param: "action", Kind: FilterText, condition: "action = $?"},
+			{Param: "request_id", Kind: FilterText, condition: "request_id = $?"},
+		},
+		rangeFilters("occurred_at", FilterTime, "occurred_at")...,
+	),
+	Sorts: map[string]string{
+		"id":          "id",
+		"occurred_at": "occurred_at",
+	},
+	DefaultSort: "-id",
+}
+
+// BatchList is the list of batches, filtered by batch number for recalls,
+// medicine, supplier, stock and expiry
+var BatchList = ListSpec{
+	columns: batchColumns,
+	from:    `medicine_batches`,
+	Filters: append(
+		[]Filter{
+			{Param: "batch_number", Kind: FilterText, condition: "batch_number = $?"},
+			{Param: "medicine_id", Kind: FilterInt, condition: "medicine_id = $?"},
+			{Param: "supplier_id", Kind: FilterInt, condition: "supplier_id = $?"},
+			{Param: "in_stock", Kind: FilterBool, condition: "(quantity > 0) = $?"},
+		},
+		rangeFilters("expiry_date", FilterTime, "expiry_date")...,
+	),
+	Sorts: map[string]string{
+		"batch_number": "batch_number",
+		"expiry_date":  "expiry_date",
+		"quantity":     "quantity",
+		"received_at":  "received_at",
+	},
+	DefaultSort: "expiry_date",
+}
+
+// MovementList is the stock ledger, filtered by medicine, batch, movement
+// type, what caused the movement, user and time
+var MovementList = ListSpec{
+	columns: movementColumns,
+	from:    `stock_movements`,
+	Filters: append(
+		[]Filter{
+			{Param: "medicine_id", Kind: FilterInt, condition: "medicine_id = $?"},
+			{Param: "batch_id", Kind: FilterInt, condition: "batch_id = $?"},
+			{Param: "movement_type", Kind: FilterText, condition: "movement_type = $?"},
+			{Param: "reference_type", Kind: FilterText, condition: "reference_type = $?"},
+			{Param: "user_id", Kind: FilterInt, condition: "user_id = $?"},
+		},
+		rangeFilters("created_at", FilterTime, "created_at")...,
+	),
+	Sorts: map[string]string{
+		"id":         "id",
+		"created_at": "created_at",
+	},
+	DefaultSort: "id",
+}
+
+// AdjustmentList is the list of stock adjustments, filtered by medicine,
+// batch, reason, user and time
+var AdjustmentList = ListSpec{
+	columns: adjustmentColumns,
+	from:    `stock_adjustments`,
+	Filters: append(
+		[]Filter{
+			{Param: "medicine_id", Kind: FilterInt, condition: "medicine_id = $?"},
+			{Param: "batch_id", Kind: FilterInt, condition: "batch_id = $?"},
+			{Param: "reason_code", Kind: FilterText, condition: "reason_code = $?"},
+			{Param: "user_id", Kind: FilterInt, condition: "user_id = $?"},
+		},
+		rangeFilters("created_at", FilterTime, "created_at")...,
+	),
+	Sorts: map[string]string{
+		"created_at": "created_at",
+		"delta":      "delta",
+	},
+	DefaultSort: "-created_at",
+}
+
+// StockTakeList is the list of stock-take sessions without their lines,
+// filtered by status, who opened them and when
+var StockTakeList = ListSpec{
+	columns: stockTakeColumns,
+	from:    `stock_takes`,
+	Filters: append(
+		[]Filter{
+			{Param: "status", Kind: FilterText, condition: "status = $?"},
+			{Param: "created_by", Kind: FilterInt, condition: "created_by = $?"},
+		},
+		rangeFilters("created_at", FilterTime, "created_at")...,
+	),
+	Sorts: map[string]string{
+		"created_at": "created_at",
+		"posted_at":  "posted_at",
+	},
+	DefaultSort: "-created_at",
+}
+
+// UserList is the list of users, filtered by role and whether they are
+// active
+var UserList = ListSpec{
+	columns: userColumns,
+	from:    `users`,
+	Filters: []Filter{
+		{Param: "role", Kind: FilterText, condition: "role = $?"},
+		{Param: "is_active", Kind: FilterBool, condition: "is_active = $?"},
+	},
+	Sorts: map[string]string{
+		"username":   "username",
+		"created_at": "created_at",
+	},
+	DefaultSort: "username",
+}
+
+// APIKeyList is the list of API keys with the usernames they act as,
+// filtered by user and whether they are revoked
+var APIKeyList = ListSpec{
+	columns: `id, name, prefix, user_id, username, scopes,
+	          expires_at, last_used_at, revoked_at, created_by, created_at`,
+	from: `(SELECT ` + apiKeyColumns + ` FROM api_keys k JOIN users u ON u.id = k.user_id) api_keys`,
+	Filters: []Filter{
+		{Param: "user_id", Kind: FilterInt, condition: "user_id = $?"},
+		{Param: "revoked", Kind: FilterBool, condition: "(revoked_at IS NOT NULL) = $?"},
+	},
+	Sorts: map[string]string{
+		"name":         "name",
+		"created_at":   "created_at",
+		"expires_at":   "expires_at",
+		"last_used_at": "last_used_at",
+	},
+	DefaultSort: "-created_at",
+}
@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestListSQL(t *testing.T) {
+	where, args, orderBy := listSQL(MedicineList, ListQuery{Sort: []SortField{{Field: "created_at", Desc: true}}})
+	if len(where) != 0 || len(args) != 0 || orderBy != "created_at DESC, id DESC" {
+		t.Errorf("defaults: %q %v %q", where, args, orderBy)
+	}
+
+	expiry := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+	where, args, orderBy = listSQL(MedicineList, ListQuery{
+		Filters: []FilterValue{
+			{Param: "category", Value: "Painkillers"},
+			{Param: "requires_prescription", Value: false},
+			{Param: "price_min", Value: models.Money(150)},
+			{Param: "expiry_date_to", Value: expiry},
+		},
+		Sort: []SortField{{Field: "name"}, {Field: "price", Desc: true}},
+	})
+	wantWhere := []string{"category = $1", "requires_prescription = $2", "price >= $3", "expiry_date < $4"}
+	if !reflect.DeepEqual(where, wantWhere) {
+		t.Errorf("where = %q, want %q", where, wantWhere)
+	}
+	wantArgs := []any{"Painkillers", false, models.Money(150), expiry}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("args = %v, want %v", args, wantArgs)
+	}
+	if orderBy != "name ASC, price DESC, id ASC" {
+		t.Errorf("orderBy = %q", orderBy)
+	}
+
+	// Sorting by ID needs no tie break
+	if _, _, orderBy = listSQL(AuditList, ListQuery{Sort: []SortField{{Field: "id"}}}); orderBy != "id ASC" {
+		t.Errorf("orderBy = %q", orderBy)
+	}
+}
+
+// TestMemoryListsMatchSpecs checks that the in-memory repositories support
+// every filter and sort of the lists
+func TestMemoryListsMatchSpecs(t *testing.T) {
+	repos := NewMemory()
+	for _, tt := range []struct {
+		spec    ListSpec
+		filters []string
+		sorts   []string
+	}{
+		{MedicineList, slices.Sorted(maps.Keys(repos.Medicines.(*memoryMedicines).list().filters)), slices.Sorted(maps.Keys(repos.Medicines.(*memoryMedicines).list().sorts))},
+		{SupplierList, slices.Sorted(maps.Keys(repos.Suppliers.(*memorySuppliers).list().filters)), slices.Sorted(maps.Keys(repos.Suppliers.(*memorySuppliers).list().sorts))},
+		{PurchaseList, slices.Sorted(maps.Keys(repos.Purchases.(*memoryPurchases).list().filters)), slices.Sorted(maps.Keys(repos.Purchases.(*memoryPurchases).list().sorts))},
+		{SaleList, slices.Sorted(maps.Keys(repos.Sales.(*memorySales).list().filters)), slices.Sorted(maps.Keys(repos.Sales.(*memorySales).list().sorts))},
+		{AuditList, slices.Sorted(maps.Keys(repos.Audit.(*memoryAudit).list().filters)), slices.Sorted(maps.Keys(repos.Audit.(*memoryAudit).list().sorts))},
+		{BatchList, slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).batchList().filters)), slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).batchList().sorts))},
+		{MovementList, slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).movementList().filters)), slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).movementList().sorts))},
+		{AdjustmentList, slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).adjustmentList().filters)), slices.Sorted(maps.Keys(repos.Stock.(*memoryStock).adjustmentList().sorts))},
+		{StockTakeList, slices.Sorted(maps.Keys(repos.StockTakes.(*memoryStockTakes).list().filters)), slices.Sorted(maps.Keys(repos.StockTakes.(*memoryStockTakes).list().sorts))},
+		{UserList, slices.Sorted(maps.Keys(repos.Users.(*memoryUsers).list().filters)), slices.Sorted(maps.Keys(repos.Users.(*memoryUsers).list().sorts))},
+		{APIKeyList, slices.Sorted(maps.Keys(repos.APIKeys.(*memoryAPIKeys).list().filters)), slices.Sorted(maps.Keys(repos.APIKeys.(*memoryAPIKeys).list().sorts))},
+	} {
+		var params []string
+		for _, f := range tt.spec.Filters {
+			params = append(params, f.Param)
+		}
+		if want := slices.Sorted(slices.Values(params)); !reflect.DeepEqual(tt.filters, want) {
+			t.Errorf("%s: memory filters %q, want %q", tt.spec.from, tt.filters, want)
+		}
+		if want := tt.spec.SortFields(); !reflect.DeepEqual(tt.sorts, want) {
+			t.Errorf("%s: memory sorts %q, want %q", tt.spec.from, tt.sorts, want)
+		}
+	}
+}
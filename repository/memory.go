@@ -0,0 +1,398 @@
+package repository
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryStore holds the data of the in-memory repositories. Its mutex is
+// held for the whole of every call, and a change is only applied once it is
+// known to succeed, so every change is atomic as in the database.
+type memoryStore struct {
+	mu     sync.Mutex
+	lastID map[string]int
+
+	medicines map[int]models.Medicine
+	suppliers map[int]models.Supplier
+	batches   map[int]models.MedicineBatch
+	movements []models.StockMovement
+	purchases map[int]models.Purchase
+	// sales hold their line items and the batches they were dispensed from
+	sales       map[int]models.Sale
+	returns     []models.SaleReturn
+	adjustments []models.StockAdjustment
+	// stock takes hold their lines
+	stockTakes []models.StockTake
+	// users hold their password hash
+	users   map[int]models.User
+	apiKeys []models.APIKey
+	audit   []models.AuditEntry
+
+	// what users sign in with, see memoryAuth
+	loginFailures map[memoryLoginCounter]memoryLoginFailure
+	sessions      map[int]memorySession
+	refreshTokens map[string]memoryRefreshToken
+	revokedTokens map[string]time.Time
+	resetTokens   map[string]memoryResetToken
+	mfa           map[int]memoryMFA
+	oidcSubjects  map[int]string
+	oidcRoles     map[int]bool
+	oidcStates    map[string]OIDCState
+	apiKeyHashes  map[int]string
+
+	idempotency map[memoryIdempotencyKey]memoryIdempotencyClaim
+}
+
+// NewMemory returns repositories that keep everything in memory, for tests.
+// They follow the same rules as the Postgres repositories, except that
+// searches only match whole words and prefixes, not misspellings.
+func NewMemory() Repositories {
+	s := &memoryStore{
+		lastID:    map[string]int{},
+		medicines: map[int]models.Medicine{},
+		suppliers: map[int]models.Supplier{},
+		batches:   map[int]models.MedicineBatch{},
+		purchases: map[int]models.Purchase{},
+		sales:     map[int]models.Sale{},
+		users:     map[int]models.User{},
+
+		loginFailures: map[memoryLoginCounter]memoryLoginFailure{},
+		sessions:      map[int]memorySession{},
+		refreshTokens: map[string]memoryRefreshToken{},
+		revokedTokens: map[string]time.Time{},
+		resetTokens:   map[string]memoryResetToken{},
+		mfa:           map[int]memoryMFA{},
+		oidcSubjects:  map[int]string{},
+		oidcRoles:     map[int]bool{},
+		oidcStates:    map[string]OIDCState{},
+		apiKeyHashes:  map[int]string{},
+
+		idempotency: map[memoryIdempotencyKey]memoryIdempotencyClaim{},
+	}
+	return Repositories{
+		Medicines:   &memoryMedicines{s},
+		Suppliers:   &memorySuppliers{s},
+		Purchases:   &memoryPurchases{s},
+		Sales:       &memorySales{s},
+		Stock:       &memoryStock{s},
+		StockTakes:  &memoryStockTakes{s},
+		Users:       &memoryUsers{s},
+		Auth:        &memoryAuth{s},
+		APIKeys:     &memoryAPIKeys{s},
+		Audit:       &memoryAudit{s},
+		Idempotency: &memoryIdempotency{s},
+	}
+}
+
+// nextID returns the next ID of a table, like a SERIAL column
+func (s *memoryStore) nextID(table string) int {
+	s.lastID[table]++
+	return s.lastID[table]
+}
+
+// recordAudit appends an entry to the audit log, like RecordAudit
+func (s *memoryStore) recordAudit(actor Actor, action, entity string, entityID int, before, after any) error {
+	beforeJSON, afterJSON, changesJSON, err := auditValues(before, after)
+	if err != nil {
+		return err
+	}
+
+	entry := models.AuditEntry{
+		ID:         int64(s.nextID("audit_log")),
+		OccurredAt: time.Now(),
+		UserID:     actor.UserID,
+		APIKeyID:   actor.APIKeyID,
+		Action:     action,
+		Entity:     entity,
+		EntityID:   &entityID,
+		Before:     beforeJSON,
+		After:      afterJSON,
+		Changes:    changesJSON,
+		Username:   nullString(actor.Username),
+		IPAddress:  nullString(actor.IP),
+		RequestID:  nullString(actor.RequestID),
+	}
+	s.audit = append(s.audit, entry)
+	return nil
+}
+
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// medicineBatches returns the batches of a medicine with stock, soonest
+// expiry first
+func (s *memoryStore) medicineBatches(medicineID int) []models.MedicineBatch {
+	var batches []models.MedicineBatch
+	for _, b := range s.batches {
+		if b.MedicineID == medicineID && b.Quantity > 0 {
+			batches = append(batches, b)
+		}
+	}
+	slices.SortFunc(batches, func(a, b models.MedicineBatch) int {
+		if c := compareTimes(a.ExpiryDate, b.ExpiryDate); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return batches
+}
+
+// allocateFEFO works out how much to take from the unexpired batches of a
+// medicine that expire soonest, like consumeFEFO does in the database,
+// without changing them. taken is what other lines of the same change
+// already take from batches.
+func (s *memoryStore) allocateFEFO(medicineID, quantity int, taken map[int]int) ([]BatchAllocation, error) {
+	today := time.Now().Truncate(24 * time.Hour)
+
+	var allocations []BatchAllocation
+	remaining := quantity
+	for _, b := range s.medicineBatches(medicineID) {
+		if remaining == 0 {
+			break
+		}
+		if b.ExpiryDate != nil && b.ExpiryDate.Before(today) {
+			continue
+		}
+		available := b.Quantity - taken[b.ID]
+		if available <= 0 {
+			continue
+		}
+		take := min(available, remaining)
+		remaining -= take
+		taken[b.ID] += take
+		allocations = append(allocations, BatchAllocation{
+			BatchID:     b.ID,
+			BatchNumber: b.BatchNumber,
+			ExpiryDate:  b.ExpiryDate,
+			Quantity:    take,
+		})
+	}
+
+	if remaining > 0 {
+		return nil, ErrInsufficientStock
+	}
+	return allocations, nil
+}
+
+// createBatch adds a batch, like createBatch does in the database
+func (s *memoryStore) createBatch(batch *models.MedicineBatch) {
+	now := time.Now()
+	batch.ID = s.nextID("medicine_batches")
+	batch.ReceivedAt = now
+	batch.CreatedAt = now
+	batch.UpdatedAt = now
+	s.batches[batch.ID] = *batch
+}
+
+// changeBatches applies signed quantity changes to batches
+func (s *memoryStore) changeBatches(changes []BatchAllocation) {
+	for _, change := range changes {
+		b := s.batches[change.BatchID]
+		b.Quantity += change.Quantity
+		b.UpdatedAt = time.Now()
+		s.batches[b.ID] = b
+	}
+}
+
+// recordMovements writes one ledger entry per batch change, like
+// recordMovements does in the database. The batches must already be changed.
+func (s *memoryStore) recordMovements(movement models.StockMovement, changes []BatchAllocation) {
+	balance := 0
+	for _, b := range s.batches {
+		if b.MedicineID == movement.MedicineID {
+			balance += b.Quantity
+		}
+	}
+	for _, change := range changes {
+		balance -= change.Quantity
+	}
+
+	for _, change := range changes {
+		balance += change.Quantity
+		m := movement
+		m.ID = s.nextID("stock_movements")
+		m.BatchID = &change.BatchID
+		m.Quantity = change.Quantity
+		m.BalanceAfter = balance
+		m.CreatedAt = time.Now()
+		s.movements = append(s.movements, m)
+	}
+}
+
+// syncMedicineStock recalculates the derived quantity and nearest expiry
+// date of a medicine from its batches, like syncMedicineStock does in the
+// database
+func (s *memoryStore) syncMedicineStock(medicineID int) {
+	m, ok := s.medicines[medicineID]
+	if !ok {
+		return
+	}
+
+	m.Quantity = 0
+	var nearest *time.Time
+	for _, b := range s.batches {
+		if b.MedicineID != medicineID {
+			continue
+		}
+		m.Quantity += b.Quantity
+		if b.Quantity > 0 && b.ExpiryDate != nil && (nearest == nil || b.ExpiryDate.Before(*nearest)) {
+			nearest = b.ExpiryDate
+		}
+	}
+	if nearest != nil {
+		m.ExpiryDate = *nearest
+	}
+	m.UpdatedAt = time.Now()
+	s.medicines[medicineID] = m
+}
+
+// memoryList filters and sorts a list of the in-memory repositories, with a
+// predicate for every filter and a comparison for every sort field of its
+// ListSpec
+type memoryList[T any] struct {
+	filters map[string]func(item T, value any) bool
+	sorts   map[string]func(a, b T) int
+	id      func(T) int
+}
+
+// page returns the page of a list and the number of items in the whole list
+func (l memoryList[T]) page(items []T, q ListQuery) (models.Page[T], error) {
+	page := models.Page[T]{Data: []T{}, Limit: q.Limit, Offset: q.Offset}
+
+	var matched []T
+	for _, item := range items {
+		ok := true
+		for _, value := range q.Filters {
+			match, known := l.filters[value.Param]
+			if !known {
+				return page, fmt.Errorf("unknown filter %s", value.Param)
+			}
+			ok = ok && match(item, value.Value)
+		}
+		if ok {
+			matched = append(matched, item)
+		}
+	}
+
+	desc := len(q.Sort) > 0 && q.Sort[0].Desc
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, field := range q.Sort {
+			c := l.sorts[field.Field](matched[i], matched[j])
+			if field.Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		c := cmp.Compare(l.id(matched[i]), l.id(matched[j]))
+		if desc {
+			c = -c
+		}
+		return c < 0
+	})
+
+	page.Total = len(matched)
+	if q.Offset < len(matched) {
+		page.Data = append(page.Data, matched[q.Offset:min(q.Offset+q.Limit, len(matched))]...)
+	}
+	return page, nil
+}
+
+// equal is a filter matching items whose field equals the value
+func equal[T any, V comparable](field func(T) V) func(T, any) bool {
+	return func(item T, value any) bool {
+		return field(item) == value.(V)
+	}
+}
+
+// valueRange adds the filters of a numeric range, as rangeFilters
+func valueRange[T any, V cmp.Ordered](filters map[string]func(T, any) bool, name string, field func(T) V) {
+	filters[name+"_min"] = func(item T, value any) bool { return field(item) >= value.(V) }
+	filters[name+"_max"] = func(item T, value any) bool { return field(item) <= value.(V) }
+}
+
+// timeRange adds the filters of a time range, as rangeFilters. Items
+// without a time match neither end, like NULL in SQL.
+func timeRange[T any](filters map[string]func(T, any) bool, name string, field func(T) *time.Time) {
+	filters[name+"_from"] = func(item T, value any) bool {
+		t := field(item)
+		return t != nil && !t.Before(value.(time.Time))
+	}
+	filters[name+"_to"] = func(item T, value any) bool {
+		t := field(item)
+		return t != nil && t.Before(value.(time.Time))
+	}
+}
+
+// by compares items by a field
+func by[T any, V cmp.Ordered](field func(T) V) func(a, b T) int {
+	return func(a, b T) int { return cmp.Compare(field(a), field(b)) }
+}
+
+// byTime compares items by a time field
+func byTime[T any](field func(T) *time.Time) func(a, b T) int {
+	return func(a, b T) int { return compareTimes(field(a), field(b)) }
+}
+
+// compareTimes orders times with missing times last, as NULLs are in an
+// ascending ORDER BY
+func compareTimes(a, b *time.Time) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+	return a.Compare(*b)
+}
+
+// memoryAudit reads the audit log of the in-memory repositories
+type memoryAudit struct {
+	s *memoryStore
+}
+
+func (r *memoryAudit) list() memoryList[models.AuditEntry] {
+	filters := map[string]func(models.AuditEntry, any) bool{
+		"entity": equal(func(e models.AuditEntry) string { return e.Entity }),
+		"action": equal(func(e models.AuditEntry) string { return e.Action }),
+		"entity_id": func(e models.AuditEntry, value any) bool {
+			return e.EntityID != nil && *e.EntityID == value.(int)
+		},
+		"user_id": func(e models.AuditEntry, value any) bool {
+			return e.UserID != nil && *e.UserID == value.(int)
+		},
+		"request_id": func(e models.AuditEntry, value any) bool {
+			return e.RequestID != nil && *e.RequestID == value.(string)
+		},
+	}
+	timeRange(filters, "occurred_at", func(e models.AuditEntry) *time.Time { return &e.OccurredAt })
+
+	return memoryList[models.AuditEntry]{
+		filters: filters,
+		sorts: map[string]func(a, b models.AuditEntry) int{
+			"id":          by(func(e models.AuditEntry) int64 { return e.ID }),
+			"occurred_at": byTime(func(e models.AuditEntry) *time.Time { return &e.OccurredAt }),
+		},
+		id: func(e models.AuditEntry) int { return int(e.ID) },
+	}
+}
+
+func (r *memoryAudit) List(q ListQuery) (models.Page[models.AuditEntry], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.list().page(r.s.audit, q)
+}
@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"slices"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryAPIKeys stores API keys in memory, with their hashes kept apart for
+// memoryAuth to authenticate against
+type memoryAPIKeys struct {
+	s *memoryStore
+}
+
+func (r *memoryAPIKeys) list() memoryList[models.APIKey] {
+	return memoryList[models.APIKey]{
+		filters: map[string]func(models.APIKey, any) bool{
+			"user_id": equal(func(k models.APIKey) int { return k.UserID }),
+			"revoked": equal(func(k models.APIKey) bool { return k.RevokedAt != nil }),
+		},
+		sorts: map[string]func(a, b models.APIKey) int{
+			"name":         by(func(k models.APIKey) string { return k.Name }),
+			"created_at":   byTime(func(k models.APIKey) *time.Time { return &k.CreatedAt }),
+			"expires_at":   byTime(func(k models.APIKey) *time.Time { return k.ExpiresAt }),
+			"last_used_at": byTime(func(k models.APIKey) *time.Time { return k.LastUsedAt }),
+		},
+		id: func(k models.APIKey) int { return k.ID },
+	}
+}
+
+func (r *memoryAPIKeys) List(q ListQuery) (models.Page[models.APIKey], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.list().page(r.s.apiKeys, q)
+}
+
+func (r *memoryAPIKeys) Create(actor Actor, key models.APIKey, keyHash string) (models.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.users[key.UserID]; !ok {
+		return models.APIKey{}, ErrNotFound
+	}
+
+	apiKey := models.APIKey{
+		ID:        r.s.nextID("api_keys"),
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		UserID:    key.UserID,
+		Username:  key.Username,
+		Scopes:    slices.Clone(key.Scopes),
+		ExpiresAt: key.ExpiresAt,
+		CreatedBy: actor.UserID,
+		CreatedAt: time.Now(),
+	}
+	r.s.apiKeys = append(r.s.apiKeys, apiKey)
+	r.s.apiKeyHashes[apiKey.ID] = keyHash
+
+	return apiKey, r.s.recordAudit(actor, AuditCreate, "api_key", apiKey.ID, nil, apiKey)
+}
+
+func (r *memoryAPIKeys) Revoke(actor Actor, id int) (models.APIKey, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i := slices.IndexFunc(r.s.apiKeys, func(k models.APIKey) bool { return k.ID == id })
+	if i < 0 {
+		return models.APIKey{}, ErrNotFound
+	}
+
+	before := r.s.apiKeys[i]
+	if before.RevokedAt == nil {
+		now := time.Now()
+		r.s.apiKeys[i].RevokedAt = &now
+	}
+	after := r.s.apiKeys[i]
+
+	return after, r.s.recordAudit(actor, AuditRevoke, "api_key", id, before, after)
+}
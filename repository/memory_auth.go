@@ -0,0 +1,598 @@
+package repository
+
+import (
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/oidc"
+)
+
+// memoryAuth stores what users sign in with in memory
+type memoryAuth struct {
+	s *memoryStore
+}
+
+// memoryLoginCounter identifies a failed login counter of a username or IP
+type memoryLoginCounter struct {
+	kind string
+	key  string
+}
+
+type memoryLoginFailure struct {
+	failures      int
+	lastFailureAt time.Time
+	lockedUntil   time.Time
+}
+
+type memorySession struct {
+	userID    int
+	expiresAt time.Time
+	revoked   bool
+}
+
+type memoryRefreshToken struct {
+	sessionID int
+	used      bool
+}
+
+type memoryResetToken struct {
+	userID    int
+	expiresAt time.Time
+	used      bool
+}
+
+// memoryMFA is the TOTP secret of a user, who may not have enabled it yet,
+// and their recovery codes by hash, true once used
+type memoryMFA struct {
+	secret        string
+	lastStep      *int64
+	recoveryCodes map[string]bool
+}
+
+func (r *memoryAuth) User(id int) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, ok := r.s.users[id]
+	if !ok {
+		return user, ErrNotFound
+	}
+	return user, nil
+}
+
+func (r *memoryAuth) UserByUsername(username string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	for _, user := range r.s.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *memoryAuth) Register(actor Actor, username, email, passwordHash, role string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if err := r.s.checkUserUnique(username, email); err != nil {
+		return models.User{}, err
+	}
+
+	now := time.Now()
+	user := models.User{
+		ID:           r.s.nextID("users"),
+		Username:     username,
+		Email:        email,
+		PasswordHash: passwordHash,
+		Role:         role,
+		IsActive:     true,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	r.s.users[user.ID] = user
+
+	return user, r.s.recordAudit(actor.as(user), AuditRegister, "user", user.ID, nil, user)
+}
+
+func (r *memoryAuth) LoginLockedUntil(username, ip string) (time.Time, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	lockedUntil := r.s.loginFailures[memoryLoginCounter{LoginFailureUsername, username}].lockedUntil
+	if ipLockedUntil := r.s.loginFailures[memoryLoginCounter{LoginFailureIP, ip}].lockedUntil; ipLockedUntil.After(lockedUntil) {
+		lockedUntil = ipLockedUntil
+	}
+	if lockedUntil.Before(time.Now()) {
+		return time.Time{}, nil
+	}
+	return lockedUntil, nil
+}
+
+func (r *memoryAuth) RecordLoginFailure(kind, key string, since time.Time) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	counter := memoryLoginCounter{kind, key}
+	failure, ok := r.s.loginFailures[counter]
+	if ok && !failure.lastFailureAt.Before(since) {
+		failure.failures++
+	} else {
+		failure.failures = 1
+	}
+	failure.lastFailureAt = time.Now()
+	r.s.loginFailures[counter] = failure
+
+	return failure.failures, nil
+}
+
+func (r *memoryAuth) LockLogin(kind, key string, until time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	counter := memoryLoginCounter{kind, key}
+	if failure, ok := r.s.loginFailures[counter]; ok {
+		failure.lockedUntil = until
+		r.s.loginFailures[counter] = failure
+	}
+	return nil
+}
+
+func (r *memoryAuth) ClearLoginFailures(username string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.loginFailures, memoryLoginCounter{LoginFailureUsername, username})
+	return nil
+}
+
+func (r *memoryAuth) StartSession(userID int, userAgent, ip string, expiresAt time.Time, refreshTokenHash string) (int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sessionID := r.s.nextID("auth_sessions")
+	r.s.sessions[sessionID] = memorySession{userID: userID, expiresAt: expiresAt}
+	r.s.refreshTokens[refreshTokenHash] = memoryRefreshToken{sessionID: sessionID}
+	return sessionID, nil
+}
+
+func (r *memoryAuth) Refresh(actor Actor, tokenHash, newTokenHash string) (models.User, int, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	token, ok := r.s.refreshTokens[tokenHash]
+	if !ok {
+		return models.User{}, 0, ErrInvalidToken
+	}
+	session := r.s.sessions[token.sessionID]
+	user := r.s.users[session.userID]
+
+	if token.used {
+		// Reuse of a rotated token revokes the session
+		if !session.revoked {
+			session.revoked = true
+			r.s.sessions[token.sessionID] = session
+			if err := r.s.recordAudit(actor.as(user), AuditRevoke, "session", token.sessionID, nil, nil); err != nil {
+				return user, 0, err
+			}
+		}
+		return user, token.sessionID, ErrTokenReused
+	}
+	if session.revoked || time.Now().After(session.expiresAt) {
+		return user, token.sessionID, ErrSessionEnded
+	}
+	if !user.IsActive {
+		return user, token.sessionID, ErrUserInactive
+	}
+
+	token.used = true
+	r.s.refreshTokens[tokenHash] = token
+	r.s.refreshTokens[newTokenHash] = memoryRefreshToken{sessionID: token.sessionID}
+	return user, token.sessionID, nil
+}
+
+func (r *memoryAuth) Session(userID, sessionID int, tokenID string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	session, ok := r.s.sessions[sessionID]
+	if !ok || session.userID != userID || session.revoked {
+		return models.User{}, ErrSessionEnded
+	}
+	if _, revoked := r.s.revokedTokens[tokenID]; revoked {
+		return models.User{}, ErrSessionEnded
+	}
+	user, ok := r.s.users[userID]
+	if !ok {
+		return user, ErrSessionEnded
+	}
+	return user, nil
+}
+
+func (r *memoryAuth) Logout(actor Actor, sessionID int, tokenID string, tokenExpiresAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.s.revokeToken(tokenID, tokenExpiresAt)
+	if session, ok := r.s.sessions[sessionID]; ok {
+		session.revoked = true
+		r.s.sessions[sessionID] = session
+	}
+	return r.s.recordAudit(actor, AuditLogout, "session", sessionID, nil, nil)
+}
+
+func (r *memoryAuth) LogoutAll(actor Actor, tokenID string, tokenExpiresAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.s.revokeToken(tokenID, tokenExpiresAt)
+	r.s.revokeUserSessions(*actor.UserID, 0)
+	return r.s.recordAudit(actor, AuditLogoutAll, "user", *actor.UserID, nil, nil)
+}
+
+// revokeToken rejects an access token until it expires, and forgets revoked
+// tokens that have expired
+func (s *memoryStore) revokeToken(tokenID string, expiresAt time.Time) {
+	now := time.Now()
+	for id, tokenExpiresAt := range s.revokedTokens {
+		if tokenExpiresAt.Before(now) {
+			delete(s.revokedTokens, id)
+		}
+	}
+	if tokenID != "" {
+		s.revokedTokens[tokenID] = expiresAt
+	}
+}
+
+// revokeUserSessions ends every session of a user other than keepSessionID
+func (s *memoryStore) revokeUserSessions(userID, keepSessionID int) {
+	for id, session := range s.sessions {
+		if session.userID == userID && id != keepSessionID {
+			session.revoked = true
+			s.sessions[id] = session
+		}
+	}
+}
+
+func (r *memoryAuth) ChangePassword(actor Actor, userID, keepSessionID int, passwordHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, ok := r.s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	user.PasswordHash = passwordHash
+	user.UpdatedAt = time.Now()
+	r.s.users[userID] = user
+
+	// Keep the session used for the change, end the others
+	r.s.revokeUserSessions(userID, keepSessionID)
+	return r.s.recordAudit(actor, AuditPasswordChange, "user", userID, nil, nil)
+}
+
+func (r *memoryAuth) PasswordResetUser(email string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// Users of the identity provider have no local password to reset
+	for _, user := range r.s.users {
+		if _, linked := r.s.oidcSubjects[user.ID]; user.Email == email && user.IsActive && !linked {
+			return user, nil
+		}
+	}
+	return models.User{}, ErrNotFound
+}
+
+func (r *memoryAuth) CreateResetToken(userID int, tokenHash string, expiresAt time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	r.s.createResetToken(userID, tokenHash, expiresAt)
+	return nil
+}
+
+// createResetToken gives a user a password reset token in place of any
+// earlier one
+func (s *memoryStore) createResetToken(userID int, tokenHash string, expiresAt time.Time) {
+	for hash, token := range s.resetTokens {
+		if token.userID == userID {
+			token.used = true
+			s.resetTokens[hash] = token
+		}
+	}
+	s.resetTokens[tokenHash] = memoryResetToken{userID: userID, expiresAt: expiresAt}
+}
+
+// resetTokenUser returns the active user a valid password reset token is for
+func (s *memoryStore) resetTokenUser(tokenHash string) (models.User, error) {
+	token, ok := s.resetTokens[tokenHash]
+	if !ok || token.used || !token.expiresAt.After(time.Now()) {
+		return models.User{}, ErrInvalidToken
+	}
+	user, ok := s.users[token.userID]
+	if !ok || !user.IsActive {
+		return models.User{}, ErrInvalidToken
+	}
+	return user, nil
+}
+
+func (r *memoryAuth) ResetTokenUser(tokenHash string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.resetTokenUser(tokenHash)
+}
+
+func (r *memoryAuth) ResetPassword(actor Actor, tokenHash, passwordHash string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, err := r.s.resetTokenUser(tokenHash)
+	if err != nil {
+		return user, err
+	}
+
+	user.PasswordHash = passwordHash
+	user.UpdatedAt = time.Now()
+	r.s.users[user.ID] = user
+
+	token := r.s.resetTokens[tokenHash]
+	token.used = true
+	r.s.resetTokens[tokenHash] = token
+
+	r.s.revokeUserSessions(user.ID, 0)
+
+	// Proving ownership of the account lifts a lockout of the username
+	delete(r.s.loginFailures, memoryLoginCounter{LoginFailureUsername, user.Username})
+
+	return user, r.s.recordAudit(actor.as(user), AuditPasswordReset, "user", user.ID, nil, nil)
+}
+
+func (r *memoryAuth) SetMFASecret(userID int, secret string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, ok := r.s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	if user.TOTPEnabled {
+		return ErrMFAEnabled
+	}
+	r.s.mfa[userID] = memoryMFA{secret: secret}
+	return nil
+}
+
+func (r *memoryAuth) EnableMFA(actor Actor, userID int, code string, recoveryCodeHashes []string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, ok := r.s.users[userID]
+	if !ok {
+		return user, ErrNotFound
+	}
+	if user.TOTPEnabled {
+		return user, ErrMFAEnabled
+	}
+	mfa, ok := r.s.mfa[userID]
+	if !ok {
+		return user, ErrMFANotSetUp
+	}
+
+	step, valid := acceptTOTP(mfa.secret, nil, code)
+	if !valid {
+		return user, ErrInvalidCode
+	}
+
+	user.TOTPEnabled = true
+	user.UpdatedAt = time.Now()
+	r.s.users[userID] = user
+	mfa.lastStep = &step
+	mfa.recoveryCodes = recoveryCodes(recoveryCodeHashes)
+	r.s.mfa[userID] = mfa
+
+	return user, r.s.recordAudit(actor, AuditMFAEnable, "user", userID, nil, nil)
+}
+
+// recoveryCodes returns unused recovery codes by their hashes
+func recoveryCodes(codeHashes []string) map[string]bool {
+	codes := make(map[string]bool, len(codeHashes))
+	for _, codeHash := range codeHashes {
+		codes[codeHash] = false
+	}
+	return codes
+}
+
+// useTOTP checks a code against the enabled TOTP secret of a user, like
+// useTOTP in the database
+func (s *memoryStore) useTOTP(userID int, code string) error {
+	user, ok := s.users[userID]
+	if !ok {
+		return ErrNotFound
+	}
+	mfa, ok := s.mfa[userID]
+	if !user.TOTPEnabled || !ok {
+		return ErrMFANotEnabled
+	}
+
+	step, valid := acceptTOTP(mfa.secret, mfa.lastStep, code)
+	if !valid {
+		return ErrInvalidCode
+	}
+	mfa.lastStep = &step
+	s.mfa[userID] = mfa
+	return nil
+}
+
+func (r *memoryAuth) UseMFACode(userID int, code string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.useTOTP(userID, code)
+}
+
+func (r *memoryAuth) UseRecoveryCode(userID int, codeHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	mfa := r.s.mfa[userID]
+	if used, ok := mfa.recoveryCodes[codeHash]; !ok || used {
+		return ErrInvalidCode
+	}
+	mfa.recoveryCodes[codeHash] = true
+	return nil
+}
+
+func (r *memoryAuth) ReplaceRecoveryCodes(actor Actor, userID int, code string, recoveryCodeHashes []string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if err := r.s.useTOTP(userID, code); err != nil {
+		return err
+	}
+
+	mfa := r.s.mfa[userID]
+	mfa.recoveryCodes = recoveryCodes(recoveryCodeHashes)
+	r.s.mfa[userID] = mfa
+	return r.s.recordAudit(actor, AuditMFARecoveryRegenerate, "user", userID, nil, nil)
+}
+
+func (r *memoryAuth) DisableMFA(actor Actor, userID int, code string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if err := r.s.useTOTP(userID, code); err != nil {
+		return err
+	}
+
+	r.s.removeMFA(userID)
+	return r.s.recordAudit(actor, AuditMFADisable, "user", userID, nil, nil)
+}
+
+// removeMFA turns off two-factor authentication for a user
+func (s *memoryStore) removeMFA(userID int) {
+	user := s.users[userID]
+	user.TOTPEnabled = false
+	user.UpdatedAt = time.Now()
+	s.users[userID] = user
+	delete(s.mfa, userID)
+}
+
+func (r *memoryAuth) SaveOIDCState(stateHash string, state OIDCState) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// Abandoned logins are cleaned up as new ones start
+	now := time.Now()
+	for hash, saved := range r.s.oidcStates {
+		if saved.ExpiresAt.Before(now) {
+			delete(r.s.oidcStates, hash)
+		}
+	}
+	r.s.oidcStates[stateHash] = state
+	return nil
+}
+
+func (r *memoryAuth) TakeOIDCState(stateHash string) (OIDCState, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	state, ok := r.s.oidcStates[stateHash]
+	delete(r.s.oidcStates, stateHash)
+	if !ok || state.ExpiresAt.Before(time.Now()) {
+		return state, ErrInvalidToken
+	}
+	return state, nil
+}
+
+func (r *memoryAuth) LinkOIDCUser(actor Actor, identity oidc.Identity, role string) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// Users are matched by subject, then by verified email
+	userID := 0
+	for id, subject := range r.s.oidcSubjects {
+		if subject == identity.Subject {
+			userID = id
+		}
+	}
+	if userID == 0 && identity.Email != "" && identity.EmailVerified {
+		for id, user := range r.s.users {
+			if _, linked := r.s.oidcSubjects[id]; user.Email == identity.Email && !linked {
+				userID = id
+			}
+		}
+	}
+
+	now := time.Now()
+	if userID != 0 {
+		user := r.s.users[userID]
+		before := user
+		action := AuditRoleChange
+		if _, linked := r.s.oidcSubjects[userID]; !linked {
+			// A linked account keeps the role it was given here
+			action = AuditOIDCLink
+			r.s.oidcSubjects[userID] = identity.Subject
+		} else if !r.s.oidcRoles[userID] || user.Role == role {
+			// Only users the identity provider created take their role from it
+			return user, nil
+		} else {
+			user.Role = role
+		}
+
+		user.UpdatedAt = now
+		r.s.users[userID] = user
+		return user, r.s.recordAudit(actor.as(user), action, "user", userID, before, user)
+	}
+
+	if identity.Email == "" {
+		return models.User{}, errors.New("identity provider did not supply an email")
+	}
+	username := oidcUsername(identity)
+	for _, user := range r.s.users {
+		if user.Username == username {
+			return models.User{}, ErrUsernameTaken
+		}
+	}
+
+	user := models.User{
+		ID:        r.s.nextID("users"),
+		Username:  username,
+		Email:     identity.Email,
+		Role:      role,
+		IsActive:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	r.s.users[user.ID] = user
+	r.s.oidcSubjects[user.ID] = identity.Subject
+	r.s.oidcRoles[user.ID] = true
+	return user, r.s.recordAudit(actor.as(user), AuditCreate, "user", user.ID, nil, user)
+}
+
+func (r *memoryAuth) APIKey(prefix string) (APIKeyCredentials, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i := slices.IndexFunc(r.s.apiKeys, func(k models.APIKey) bool { return k.Prefix == prefix })
+	if i < 0 {
+		return APIKeyCredentials{}, ErrNotFound
+	}
+	key := r.s.apiKeys[i]
+	return APIKeyCredentials{Key: key, KeyHash: r.s.apiKeyHashes[key.ID], User: r.s.users[key.UserID]}, nil
+}
+
+func (r *memoryAuth) RecordAPIKeyUse(id int, at, since time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i := slices.IndexFunc(r.s.apiKeys, func(k models.APIKey) bool { return k.ID == id })
+	if i >= 0 && (r.s.apiKeys[i].LastUsedAt == nil || r.s.apiKeys[i].LastUsedAt.Before(since)) {
+		r.s.apiKeys[i].LastUsedAt = &at
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package repository
+
+import "time"
+
+// memoryIdempotencyKey identifies a claim on an idempotency key
+type memoryIdempotencyKey struct {
+	userID int
+	key    string
+}
+
+type memoryIdempotencyClaim struct {
+	IdempotencyClaim
+	expiresAt time.Time
+}
+
+// memoryIdempotency stores idempotency keys in memory
+type memoryIdempotency struct {
+	s *memoryStore
+}
+
+func (r *memoryIdempotency) Claim(userID int, key, requestHash string, expiresAt time.Time) (*IdempotencyClaim, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	id := memoryIdempotencyKey{userID, key}
+	if claim, ok := r.s.idempotency[id]; ok && !claim.expiresAt.Before(time.Now()) {
+		existing := claim.IdempotencyClaim
+		return &existing, nil
+	}
+	r.s.idempotency[id] = memoryIdempotencyClaim{
+		IdempotencyClaim: IdempotencyClaim{RequestHash: requestHash},
+		expiresAt:        expiresAt,
+	}
+	return nil, nil
+}
+
+func (r *memoryIdempotency) Complete(userID int, key string, response IdempotentResponse) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	id := memoryIdempotencyKey{userID, key}
+	claim, ok := r.s.idempotency[id]
+	if !ok {
+		return nil
+	}
+	response.Body = append([]byte(nil), response.Body...)
+	claim.Response = &response
+	r.s.idempotency[id] = claim
+	return nil
+}
+
+func (r *memoryIdempotency) Release(userID int, key string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	delete(r.s.idempotency, memoryIdempotencyKey{userID, key})
+	return nil
+}
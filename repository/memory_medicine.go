@@ -0,0 +1,309 @@
+package repository
+
+import (
+	"html"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryMedicines stores medicines in memory
+type memoryMedicines struct {
+	s *memoryStore
+}
+
+func (r *memoryMedicines) list() memoryList[models.Medicine] {
+	filters := map[string]func(models.Medicine, any) bool{
+		"category":              equal(func(m models.Medicine) string { return m.Category }),
+		"manufacturer":          equal(func(m models.Medicine) string { return m.Manufacturer }),
+		"requires_prescription": equal(func(m models.Medicine) bool { return m.RequiresPrescription }),
+		"supplier_id": func(m models.Medicine, value any) bool {
+			for _, p := range r.s.purchases {
+				if p.MedicineID == m.ID && p.SupplierID == value.(int) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	valueRange(filters, "price", func(m models.Medicine) models.Money { return m.Price })
+	valueRange(filters, "quantity", func(m models.Medicine) int { return m.Quantity })
+	timeRange(filters, "expiry_date", func(m models.Medicine) *time.Time { return &m.ExpiryDate })
+
+	return memoryList[models.Medicine]{
+		filters: filters,
+		sorts: map[string]func(a, b models.Medicine) int{
+			"name":         by(func(m models.Medicine) string { return m.Name }),
+			"category":     by(func(m models.Medicine) string { return m.Category }),
+			"manufacturer": by(func(m models.Medicine) string { return m.Manufacturer }),
+			"price":        by(func(m models.Medicine) models.Money { return m.Price }),
+			"quantity":     by(func(m models.Medicine) int { return m.Quantity }),
+			"expiry_date":  byTime(func(m models.Medicine) *time.Time { return &m.ExpiryDate }),
+			"created_at":   byTime(func(m models.Medicine) *time.Time { return &m.CreatedAt }),
+			"updated_at":   byTime(func(m models.Medicine) *time.Time { return &m.UpdatedAt }),
+		},
+		id: func(m models.Medicine) int { return m.ID },
+	}
+}
+
+func (r *memoryMedicines) List(q ListQuery) (models.Page[models.Medicine], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	medicines := make([]models.Medicine, 0, len(r.s.medicines))
+	for _, m := range r.s.medicines {
+		medicines = append(medicines, m)
+	}
+	return r.list().page(medicines, q)
+}
+
+func (r *memoryMedicines) Get(id int) (models.Medicine, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	medicine, ok := r.s.medicines[id]
+	if !ok {
+		return medicine, ErrNotFound
+	}
+	return medicine, nil
+}
+
+// Search matches every word of the search in the name, manufacturer,
+// category or description, the last word as a prefix. Matches in the name
+// rank highest, then the manufacturer and category, then the description,
+// as the weights of the search document in the database.
+func (r *memoryMedicines) Search(search string, limit int) ([]models.MedicineSearchResult, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	words := SearchWords(search)
+	results := []models.MedicineSearchResult{}
+	for _, m := range r.s.medicines {
+		fields := []struct {
+			name   string
+			text   string
+			weight float64
+		}{
+			{"name", m.Name, 1},
+			{"manufacturer", m.Manufacturer, 0.4},
+			{"category", m.Category, 0.4},
+			{"description", m.Description, 0.2},
+		}
+
+		result := models.MedicineSearchResult{Medicine: m, Highlights: map[string]string{}}
+		matchedAll := len(words) > 0
+		for i, word := range words {
+			prefix := i == len(words)-1
+			matched := false
+			for _, field := range fields {
+				if slices.ContainsFunc(SearchWords(field.text), func(w string) bool { return wordMatches(w, word, prefix) }) {
+					matched = true
+					result.Rank += field.weight
+				}
+			}
+			matchedAll = matchedAll && matched
+		}
+		if !matchedAll {
+			continue
+		}
+
+		for _, field := range fields {
+			if marked := markWords(field.text, words); marked != "" {
+				result.Highlights[field.name] = marked
+			}
+		}
+		results = append(results, result)
+	}
+
+	slices.SortFunc(results, func(a, b models.MedicineSearchResult) int {
+		switch {
+		case a.Rank != b.Rank && a.Rank > b.Rank:
+			return -1
+		case a.Rank != b.Rank:
+			return 1
+		case a.Name != b.Name:
+			return strings.Compare(a.Name, b.Name)
+		}
+		return a.ID - b.ID
+	})
+	return results[:min(limit, len(results))], nil
+}
+
+// wordMatches reports whether a word of a text matches a word of a search
+func wordMatches(textWord, searchWord string, prefix bool) bool {
+	if prefix {
+		return strings.HasPrefix(textWord, searchWord)
+	}
+	return textWord == searchWord
+}
+
+// markWords puts <mark> tags around the words of a text that match a
+// search, escaping the rest of the text. It is empty if nothing matched.
+func markWords(text string, words []string) string {
+	var b strings.Builder
+	marked := false
+	last := 0
+	for _, loc := range searchWord.FindAllStringIndex(text, -1) {
+		word := strings.ToLower(text[loc[0]:loc[1]])
+		matches := false
+		for i, w := range words {
+			matches = matches || wordMatches(word, w, i == len(words)-1)
+		}
+		if !matches {
+			continue
+		}
+		b.WriteString(html.EscapeString(text[last:loc[0]]))
+		b.WriteString("<mark>" + html.EscapeString(text[loc[0]:loc[1]]) + "</mark>")
+		last = loc[1]
+		marked = true
+	}
+	if !marked {
+		return ""
+	}
+	b.WriteString(html.EscapeString(text[last:]))
+	return b.String()
+}
+
+func (r *memoryMedicines) Create(actor Actor, req models.CreateMedicineRequest) (models.Medicine, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	medicine := models.Medicine{
+		ID:                   r.s.nextID("medicines"),
+		Name:                 req.Name,
+		Description:          req.Description,
+		Manufacturer:         req.Manufacturer,
+		Price:                req.Price,
+		ExpiryDate:           req.ExpiryDate,
+		Category:             req.Category,
+		RequiresPrescription: req.RequiresPrescription,
+		CreatedAt:            now,
+		UpdatedAt:            now,
+		Version:              1,
+	}
+	r.s.medicines[medicine.ID] = medicine
+
+	// Opening stock is recorded as its own batch
+	if req.Quantity > 0 {
+		batchNumber := req.BatchNumber
+		if batchNumber == "" {
+			batchNumber = "OPENING-" + strconv.Itoa(medicine.ID)
+		}
+		batch := models.MedicineBatch{
+			MedicineID:  medicine.ID,
+			BatchNumber: batchNumber,
+			Quantity:    req.Quantity,
+		}
+		if !req.ExpiryDate.IsZero() {
+			batch.ExpiryDate = &req.ExpiryDate
+		}
+		r.s.createBatch(&batch)
+		r.s.recordMovements(models.StockMovement{
+			MedicineID:    medicine.ID,
+			MovementType:  models.MovementInbound,
+			UserID:        actor.UserID,
+			Reason:        "Opening stock",
+			ReferenceType: "medicine",
+			ReferenceID:   &medicine.ID,
+		}, []BatchAllocation{{BatchID: batch.ID, Quantity: batch.Quantity}})
+		r.s.syncMedicineStock(medicine.ID)
+		medicine = r.s.medicines[medicine.ID]
+	}
+
+	return medicine, r.s.recordAudit(actor, AuditCreate, "medicine", medicine.ID, nil, medicine)
+}
+
+func (r *memoryMedicines) Update(actor Actor, id, version int, req models.UpdateMedicineRequest) (models.Medicine, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before, ok := r.s.medicines[id]
+	if !ok {
+		return before, ErrNotFound
+	}
+	if version != 0 && before.Version != version {
+		return before, ErrVersionMismatch
+	}
+
+	medicine := before
+	if req.Name != nil {
+		medicine.Name = *req.Name
+	}
+	if req.Description != nil {
+		medicine.Description = *req.Description
+	}
+	if req.Manufacturer != nil {
+		medicine.Manufacturer = *req.Manufacturer
+	}
+	if req.Price != nil {
+		medicine.Price = *req.Price
+	}
+	if req.Category != nil {
+		medicine.Category = *req.Category
+	}
+	if req.RequiresPrescription != nil {
+		medicine.RequiresPrescription = *req.RequiresPrescription
+	}
+	medicine.UpdatedAt = time.Now()
+	medicine.Version++
+	r.s.medicines[id] = medicine
+
+	return medicine, r.s.recordAudit(actor, AuditUpdate, "medicine", id, before, medicine)
+}
+
+// Delete removes a medicine with its batches, purchases, sale lines and
+// ledger, as the foreign keys of the database cascade
+func (r *memoryMedicines) Delete(actor Actor, id, version int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before, ok := r.s.medicines[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && before.Version != version {
+		return ErrVersionMismatch
+	}
+
+	if r.s.medicineInUse(id) {
+		return ErrInUse
+	}
+	delete(r.s.medicines, id)
+
+	return r.s.recordAudit(actor, AuditDelete, "medicine", id, before, nil)
+}
+
+// medicineInUse reports whether the stock, purchase or sales history of a
+// medicine refers to it, like the foreign keys that keep it from being
+// deleted in the database
+func (s *memoryStore) medicineInUse(id int) bool {
+	for _, b := range s.batches {
+		if b.MedicineID == id {
+			return true
+		}
+	}
+	for _, p := range s.purchases {
+		if p.MedicineID == id {
+			return true
+		}
+	}
+	for _, sale := range s.sales {
+		if slices.ContainsFunc(sale.Items, func(item models.SaleItem) bool { return item.MedicineID == id }) {
+			return true
+		}
+	}
+	if slices.ContainsFunc(s.movements, func(m models.StockMovement) bool { return m.MedicineID == id }) ||
+		slices.ContainsFunc(s.adjustments, func(a models.StockAdjustment) bool { return a.MedicineID == id }) {
+		return true
+	}
+	for _, st := range s.stockTakes {
+		if slices.ContainsFunc(st.Lines, func(l models.StockTakeLine) bool { return l.MedicineID == id }) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryPurchases stores purchases in memory
+type memoryPurchases struct {
+	s *memoryStore
+}
+
+func (r *memoryPurchases) list() memoryList[models.Purchase] {
+	filters := map[string]func(models.Purchase, any) bool{
+		"medicine_id": equal(func(p models.Purchase) int { return p.MedicineID }),
+		"supplier_id": equal(func(p models.Purchase) int { return p.SupplierID }),
+		"voided":      equal(func(p models.Purchase) bool { return p.VoidedAt != nil }),
+	}
+	timeRange(filters, "purchase_date", func(p models.Purchase) *time.Time { return &p.PurchaseDate })
+	timeRange(filters, "expiry_date", func(p models.Purchase) *time.Time { return p.ExpiryDate })
+	valueRange(filters, "total_price", func(p models.Purchase) models.Money { return p.TotalPrice })
+
+	return memoryList[models.Purchase]{
+		filters: filters,
+		sorts: map[string]func(a, b models.Purchase) int{
+			"purchase_date": byTime(func(p models.Purchase) *time.Time { return &p.PurchaseDate }),
+			"expiry_date":   byTime(func(p models.Purchase) *time.Time { return p.ExpiryDate }),
+			"quantity":      by(func(p models.Purchase) int { return p.Quantity }),
+			"total_price":   by(func(p models.Purchase) models.Money { return p.TotalPrice }),
+			"created_at":    byTime(func(p models.Purchase) *time.Time { return &p.CreatedAt }),
+		},
+		id: func(p models.Purchase) int { return p.ID },
+	}
+}
+
+func (r *memoryPurchases) List(q ListQuery) (models.Page[models.Purchase], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	purchases := make([]models.Purchase, 0, len(r.s.purchases))
+	for _, p := range r.s.purchases {
+		purchases = append(purchases, p)
+	}
+	return r.list().page(purchases, q)
+}
+
+func (r *memoryPurchases) Get(id int) (models.Purchase, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	purchase, ok := r.s.purchases[id]
+	if !ok {
+		return purchase, ErrNotFound
+	}
+
+	// Attach the batch received with this purchase, if it still exists
+	if batch, ok := r.s.purchaseBatch(id); ok {
+		purchase.Batch = &batch
+	}
+	return purchase, nil
+}
+
+// purchaseBatch returns the batch received with a purchase
+func (s *memoryStore) purchaseBatch(purchaseID int) (models.MedicineBatch, bool) {
+	for _, b := range s.batches {
+		if b.PurchaseID != nil && *b.PurchaseID == purchaseID {
+			return b, true
+		}
+	}
+	return models.MedicineBatch{}, false
+}
+
+func (r *memoryPurchases) Create(actor Actor, req models.CreatePurchaseRequest) (models.Purchase, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.medicines[req.MedicineID]; !ok {
+		return models.Purchase{}, &MedicineError{MedicineID: req.MedicineID, Err: ErrNotFound}
+	}
+	if _, ok := r.s.suppliers[req.SupplierID]; !ok {
+		return models.Purchase{}, ErrSupplierNotFound
+	}
+
+	now := time.Now()
+	expiryDate := req.ExpiryDate
+	purchase := models.Purchase{
+		ID:           r.s.nextID("purchases"),
+		MedicineID:   req.MedicineID,
+		SupplierID:   req.SupplierID,
+		Quantity:     req.Quantity,
+		UnitPrice:    req.UnitPrice,
+		TotalPrice:   req.UnitPrice.Times(req.Quantity),
+		BatchNumber:  req.BatchNumber,
+		ExpiryDate:   &expiryDate,
+		PurchaseDate: now,
+		CreatedAt:    now,
+	}
+	r.s.purchases[purchase.ID] = purchase
+
+	// Receive the delivery as a new batch
+	batch := models.MedicineBatch{
+		MedicineID:  purchase.MedicineID,
+		SupplierID:  &purchase.SupplierID,
+		PurchaseID:  &purchase.ID,
+		BatchNumber: purchase.BatchNumber,
+		ExpiryDate:  purchase.ExpiryDate,
+		Quantity:    purchase.Quantity,
+	}
+	r.s.createBatch(&batch)
+	purchase.Batch = &batch
+
+	r.s.recordMovements(models.StockMovement{
+		MedicineID:    purchase.MedicineID,
+		MovementType:  models.MovementInbound,
+		UserID:        actor.UserID,
+		Reason:        "Purchase received",
+		ReferenceType: "purchase",
+		ReferenceID:   &purchase.ID,
+	}, []BatchAllocation{{BatchID: batch.ID, Quantity: batch.Quantity}})
+	r.s.syncMedicineStock(purchase.MedicineID)
+
+	return purchase, r.s.recordAudit(actor, AuditCreate, "purchase", purchase.ID, nil, purchase)
+}
+
+func (r *memoryPurchases) Void(actor Actor, id int, reason string) (models.Purchase, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before, ok := r.s.purchases[id]
+	if !ok {
+		return before, ErrNotFound
+	}
+	if before.VoidedAt != nil {
+		return before, ErrAlreadyVoided
+	}
+
+	// The whole received quantity must still be on hand in the purchase's batch
+	batch, ok := r.s.purchaseBatch(id)
+	if !ok {
+		return before, ErrPurchaseBatchGone
+	}
+	if batch.Quantity < before.Quantity {
+		return before, &StockLeftError{Left: before.Quantity - batch.Quantity, Received: before.Quantity}
+	}
+
+	changes := []BatchAllocation{{BatchID: batch.ID, Quantity: -before.Quantity}}
+	r.s.changeBatches(changes)
+	r.s.recordMovements(models.StockMovement{
+		MedicineID:    before.MedicineID,
+		MovementType:  models.MovementReversal,
+		UserID:        actor.UserID,
+		Reason:        reason,
+		ReferenceType: "purchase",
+		ReferenceID:   &id,
+	}, changes)
+
+	now := time.Now()
+	purchase := before
+	purchase.VoidedAt = &now
+	purchase.VoidedBy = actor.UserID
+	purchase.VoidReason = &reason
+	r.s.purchases[id] = purchase
+	r.s.syncMedicineStock(purchase.MedicineID)
+
+	return purchase, r.s.recordAudit(actor, AuditVoid, "purchase", id, before, purchase)
+}
@@ -0,0 +1,348 @@
+package repository
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memorySales stores sales and their returns in memory
+type memorySales struct {
+	s *memoryStore
+}
+
+func (r *memorySales) list() memoryList[models.Sale] {
+	filters := map[string]func(models.Sale, any) bool{
+		"user_id":        equal(func(s models.Sale) int { return s.UserID }),
+		"receipt_number": equal(func(s models.Sale) string { return s.ReceiptNumber }),
+		"medicine_id": func(s models.Sale, value any) bool {
+			return slices.ContainsFunc(s.Items, func(item models.SaleItem) bool { return item.MedicineID == value.(int) })
+		},
+	}
+	timeRange(filters, "sale_date", func(s models.Sale) *time.Time { return &s.SaleDate })
+	valueRange(filters, "total", func(s models.Sale) models.Money { return s.Total })
+
+	return memoryList[models.Sale]{
+		filters: filters,
+		sorts: map[string]func(a, b models.Sale) int{
+			"sale_date":  byTime(func(s models.Sale) *time.Time { return &s.SaleDate }),
+			"total":      by(func(s models.Sale) models.Money { return s.Total }),
+			"created_at": byTime(func(s models.Sale) *time.Time { return &s.CreatedAt }),
+		},
+		id: func(s models.Sale) int { return s.ID },
+	}
+}
+
+func (r *memorySales) List(q ListQuery) (models.Page[models.Sale], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sales := make([]models.Sale, 0, len(r.s.sales))
+	for _, sale := range r.s.sales {
+		sales = append(sales, sale)
+	}
+	page, err := r.list().page(sales, q)
+
+	// Lists hold the receipt headers only
+	for i := range page.Data {
+		page.Data[i].Items = nil
+	}
+	return page, err
+}
+
+func (r *memorySales) Get(id int) (models.Sale, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sale, ok := r.s.sales[id]
+	if !ok {
+		return sale, ErrNotFound
+	}
+	return sale, nil
+}
+
+func (r *memorySales) Create(actor Actor, req models.CreateSaleRequest) (models.Sale, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	// Medicines are checked in ID order, as they are locked in the database
+	medicineIDs := make([]int, 0, len(req.Items))
+	for _, item := range req.Items {
+		medicineIDs = append(medicineIDs, item.MedicineID)
+	}
+	sort.Ints(medicineIDs)
+
+	prices := make(map[int]models.Money, len(medicineIDs))
+	names := make(map[int]string, len(medicineIDs))
+	for _, medicineID := range medicineIDs {
+		medicine, ok := r.s.medicines[medicineID]
+		if !ok {
+			return models.Sale{}, &MedicineError{MedicineID: medicineID, Err: ErrNotFound}
+		}
+		prices[medicineID] = medicine.Price
+		names[medicineID] = medicine.Name
+	}
+
+	var subtotal models.Money
+	for _, item := range req.Items {
+		subtotal += prices[item.MedicineID].Times(item.Quantity)
+	}
+	if req.Discount > subtotal {
+		return models.Sale{}, ErrDiscountTooLarge
+	}
+
+	// Take stock from the batches that expire soonest, skipping expired ones
+	taken := map[int]int{}
+	allocations := make([][]BatchAllocation, len(req.Items))
+	for i, line := range req.Items {
+		var err error
+		allocations[i], err = r.s.allocateFEFO(line.MedicineID, line.Quantity, taken)
+		if err != nil {
+			return models.Sale{}, &MedicineError{MedicineID: line.MedicineID, Err: err}
+		}
+	}
+
+	now := time.Now()
+	sale := models.Sale{
+		ID:        r.s.nextID("sales"),
+		UserID:    *actor.UserID,
+		Subtotal:  subtotal,
+		Discount:  req.Discount,
+		Total:     subtotal - req.Discount,
+		SaleDate:  now,
+		CreatedAt: now,
+	}
+	sale.ReceiptNumber = fmt.Sprintf("R%s-%06d", now.Format("20060102"), sale.ID)
+
+	for i, line := range req.Items {
+		price := prices[line.MedicineID]
+		item := models.SaleItem{
+			ID:           r.s.nextID("sale_items"),
+			SaleID:       sale.ID,
+			MedicineID:   line.MedicineID,
+			MedicineName: names[line.MedicineID],
+			Quantity:     line.Quantity,
+			UnitPrice:    price,
+			TotalPrice:   price.Times(line.Quantity),
+		}
+
+		// Record which batches the line was dispensed from
+		changes := make([]BatchAllocation, len(allocations[i]))
+		for j, a := range allocations[i] {
+			item.Batches = append(item.Batches, models.SaleBatch{
+				ID:          r.s.nextID("sale_batches"),
+				SaleID:      sale.ID,
+				SaleItemID:  item.ID,
+				BatchID:     a.BatchID,
+				BatchNumber: a.BatchNumber,
+				ExpiryDate:  a.ExpiryDate,
+				Quantity:    a.Quantity,
+			})
+			changes[j] = a
+			changes[j].Quantity = -a.Quantity
+		}
+
+		r.s.changeBatches(changes)
+		r.s.recordMovements(models.StockMovement{
+			MedicineID:    line.MedicineID,
+			MovementType:  models.MovementOutbound,
+			UserID:        actor.UserID,
+			Reason:        "Sale " + sale.ReceiptNumber,
+			ReferenceType: "sale",
+			ReferenceID:   &sale.ID,
+		}, changes)
+		r.s.syncMedicineStock(line.MedicineID)
+
+		sale.Items = append(sale.Items, item)
+	}
+	r.s.sales[sale.ID] = sale
+
+	return sale, r.s.recordAudit(actor, AuditCreate, "sale", sale.ID, nil, sale)
+}
+
+func (r *memorySales) Returns(saleID int) ([]models.SaleReturn, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.sales[saleID]; !ok {
+		return nil, ErrNotFound
+	}
+
+	returns := []models.SaleReturn{}
+	for _, saleReturn := range r.s.returns {
+		if saleReturn.SaleID == saleID {
+			returns = append(returns, saleReturn)
+		}
+	}
+	return returns, nil
+}
+
+// returnableBatches returns, per batch, how much of a sale line has not been
+// returned yet, the batches allocated last first, like returnableBatches
+func (s *memoryStore) returnableBatches(item models.SaleItem) []BatchAllocation {
+	var allocations []BatchAllocation
+	lastSaleBatch := map[int]int{}
+	for _, sb := range item.Batches {
+		i := slices.IndexFunc(allocations, func(a BatchAllocation) bool { return a.BatchID == sb.BatchID })
+		if i < 0 {
+			allocations = append(allocations, BatchAllocation{BatchID: sb.BatchID, BatchNumber: sb.BatchNumber, ExpiryDate: sb.ExpiryDate})
+			i = len(allocations) - 1
+		}
+		allocations[i].Quantity += sb.Quantity
+		lastSaleBatch[sb.BatchID] = max(lastSaleBatch[sb.BatchID], sb.ID)
+	}
+
+	for _, saleReturn := range s.returns {
+		for _, ri := range saleReturn.Items {
+			if ri.SaleItemID != item.ID || ri.BatchID == nil {
+				continue
+			}
+			if i := slices.IndexFunc(allocations, func(a BatchAllocation) bool { return a.BatchID == *ri.BatchID }); i >= 0 {
+				allocations[i].Quantity -= ri.Quantity
+			}
+		}
+	}
+
+	allocations = slices.DeleteFunc(allocations, func(a BatchAllocation) bool { return a.Quantity <= 0 })
+	slices.SortFunc(allocations, func(a, b BatchAllocation) int {
+		return cmp.Compare(lastSaleBatch[b.BatchID], lastSaleBatch[a.BatchID])
+	})
+	return allocations
+}
+
+func (r *memorySales) CreateReturn(actor Actor, saleID int, req models.CreateSaleReturnRequest) (models.SaleReturn, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	sale, ok := r.s.sales[saleID]
+	if !ok {
+		return models.SaleReturn{}, ErrNotFound
+	}
+
+	// Every line is checked before anything is returned
+	type returnLine struct {
+		models.CreateSaleReturnItemRequest
+		item        models.SaleItem
+		index       int
+		outstanding []BatchAllocation
+		available   int
+		quantity    int
+	}
+	lines := make([]returnLine, len(req.Items))
+	for i, line := range req.Items {
+		j := slices.IndexFunc(sale.Items, func(item models.SaleItem) bool { return item.ID == line.SaleItemID })
+		if j < 0 {
+			return models.SaleReturn{}, &ReturnError{SaleItemID: line.SaleItemID, Returnable: -1}
+		}
+
+		outstanding := r.s.returnableBatches(sale.Items[j])
+		available := 0
+		for _, a := range outstanding {
+			available += a.Quantity
+		}
+
+		quantity := line.Quantity
+		if quantity == 0 {
+			quantity = available
+		}
+		if quantity == 0 || quantity > available {
+			return models.SaleReturn{}, &ReturnError{SaleItemID: line.SaleItemID, Returnable: available}
+		}
+		lines[i] = returnLine{line, sale.Items[j], j, outstanding, available, quantity}
+	}
+
+	saleReturn := models.SaleReturn{
+		ID:        r.s.nextID("sale_returns"),
+		SaleID:    saleID,
+		UserID:    *actor.UserID,
+		Reason:    req.Reason,
+		CreatedAt: time.Now(),
+	}
+
+	// The total is spread over the lines to know what each line was paid
+	// for, and refunds never add up to more than was paid
+	lineTotals := make([]models.Money, len(sale.Items))
+	for i, item := range sale.Items {
+		lineTotals[i] = item.TotalPrice
+	}
+	var refunded models.Money
+	for _, earlier := range r.s.returns {
+		if earlier.SaleID == saleID {
+			refunded += earlier.RefundAmount
+		}
+	}
+	returnedBefore := map[int]int{}
+	for _, line := range lines {
+		if _, ok := returnedBefore[line.SaleItemID]; !ok {
+			returnedBefore[line.SaleItemID] = line.item.Quantity - line.available
+		}
+	}
+
+	touched := map[int]bool{}
+	for _, line := range lines {
+		paid := paidShare(lineTotals, line.index, sale.Total)
+		var returned []BatchAllocation
+		remaining := line.quantity
+		for _, a := range line.outstanding {
+			if remaining == 0 {
+				break
+			}
+			take := min(a.Quantity, remaining)
+			remaining -= take
+			returned = append(returned, BatchAllocation{BatchID: a.BatchID, Quantity: take})
+			refund := min(refundAmount(paid, line.item.Quantity, returnedBefore[line.SaleItemID], take), sale.Total-refunded)
+			returnedBefore[line.SaleItemID] += take
+			refunded += refund
+
+			item := models.SaleReturnItem{
+				ID:           r.s.nextID("sale_return_items"),
+				ReturnID:     saleReturn.ID,
+				SaleItemID:   line.SaleItemID,
+				BatchID:      &a.BatchID,
+				Quantity:     take,
+				Disposition:  line.Disposition,
+				RefundAmount: refund,
+			}
+			saleReturn.RefundAmount += item.RefundAmount
+			saleReturn.Items = append(saleReturn.Items, item)
+		}
+
+		// Returned stock always goes back into its batch first; damaged
+		// stock is then written off so both steps show in the ledger
+		r.s.changeBatches(returned)
+		movement := models.StockMovement{
+			MedicineID:    line.item.MedicineID,
+			MovementType:  models.MovementReturn,
+			UserID:        actor.UserID,
+			Reason:        req.Reason,
+			ReferenceType: "sale_return",
+			ReferenceID:   &saleReturn.ID,
+		}
+		r.s.recordMovements(movement, returned)
+
+		if line.Disposition == models.ReturnDamaged {
+			writeOffs := make([]BatchAllocation, len(returned))
+			for i, ret := range returned {
+				writeOffs[i] = BatchAllocation{BatchID: ret.BatchID, Quantity: -ret.Quantity}
+			}
+			r.s.changeBatches(writeOffs)
+			movement.MovementType = models.MovementWriteOff
+			movement.Reason = "Damaged return: " + req.Reason
+			r.s.recordMovements(movement, writeOffs)
+		}
+
+		touched[line.item.MedicineID] = true
+	}
+
+	// Update medicine quantities
+	for medicineID := range touched {
+		r.s.syncMedicineStock(medicineID)
+	}
+	r.s.returns = append(r.s.returns, saleReturn)
+
+	return saleReturn, r.s.recordAudit(actor, AuditCreate, "sale_return", saleReturn.ID, nil, saleReturn)
+}
@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryStock stores batches, the stock ledger and adjustments in memory
+type memoryStock struct {
+	s *memoryStore
+}
+
+func (r *memoryStock) batchList() memoryList[models.MedicineBatch] {
+	filters := map[string]func(models.MedicineBatch, any) bool{
+		"batch_number": equal(func(b models.MedicineBatch) string { return b.BatchNumber }),
+		"medicine_id":  equal(func(b models.MedicineBatch) int { return b.MedicineID }),
+		"supplier_id": func(b models.MedicineBatch, value any) bool {
+			return b.SupplierID != nil && *b.SupplierID == value.(int)
+		},
+		"in_stock": equal(func(b models.MedicineBatch) bool { return b.Quantity > 0 }),
+	}
+	timeRange(filters, "expiry_date", func(b models.MedicineBatch) *time.Time { return b.ExpiryDate })
+
+	return memoryList[models.MedicineBatch]{
+		filters: filters,
+		sorts: map[string]func(a, b models.MedicineBatch) int{
+			"batch_number": by(func(b models.MedicineBatch) string { return b.BatchNumber }),
+			"expiry_date":  byTime(func(b models.MedicineBatch) *time.Time { return b.ExpiryDate }),
+			"quantity":     by(func(b models.MedicineBatch) int { return b.Quantity }),
+			"received_at":  byTime(func(b models.MedicineBatch) *time.Time { return &b.ReceivedAt }),
+		},
+		id: func(b models.MedicineBatch) int { return b.ID },
+	}
+}
+
+func (r *memoryStock) Batches(q ListQuery) (models.Page[models.MedicineBatch], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	batches := make([]models.MedicineBatch, 0, len(r.s.batches))
+	for _, b := range r.s.batches {
+		batches = append(batches, b)
+	}
+	return r.batchList().page(batches, q)
+}
+
+func (r *memoryStock) Batch(id int) (models.MedicineBatch, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	batch, ok := r.s.batches[id]
+	if !ok {
+		return batch, ErrNotFound
+	}
+	return batch, nil
+}
+
+func (r *memoryStock) movementList() memoryList[models.StockMovement] {
+	filters := map[string]func(models.StockMovement, any) bool{
+		"medicine_id": equal(func(m models.StockMovement) int { return m.MedicineID }),
+		"batch_id": func(m models.StockMovement, value any) bool {
+			return m.BatchID != nil && *m.BatchID == value.(int)
+		},
+		"movement_type":  equal(func(m models.StockMovement) string { return m.MovementType }),
+		"reference_type": equal(func(m models.StockMovement) string { return m.ReferenceType }),
+		"user_id": func(m models.StockMovement, value any) bool {
+			return m.UserID != nil && *m.UserID == value.(int)
+		},
+	}
+	timeRange(filters, "created_at", func(m models.StockMovement) *time.Time { return &m.CreatedAt })
+
+	return memoryList[models.StockMovement]{
+		filters: filters,
+		sorts: map[string]func(a, b models.StockMovement) int{
+			"id":         by(func(m models.StockMovement) int { return m.ID }),
+			"created_at": byTime(func(m models.StockMovement) *time.Time { return &m.CreatedAt }),
+		},
+		id: func(m models.StockMovement) int { return m.ID },
+	}
+}
+
+func (r *memoryStock) Movements(q ListQuery) (models.Page[models.StockMovement], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.movementList().page(r.s.movements, q)
+}
+
+func (r *memoryStock) adjustmentList() memoryList[models.StockAdjustment] {
+	filters := map[string]func(models.StockAdjustment, any) bool{
+		"medicine_id": equal(func(a models.StockAdjustment) int { return a.MedicineID }),
+		"batch_id": func(a models.StockAdjustment, value any) bool {
+			return a.BatchID != nil && *a.BatchID == value.(int)
+		},
+		"reason_code": equal(func(a models.StockAdjustment) string { return a.ReasonCode }),
+		"user_id":     equal(func(a models.StockAdjustment) int { return a.UserID }),
+	}
+	timeRange(filters, "created_at", func(a models.StockAdjustment) *time.Time { return &a.CreatedAt })
+
+	return memoryList[models.StockAdjustment]{
+		filters: filters,
+		sorts: map[string]func(a, b models.StockAdjustment) int{
+			"created_at": byTime(func(a models.StockAdjustment) *time.Time { return &a.CreatedAt }),
+			"delta":      by(func(a models.StockAdjustment) int { return a.Delta }),
+		},
+		id: func(a models.StockAdjustment) int { return a.ID },
+	}
+}
+
+func (r *memoryStock) Adjustments(q ListQuery) (models.Page[models.StockAdjustment], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.adjustmentList().page(r.s.adjustments, q)
+}
+
+func (r *memoryStock) Reconcile() ([]models.StockDiscrepancy, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	ledger := map[int]int{}
+	for _, m := range r.s.movements {
+		ledger[m.MedicineID] += m.Quantity
+	}
+
+	discrepancies := []models.StockDiscrepancy{}
+	for _, m := range r.s.medicines {
+		if m.Quantity != ledger[m.ID] {
+			discrepancies = append(discrepancies, models.StockDiscrepancy{
+				MedicineID:     m.ID,
+				Name:           m.Name,
+				Quantity:       m.Quantity,
+				LedgerQuantity: ledger[m.ID],
+			})
+		}
+	}
+	slices.SortFunc(discrepancies, func(a, b models.StockDiscrepancy) int {
+		return cmp.Compare(a.MedicineID, b.MedicineID)
+	})
+	return discrepancies, nil
+}
+
+func (r *memoryStock) Adjust(actor Actor, medicineID int, req models.CreateStockAdjustmentRequest) (models.StockAdjustment, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if _, ok := r.s.medicines[medicineID]; !ok {
+		return models.StockAdjustment{}, ErrNotFound
+	}
+
+	adjustment, err := r.s.applyAdjustment(actor, medicineID, req.BatchID, req.Delta, req.ReasonCode, req.Note)
+	if err != nil {
+		return adjustment, err
+	}
+	return adjustment, r.s.recordAudit(actor, AuditCreate, "stock_adjustment", adjustment.ID, nil, adjustment)
+}
+
+// allocateAdjustment works out the batch changes of an adjustment, like
+// adjustStock does in the database, without changing the batches. An
+// increase without a batch is returned with a batch ID of 0, to be received
+// into a new batch.
+func (s *memoryStore) allocateAdjustment(medicineID int, batchID *int, delta int) ([]BatchAllocation, error) {
+	if batchID != nil {
+		b, ok := s.batches[*batchID]
+		if !ok || b.MedicineID != medicineID {
+			return nil, ErrBatchNotFound
+		}
+		if b.Quantity+delta < 0 {
+			return nil, ErrInsufficientStock
+		}
+		return []BatchAllocation{{BatchID: b.ID, BatchNumber: b.BatchNumber, ExpiryDate: b.ExpiryDate, Quantity: delta}}, nil
+	}
+
+	if delta > 0 {
+		return []BatchAllocation{{Quantity: delta}}, nil
+	}
+
+	var changes []BatchAllocation
+	remaining := -delta
+	for _, b := range s.medicineBatches(medicineID) {
+		if remaining == 0 {
+			break
+		}
+		take := min(b.Quantity, remaining)
+		remaining -= take
+		changes = append(changes, BatchAllocation{
+			BatchID:     b.ID,
+			BatchNumber: b.BatchNumber,
+			ExpiryDate:  b.ExpiryDate,
+			Quantity:    -take,
+		})
+	}
+	if remaining > 0 {
+		return nil, ErrInsufficientStock
+	}
+	return changes, nil
+}
+
+// applyAdjustment changes the stock of a medicine and records the adjustment
+// and its ledger entries, like applyAdjustment does in the database. Nothing
+// is changed if the adjustment fails.
+func (s *memoryStore) applyAdjustment(actor Actor, medicineID int, batchID *int, delta int, reasonCode, note string) (models.StockAdjustment, error) {
+	changes, err := s.allocateAdjustment(medicineID, batchID, delta)
+	if err != nil {
+		return models.StockAdjustment{}, err
+	}
+
+	if len(changes) == 1 && changes[0].BatchID == 0 {
+		batch := models.MedicineBatch{
+			MedicineID:  medicineID,
+			BatchNumber: "ADJ-" + strconv.Itoa(medicineID) + "-" + time.Now().Format("20060102150405"),
+			Quantity:    delta,
+		}
+		s.createBatch(&batch)
+		changes[0].BatchID = batch.ID
+		changes[0].BatchNumber = batch.BatchNumber
+	} else {
+		s.changeBatches(changes)
+	}
+	if batchID == nil && len(changes) == 1 {
+		batchID = &changes[0].BatchID
+	}
+
+	adjustment := models.StockAdjustment{
+		ID:         s.nextID("stock_adjustments"),
+		MedicineID: medicineID,
+		BatchID:    batchID,
+		Delta:      delta,
+		ReasonCode: reasonCode,
+		Note:       note,
+		UserID:     *actor.UserID,
+		CreatedAt:  time.Now(),
+	}
+	s.adjustments = append(s.adjustments, adjustment)
+
+	s.recordMovements(models.StockMovement{
+		MedicineID:    medicineID,
+		MovementType:  adjustmentMovementType(reasonCode),
+		UserID:        actor.UserID,
+		Reason:        adjustmentReason(reasonCode, note),
+		ReferenceType: "stock_adjustment",
+		ReferenceID:   &adjustment.ID,
+	}, changes)
+	s.syncMedicineStock(medicineID)
+
+	return adjustment, nil
+}
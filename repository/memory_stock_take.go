@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryStockTakes stores stock takes in memory
+type memoryStockTakes struct {
+	s *memoryStore
+}
+
+func (r *memoryStockTakes) list() memoryList[models.StockTake] {
+	filters := map[string]func(models.StockTake, any) bool{
+		"status":     equal(func(st models.StockTake) string { return st.Status }),
+		"created_by": equal(func(st models.StockTake) int { return st.CreatedBy }),
+	}
+	timeRange(filters, "created_at", func(st models.StockTake) *time.Time { return &st.CreatedAt })
+
+	return memoryList[models.StockTake]{
+		filters: filters,
+		sorts: map[string]func(a, b models.StockTake) int{
+			"created_at": byTime(func(st models.StockTake) *time.Time { return &st.CreatedAt }),
+			"posted_at":  byTime(func(st models.StockTake) *time.Time { return st.PostedAt }),
+		},
+		id: func(st models.StockTake) int { return st.ID },
+	}
+}
+
+func (r *memoryStockTakes) List(q ListQuery) (models.Page[models.StockTake], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	stockTakes := make([]models.StockTake, 0, len(r.s.stockTakes))
+	for _, st := range r.s.stockTakes {
+		st.Lines = nil
+		stockTakes = append(stockTakes, st)
+	}
+	return r.list().page(stockTakes, q)
+}
+
+func (r *memoryStockTakes) Get(id int) (models.StockTake, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	return r.s.stockTake(id)
+}
+
+// stockTake returns a stock take with its lines
+func (s *memoryStore) stockTake(id int) (models.StockTake, error) {
+	i := slices.IndexFunc(s.stockTakes, func(st models.StockTake) bool { return st.ID == id })
+	if i < 0 {
+		return models.StockTake{}, ErrNotFound
+	}
+
+	stockTake := s.stockTakes[i]
+	stockTake.Lines = slices.Clone(stockTake.Lines)
+	for j, line := range stockTake.Lines {
+		line.Variance = line.CountedQuantity - line.ExpectedQuantity
+		stockTake.Lines[j] = line
+	}
+	slices.SortFunc(stockTake.Lines, func(a, b models.StockTakeLine) int {
+		if c := cmp.Compare(a.MedicineID, b.MedicineID); c != 0 {
+			return c
+		}
+		return cmp.Compare(batchKey(a.BatchID), batchKey(b.BatchID))
+	})
+	return stockTake, nil
+}
+
+// onHand is the quantity of a counted batch, or of the medicine when it is
+// counted as a whole
+func (s *memoryStore) onHand(medicineID int, batchID *int) int {
+	if batchID != nil {
+		return s.batches[*batchID].Quantity
+	}
+	return s.medicines[medicineID].Quantity
+}
+
+// batchKey identifies a counted batch, with 0 for a whole medicine like the
+// unique index on stock_take_lines
+func batchKey(batchID *int) int {
+	if batchID == nil {
+		return 0
+	}
+	return *batchID
+}
+
+func (r *memoryStockTakes) Create(actor Actor, note string) (models.StockTake, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	stockTake := models.StockTake{
+		ID:        r.s.nextID("stock_takes"),
+		Status:    models.StockTakeOpen,
+		Note:      note,
+		CreatedBy: *actor.UserID,
+		CreatedAt: time.Now(),
+	}
+	r.s.stockTakes = append(r.s.stockTakes, stockTake)
+
+	return stockTake, r.s.recordAudit(actor, AuditCreate, "stock_take", stockTake.ID, nil, stockTake)
+}
+
+// openStockTake returns the index of a stock take that is open
+func (s *memoryStore) openStockTake(id int) (int, error) {
+	i := slices.IndexFunc(s.stockTakes, func(st models.StockTake) bool { return st.ID == id })
+	if i < 0 {
+		return i, ErrNotFound
+	}
+	if status := s.stockTakes[i].Status; status != models.StockTakeOpen {
+		return i, &StockTakeStatusError{Status: status}
+	}
+	return i, nil
+}
+
+func (r *memoryStockTakes) SubmitCounts(actor Actor, id int, counts []models.StockCountRequest) (models.StockTake, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i, err := r.s.openStockTake(id)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+
+	// Validate every count before recording any
+	lines := slices.Clone(r.s.stockTakes[i].Lines)
+	for _, count := range counts {
+		if _, ok := r.s.medicines[count.MedicineID]; !ok {
+			return models.StockTake{}, &MedicineError{MedicineID: count.MedicineID, Err: ErrNotFound}
+		}
+		// A medicine is counted either as a whole or batch by batch, not both
+		if slices.ContainsFunc(lines, func(l models.StockTakeLine) bool {
+			return l.MedicineID == count.MedicineID && (l.BatchID == nil) != (count.BatchID == nil)
+		}) {
+			return models.StockTake{}, &CountError{MedicineID: count.MedicineID}
+		}
+		if count.BatchID != nil {
+			if b, ok := r.s.batches[*count.BatchID]; !ok || b.MedicineID != count.MedicineID {
+				return models.StockTake{}, &CountError{MedicineID: count.MedicineID, BatchID: count.BatchID}
+			}
+		}
+
+		// The count is compared with the quantity on hand when it is taken,
+		// so sales and receipts before posting are not mistaken for variance
+		line := models.StockTakeLine{
+			StockTakeID:      id,
+			MedicineID:       count.MedicineID,
+			BatchID:          count.BatchID,
+			CountedQuantity:  count.CountedQuantity,
+			ExpectedQuantity: r.s.onHand(count.MedicineID, count.BatchID),
+			CountedBy:        *actor.UserID,
+			CountedAt:        time.Now(),
+		}
+		j := slices.IndexFunc(lines, func(l models.StockTakeLine) bool {
+			return l.MedicineID == count.MedicineID && batchKey(l.BatchID) == batchKey(count.BatchID)
+		})
+		if j >= 0 {
+			line.ID = lines[j].ID
+			lines[j] = line
+		} else {
+			lines = append(lines, line)
+		}
+	}
+	for j := range lines {
+		if lines[j].ID == 0 {
+			lines[j].ID = r.s.nextID("stock_take_lines")
+		}
+	}
+	r.s.stockTakes[i].Lines = lines
+
+	if err = r.s.recordAudit(actor, AuditCount, "stock_take", id, nil, models.SubmitStockCountsRequest{Counts: counts}); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.s.stockTake(id)
+}
+
+func (r *memoryStockTakes) Post(actor Actor, id int) (models.StockTake, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i, err := r.s.openStockTake(id)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	before := r.s.stockTakes[i]
+	before.Lines = nil
+	lines := slices.Clone(r.s.stockTakes[i].Lines)
+	if len(lines) == 0 {
+		return models.StockTake{}, ErrNoCounts
+	}
+	slices.SortFunc(lines, func(a, b models.StockTakeLine) int { return cmp.Compare(a.MedicineID, b.MedicineID) })
+
+	// Check every correction before applying any. Lines never touch the
+	// same batch, so they can be checked independently.
+	for _, line := range lines {
+		variance := line.CountedQuantity - line.ExpectedQuantity
+		if variance == 0 {
+			continue
+		}
+		if _, err := r.s.allocateAdjustment(line.MedicineID, line.BatchID, variance); err != nil {
+			return models.StockTake{}, &MedicineError{MedicineID: line.MedicineID, Err: err}
+		}
+	}
+
+	note := "Stock take #" + strconv.Itoa(id)
+	for j, line := range lines {
+		line.Variance = line.CountedQuantity - line.ExpectedQuantity
+		if line.Variance != 0 {
+			adjustment, err := r.s.applyAdjustment(actor, line.MedicineID, line.BatchID, line.Variance,
+				models.AdjustmentCountCorrection, note)
+			if err != nil {
+				return models.StockTake{}, &MedicineError{MedicineID: line.MedicineID, Err: err}
+			}
+			line.AdjustmentID = &adjustment.ID
+		}
+		lines[j] = line
+	}
+
+	now := time.Now()
+	stockTake := &r.s.stockTakes[i]
+	stockTake.Lines = lines
+	stockTake.Status = models.StockTakePosted
+	stockTake.PostedBy = actor.UserID
+	stockTake.PostedAt = &now
+
+	after := *stockTake
+	after.Lines = nil
+	if err = r.s.recordAudit(actor, AuditPost, "stock_take", id, before, after); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.s.stockTake(id)
+}
+
+func (r *memoryStockTakes) Cancel(actor Actor, id int) (models.StockTake, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	i, err := r.s.openStockTake(id)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	before := r.s.stockTakes[i]
+	before.Lines = nil
+	r.s.stockTakes[i].Status = models.StockTakeCancelled
+	after := r.s.stockTakes[i]
+	after.Lines = nil
+
+	if err = r.s.recordAudit(actor, AuditCancel, "stock_take", id, before, after); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.s.stockTake(id)
+}
@@ -0,0 +1,146 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memorySuppliers stores suppliers in memory
+type memorySuppliers struct {
+	s *memoryStore
+}
+
+func (r *memorySuppliers) list() memoryList[models.Supplier] {
+	return memoryList[models.Supplier]{
+		filters: map[string]func(models.Supplier, any) bool{
+			"medicine_id": func(supplier models.Supplier, value any) bool {
+				for _, p := range r.s.purchases {
+					if p.SupplierID == supplier.ID && p.MedicineID == value.(int) {
+						return true
+					}
+				}
+				return false
+			},
+		},
+		sorts: map[string]func(a, b models.Supplier) int{
+			"name":           by(func(s models.Supplier) string { return s.Name }),
+			"contact_person": by(func(s models.Supplier) string { return s.ContactPerson }),
+			"created_at":     byTime(func(s models.Supplier) *time.Time { return &s.CreatedAt }),
+			"updated_at":     byTime(func(s models.Supplier) *time.Time { return &s.UpdatedAt }),
+		},
+		id: func(s models.Supplier) int { return s.ID },
+	}
+}
+
+func (r *memorySuppliers) List(q ListQuery) (models.Page[models.Supplier], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	suppliers := make([]models.Supplier, 0, len(r.s.suppliers))
+	for _, supplier := range r.s.suppliers {
+		suppliers = append(suppliers, supplier)
+	}
+	return r.list().page(suppliers, q)
+}
+
+func (r *memorySuppliers) Get(id int) (models.Supplier, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	supplier, ok := r.s.suppliers[id]
+	if !ok {
+		return supplier, ErrNotFound
+	}
+	return supplier, nil
+}
+
+func (r *memorySuppliers) Create(actor Actor, req models.CreateSupplierRequest) (models.Supplier, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	now := time.Now()
+	supplier := models.Supplier{
+		ID:            r.s.nextID("suppliers"),
+		Name:          req.Name,
+		ContactPerson: req.ContactPerson,
+		Phone:         req.Phone,
+		Email:         req.Email,
+		Address:       req.Address,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		Version:       1,
+	}
+	r.s.suppliers[supplier.ID] = supplier
+
+	return supplier, r.s.recordAudit(actor, AuditCreate, "supplier", supplier.ID, nil, supplier)
+}
+
+func (r *memorySuppliers) Update(actor Actor, id, version int, req models.UpdateSupplierRequest) (models.Supplier, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before, ok := r.s.suppliers[id]
+	if !ok {
+		return before, ErrNotFound
+	}
+	if version != 0 && before.Version != version {
+		return before, ErrVersionMismatch
+	}
+
+	supplier := before
+	if req.Name != nil {
+		supplier.Name = *req.Name
+	}
+	if req.ContactPerson != nil {
+		supplier.ContactPerson = *req.ContactPerson
+	}
+	if req.Phone != nil {
+		supplier.Phone = *req.Phone
+	}
+	if req.Email != nil {
+		supplier.Email = *req.Email
+	}
+	if req.Address != nil {
+		supplier.Address = *req.Address
+	}
+	supplier.UpdatedAt = time.Now()
+	supplier.Version++
+	r.s.suppliers[id] = supplier
+
+	return supplier, r.s.recordAudit(actor, AuditUpdate, "supplier", id, before, supplier)
+}
+
+// Delete removes a supplier with its purchases, as the foreign keys of the
+// database cascade. Batches it delivered are kept.
+func (r *memorySuppliers) Delete(actor Actor, id, version int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	before, ok := r.s.suppliers[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if version != 0 && before.Version != version {
+		return ErrVersionMismatch
+	}
+
+	// Purchases keep a supplier from being deleted, like the foreign key in
+	// the database
+	for _, p := range r.s.purchases {
+		if p.SupplierID == id {
+			return ErrInUse
+		}
+	}
+
+	delete(r.s.suppliers, id)
+	for batchID, b := range r.s.batches {
+		if b.SupplierID != nil && *b.SupplierID == id {
+			b.SupplierID = nil
+			b.PurchaseID = nil
+			r.s.batches[batchID] = b
+		}
+	}
+
+	return r.s.recordAudit(actor, AuditDelete, "supplier", id, before, nil)
+}
@@ -0,0 +1,143 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// memoryUsers stores users in memory, with what they sign in with kept by
+// memoryAuth
+type memoryUsers struct {
+	s *memoryStore
+}
+
+// checkUserUnique refuses a username or email another user already has, as
+// the unique constraints of the users table do
+func (s *memoryStore) checkUserUnique(username, email string) error {
+	for _, u := range s.users {
+		if u.Username == username || u.Email == email {
+			return ErrConflict
+		}
+	}
+	return nil
+}
+
+func (r *memoryUsers) list() memoryList[models.User] {
+	return memoryList[models.User]{
+		filters: map[string]func(models.User, any) bool{
+			"role":      equal(func(u models.User) string { return u.Role }),
+			"is_active": equal(func(u models.User) bool { return u.IsActive }),
+		},
+		sorts: map[string]func(a, b models.User) int{
+			"username":   by(func(u models.User) string { return u.Username }),
+			"created_at": byTime(func(u models.User) *time.Time { return &u.CreatedAt }),
+		},
+		id: func(u models.User) int { return u.ID },
+	}
+}
+
+func (r *memoryUsers) List(q ListQuery) (models.Page[models.User], error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	users := make([]models.User, 0, len(r.s.users))
+	for _, u := range r.s.users {
+		users = append(users, u)
+	}
+	return r.list().page(users, q)
+}
+
+func (r *memoryUsers) Get(id int) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[id]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+	return u, nil
+}
+
+func (r *memoryUsers) Invite(actor Actor, username, email, role, tokenHash string, expiresAt time.Time) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	if err := r.s.checkUserUnique(username, email); err != nil {
+		return models.User{}, err
+	}
+
+	now := time.Now()
+	user := models.User{
+		ID:        r.s.nextID("users"),
+		Username:  username,
+		Email:     email,
+		Role:      role,
+		IsActive:  true,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	r.s.users[user.ID] = user
+	r.s.createResetToken(user.ID, tokenHash, expiresAt)
+
+	return user, r.s.recordAudit(actor, AuditCreate, "user", user.ID, nil, user)
+}
+
+func (r *memoryUsers) UpdateRole(actor Actor, id int, role string) (models.User, error) {
+	return r.update(actor, AuditRoleChange, id, func(user *models.User) {
+		user.Role = role
+	})
+}
+
+func (r *memoryUsers) SetActive(actor Actor, id int, active bool) (models.User, error) {
+	action := AuditReactivate
+	if !active {
+		action = AuditDeactivate
+	}
+	return r.update(actor, action, id, func(user *models.User) {
+		user.IsActive = active
+
+		// A deactivated user's sessions can no longer be refreshed
+		if !active {
+			r.s.revokeUserSessions(id, 0)
+		}
+	})
+}
+
+func (r *memoryUsers) ResetMFA(actor Actor, id int) (models.User, error) {
+	return r.update(actor, AuditMFAReset, id, func(user *models.User) {
+		r.s.removeMFA(id)
+		*user = r.s.users[id]
+	})
+}
+
+// update changes a user with fn and records the change in the audit log
+func (r *memoryUsers) update(actor Actor, action string, id int, fn func(user *models.User)) (models.User, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	u, ok := r.s.users[id]
+	if !ok {
+		return models.User{}, ErrNotFound
+	}
+
+	before := u
+	fn(&u)
+	u.UpdatedAt = time.Now()
+	r.s.users[id] = u
+
+	return u, r.s.recordAudit(actor, action, "user", id, before, u)
+}
+
+func (r *memoryUsers) Unlock(actor Actor, id int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+
+	user, ok := r.s.users[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(r.s.loginFailures, memoryLoginCounter{LoginFailureUsername, user.Username})
+
+	return r.s.recordAudit(actor, AuditUnlock, "user", id, nil, nil)
+}
@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// NewPostgres returns the repositories stored in a PostgreSQL database
+func NewPostgres(db *sqlx.DB) Repositories {
+	return Repositories{
+		Medicines:   &postgresMedicines{db: db},
+		Suppliers:   &postgresSuppliers{db: db},
+		Purchases:   &postgresPurchases{db: db},
+		Sales:       &postgresSales{db: db},
+		Stock:       &postgresStock{db: db},
+		StockTakes:  &postgresStockTakes{db: db},
+		Users:       &postgresUsers{db: db},
+		Auth:        &postgresAuth{db: db},
+		APIKeys:     &postgresAPIKeys{db: db},
+		Audit:       &postgresAudit{db: db},
+		Idempotency: &postgresIdempotency{db: db},
+	}
+}
+
+// isForeignKeyViolation reports whether err is a foreign key violation, such
+// as deleting a row that other rows still refer to
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+// isUniqueViolation reports whether err is a unique constraint violation, such
+// as inserting a username that another row already has
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+// listSQL returns the WHERE conditions, their arguments and the ORDER BY
+// clause of a list query
+func listSQL(spec ListSpec, q ListQuery) ([]string, []any, string) {
+	var where []string
+	var args []any
+	for _, value := range q.Filters {
+		i := slices.IndexFunc(spec.Filters, func(f Filter) bool { return f.Param == value.Param })
+		if i < 0 {
+			continue
+		}
+		args = append(args, value.Value)
+		where = append(where, strings.ReplaceAll(spec.Filters[i].condition, "$?", "$"+strconv.Itoa(len(args))))
+	}
+
+	var order []string
+	sortedByID := false
+	tieBreak := " ASC"
+	for i, field := range q.Sort {
+		column := spec.Sorts[field.Field]
+		direction := " ASC"
+		if field.Desc {
+			direction = " DESC"
+		}
+		if i == 0 {
+			tieBreak = direction
+		}
+		sortedByID = sortedByID || column == "id"
+		order = append(order, column+direction)
+	}
+	if !sortedByID {
+		order = append(order, "id"+tieBreak)
+	}
+
+	return where, args, strings.Join(order, ", ")
+}
+
+// fetchPage returns the page of a list and the number of rows in the whole
+// list
+func fetchPage[T any](db *sqlx.DB, spec ListSpec, q ListQuery) (models.Page[T], error) {
+	page := models.Page[T]{Data: []T{}, Limit: q.Limit, Offset: q.Offset}
+	conditions, args, orderBy := listSQL(spec, q)
+
+	where := ""
+	if len(conditions) > 0 {
+		where = ` WHERE ` + strings.Join(conditions, ` AND `)
+	}
+
+	countQuery := `SELECT COUNT(*) FROM ` + spec.from + where
+	if err := db.Get(&page.Total, countQuery, args...); err != nil {
+		return page, err
+	}
+
+	args = append(args, q.Limit, q.Offset)
+	query := `SELECT ` + spec.columns + ` FROM ` + spec.from + where +
+		` ORDER BY ` + orderBy +
+		` LIMIT $` + strconv.Itoa(len(args)-1) + ` OFFSET $` + strconv.Itoa(len(args))
+	err := db.Select(&page.Data, query, args...)
+	return page, err
+}
+
+// postgresAudit reads the audit log from the audit_log table
+type postgresAudit struct {
+	db *sqlx.DB
+}
+
+func (r *postgresAudit) List(q ListQuery) (models.Page[models.AuditEntry], error) {
+	return fetchPage[models.AuditEntry](r.db, AuditList, q)
+}
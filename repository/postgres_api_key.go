@@ -0,0 +1,118 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const apiKeyColumns = `k.id, k.name, k.prefix, k.user_id, u.username, k.scopes,
+	k.expires_at, k.last_used_at, k.revoked_at, k.created_by, k.created_at`
+
+// postgresAPIKeys stores API keys in the api_keys table
+type postgresAPIKeys struct {
+	db *sqlx.DB
+}
+
+func (r *postgresAPIKeys) List(q ListQuery) (models.Page[models.APIKey], error) {
+	return fetchPage[models.APIKey](r.db, APIKeyList, q)
+}
+
+func (r *postgresAPIKeys) Create(actor Actor, key models.APIKey, keyHash string) (models.APIKey, error) {
+	query := `
+		INSERT INTO api_keys (name, prefix, key_hash, user_id, scopes, expires_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, name, prefix, user_id, scopes, expires_at, last_used_at, revoked_at, created_by, created_at
+	`
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return key, err
+	}
+	defer tx.Rollback()
+
+	apiKey := models.APIKey{Username: key.Username}
+	err = tx.QueryRow(
+		query,
+		key.Name,
+		key.Prefix,
+		keyHash,
+		key.UserID,
+		pq.Array(key.Scopes),
+		key.ExpiresAt,
+		actor.UserID,
+		time.Now(),
+	).Scan(
+		&apiKey.ID,
+		&apiKey.Name,
+		&apiKey.Prefix,
+		&apiKey.UserID,
+		&apiKey.Scopes,
+		&apiKey.ExpiresAt,
+		&apiKey.LastUsedAt,
+		&apiKey.RevokedAt,
+		&apiKey.CreatedBy,
+		&apiKey.CreatedAt,
+	)
+	if err != nil {
+		return apiKey, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "api_key", apiKey.ID, nil, apiKey); err != nil {
+		return apiKey, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return apiKey, err
+	}
+	return apiKey, nil
+}
+
+func (r *postgresAPIKeys) Revoke(actor Actor, id int) (models.APIKey, error) {
+	var apiKey models.APIKey
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return apiKey, err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "api_keys", id, true)
+	if err == sql.ErrNoRows {
+		return apiKey, ErrNotFound
+	}
+	if err != nil {
+		return apiKey, err
+	}
+
+	query := `
+		UPDATE api_keys k
+		SET revoked_at = COALESCE(k.revoked_at, $1)
+		FROM users u
+		WHERE u.id = k.user_id AND k.id = $2
+		RETURNING ` + apiKeyColumns
+
+	if err = tx.Get(&apiKey, query, time.Now(), id); err != nil {
+		return apiKey, err
+	}
+
+	after, err := AuditSnapshot(tx, "api_keys", id, false)
+	if err != nil {
+		return apiKey, err
+	}
+	if err = RecordAudit(tx, actor, AuditRevoke, "api_key", id, before, after); err != nil {
+		return apiKey, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return apiKey, err
+	}
+	return apiKey, nil
+}
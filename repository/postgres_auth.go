@@ -0,0 +1,837 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/oidc"
+	"github.com/jmoiron/sqlx"
+)
+
+// postgresAuth stores what users sign in with in the users, login_failures,
+// auth_sessions, refresh_tokens, revoked_tokens, password_reset_tokens,
+// mfa_recovery_codes, oidc_states and api_keys tables
+type postgresAuth struct {
+	db *sqlx.DB
+}
+
+func (r *postgresAuth) User(id int) (models.User, error) {
+	return r.user(`id = $1`, id)
+}
+
+func (r *postgresAuth) UserByUsername(username string) (models.User, error) {
+	return r.user(`username = $1`, username)
+}
+
+// user returns the user matching a condition, with their password hash
+func (r *postgresAuth) user(condition string, arg any) (models.User, error) {
+	query := `SELECT ` + userColumns + `, password_hash FROM users WHERE ` + condition
+
+	var user models.User
+	err := r.db.Get(&user, query, arg)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (r *postgresAuth) Register(actor Actor, username, email, passwordHash, role string) (models.User, error) {
+	var user models.User
+
+	query := `
+		INSERT INTO users (username, email, password_hash, role, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $5)
+		RETURNING ` + userColumns
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	err = tx.Get(&user, query, username, email, passwordHash, role, time.Now())
+	if isUniqueViolation(err) {
+		return user, ErrConflict
+	}
+	if err != nil {
+		return user, err
+	}
+
+	if err = RecordAudit(tx, actor.as(user), AuditRegister, "user", user.ID, nil, user); err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *postgresAuth) LoginLockedUntil(username, ip string) (time.Time, error) {
+	var lockedUntil *time.Time
+	query := `
+		SELECT MAX(locked_until)
+		FROM login_failures
+		WHERE (kind = $1 AND key = $2) OR (kind = $3 AND key = $4)
+	`
+	err := r.db.QueryRow(query, LoginFailureUsername, username, LoginFailureIP, ip).Scan(&lockedUntil)
+	if err != nil || lockedUntil == nil || lockedUntil.Before(time.Now()) {
+		return time.Time{}, err
+	}
+	return *lockedUntil, nil
+}
+
+func (r *postgresAuth) RecordLoginFailure(kind, key string, since time.Time) (int, error) {
+	query := `
+		INSERT INTO login_failures (kind, key, failures, last_failure_at)
+		VALUES ($1, $2, 1, $3)
+		ON CONFLICT (kind, key) DO UPDATE
+		SET failures = CASE WHEN login_failures.last_failure_at < $4 THEN 1
+		                    ELSE login_failures.failures + 1 END,
+		    last_failure_at = $3
+		RETURNING failures
+	`
+
+	var failures int
+	err := r.db.QueryRow(query, kind, key, time.Now(), since).Scan(&failures)
+	return failures, err
+}
+
+func (r *postgresAuth) LockLogin(kind, key string, until time.Time) error {
+	query := `UPDATE login_failures SET locked_until = $1 WHERE kind = $2 AND key = $3`
+	_, err := r.db.Exec(query, until, kind, key)
+	return err
+}
+
+func (r *postgresAuth) ClearLoginFailures(username string) error {
+	return clearLoginFailures(r.db, username)
+}
+
+func (r *postgresAuth) StartSession(userID int, userAgent, ip string, expiresAt time.Time, refreshTokenHash string) (int, error) {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var sessionID int
+	query := `
+		INSERT INTO auth_sessions (user_id, user_agent, ip_address, created_at, last_used_at, expires_at)
+		VALUES ($1, $2, $3, $4, $4, $5)
+		RETURNING id
+	`
+	if err = tx.QueryRow(query, userID, userAgent, ip, time.Now(), expiresAt).Scan(&sessionID); err != nil {
+		return 0, err
+	}
+
+	if err = insertRefreshToken(tx, sessionID, refreshTokenHash); err != nil {
+		return 0, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return sessionID, nil
+}
+
+// insertRefreshToken stores the hash of a new refresh token of a session
+func insertRefreshToken(tx *sql.Tx, sessionID int, tokenHash string) error {
+	query := `INSERT INTO refresh_tokens (session_id, token_hash, created_at) VALUES ($1, $2, $3)`
+	_, err := tx.Exec(query, sessionID, tokenHash, time.Now())
+	return err
+}
+
+func (r *postgresAuth) Refresh(actor Actor, tokenHash, newTokenHash string) (models.User, int, error) {
+	var user models.User
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return user, 0, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, sessionID int
+	var usedAt, revokedAt *time.Time
+	var expiresAt time.Time
+	query := `
+		SELECT rt.id, rt.used_at, s.id, s.expires_at, s.revoked_at,
+		       u.id, u.username, u.email, u.role, u.is_active, u.totp_enabled, u.created_at, u.updated_at
+		FROM refresh_tokens rt
+		JOIN auth_sessions s ON s.id = rt.session_id
+		JOIN users u ON u.id = s.user_id
+		WHERE rt.token_hash = $1
+		FOR UPDATE OF rt, s
+	`
+	err = tx.QueryRow(query, tokenHash).Scan(
+		&tokenID,
+		&usedAt,
+		&sessionID,
+		&expiresAt,
+		&revokedAt,
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Role,
+		&user.IsActive,
+		&user.TOTPEnabled,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return user, 0, ErrInvalidToken
+	}
+	if err != nil {
+		return user, 0, err
+	}
+
+	now := time.Now()
+	if usedAt != nil {
+		// Reuse of a rotated token: revoke the session so neither the thief
+		// nor the legitimate client can continue with it
+		if revokedAt == nil {
+			revokeQuery := `UPDATE auth_sessions SET revoked_at = $1 WHERE id = $2`
+			if _, err = tx.Exec(revokeQuery, now, sessionID); err != nil {
+				return user, 0, err
+			}
+			if err = RecordAudit(tx, actor.as(user), AuditRevoke, "session", sessionID, nil, nil); err != nil {
+				return user, 0, err
+			}
+			if err = tx.Commit(); err != nil {
+				return user, 0, err
+			}
+		}
+		return user, sessionID, ErrTokenReused
+	}
+	if revokedAt != nil || now.After(expiresAt) {
+		return user, sessionID, ErrSessionEnded
+	}
+	if !user.IsActive {
+		return user, sessionID, ErrUserInactive
+	}
+
+	// Rotate the refresh token
+	if _, err = tx.Exec(`UPDATE refresh_tokens SET used_at = $1 WHERE id = $2`, now, tokenID); err != nil {
+		return user, 0, err
+	}
+	if _, err = tx.Exec(`UPDATE auth_sessions SET last_used_at = $1 WHERE id = $2`, now, sessionID); err != nil {
+		return user, 0, err
+	}
+	if err = insertRefreshToken(tx, sessionID, newTokenHash); err != nil {
+		return user, 0, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, 0, err
+	}
+	return user, sessionID, nil
+}
+
+func (r *postgresAuth) Session(userID, sessionID int, tokenID string) (models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE id = $1
+		  AND EXISTS (SELECT 1 FROM auth_sessions WHERE id = $2 AND user_id = $1 AND revoked_at IS NULL)
+		  AND NOT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = $3)
+	`
+
+	var user models.User
+	err := r.db.Get(&user, query, userID, sessionID, tokenID)
+	if err == sql.ErrNoRows {
+		return user, ErrSessionEnded
+	}
+	return user, err
+}
+
+func (r *postgresAuth) Logout(actor Actor, sessionID int, tokenID string, tokenExpiresAt time.Time) error {
+	return r.logout(tokenID, tokenExpiresAt, func(tx *sql.Tx) error {
+		query := `UPDATE auth_sessions SET revoked_at = $1 WHERE id = $2 AND revoked_at IS NULL`
+		if _, err := tx.Exec(query, time.Now(), sessionID); err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, AuditLogout, "session", sessionID, nil, nil)
+	})
+}
+
+func (r *postgresAuth) LogoutAll(actor Actor, tokenID string, tokenExpiresAt time.Time) error {
+	return r.logout(tokenID, tokenExpiresAt, func(tx *sql.Tx) error {
+		if err := revokeUserSessions(tx, *actor.UserID); err != nil {
+			return err
+		}
+		return RecordAudit(tx, actor, AuditLogoutAll, "user", *actor.UserID, nil, nil)
+	})
+}
+
+// logout revokes an access token and ends sessions with end, in one
+// transaction
+func (r *postgresAuth) logout(tokenID string, tokenExpiresAt time.Time, end func(tx *sql.Tx) error) error {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if tokenID != "" {
+		revokeQuery := `
+			INSERT INTO revoked_tokens (jti, expires_at, revoked_at)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (jti) DO NOTHING
+		`
+		if _, err = tx.Exec(revokeQuery, tokenID, tokenExpiresAt, now); err != nil {
+			return err
+		}
+	}
+
+	if err = end(tx); err != nil {
+		return err
+	}
+
+	// Revoked tokens only need to be remembered until they expire
+	if _, err = tx.Exec(`DELETE FROM revoked_tokens WHERE expires_at < $1`, now); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+func (r *postgresAuth) ChangePassword(actor Actor, userID, keepSessionID int, passwordHash string) error {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	updateQuery := `UPDATE users SET password_hash = $1, updated_at = $2 WHERE id = $3`
+	if _, err = tx.Exec(updateQuery, passwordHash, now, userID); err != nil {
+		return err
+	}
+
+	// Keep the session used for the change, end the others
+	sessionQuery := `
+		UPDATE auth_sessions
+		SET revoked_at = $1
+		WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL
+	`
+	if _, err = tx.Exec(sessionQuery, now, userID, keepSessionID); err != nil {
+		return err
+	}
+
+	if err = RecordAudit(tx, actor, AuditPasswordChange, "user", userID, nil, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+func (r *postgresAuth) PasswordResetUser(email string) (models.User, error) {
+	// Users of the identity provider have no local password to reset
+	query := `SELECT ` + userColumns + ` FROM users WHERE email = $1 AND is_active AND oidc_subject IS NULL`
+
+	var user models.User
+	err := r.db.Get(&user, query, email)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (r *postgresAuth) CreateResetToken(userID int, tokenHash string, expiresAt time.Time) error {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the newest reset token of a user is valid
+	now := time.Now()
+	expireQuery := `UPDATE password_reset_tokens SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL`
+	if _, err = tx.Exec(expireQuery, now, userID); err != nil {
+		return err
+	}
+
+	insertQuery := `
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err = tx.Exec(insertQuery, userID, tokenHash, expiresAt, now); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+func (r *postgresAuth) ResetTokenUser(tokenHash string) (models.User, error) {
+	query := `
+		SELECT ` + userColumns + `
+		FROM users
+		WHERE is_active AND id = (
+			SELECT user_id FROM password_reset_tokens
+			WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2
+		)
+	`
+
+	var user models.User
+	err := r.db.Get(&user, query, tokenHash, time.Now())
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidToken
+	}
+	return user, err
+}
+
+func (r *postgresAuth) ResetPassword(actor Actor, tokenHash, passwordHash string) (models.User, error) {
+	var user models.User
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, userID int
+	query := `
+		SELECT t.id, t.user_id
+		FROM password_reset_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1
+		  AND t.used_at IS NULL
+		  AND t.expires_at > $2
+		  AND u.is_active
+		FOR UPDATE OF t
+	`
+	now := time.Now()
+	err = tx.QueryRow(query, tokenHash, now).Scan(&tokenID, &userID)
+	if err == sql.ErrNoRows {
+		return user, ErrInvalidToken
+	}
+	if err != nil {
+		return user, err
+	}
+
+	updateQuery := `
+		UPDATE users SET password_hash = $1, updated_at = $2
+		WHERE id = $3
+		RETURNING ` + userColumns
+	if err = tx.Get(&user, updateQuery, passwordHash, now, userID); err != nil {
+		return user, err
+	}
+
+	usedQuery := `UPDATE password_reset_tokens SET used_at = $1 WHERE id = $2`
+	if _, err = tx.Exec(usedQuery, now, tokenID); err != nil {
+		return user, err
+	}
+
+	if err = revokeUserSessions(tx, userID); err != nil {
+		return user, err
+	}
+
+	// Proving ownership of the account lifts a lockout of the username
+	if err = clearLoginFailures(tx, user.Username); err != nil {
+		return user, err
+	}
+
+	if err = RecordAudit(tx, actor.as(user), AuditPasswordReset, "user", userID, nil, nil); err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *postgresAuth) SetMFASecret(userID int, secret string) error {
+	query := `
+		UPDATE users SET totp_secret = $1, totp_last_step = NULL, updated_at = $2
+		WHERE id = $3 AND NOT totp_enabled
+	`
+	result, err := r.db.Exec(query, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return ErrMFAEnabled
+	}
+	return nil
+}
+
+func (r *postgresAuth) EnableMFA(actor Actor, userID int, code string, recoveryCodeHashes []string) (models.User, error) {
+	var user models.User
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	var secret *string
+	query := `SELECT ` + userColumns + `, totp_secret FROM users WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(query, userID).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.Role,
+		&user.IsActive,
+		&user.TOTPEnabled,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&secret,
+	)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+	if user.TOTPEnabled {
+		return user, ErrMFAEnabled
+	}
+	if secret == nil {
+		return user, ErrMFANotSetUp
+	}
+
+	step, valid := acceptTOTP(*secret, nil, code)
+	if !valid {
+		return user, ErrInvalidCode
+	}
+
+	enableQuery := `UPDATE users SET totp_enabled = TRUE, totp_last_step = $1, updated_at = $2 WHERE id = $3`
+	if _, err = tx.Exec(enableQuery, step, time.Now(), userID); err != nil {
+		return user, err
+	}
+	user.TOTPEnabled = true
+
+	if err = replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return user, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditMFAEnable, "user", userID, nil, nil); err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *postgresAuth) UseMFACode(userID int, code string) error {
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = useTOTP(tx, userID, code); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+func (r *postgresAuth) UseRecoveryCode(userID int, codeHash string) error {
+	query := `
+		UPDATE mfa_recovery_codes
+		SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL
+	`
+	result, err := r.db.Exec(query, time.Now(), userID, codeHash)
+	if err != nil {
+		return err
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if used == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+func (r *postgresAuth) ReplaceRecoveryCodes(actor Actor, userID int, code string, recoveryCodeHashes []string) error {
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = useTOTP(tx, userID, code); err != nil {
+		return err
+	}
+
+	if err = replaceRecoveryCodes(tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+
+	if err = RecordAudit(tx, actor, AuditMFARecoveryRegenerate, "user", userID, nil, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+func (r *postgresAuth) DisableMFA(actor Actor, userID int, code string) error {
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = useTOTP(tx, userID, code); err != nil {
+		return err
+	}
+
+	if err = removeMFA(tx, userID); err != nil {
+		return err
+	}
+
+	if err = RecordAudit(tx, actor, AuditMFADisable, "user", userID, nil, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
+
+// useTOTP checks a code against the enabled TOTP secret of a user inside a
+// transaction, and records its time step so it cannot be used again
+func useTOTP(tx *sqlx.Tx, userID int, code string) error {
+	var secret *string
+	var enabled bool
+	var lastStep *int64
+	query := `SELECT totp_secret, totp_enabled, totp_last_step FROM users WHERE id = $1 FOR UPDATE`
+	err := tx.QueryRow(query, userID).Scan(&secret, &enabled, &lastStep)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !enabled || secret == nil {
+		return ErrMFANotEnabled
+	}
+
+	step, valid := acceptTOTP(*secret, lastStep, code)
+	if !valid {
+		return ErrInvalidCode
+	}
+
+	_, err = tx.Exec(`UPDATE users SET totp_last_step = $1 WHERE id = $2`, step, userID)
+	return err
+}
+
+// replaceRecoveryCodes discards the recovery codes of a user and stores new
+// ones by their hashes
+func replaceRecoveryCodes(tx *sqlx.Tx, userID int, codeHashes []string) error {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	insertQuery := `INSERT INTO mfa_recovery_codes (user_id, code_hash, created_at) VALUES ($1, $2, $3)`
+	for _, codeHash := range codeHashes {
+		if _, err := tx.Exec(insertQuery, userID, codeHash, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *postgresAuth) SaveOIDCState(stateHash string, state OIDCState) error {
+	// Abandoned logins are cleaned up as new ones start
+	if _, err := r.db.Exec(`DELETE FROM oidc_states WHERE expires_at < $1`, time.Now()); err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO oidc_states (state_hash, nonce, code_verifier, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+	_, err := r.db.Exec(query, stateHash, state.Nonce, state.CodeVerifier, state.ExpiresAt, time.Now())
+	return err
+}
+
+func (r *postgresAuth) TakeOIDCState(stateHash string) (OIDCState, error) {
+	var state OIDCState
+	query := `DELETE FROM oidc_states WHERE state_hash = $1 RETURNING nonce, code_verifier, expires_at`
+	err := r.db.QueryRow(query, stateHash).Scan(&state.Nonce, &state.CodeVerifier, &state.ExpiresAt)
+	if err == sql.ErrNoRows || (err == nil && state.ExpiresAt.Before(time.Now())) {
+		return state, ErrInvalidToken
+	}
+	return state, err
+}
+
+func (r *postgresAuth) LinkOIDCUser(actor Actor, identity oidc.Identity, role string) (models.User, error) {
+	var user models.User
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var id int
+	err = tx.Get(&id, `SELECT id FROM users WHERE oidc_subject = $1`, identity.Subject)
+	if err == nil {
+		// Only users the identity provider created take their role from it
+		roleQuery := `UPDATE users SET role = $1, updated_at = $2 WHERE id = $3 AND oidc_manages_role AND role <> $1`
+		user, err = changeOIDCUser(tx, actor, AuditRoleChange, id, roleQuery, role, now, id)
+	}
+
+	if err == sql.ErrNoRows && identity.Email != "" && identity.EmailVerified {
+		// A linked account keeps the role it was given here
+		err = tx.Get(&id, `SELECT id FROM users WHERE email = $1 AND oidc_subject IS NULL`, identity.Email)
+		if err == nil {
+			linkQuery := `UPDATE users SET oidc_subject = $1, updated_at = $2 WHERE id = $3`
+			user, err = changeOIDCUser(tx, actor, AuditOIDCLink, id, linkQuery, identity.Subject, now, id)
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		if identity.Email == "" {
+			return user, errors.New("identity provider did not supply an email")
+		}
+
+		username := oidcUsername(identity)
+		var taken bool
+		if err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE username = $1)`, username).Scan(&taken); err != nil {
+			return user, err
+		}
+		if taken {
+			return user, ErrUsernameTaken
+		}
+
+		insertQuery := `
+			INSERT INTO users (username, email, password_hash, role, oidc_subject, oidc_manages_role, created_at, updated_at)
+			VALUES ($1, $2, '', $3, $4, TRUE, $5, $5)
+			RETURNING ` + userColumns
+		if err = tx.Get(&user, insertQuery, username, identity.Email, role, identity.Subject, now); err != nil {
+			return user, err
+		}
+		err = RecordAudit(tx, actor.as(user), AuditCreate, "user", user.ID, nil, user)
+	}
+	if err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+// changeOIDCUser applies an update to a user logging in through the identity
+// provider and records it in the audit log as action, unless it changed
+// nothing
+func changeOIDCUser(tx *sqlx.Tx, actor Actor, action string, id int, query string, args ...any) (models.User, error) {
+	var user models.User
+
+	before, err := AuditSnapshot(tx, "users", id, true)
+	if err != nil {
+		return user, err
+	}
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return user, err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return user, err
+	}
+
+	if err = tx.Get(&user, `SELECT `+userColumns+` FROM users WHERE id = $1`, id); err != nil {
+		return user, err
+	}
+	if changed == 0 {
+		return user, nil
+	}
+
+	after, err := AuditSnapshot(tx, "users", id, false)
+	if err != nil {
+		return user, err
+	}
+	return user, RecordAudit(tx, actor.as(user), action, "user", id, before, after)
+}
+
+// oidcUsername is the username of a user created for an identity provider
+// user: their preferred username, else the local part of their email
+func oidcUsername(identity oidc.Identity) string {
+	if identity.Username != "" {
+		return identity.Username
+	}
+	username, _, _ := strings.Cut(identity.Email, "@")
+	return username
+}
+
+func (r *postgresAuth) APIKey(prefix string) (APIKeyCredentials, error) {
+	var creds APIKeyCredentials
+	query := `
+		SELECT k.id, k.name, k.prefix, k.key_hash, k.scopes, k.expires_at, k.last_used_at, k.revoked_at,
+		       u.id, u.username, u.role, u.is_active
+		FROM api_keys k
+		JOIN users u ON u.id = k.user_id
+		WHERE k.prefix = $1
+	`
+	err := r.db.QueryRow(query, prefix).Scan(
+		&creds.Key.ID,
+		&creds.Key.Name,
+		&creds.Key.Prefix,
+		&creds.KeyHash,
+		&creds.Key.Scopes,
+		&creds.Key.ExpiresAt,
+		&creds.Key.LastUsedAt,
+		&creds.Key.RevokedAt,
+		&creds.User.ID,
+		&creds.User.Username,
+		&creds.User.Role,
+		&creds.User.IsActive,
+	)
+	if err == sql.ErrNoRows {
+		return creds, ErrNotFound
+	}
+	creds.Key.UserID = creds.User.ID
+	creds.Key.Username = creds.User.Username
+	return creds, err
+}
+
+func (r *postgresAuth) RecordAPIKeyUse(id int, at, since time.Time) error {
+	query := `
+		UPDATE api_keys SET last_used_at = $1
+		WHERE id = $2 AND (last_used_at IS NULL OR last_used_at < $3)
+	`
+	_, err := r.db.Exec(query, at, id, since)
+	return err
+}
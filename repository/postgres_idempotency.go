@@ -0,0 +1,71 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// postgresIdempotency stores idempotency keys in the idempotency_keys table
+type postgresIdempotency struct {
+	db *sqlx.DB
+}
+
+func (r *postgresIdempotency) Claim(userID int, key, requestHash string, expiresAt time.Time) (*IdempotencyClaim, error) {
+	now := time.Now()
+
+	// Keys are forgotten once they expire
+	if _, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE expires_at < $1`, now); err != nil {
+		return nil, err
+	}
+
+	// Take the key unless an unexpired claim holds it
+	query := `
+		INSERT INTO idempotency_keys (user_id, key, request_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, key) DO UPDATE
+		SET request_hash = EXCLUDED.request_hash, status = NULL, content_type = NULL, body = NULL,
+			created_at = CURRENT_TIMESTAMP, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < $5
+	`
+	result, err := r.db.Exec(query, userID, key, requestHash, expiresAt, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil, nil
+	}
+
+	var row struct {
+		RequestHash string         `db:"request_hash"`
+		Status      sql.NullInt64  `db:"status"`
+		ContentType sql.NullString `db:"content_type"`
+		Body        []byte         `db:"body"`
+	}
+	query = `SELECT request_hash, status, content_type, body FROM idempotency_keys WHERE user_id = $1 AND key = $2`
+	if err := r.db.Get(&row, query, userID, key); err != nil {
+		return nil, err
+	}
+
+	claim := &IdempotencyClaim{RequestHash: row.RequestHash}
+	if row.Status.Valid {
+		claim.Response = &IdempotentResponse{
+			Status:      int(row.Status.Int64),
+			ContentType: row.ContentType.String,
+			Body:        row.Body,
+		}
+	}
+	return claim, nil
+}
+
+func (r *postgresIdempotency) Complete(userID int, key string, response IdempotentResponse) error {
+	query := `UPDATE idempotency_keys SET status = $1, content_type = $2, body = $3 WHERE user_id = $4 AND key = $5`
+	_, err := r.db.Exec(query, response.Status, response.ContentType, response.Body, userID, key)
+	return err
+}
+
+func (r *postgresIdempotency) Release(userID int, key string) error {
+	_, err := r.db.Exec(`DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2`, userID, key)
+	return err
+}
@@ -0,0 +1,338 @@
+package repository
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const medicineColumns = `id, name, description, manufacturer, price, quantity, expiry_date,
+		       category, requires_prescription, created_at, updated_at, version`
+
+// postgresMedicines stores medicines in the medicines table
+type postgresMedicines struct {
+	db *sqlx.DB
+}
+
+func (r *postgresMedicines) List(q ListQuery) (models.Page[models.Medicine], error) {
+	return fetchPage[models.Medicine](r.db, MedicineList, q)
+}
+
+func (r *postgresMedicines) Get(id int) (models.Medicine, error) {
+	query := `SELECT ` + medicineColumns + ` FROM medicines WHERE id = $1`
+
+	var medicine models.Medicine
+	err := r.db.Get(&medicine, query, id)
+	if err == sql.ErrNoRows {
+		return medicine, ErrNotFound
+	}
+	return medicine, err
+}
+
+// medicineSearchRow is a search result with the ts_headline fragments of
+// its fields
+type medicineSearchRow struct {
+	models.MedicineSearchResult
+	NameHighlight         string `db:"name_highlight"`
+	ManufacturerHighlight string `db:"manufacturer_highlight"`
+	CategoryHighlight     string `db:"category_highlight"`
+	DescriptionHighlight  string `db:"description_highlight"`
+}
+
+// Search combines full-text matches of every word with trigram similarity
+// of the name and manufacturer, so misspelled names are found too
+func (r *postgresMedicines) Search(search string, limit int) ([]models.MedicineSearchResult, error) {
+	query := `
+		WITH search AS (
+			SELECT to_tsquery('simple', $2) AS tsq,
+			       'StartSel=' || $3 || ', StopSel=' || $4 AS options
+		)
+		SELECT m.id, m.name, m.description, m.manufacturer, m.price, m.quantity, m.expiry_date,
+		       m.category, m.requires_prescription, m.created_at, m.updated_at, m.version,
+		       ts_rank(m.search_vector, s.tsq) +
+		           GREATEST(word_similarity($1, m.name), word_similarity($1, coalesce(m.manufacturer, '')) / 2) AS rank,
+		       ts_headline('simple', m.name, s.tsq, s.options || ', HighlightAll=true') AS name_highlight,
+		       ts_headline('simple', coalesce(m.manufacturer, ''), s.tsq, s.options || ', HighlightAll=true') AS manufacturer_highlight,
+		       ts_headline('simple', coalesce(m.category, ''), s.tsq, s.options || ', HighlightAll=true') AS category_highlight,
+		       ts_headline('simple', coalesce(m.description, ''), s.tsq, s.options || ', MaxFragments=2') AS description_highlight
+		FROM medicines m, search s
+		WHERE m.search_vector @@ s.tsq OR $1 <% m.name OR $1 <% m.manufacturer
+		ORDER BY rank DESC, m.name, m.id
+		LIMIT $5
+	`
+
+	var rows []medicineSearchRow
+	err := r.db.Select(&rows, query, search, searchTSQuery(search), highlightStart, highlightStop, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]models.MedicineSearchResult, len(rows))
+	for i, row := range rows {
+		result := row.MedicineSearchResult
+		result.Highlights = map[string]string{}
+		for field, fragment := range map[string]string{
+			"name":         row.NameHighlight,
+			"manufacturer": row.ManufacturerHighlight,
+			"category":     row.CategoryHighlight,
+			"description":  row.DescriptionHighlight,
+		} {
+			if marked := highlight(fragment); marked != "" {
+				result.Highlights[field] = marked
+			}
+		}
+		results[i] = result
+	}
+	return results, nil
+}
+
+func (r *postgresMedicines) Create(actor Actor, req models.CreateMedicineRequest) (models.Medicine, error) {
+	var medicine models.Medicine
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return medicine, err
+	}
+	defer tx.Rollback()
+
+	// Quantity is derived from batches, so the medicine starts empty
+	query := `
+		INSERT INTO medicines (name, description, manufacturer, price, quantity, expiry_date,
+		                      category, requires_prescription, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, 0, $5, $6, $7, $8, $9)
+		RETURNING id
+	`
+
+	var medicineID int
+	err = tx.QueryRow(
+		query,
+		req.Name,
+		req.Description,
+		req.Manufacturer,
+		req.Price,
+		req.ExpiryDate,
+		req.Category,
+		req.RequiresPrescription,
+		time.Now(),
+		time.Now(),
+	).Scan(&medicineID)
+	if err != nil {
+		return medicine, err
+	}
+
+	// Opening stock is recorded as its own batch
+	if req.Quantity > 0 {
+		batchNumber := req.BatchNumber
+		if batchNumber == "" {
+			batchNumber = "OPENING-" + strconv.Itoa(medicineID)
+		}
+		batch := models.MedicineBatch{
+			MedicineID:  medicineID,
+			BatchNumber: batchNumber,
+			Quantity:    req.Quantity,
+		}
+		if !req.ExpiryDate.IsZero() {
+			batch.ExpiryDate = &req.ExpiryDate
+		}
+		if err = createBatch(tx, &batch); err != nil {
+			return medicine, err
+		}
+		movement := models.StockMovement{
+			MedicineID:    medicineID,
+			MovementType:  models.MovementInbound,
+			UserID:        actor.UserID,
+			Reason:        "Opening stock",
+			ReferenceType: "medicine",
+			ReferenceID:   &medicineID,
+		}
+		changes := []BatchAllocation{{BatchID: batch.ID, Quantity: batch.Quantity}}
+		if err = recordMovements(tx, movement, changes); err != nil {
+			return medicine, err
+		}
+		if err = syncMedicineStock(tx, medicineID); err != nil {
+			return medicine, err
+		}
+	}
+
+	selectQuery := `SELECT ` + medicineColumns + ` FROM medicines WHERE id = $1`
+	err = tx.QueryRow(selectQuery, medicineID).Scan(
+		&medicine.ID,
+		&medicine.Name,
+		&medicine.Description,
+		&medicine.Manufacturer,
+		&medicine.Price,
+		&medicine.Quantity,
+		&medicine.ExpiryDate,
+		&medicine.Category,
+		&medicine.RequiresPrescription,
+		&medicine.CreatedAt,
+		&medicine.UpdatedAt,
+		&medicine.Version,
+	)
+	if err != nil {
+		return medicine, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "medicine", medicine.ID, nil, medicine); err != nil {
+		return medicine, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return medicine, err
+	}
+	return medicine, nil
+}
+
+func (r *postgresMedicines) Update(actor Actor, id, version int, req models.UpdateMedicineRequest) (models.Medicine, error) {
+	var medicine models.Medicine
+
+	// Build dynamic update query
+	updates := []string{}
+	args := []interface{}{}
+	argCount := 1
+
+	if req.Name != nil {
+		updates = append(updates, "name = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Name)
+		argCount++
+	}
+	if req.Description != nil {
+		updates = append(updates, "description = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Description)
+		argCount++
+	}
+	if req.Manufacturer != nil {
+		updates = append(updates, "manufacturer = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Manufacturer)
+		argCount++
+	}
+	if req.Price != nil {
+		updates = append(updates, "price = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Price)
+		argCount++
+	}
+	if req.Category != nil {
+		updates = append(updates, "category = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Category)
+		argCount++
+	}
+	if req.RequiresPrescription != nil {
+		updates = append(updates, "requires_prescription = $"+strconv.Itoa(argCount))
+		args = append(args, *req.RequiresPrescription)
+		argCount++
+	}
+
+	updates = append(updates, "updated_at = $"+strconv.Itoa(argCount), "version = version + 1")
+	args = append(args, time.Now())
+	argCount++
+
+	args = append(args, id, version)
+	idArg, versionArg := "$"+strconv.Itoa(argCount), "$"+strconv.Itoa(argCount+1)
+
+	query := `
+		UPDATE medicines
+		SET ` + updates[0]
+	for i := 1; i < len(updates); i++ {
+		query += ", " + updates[i]
+	}
+	query += `
+		WHERE id = ` + idArg + ` AND (` + versionArg + ` = 0 OR version = ` + versionArg + `)
+		RETURNING ` + medicineColumns
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return medicine, err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "medicines", id, true)
+	if err == sql.ErrNoRows {
+		return medicine, ErrNotFound
+	}
+	if err != nil {
+		return medicine, err
+	}
+
+	err = tx.QueryRow(query, args...).Scan(
+		&medicine.ID,
+		&medicine.Name,
+		&medicine.Description,
+		&medicine.Manufacturer,
+		&medicine.Price,
+		&medicine.Quantity,
+		&medicine.ExpiryDate,
+		&medicine.Category,
+		&medicine.RequiresPrescription,
+		&medicine.CreatedAt,
+		&medicine.UpdatedAt,
+		&medicine.Version,
+	)
+	if err == sql.ErrNoRows {
+		return medicine, ErrVersionMismatch
+	}
+	if err != nil {
+		return medicine, err
+	}
+
+	after, err := AuditSnapshot(tx, "medicines", id, false)
+	if err != nil {
+		return medicine, err
+	}
+	if err = RecordAudit(tx, actor, AuditUpdate, "medicine", id, before, after); err != nil {
+		return medicine, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return medicine, err
+	}
+	return medicine, nil
+}
+
+func (r *postgresMedicines) Delete(actor Actor, id, version int) error {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "medicines", id, true)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Batches, the ledger, adjustments, counts, purchases and sales keep a
+	// medicine from being deleted
+	query := `DELETE FROM medicines WHERE id = $1 AND ($2 = 0 OR version = $2)`
+	result, err := tx.Exec(query, id, version)
+	if isForeignKeyViolation(err) {
+		return ErrInUse
+	}
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrVersionMismatch
+	}
+
+	if err = RecordAudit(tx, actor, AuditDelete, "medicine", id, before, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
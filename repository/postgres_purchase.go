@@ -0,0 +1,270 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const purchaseColumns = `id, medicine_id, supplier_id, quantity, unit_price, total_price,
+		       batch_number, expiry_date, purchase_date, created_at,
+		       voided_at, voided_by, void_reason`
+
+// postgresPurchases stores purchases in the purchases table
+type postgresPurchases struct {
+	db *sqlx.DB
+}
+
+func (r *postgresPurchases) List(q ListQuery) (models.Page[models.Purchase], error) {
+	return fetchPage[models.Purchase](r.db, PurchaseList, q)
+}
+
+func (r *postgresPurchases) Get(id int) (models.Purchase, error) {
+	query := `SELECT ` + purchaseColumns + ` FROM purchases WHERE id = $1`
+
+	var purchase models.Purchase
+	err := r.db.Get(&purchase, query, id)
+	if err == sql.ErrNoRows {
+		return purchase, ErrNotFound
+	}
+	if err != nil {
+		return purchase, err
+	}
+
+	// Attach the batch received with this purchase, if it still exists
+	var batch models.MedicineBatch
+	batchQuery := `SELECT ` + batchColumns + ` FROM medicine_batches WHERE purchase_id = $1`
+	err = r.db.Get(&batch, batchQuery, id)
+	if err == nil {
+		purchase.Batch = &batch
+	} else if err != sql.ErrNoRows {
+		return purchase, err
+	}
+
+	return purchase, nil
+}
+
+func (r *postgresPurchases) Create(actor Actor, req models.CreatePurchaseRequest) (models.Purchase, error) {
+	var purchase models.Purchase
+	totalPrice := req.UnitPrice.Times(req.Quantity)
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return purchase, err
+	}
+	defer tx.Rollback()
+
+	// Check the medicine and supplier exist, and keep them from being deleted
+	// until the purchase is in
+	var exists bool
+	err = tx.QueryRow(`SELECT true FROM medicines WHERE id = $1 FOR KEY SHARE`, req.MedicineID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return purchase, &MedicineError{MedicineID: req.MedicineID, Err: ErrNotFound}
+	}
+	if err != nil {
+		return purchase, err
+	}
+	err = tx.QueryRow(`SELECT true FROM suppliers WHERE id = $1 FOR KEY SHARE`, req.SupplierID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return purchase, ErrSupplierNotFound
+	}
+	if err != nil {
+		return purchase, err
+	}
+
+	// Insert purchase
+	query := `
+		INSERT INTO purchases (medicine_id, supplier_id, quantity, unit_price, total_price,
+		                      batch_number, expiry_date, purchase_date, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, medicine_id, supplier_id, quantity, unit_price, total_price,
+		          batch_number, expiry_date, purchase_date, created_at
+	`
+	err = tx.QueryRow(
+		query,
+		req.MedicineID,
+		req.SupplierID,
+		req.Quantity,
+		req.UnitPrice,
+		totalPrice,
+		req.BatchNumber,
+		req.ExpiryDate,
+		time.Now(),
+		time.Now(),
+	).Scan(
+		&purchase.ID,
+		&purchase.MedicineID,
+		&purchase.SupplierID,
+		&purchase.Quantity,
+		&purchase.UnitPrice,
+		&purchase.TotalPrice,
+		&purchase.BatchNumber,
+		&purchase.ExpiryDate,
+		&purchase.PurchaseDate,
+		&purchase.CreatedAt,
+	)
+	if err != nil {
+		return purchase, err
+	}
+
+	// Receive the delivery as a new batch
+	batch := models.MedicineBatch{
+		MedicineID:  purchase.MedicineID,
+		SupplierID:  &purchase.SupplierID,
+		PurchaseID:  &purchase.ID,
+		BatchNumber: purchase.BatchNumber,
+		ExpiryDate:  purchase.ExpiryDate,
+		Quantity:    purchase.Quantity,
+	}
+	if err = createBatch(tx, &batch); err != nil {
+		return purchase, err
+	}
+	purchase.Batch = &batch
+
+	movement := models.StockMovement{
+		MedicineID:    purchase.MedicineID,
+		MovementType:  models.MovementInbound,
+		UserID:        actor.UserID,
+		Reason:        "Purchase received",
+		ReferenceType: "purchase",
+		ReferenceID:   &purchase.ID,
+	}
+	changes := []BatchAllocation{{BatchID: batch.ID, Quantity: batch.Quantity}}
+	if err = recordMovements(tx, movement, changes); err != nil {
+		return purchase, err
+	}
+
+	// Update medicine quantity
+	if err = syncMedicineStock(tx, req.MedicineID); err != nil {
+		return purchase, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "purchase", purchase.ID, nil, purchase); err != nil {
+		return purchase, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return purchase, err
+	}
+	return purchase, nil
+}
+
+func (r *postgresPurchases) Void(actor Actor, id int, reason string) (models.Purchase, error) {
+	var purchase models.Purchase
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return purchase, err
+	}
+	defer tx.Rollback()
+
+	var medicineID, quantity int
+	var voidedAt *time.Time
+	purchaseQuery := `SELECT medicine_id, quantity, voided_at FROM purchases WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(purchaseQuery, id).Scan(&medicineID, &quantity, &voidedAt)
+	if err == sql.ErrNoRows {
+		return purchase, ErrNotFound
+	}
+	if err != nil {
+		return purchase, err
+	}
+	if voidedAt != nil {
+		return purchase, ErrAlreadyVoided
+	}
+
+	before, err := AuditSnapshot(tx, "purchases", id, false)
+	if err != nil {
+		return purchase, err
+	}
+
+	// Lock the medicine before its batch, in the same order as sales, so a
+	// void and a sale of the medicine cannot deadlock
+	var exists bool
+	if err = tx.QueryRow(`SELECT true FROM medicines WHERE id = $1 FOR UPDATE`, medicineID).Scan(&exists); err != nil {
+		return purchase, err
+	}
+
+	// The whole received quantity must still be on hand in the purchase's batch
+	var batchID, onHand int
+	batchQuery := `SELECT id, quantity FROM medicine_batches WHERE purchase_id = $1 FOR UPDATE`
+	err = tx.QueryRow(batchQuery, id).Scan(&batchID, &onHand)
+	if err == sql.ErrNoRows {
+		return purchase, ErrPurchaseBatchGone
+	}
+	if err != nil {
+		return purchase, err
+	}
+	if onHand < quantity {
+		return purchase, &StockLeftError{Left: quantity - onHand, Received: quantity}
+	}
+
+	updateBatchQuery := `
+		UPDATE medicine_batches
+		SET quantity = quantity - $1, updated_at = $2
+		WHERE id = $3
+	`
+	if _, err = tx.Exec(updateBatchQuery, quantity, time.Now(), batchID); err != nil {
+		return purchase, err
+	}
+
+	movement := models.StockMovement{
+		MedicineID:    medicineID,
+		MovementType:  models.MovementReversal,
+		UserID:        actor.UserID,
+		Reason:        reason,
+		ReferenceType: "purchase",
+		ReferenceID:   &id,
+	}
+	changes := []BatchAllocation{{BatchID: batchID, Quantity: -quantity}}
+	if err = recordMovements(tx, movement, changes); err != nil {
+		return purchase, err
+	}
+
+	query := `
+		UPDATE purchases
+		SET voided_at = $1, voided_by = $2, void_reason = $3
+		WHERE id = $4
+		RETURNING ` + purchaseColumns
+	err = tx.QueryRow(query, time.Now(), actor.UserID, reason, id).Scan(
+		&purchase.ID,
+		&purchase.MedicineID,
+		&purchase.SupplierID,
+		&purchase.Quantity,
+		&purchase.UnitPrice,
+		&purchase.TotalPrice,
+		&purchase.BatchNumber,
+		&purchase.ExpiryDate,
+		&purchase.PurchaseDate,
+		&purchase.CreatedAt,
+		&purchase.VoidedAt,
+		&purchase.VoidedBy,
+		&purchase.VoidReason,
+	)
+	if err != nil {
+		return purchase, err
+	}
+
+	// Update medicine quantity
+	if err = syncMedicineStock(tx, medicineID); err != nil {
+		return purchase, err
+	}
+
+	after, err := AuditSnapshot(tx, "purchases", id, false)
+	if err != nil {
+		return purchase, err
+	}
+	if err = RecordAudit(tx, actor, AuditVoid, "purchase", id, before, after); err != nil {
+		return purchase, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return purchase, err
+	}
+	return purchase, nil
+}
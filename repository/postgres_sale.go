@@ -0,0 +1,592 @@
+package repository
+
+import (
+	"database/sql"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const saleColumns = `id, user_id, receipt_number, subtotal, discount, total, sale_date, created_at`
+
+// postgresSales stores sales in the sales table, with their line items,
+// the batches the lines were dispensed from and their returns
+type postgresSales struct {
+	db *sqlx.DB
+}
+
+func (r *postgresSales) List(q ListQuery) (models.Page[models.Sale], error) {
+	return fetchPage[models.Sale](r.db, SaleList, q)
+}
+
+func (r *postgresSales) Get(id int) (models.Sale, error) {
+	query := `SELECT ` + saleColumns + ` FROM sales WHERE id = $1`
+
+	var sale models.Sale
+	err := r.db.Get(&sale, query, id)
+	if err == sql.ErrNoRows {
+		return sale, ErrNotFound
+	}
+	if err != nil {
+		return sale, err
+	}
+
+	sale.Items, err = r.loadItems(id)
+	return sale, err
+}
+
+// loadItems returns the line items of a sale with the batches each line was
+// dispensed from
+func (r *postgresSales) loadItems(saleID int) ([]models.SaleItem, error) {
+	itemQuery := `
+		SELECT id, sale_id, medicine_id, medicine_name, quantity, unit_price, total_price
+		FROM sale_items
+		WHERE sale_id = $1
+		ORDER BY id
+	`
+	var items []models.SaleItem
+	if err := r.db.Select(&items, itemQuery, saleID); err != nil {
+		return nil, err
+	}
+
+	batchQuery := `
+		SELECT sb.id, sb.sale_id, sb.sale_item_id, sb.batch_id, b.batch_number, b.expiry_date, sb.quantity
+		FROM sale_batches sb
+		JOIN medicine_batches b ON b.id = sb.batch_id
+		WHERE sb.sale_id = $1
+		ORDER BY sb.id
+	`
+	var batches []models.SaleBatch
+	if err := r.db.Select(&batches, batchQuery, saleID); err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		for _, batch := range batches {
+			if batch.SaleItemID == items[i].ID {
+				items[i].Batches = append(items[i].Batches, batch)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+func (r *postgresSales) Create(actor Actor, req models.CreateSaleRequest) (models.Sale, error) {
+	var sale models.Sale
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return sale, err
+	}
+	defer tx.Rollback()
+
+	// Get medicine prices, locking the medicines against concurrent sales.
+	// Locks are taken in ID order so concurrent receipts cannot deadlock.
+	medicineIDs := make([]int, 0, len(req.Items))
+	for _, item := range req.Items {
+		medicineIDs = append(medicineIDs, item.MedicineID)
+	}
+	sort.Ints(medicineIDs)
+
+	prices := make(map[int]models.Money, len(medicineIDs))
+	names := make(map[int]string, len(medicineIDs))
+	medicineQuery := `SELECT name, price FROM medicines WHERE id = $1 FOR UPDATE`
+	for _, medicineID := range medicineIDs {
+		if _, seen := prices[medicineID]; seen {
+			continue
+		}
+		var name string
+		var price models.Money
+		err = tx.QueryRow(medicineQuery, medicineID).Scan(&name, &price)
+		if err == sql.ErrNoRows {
+			return sale, &MedicineError{MedicineID: medicineID, Err: ErrNotFound}
+		}
+		if err != nil {
+			return sale, err
+		}
+		prices[medicineID] = price
+		names[medicineID] = name
+	}
+
+	var subtotal models.Money
+	for _, item := range req.Items {
+		subtotal += prices[item.MedicineID].Times(item.Quantity)
+	}
+	if req.Discount > subtotal {
+		return sale, ErrDiscountTooLarge
+	}
+
+	// Insert sale header; the receipt number is derived from the sale ID
+	query := `
+		INSERT INTO sales (user_id, subtotal, discount, total, sale_date, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`
+
+	var saleID int
+	err = tx.QueryRow(
+		query,
+		actor.UserID,
+		subtotal,
+		req.Discount,
+		subtotal-req.Discount,
+		time.Now(),
+		time.Now(),
+	).Scan(&saleID)
+	if err != nil {
+		return sale, err
+	}
+
+	receiptQuery := `
+		UPDATE sales
+		SET receipt_number = 'R' || to_char(sale_date, 'YYYYMMDD') || '-' || LPAD(id::text, 6, '0')
+		WHERE id = $1
+		RETURNING ` + saleColumns
+
+	err = tx.QueryRow(receiptQuery, saleID).Scan(
+		&sale.ID,
+		&sale.UserID,
+		&sale.ReceiptNumber,
+		&sale.Subtotal,
+		&sale.Discount,
+		&sale.Total,
+		&sale.SaleDate,
+		&sale.CreatedAt,
+	)
+	if err != nil {
+		return sale, err
+	}
+
+	itemQuery := `
+		INSERT INTO sale_items (sale_id, medicine_id, medicine_name, quantity, unit_price, total_price)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, sale_id, medicine_id, medicine_name, quantity, unit_price, total_price
+	`
+	batchQuery := `
+		INSERT INTO sale_batches (sale_id, sale_item_id, batch_id, quantity)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`
+	for _, line := range req.Items {
+		// Take stock from the batches that expire soonest, skipping expired ones
+		allocations, err := consumeFEFO(tx, line.MedicineID, line.Quantity)
+		if err == ErrInsufficientStock {
+			return sale, &MedicineError{MedicineID: line.MedicineID, Err: err}
+		}
+		if err != nil {
+			return sale, err
+		}
+
+		price := prices[line.MedicineID]
+		var item models.SaleItem
+		err = tx.QueryRow(
+			itemQuery,
+			sale.ID,
+			line.MedicineID,
+			names[line.MedicineID],
+			line.Quantity,
+			price,
+			price.Times(line.Quantity),
+		).Scan(
+			&item.ID,
+			&item.SaleID,
+			&item.MedicineID,
+			&item.MedicineName,
+			&item.Quantity,
+			&item.UnitPrice,
+			&item.TotalPrice,
+		)
+		if err != nil {
+			return sale, err
+		}
+
+		// Record which batches the line was dispensed from
+		for _, a := range allocations {
+			saleBatch := models.SaleBatch{
+				SaleID:      sale.ID,
+				SaleItemID:  item.ID,
+				BatchID:     a.BatchID,
+				BatchNumber: a.BatchNumber,
+				ExpiryDate:  a.ExpiryDate,
+				Quantity:    a.Quantity,
+			}
+			err = tx.QueryRow(batchQuery, sale.ID, item.ID, a.BatchID, a.Quantity).Scan(&saleBatch.ID)
+			if err != nil {
+				return sale, err
+			}
+			item.Batches = append(item.Batches, saleBatch)
+		}
+
+		movement := models.StockMovement{
+			MedicineID:    line.MedicineID,
+			MovementType:  models.MovementOutbound,
+			UserID:        actor.UserID,
+			Reason:        "Sale " + sale.ReceiptNumber,
+			ReferenceType: "sale",
+			ReferenceID:   &sale.ID,
+		}
+		changes := make([]BatchAllocation, len(allocations))
+		for i, a := range allocations {
+			changes[i] = a
+			changes[i].Quantity = -a.Quantity
+		}
+		if err = recordMovements(tx, movement, changes); err != nil {
+			return sale, err
+		}
+
+		// Update medicine quantity
+		if err = syncMedicineStock(tx, line.MedicineID); err != nil {
+			return sale, err
+		}
+
+		sale.Items = append(sale.Items, item)
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "sale", sale.ID, nil, sale); err != nil {
+		return sale, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return sale, err
+	}
+	return sale, nil
+}
+
+func (r *postgresSales) Returns(saleID int) ([]models.SaleReturn, error) {
+	query := `
+		SELECT id, sale_id, user_id, reason, refund_amount, created_at
+		FROM sale_returns
+		WHERE sale_id = $1
+		ORDER BY created_at
+	`
+
+	returns := []models.SaleReturn{}
+	if err := r.db.Select(&returns, query, saleID); err != nil {
+		return nil, err
+	}
+	if len(returns) == 0 {
+		var exists bool
+		if err := r.db.Get(&exists, `SELECT EXISTS (SELECT 1 FROM sales WHERE id = $1)`, saleID); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrNotFound
+		}
+	}
+
+	itemQuery := `
+		SELECT id, return_id, sale_item_id, batch_id, quantity, disposition, refund_amount
+		FROM sale_return_items
+		WHERE return_id = $1
+		ORDER BY id
+	`
+	for i := range returns {
+		if err := r.db.Select(&returns[i].Items, itemQuery, returns[i].ID); err != nil {
+			return nil, err
+		}
+	}
+
+	return returns, nil
+}
+
+func (r *postgresSales) CreateReturn(actor Actor, saleID int, req models.CreateSaleReturnRequest) (models.SaleReturn, error) {
+	var saleReturn models.SaleReturn
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return saleReturn, err
+	}
+	defer tx.Rollback()
+
+	// Lock the sale so concurrent returns cannot over-return a line
+	var total models.Money
+	saleQuery := `SELECT total FROM sales WHERE id = $1 FOR UPDATE`
+	err = tx.QueryRow(saleQuery, saleID).Scan(&total)
+	if err == sql.ErrNoRows {
+		return saleReturn, ErrNotFound
+	}
+	if err != nil {
+		return saleReturn, err
+	}
+
+	// The total is spread over the lines to know what each line was paid for
+	lineIDs, lineTotals, err := saleLineTotals(tx, saleID)
+	if err != nil {
+		return saleReturn, err
+	}
+
+	// Lock the medicines of the sale before their batches, in ID order like
+	// sales do, so a return and a sale cannot deadlock
+	lockQuery := `
+		SELECT m.id
+		FROM medicines m
+		JOIN sale_items si ON si.medicine_id = m.id
+		WHERE si.sale_id = $1
+		ORDER BY m.id
+		FOR UPDATE OF m
+	`
+	if _, err = tx.Exec(lockQuery, saleID); err != nil {
+		return saleReturn, err
+	}
+
+	// Refunds never add up to more than was paid
+	var refunded models.Money
+	refundedQuery := `SELECT COALESCE(SUM(refund_amount), 0) FROM sale_returns WHERE sale_id = $1`
+	if err = tx.QueryRow(refundedQuery, saleID).Scan(&refunded); err != nil {
+		return saleReturn, err
+	}
+
+	returnQuery := `
+		INSERT INTO sale_returns (sale_id, user_id, reason, refund_amount, created_at)
+		VALUES ($1, $2, $3, 0, $4)
+		RETURNING id, sale_id, user_id, reason, refund_amount, created_at
+	`
+	err = tx.QueryRow(returnQuery, saleID, actor.UserID, req.Reason, time.Now()).Scan(
+		&saleReturn.ID,
+		&saleReturn.SaleID,
+		&saleReturn.UserID,
+		&saleReturn.Reason,
+		&saleReturn.RefundAmount,
+		&saleReturn.CreatedAt,
+	)
+	if err != nil {
+		return saleReturn, err
+	}
+
+	touched := map[int]bool{}
+	for _, line := range req.Items {
+		var medicineID, soldQuantity int
+		itemQuery := `
+			SELECT medicine_id, quantity
+			FROM sale_items
+			WHERE id = $1 AND sale_id = $2
+		`
+		err = tx.QueryRow(itemQuery, line.SaleItemID, saleID).Scan(&medicineID, &soldQuantity)
+		if err == sql.ErrNoRows {
+			return saleReturn, &ReturnError{SaleItemID: line.SaleItemID, Returnable: -1}
+		}
+		if err != nil {
+			return saleReturn, err
+		}
+
+		// Work out how much of each batch is still returnable for this line
+		outstanding, err := returnableBatches(tx, line.SaleItemID)
+		if err != nil {
+			return saleReturn, err
+		}
+		available := 0
+		for _, a := range outstanding {
+			available += a.Quantity
+		}
+		returnedBefore := soldQuantity - available
+		paid := paidShare(lineTotals, slices.Index(lineIDs, line.SaleItemID), total)
+
+		quantity := line.Quantity
+		if quantity == 0 {
+			quantity = available
+		}
+		if quantity == 0 || quantity > available {
+			return saleReturn, &ReturnError{SaleItemID: line.SaleItemID, Returnable: available}
+		}
+
+		var returned []BatchAllocation
+		remaining := quantity
+		for _, a := range outstanding {
+			if remaining == 0 {
+				break
+			}
+			take := min(a.Quantity, remaining)
+			remaining -= take
+			refund := min(refundAmount(paid, soldQuantity, returnedBefore, take), total-refunded)
+			returnedBefore += take
+			refunded += refund
+
+			// Returned stock always goes back into its batch first; damaged
+			// stock is then written off so both steps show in the ledger
+			restockQuery := `
+				UPDATE medicine_batches
+				SET quantity = quantity + $1, updated_at = $2
+				WHERE id = $3
+			`
+			if _, err = tx.Exec(restockQuery, take, time.Now(), a.BatchID); err != nil {
+				return saleReturn, err
+			}
+			returned = append(returned, BatchAllocation{BatchID: a.BatchID, Quantity: take})
+
+			item := models.SaleReturnItem{
+				ReturnID:     saleReturn.ID,
+				SaleItemID:   line.SaleItemID,
+				BatchID:      &a.BatchID,
+				Quantity:     take,
+				Disposition:  line.Disposition,
+				RefundAmount: refund,
+			}
+			insertQuery := `
+				INSERT INTO sale_return_items (return_id, sale_item_id, batch_id, quantity, disposition, refund_amount)
+				VALUES ($1, $2, $3, $4, $5, $6)
+				RETURNING id
+			`
+			err = tx.QueryRow(
+				insertQuery,
+				item.ReturnID,
+				item.SaleItemID,
+				item.BatchID,
+				item.Quantity,
+				item.Disposition,
+				item.RefundAmount,
+			).Scan(&item.ID)
+			if err != nil {
+				return saleReturn, err
+			}
+			saleReturn.RefundAmount += item.RefundAmount
+			saleReturn.Items = append(saleReturn.Items, item)
+		}
+
+		movement := models.StockMovement{
+			MedicineID:    medicineID,
+			MovementType:  models.MovementReturn,
+			UserID:        actor.UserID,
+			Reason:        req.Reason,
+			ReferenceType: "sale_return",
+			ReferenceID:   &saleReturn.ID,
+		}
+		if err = recordMovements(tx, movement, returned); err != nil {
+			return saleReturn, err
+		}
+
+		if line.Disposition == models.ReturnDamaged {
+			writeOffs := make([]BatchAllocation, len(returned))
+			for i, r := range returned {
+				if _, err = adjustStock(tx, medicineID, &r.BatchID, -r.Quantity); err != nil {
+					return saleReturn, err
+				}
+				writeOffs[i] = BatchAllocation{BatchID: r.BatchID, Quantity: -r.Quantity}
+			}
+			movement.MovementType = models.MovementWriteOff
+			movement.Reason = "Damaged return: " + req.Reason
+			if err = recordMovements(tx, movement, writeOffs); err != nil {
+				return saleReturn, err
+			}
+		}
+
+		touched[medicineID] = true
+	}
+
+	// Update medicine quantities
+	for medicineID := range touched {
+		if err = syncMedicineStock(tx, medicineID); err != nil {
+			return saleReturn, err
+		}
+	}
+
+	refundQuery := `UPDATE sale_returns SET refund_amount = $1 WHERE id = $2`
+	if _, err = tx.Exec(refundQuery, saleReturn.RefundAmount, saleReturn.ID); err != nil {
+		return saleReturn, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "sale_return", saleReturn.ID, nil, saleReturn); err != nil {
+		return saleReturn, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return saleReturn, err
+	}
+	return saleReturn, nil
+}
+
+// paidShare is the part of the total paid for a sale that falls on its line
+// i: the total spread over the lines in proportion to their totals, which
+// are given in the order of the line IDs. Each share is the difference of
+// two running totals, so the shares add up to the total exactly.
+func paidShare(lineTotals []models.Money, i int, total models.Money) models.Money {
+	var subtotal, before models.Money
+	for j, lineTotal := range lineTotals {
+		subtotal += lineTotal
+		if j < i {
+			before += lineTotal
+		}
+	}
+	if subtotal == 0 {
+		return 0
+	}
+	through := before + lineTotals[i]
+	return total.MulDiv(through, subtotal) - total.MulDiv(before, subtotal)
+}
+
+// refundAmount is what is refunded for returning quantity units of a sale
+// line of which returned units were returned before. paid is the line's
+// share of the sale total. Like paidShare, it is a difference of running
+// totals: the refunds of a line add up to exactly its share once all of it
+// is returned, however it was split.
+func refundAmount(paid models.Money, sold, returned, quantity int) models.Money {
+	return paid.MulDiv(models.Money(returned+quantity), models.Money(sold)) -
+		paid.MulDiv(models.Money(returned), models.Money(sold))
+}
+
+// saleLineTotals returns the IDs and totals of the lines of a sale, in the
+// order of their IDs
+func saleLineTotals(tx *sql.Tx, saleID int) ([]int, []models.Money, error) {
+	rows, err := tx.Query(`SELECT id, total_price FROM sale_items WHERE sale_id = $1 ORDER BY id`, saleID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	var totals []models.Money
+	for rows.Next() {
+		var id int
+		var total models.Money
+		if err = rows.Scan(&id, &total); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		totals = append(totals, total)
+	}
+	return ids, totals, rows.Err()
+}
+
+// returnableBatches returns, per batch, how much of a sale line has not been
+// returned yet. The batches allocated last are listed first so returned stock
+// goes back to the freshest batch.
+func returnableBatches(tx *sql.Tx, saleItemID int) ([]BatchAllocation, error) {
+	query := `
+		SELECT sb.batch_id, b.batch_number, b.expiry_date,
+		       SUM(sb.quantity) - COALESCE((
+		           SELECT SUM(ri.quantity)
+		           FROM sale_return_items ri
+		           WHERE ri.sale_item_id = $1 AND ri.batch_id = sb.batch_id
+		       ), 0) AS outstanding
+		FROM sale_batches sb
+		JOIN medicine_batches b ON b.id = sb.batch_id
+		WHERE sb.sale_item_id = $1
+		GROUP BY sb.batch_id, b.batch_number, b.expiry_date
+		ORDER BY MAX(sb.id) DESC
+	`
+	rows, err := tx.Query(query, saleItemID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var allocations []BatchAllocation
+	for rows.Next() {
+		var a BatchAllocation
+		if err := rows.Scan(&a.BatchID, &a.BatchNumber, &a.ExpiryDate, &a.Quantity); err != nil {
+			return nil, err
+		}
+		if a.Quantity > 0 {
+			allocations = append(allocations, a)
+		}
+	}
+
+	return allocations, rows.Err()
+}
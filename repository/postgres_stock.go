@@ -0,0 +1,163 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const movementColumns = `id, medicine_id, batch_id, movement_type, quantity, balance_after, user_id,
+		       reason, reference_type, reference_id, created_at`
+
+const adjustmentColumns = `id, medicine_id, batch_id, delta, reason_code, note, user_id, created_at`
+
+// postgresStock stores batches, the stock ledger and adjustments in the
+// medicine_batches, stock_movements and stock_adjustments tables
+type postgresStock struct {
+	db *sqlx.DB
+}
+
+func (r *postgresStock) Batches(q ListQuery) (models.Page[models.MedicineBatch], error) {
+	return fetchPage[models.MedicineBatch](r.db, BatchList, q)
+}
+
+func (r *postgresStock) Batch(id int) (models.MedicineBatch, error) {
+	query := `SELECT ` + batchColumns + ` FROM medicine_batches WHERE id = $1`
+
+	var batch models.MedicineBatch
+	err := r.db.Get(&batch, query, id)
+	if err == sql.ErrNoRows {
+		return batch, ErrNotFound
+	}
+	return batch, err
+}
+
+func (r *postgresStock) Movements(q ListQuery) (models.Page[models.StockMovement], error) {
+	return fetchPage[models.StockMovement](r.db, MovementList, q)
+}
+
+func (r *postgresStock) Adjustments(q ListQuery) (models.Page[models.StockAdjustment], error) {
+	return fetchPage[models.StockAdjustment](r.db, AdjustmentList, q)
+}
+
+func (r *postgresStock) Reconcile() ([]models.StockDiscrepancy, error) {
+	query := `
+		SELECT m.id AS medicine_id, m.name, m.quantity,
+		       COALESCE(SUM(sm.quantity), 0) AS ledger_quantity
+		FROM medicines m
+		LEFT JOIN stock_movements sm ON sm.medicine_id = m.id
+		GROUP BY m.id, m.name, m.quantity
+		HAVING m.quantity <> COALESCE(SUM(sm.quantity), 0)
+		ORDER BY m.id
+	`
+
+	discrepancies := []models.StockDiscrepancy{}
+	err := r.db.Select(&discrepancies, query)
+	return discrepancies, err
+}
+
+func (r *postgresStock) Adjust(actor Actor, medicineID int, req models.CreateStockAdjustmentRequest) (models.StockAdjustment, error) {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return models.StockAdjustment{}, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	err = tx.QueryRow(`SELECT true FROM medicines WHERE id = $1 FOR UPDATE`, medicineID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return models.StockAdjustment{}, ErrNotFound
+	}
+	if err != nil {
+		return models.StockAdjustment{}, err
+	}
+
+	adjustment, err := applyAdjustment(tx, actor, medicineID, req.BatchID, req.Delta, req.ReasonCode, req.Note)
+	if err != nil {
+		return adjustment, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "stock_adjustment", adjustment.ID, nil, adjustment); err != nil {
+		return adjustment, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return adjustment, err
+	}
+	return adjustment, nil
+}
+
+// applyAdjustment changes the stock of a medicine, records the adjustment and
+// its ledger entries, and updates the medicine quantity. Count corrections are
+// ledgered as adjustments; every other reason is a write-off.
+func applyAdjustment(tx *sql.Tx, actor Actor, medicineID int, batchID *int, delta int, reasonCode, note string) (models.StockAdjustment, error) {
+	var adjustment models.StockAdjustment
+
+	changes, err := adjustStock(tx, medicineID, batchID, delta)
+	if err == sql.ErrNoRows {
+		return adjustment, ErrBatchNotFound
+	}
+	if err != nil {
+		return adjustment, err
+	}
+
+	query := `
+		INSERT INTO stock_adjustments (medicine_id, batch_id, delta, reason_code, note, user_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + adjustmentColumns
+	if batchID == nil && len(changes) == 1 {
+		batchID = &changes[0].BatchID
+	}
+
+	err = tx.QueryRow(query, medicineID, batchID, delta, reasonCode, note, actor.UserID, time.Now()).Scan(
+		&adjustment.ID,
+		&adjustment.MedicineID,
+		&adjustment.BatchID,
+		&adjustment.Delta,
+		&adjustment.ReasonCode,
+		&adjustment.Note,
+		&adjustment.UserID,
+		&adjustment.CreatedAt,
+	)
+	if err != nil {
+		return adjustment, err
+	}
+
+	movement := models.StockMovement{
+		MedicineID:    medicineID,
+		MovementType:  adjustmentMovementType(reasonCode),
+		UserID:        actor.UserID,
+		Reason:        adjustmentReason(reasonCode, note),
+		ReferenceType: "stock_adjustment",
+		ReferenceID:   &adjustment.ID,
+	}
+	if err = recordMovements(tx, movement, changes); err != nil {
+		return adjustment, err
+	}
+
+	if err = syncMedicineStock(tx, medicineID); err != nil {
+		return adjustment, err
+	}
+	return adjustment, nil
+}
+
+// adjustmentMovementType is the ledger type of an adjustment: count
+// corrections are adjustments, every other reason is a write-off
+func adjustmentMovementType(reasonCode string) string {
+	if reasonCode == models.AdjustmentCountCorrection {
+		return models.MovementAdjustment
+	}
+	return models.MovementWriteOff
+}
+
+// adjustmentReason is the ledger reason of an adjustment
+func adjustmentReason(reasonCode, note string) string {
+	if note == "" {
+		return reasonCode
+	}
+	return reasonCode + ": " + note
+}
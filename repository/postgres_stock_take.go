@@ -0,0 +1,338 @@
+package repository
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const stockTakeColumns = `id, status, note, created_by, posted_by, created_at, posted_at`
+
+// Expected quantity is snapshotted when a line is counted. Lines counted
+// before the snapshot was kept fall back to the live quantity of the counted
+// batch, or of the medicine for lines counted without a batch.
+const stockTakeLineQuery = `
+	SELECT l.id, l.stock_take_id, l.medicine_id, l.batch_id, l.counted_quantity,
+	       COALESCE(l.expected_quantity, b.quantity, m.quantity) AS expected_quantity,
+	       l.counted_quantity - COALESCE(l.expected_quantity, b.quantity, m.quantity) AS variance,
+	       l.adjustment_id, l.counted_by, l.counted_at
+	FROM stock_take_lines l
+	JOIN medicines m ON m.id = l.medicine_id
+	LEFT JOIN medicine_batches b ON b.id = l.batch_id
+	WHERE l.stock_take_id = $1
+	ORDER BY l.medicine_id, l.batch_id NULLS FIRST
+`
+
+// postgresStockTakes stores stock takes in the stock_takes and
+// stock_take_lines tables
+type postgresStockTakes struct {
+	db *sqlx.DB
+}
+
+func (r *postgresStockTakes) List(q ListQuery) (models.Page[models.StockTake], error) {
+	return fetchPage[models.StockTake](r.db, StockTakeList, q)
+}
+
+func (r *postgresStockTakes) Get(id int) (models.StockTake, error) {
+	query := `SELECT ` + stockTakeColumns + ` FROM stock_takes WHERE id = $1`
+
+	var stockTake models.StockTake
+	err := r.db.Get(&stockTake, query, id)
+	if err == sql.ErrNoRows {
+		return stockTake, ErrNotFound
+	}
+	if err != nil {
+		return stockTake, err
+	}
+
+	stockTake.Lines = []models.StockTakeLine{}
+	err = r.db.Select(&stockTake.Lines, stockTakeLineQuery, id)
+	return stockTake, err
+}
+
+func (r *postgresStockTakes) Create(actor Actor, note string) (models.StockTake, error) {
+	var stockTake models.StockTake
+
+	query := `
+		INSERT INTO stock_takes (status, note, created_by, created_at)
+		VALUES ($1, $2, $3, $4)
+		RETURNING ` + stockTakeColumns
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return stockTake, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(query, models.StockTakeOpen, note, actor.UserID, time.Now()).Scan(
+		&stockTake.ID,
+		&stockTake.Status,
+		&stockTake.Note,
+		&stockTake.CreatedBy,
+		&stockTake.PostedBy,
+		&stockTake.CreatedAt,
+		&stockTake.PostedAt,
+	)
+	if err != nil {
+		return stockTake, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "stock_take", stockTake.ID, nil, stockTake); err != nil {
+		return stockTake, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return stockTake, err
+	}
+	return stockTake, nil
+}
+
+func (r *postgresStockTakes) SubmitCounts(actor Actor, id int, counts []models.StockCountRequest) (models.StockTake, error) {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	defer tx.Rollback()
+
+	if err = lockOpenStockTake(tx, id); err != nil {
+		return models.StockTake{}, err
+	}
+
+	upsertQuery := `
+		INSERT INTO stock_take_lines (stock_take_id, medicine_id, batch_id, counted_quantity, expected_quantity, counted_by, counted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (stock_take_id, medicine_id, COALESCE(batch_id, 0))
+		DO UPDATE SET counted_quantity = EXCLUDED.counted_quantity,
+		              expected_quantity = EXCLUDED.expected_quantity,
+		              counted_by = EXCLUDED.counted_by,
+		              counted_at = EXCLUDED.counted_at
+	`
+	for _, count := range counts {
+		// The quantity on hand when the shelf is counted is what the count is
+		// compared with, so sales and receipts before posting are not
+		// mistaken for variance
+		var expected int
+		err = tx.QueryRow(`SELECT quantity FROM medicines WHERE id = $1`, count.MedicineID).Scan(&expected)
+		if err == sql.ErrNoRows {
+			return models.StockTake{}, &MedicineError{MedicineID: count.MedicineID, Err: ErrNotFound}
+		}
+		if err != nil {
+			return models.StockTake{}, err
+		}
+
+		// A medicine is counted either as a whole or batch by batch, not both
+		var conflicting bool
+		conflictQuery := `
+			SELECT EXISTS (
+				SELECT 1 FROM stock_take_lines
+				WHERE stock_take_id = $1 AND medicine_id = $2 AND (batch_id IS NULL) <> $3
+			)
+		`
+		err = tx.QueryRow(conflictQuery, id, count.MedicineID, count.BatchID == nil).Scan(&conflicting)
+		if err != nil {
+			return models.StockTake{}, err
+		}
+		if conflicting {
+			return models.StockTake{}, &CountError{MedicineID: count.MedicineID}
+		}
+
+		if count.BatchID != nil {
+			batchQuery := `SELECT quantity FROM medicine_batches WHERE id = $1 AND medicine_id = $2`
+			err = tx.QueryRow(batchQuery, *count.BatchID, count.MedicineID).Scan(&expected)
+			if err == sql.ErrNoRows {
+				return models.StockTake{}, &CountError{MedicineID: count.MedicineID, BatchID: count.BatchID}
+			}
+			if err != nil {
+				return models.StockTake{}, err
+			}
+		}
+
+		_, err = tx.Exec(upsertQuery, id, count.MedicineID, count.BatchID, count.CountedQuantity, expected, actor.UserID, time.Now())
+		if err != nil {
+			return models.StockTake{}, err
+		}
+	}
+
+	if err = RecordAudit(tx, actor, AuditCount, "stock_take", id, nil, models.SubmitStockCountsRequest{Counts: counts}); err != nil {
+		return models.StockTake{}, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.Get(id)
+}
+
+func (r *postgresStockTakes) Post(actor Actor, id int) (models.StockTake, error) {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	defer tx.Rollback()
+
+	// The session row lock makes a concurrent post wait and then see the
+	// session as already posted
+	if err = lockOpenStockTake(tx, id); err != nil {
+		return models.StockTake{}, err
+	}
+
+	before, err := AuditSnapshot(tx, "stock_takes", id, false)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+
+	// A line's expected quantity is nil if it was counted before snapshots
+	// were kept
+	type countedLine struct {
+		models.StockTakeLine
+		expected *int
+	}
+	var lines []countedLine
+	linesQuery := `
+		SELECT id, stock_take_id, medicine_id, batch_id, counted_quantity, expected_quantity, counted_by, counted_at
+		FROM stock_take_lines
+		WHERE stock_take_id = $1
+	`
+	rows, err := tx.Query(linesQuery, id)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	for rows.Next() {
+		var line countedLine
+		err = rows.Scan(&line.ID, &line.StockTakeID, &line.MedicineID, &line.BatchID,
+			&line.CountedQuantity, &line.expected, &line.CountedBy, &line.CountedAt)
+		if err != nil {
+			rows.Close()
+			return models.StockTake{}, err
+		}
+		lines = append(lines, line)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return models.StockTake{}, err
+	}
+	if len(lines) == 0 {
+		return models.StockTake{}, ErrNoCounts
+	}
+
+	// Lock medicines in ID order so posting cannot deadlock with sales
+	sort.Slice(lines, func(i, j int) bool { return lines[i].MedicineID < lines[j].MedicineID })
+
+	note := "Stock take #" + strconv.Itoa(id)
+	for _, line := range lines {
+		var live int
+		err = tx.QueryRow(`SELECT quantity FROM medicines WHERE id = $1 FOR UPDATE`, line.MedicineID).Scan(&live)
+		if err != nil {
+			return models.StockTake{}, err
+		}
+		if line.BatchID != nil {
+			err = tx.QueryRow(`SELECT quantity FROM medicine_batches WHERE id = $1 FOR UPDATE`, *line.BatchID).Scan(&live)
+			if err != nil {
+				return models.StockTake{}, err
+			}
+		}
+		expected := live
+		if line.expected != nil {
+			expected = *line.expected
+		}
+
+		// The variance is applied to the stock on hand now, which keeps
+		// whatever was sold or received since the line was counted
+		var adjustmentID *int
+		if variance := line.CountedQuantity - expected; variance != 0 {
+			adjustment, err := applyAdjustment(tx, actor, line.MedicineID, line.BatchID, variance,
+				models.AdjustmentCountCorrection, note)
+			if err != nil {
+				return models.StockTake{}, &MedicineError{MedicineID: line.MedicineID, Err: err}
+			}
+			adjustmentID = &adjustment.ID
+		}
+
+		updateQuery := `UPDATE stock_take_lines SET expected_quantity = $1, adjustment_id = $2 WHERE id = $3`
+		if _, err = tx.Exec(updateQuery, expected, adjustmentID, line.ID); err != nil {
+			return models.StockTake{}, err
+		}
+	}
+
+	postQuery := `UPDATE stock_takes SET status = $1, posted_by = $2, posted_at = $3 WHERE id = $4`
+	if _, err = tx.Exec(postQuery, models.StockTakePosted, actor.UserID, time.Now(), id); err != nil {
+		return models.StockTake{}, err
+	}
+
+	after, err := AuditSnapshot(tx, "stock_takes", id, false)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	if err = RecordAudit(tx, actor, AuditPost, "stock_take", id, before, after); err != nil {
+		return models.StockTake{}, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.Get(id)
+}
+
+func (r *postgresStockTakes) Cancel(actor Actor, id int) (models.StockTake, error) {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	defer tx.Rollback()
+
+	if err = lockOpenStockTake(tx, id); err != nil {
+		return models.StockTake{}, err
+	}
+
+	before, err := AuditSnapshot(tx, "stock_takes", id, false)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+
+	query := `UPDATE stock_takes SET status = $1 WHERE id = $2`
+	if _, err = tx.Exec(query, models.StockTakeCancelled, id); err != nil {
+		return models.StockTake{}, err
+	}
+
+	after, err := AuditSnapshot(tx, "stock_takes", id, false)
+	if err != nil {
+		return models.StockTake{}, err
+	}
+	if err = RecordAudit(tx, actor, AuditCancel, "stock_take", id, before, after); err != nil {
+		return models.StockTake{}, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return models.StockTake{}, err
+	}
+	return r.Get(id)
+}
+
+// lockOpenStockTake locks a stock-take session for the rest of the
+// transaction. It fails unless the session exists and is open.
+func lockOpenStockTake(tx *sql.Tx, id int) error {
+	var status string
+	err := tx.QueryRow(`SELECT status FROM stock_takes WHERE id = $1 FOR UPDATE`, id).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != models.StockTakeOpen {
+		return &StockTakeStatusError{Status: status}
+	}
+	return nil
+}
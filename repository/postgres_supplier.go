@@ -0,0 +1,222 @@
+package repository
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+const supplierColumns = `id, name, contact_person, phone, email, address, created_at, updated_at, version`
+
+// postgresSuppliers stores suppliers in the suppliers table
+type postgresSuppliers struct {
+	db *sqlx.DB
+}
+
+func (r *postgresSuppliers) List(q ListQuery) (models.Page[models.Supplier], error) {
+	return fetchPage[models.Supplier](r.db, SupplierList, q)
+}
+
+func (r *postgresSuppliers) Get(id int) (models.Supplier, error) {
+	query := `SELECT ` + supplierColumns + ` FROM suppliers WHERE id = $1`
+
+	var supplier models.Supplier
+	err := r.db.Get(&supplier, query, id)
+	if err == sql.ErrNoRows {
+		return supplier, ErrNotFound
+	}
+	return supplier, err
+}
+
+func (r *postgresSuppliers) Create(actor Actor, req models.CreateSupplierRequest) (models.Supplier, error) {
+	var supplier models.Supplier
+
+	query := `
+		INSERT INTO suppliers (name, contact_person, phone, email, address, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING ` + supplierColumns
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return supplier, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(
+		query,
+		req.Name,
+		req.ContactPerson,
+		req.Phone,
+		req.Email,
+		req.Address,
+		time.Now(),
+		time.Now(),
+	).Scan(
+		&supplier.ID,
+		&supplier.Name,
+		&supplier.ContactPerson,
+		&supplier.Phone,
+		&supplier.Email,
+		&supplier.Address,
+		&supplier.CreatedAt,
+		&supplier.UpdatedAt,
+		&supplier.Version,
+	)
+	if err != nil {
+		return supplier, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "supplier", supplier.ID, nil, supplier); err != nil {
+		return supplier, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return supplier, err
+	}
+	return supplier, nil
+}
+
+func (r *postgresSuppliers) Update(actor Actor, id, version int, req models.UpdateSupplierRequest) (models.Supplier, error) {
+	var supplier models.Supplier
+
+	// Build dynamic update query
+	updates := []string{}
+	args := []interface{}{}
+	argCount := 1
+
+	if req.Name != nil {
+		updates = append(updates, "name = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Name)
+		argCount++
+	}
+	if req.ContactPerson != nil {
+		updates = append(updates, "contact_person = $"+strconv.Itoa(argCount))
+		args = append(args, *req.ContactPerson)
+		argCount++
+	}
+	if req.Phone != nil {
+		updates = append(updates, "phone = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Phone)
+		argCount++
+	}
+	if req.Email != nil {
+		updates = append(updates, "email = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Email)
+		argCount++
+	}
+	if req.Address != nil {
+		updates = append(updates, "address = $"+strconv.Itoa(argCount))
+		args = append(args, *req.Address)
+		argCount++
+	}
+
+	updates = append(updates, "updated_at = $"+strconv.Itoa(argCount), "version = version + 1")
+	args = append(args, time.Now())
+	argCount++
+
+	args = append(args, id, version)
+	idArg, versionArg := "$"+strconv.Itoa(argCount), "$"+strconv.Itoa(argCount+1)
+
+	query := `
+		UPDATE suppliers
+		SET ` + updates[0]
+	for i := 1; i < len(updates); i++ {
+		query += ", " + updates[i]
+	}
+	query += `
+		WHERE id = ` + idArg + ` AND (` + versionArg + ` = 0 OR version = ` + versionArg + `)
+		RETURNING ` + supplierColumns
+
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return supplier, err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "suppliers", id, true)
+	if err == sql.ErrNoRows {
+		return supplier, ErrNotFound
+	}
+	if err != nil {
+		return supplier, err
+	}
+
+	err = tx.QueryRow(query, args...).Scan(
+		&supplier.ID,
+		&supplier.Name,
+		&supplier.ContactPerson,
+		&supplier.Phone,
+		&supplier.Email,
+		&supplier.Address,
+		&supplier.CreatedAt,
+		&supplier.UpdatedAt,
+		&supplier.Version,
+	)
+	if err == sql.ErrNoRows {
+		return supplier, ErrVersionMismatch
+	}
+	if err != nil {
+		return supplier, err
+	}
+
+	after, err := AuditSnapshot(tx, "suppliers", id, false)
+	if err != nil {
+		return supplier, err
+	}
+	if err = RecordAudit(tx, actor, AuditUpdate, "supplier", id, before, after); err != nil {
+		return supplier, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return supplier, err
+	}
+	return supplier, nil
+}
+
+func (r *postgresSuppliers) Delete(actor Actor, id, version int) error {
+	// Start transaction
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "suppliers", id, true)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// Purchases keep a supplier from being deleted
+	query := `DELETE FROM suppliers WHERE id = $1 AND ($2 = 0 OR version = $2)`
+	result, err := tx.Exec(query, id, version)
+	if isForeignKeyViolation(err) {
+		return ErrInUse
+	}
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrVersionMismatch
+	}
+
+	if err = RecordAudit(tx, actor, AuditDelete, "supplier", id, before, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
@@ -0,0 +1,215 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// These tests cover what only the PostgreSQL repositories do: row locking and
+// storing amounts in DECIMAL columns. They run when TEST_DATABASE_URL is set,
+// see make test-postgres.
+
+// lockMedicine locks a medicine row in a transaction of its own, as a sale
+// does while it takes stock, until the returned transaction ends
+func lockMedicine(t *testing.T, db *sqlx.DB, medicineID int) *sqlx.Tx {
+	t.Helper()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		t.Fatalf("begin: %v", err)
+	}
+	t.Cleanup(func() { tx.Rollback() })
+
+	if _, err = tx.Exec(`SELECT true FROM medicines WHERE id = $1 FOR UPDATE`, medicineID); err != nil {
+		t.Fatalf("lock medicine: %v", err)
+	}
+	return tx
+}
+
+// waitForLockWait waits until a connection is waiting for a row lock
+func waitForLockWait(t *testing.T, db *sqlx.DB) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var waiting bool
+		if err := db.Get(&waiting, `SELECT EXISTS (SELECT 1 FROM pg_locks WHERE NOT granted)`); err != nil {
+			t.Fatalf("list locks: %v", err)
+		}
+		if waiting {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("nothing waited for the medicine lock")
+}
+
+// assertBatchUnlocked checks that a batch can be locked without waiting, by
+// the transaction holding its medicine
+func assertBatchUnlocked(t *testing.T, tx *sqlx.Tx, batchID int) {
+	t.Helper()
+
+	if _, err := tx.Exec(`SELECT true FROM medicine_batches WHERE id = $1 FOR UPDATE NOWAIT`, batchID); err != nil {
+		t.Errorf("batch %d is locked by a change waiting for its medicine, which deadlocks with sales: %v", batchID, err)
+	}
+}
+
+func TestVoidLocksMedicineBeforeBatch(t *testing.T) {
+	db := postgresTestDatabase(t)
+	repos := NewPostgres(db)
+	actor := testActor()
+	medicine, purchases := seedStock(t, repos, actor, 5, time.Now().AddDate(1, 0, 0))
+
+	holder := lockMedicine(t, db, medicine.ID)
+	voided := make(chan error, 1)
+	go func() {
+		_, err := repos.Purchases.Void(actor, purchases[0].ID, "Wrong delivery")
+		voided <- err
+	}()
+	waitForLockWait(t, db)
+
+	assertBatchUnlocked(t, holder, purchases[0].Batch.ID)
+	holder.Rollback()
+	if err := <-voided; err != nil {
+		t.Fatalf("void: %v", err)
+	}
+	if got := quantity(t, repos, medicine.ID); got != 0 {
+		t.Errorf("quantity after void = %d, want 0", got)
+	}
+}
+
+func TestReturnLocksMedicineBeforeBatch(t *testing.T) {
+	db := postgresTestDatabase(t)
+	repos := NewPostgres(db)
+	actor := testActor()
+	medicine, purchases := seedStock(t, repos, actor, 5, time.Now().AddDate(1, 0, 0))
+
+	sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 2}},
+	})
+	if err != nil {
+		t.Fatalf("create sale: %v", err)
+	}
+
+	holder := lockMedicine(t, db, medicine.ID)
+	returned := make(chan error, 1)
+	go func() {
+		_, err := repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID, Disposition: models.ReturnRestock}},
+		})
+		returned <- err
+	}()
+	waitForLockWait(t, db)
+
+	assertBatchUnlocked(t, holder, purchases[0].Batch.ID)
+	holder.Rollback()
+	if err := <-returned; err != nil {
+		t.Fatalf("create return: %v", err)
+	}
+	if got := quantity(t, repos, medicine.ID); got != 5 {
+		t.Errorf("quantity after return = %d, want 5", got)
+	}
+}
+
+func TestConcurrentSalesDoNotOversell(t *testing.T) {
+	db := postgresTestDatabase(t)
+	repos := NewPostgres(db)
+	actor := testActor()
+	now := time.Now()
+	medicine, purchases := seedStock(t, repos, actor, 5, now.AddDate(1, 0, 0), now.AddDate(0, 1, 0))
+
+	// Both sales see 10 units in stock, only one can have 6 of them
+	start := make(chan struct{})
+	results := make(chan error, 2)
+	for range 2 {
+		go func() {
+			<-start
+			_, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+				Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 6}},
+			})
+			results <- err
+		}()
+	}
+	close(start)
+
+	failed := 0
+	for range 2 {
+		if err := <-results; err != nil {
+			if !errors.Is(err, ErrInsufficientStock) {
+				t.Errorf("create sale: %v", err)
+			}
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("%d of 2 sales failed, want 1", failed)
+	}
+
+	// The sale took the batch expiring sooner first
+	if got := quantity(t, repos, medicine.ID); got != 4 {
+		t.Errorf("quantity = %d, want 4", got)
+	}
+	sooner, err := repos.Stock.Batch(purchases[1].Batch.ID)
+	if err != nil {
+		t.Fatalf("get batch: %v", err)
+	}
+	later, err := repos.Stock.Batch(purchases[0].Batch.ID)
+	if err != nil {
+		t.Fatalf("get batch: %v", err)
+	}
+	if sooner.Quantity != 0 || later.Quantity != 4 {
+		t.Errorf("batch quantities = %d expiring sooner, %d later, want 0 and 4", sooner.Quantity, later.Quantity)
+	}
+}
+
+func TestStoredRefundsAddUpToTotal(t *testing.T) {
+	db := postgresTestDatabase(t)
+	repos := NewPostgres(db)
+	actor := testActor()
+	medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+	// 7 x 2.50 less 0.01 is 17.49, which does not split evenly over 7 units
+	sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+		Items:    []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 7}},
+		Discount: 1,
+	})
+	if err != nil {
+		t.Fatalf("create sale: %v", err)
+	}
+	for _, returnQuantity := range []int{2, 1, 3, 1} {
+		_, err := repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID, Quantity: returnQuantity, Disposition: models.ReturnRestock}},
+		})
+		if err != nil {
+			t.Fatalf("create return: %v", err)
+		}
+	}
+
+	// The DECIMAL columns hold the refunds as computed, so the stored
+	// returns and their lines both add up to the stored total
+	var total, returns, items models.Money
+	if err = db.Get(&total, `SELECT total FROM sales WHERE id = $1`, sale.ID); err != nil {
+		t.Fatalf("get total: %v", err)
+	}
+	if err = db.Get(&returns, `SELECT SUM(refund_amount) FROM sale_returns WHERE sale_id = $1`, sale.ID); err != nil {
+		t.Fatalf("sum returns: %v", err)
+	}
+	query := `
+		SELECT SUM(ri.refund_amount)
+		FROM sale_return_items ri
+		JOIN sale_returns r ON r.id = ri.return_id
+		WHERE r.sale_id = $1
+	`
+	if err = db.Get(&items, query, sale.ID); err != nil {
+		t.Fatalf("sum return items: %v", err)
+	}
+	if total != 1749 || returns != total || items != total {
+		t.Errorf("refunded %v in returns and %v in lines of a %v sale", returns, items, total)
+	}
+}
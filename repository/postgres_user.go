@@ -0,0 +1,218 @@
+package repository
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// userColumns are the columns of users, in the order of models.User. The
+// password hash is left out.
+const userColumns = `id, username, email, role, is_active, totp_enabled, created_at, updated_at`
+
+// revokeUserSessions ends every open session of a user
+func revokeUserSessions(exec sqlx.Execer, userID int) error {
+	query := `UPDATE auth_sessions SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`
+	_, err := exec.Exec(query, time.Now(), userID)
+	return err
+}
+
+// clearLoginFailures forgets the failed logins of a username
+func clearLoginFailures(exec sqlx.Execer, username string) error {
+	query := `DELETE FROM login_failures WHERE kind = $1 AND key = $2`
+	_, err := exec.Exec(query, LoginFailureUsername, username)
+	return err
+}
+
+// removeMFA turns off two-factor authentication for a user
+func removeMFA(tx *sqlx.Tx, userID int) error {
+	query := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = NULL, updated_at = $1
+		WHERE id = $2
+	`
+	if _, err := tx.Exec(query, time.Now(), userID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+	return err
+}
+
+// postgresUsers stores users in the users table
+type postgresUsers struct {
+	db *sqlx.DB
+}
+
+func (r *postgresUsers) List(q ListQuery) (models.Page[models.User], error) {
+	return fetchPage[models.User](r.db, UserList, q)
+}
+
+func (r *postgresUsers) Get(id int) (models.User, error) {
+	query := `SELECT ` + userColumns + ` FROM users WHERE id = $1`
+
+	var user models.User
+	err := r.db.Get(&user, query, id)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	return user, err
+}
+
+func (r *postgresUsers) Invite(actor Actor, username, email, role, tokenHash string, expiresAt time.Time) (models.User, error) {
+	var user models.User
+
+	// Without a password hash no password matches until the invite is used
+	query := `
+		INSERT INTO users (username, email, password_hash, role, is_active, created_at, updated_at)
+		VALUES ($1, $2, '', $3, TRUE, $4, $4)
+		RETURNING ` + userColumns
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	err = tx.Get(&user, query, username, email, role, now)
+	if isUniqueViolation(err) {
+		return user, ErrConflict
+	}
+	if err != nil {
+		return user, err
+	}
+
+	tokenQuery := `
+		INSERT INTO password_reset_tokens (user_id, token_hash, expires_at, created_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	if _, err = tx.Exec(tokenQuery, user.ID, tokenHash, expiresAt, now); err != nil {
+		return user, err
+	}
+
+	if err = RecordAudit(tx, actor, AuditCreate, "user", user.ID, nil, user); err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *postgresUsers) UpdateRole(actor Actor, id int, role string) (models.User, error) {
+	query := `
+		UPDATE users
+		SET role = $1, updated_at = $2
+		WHERE id = $3
+		RETURNING ` + userColumns
+
+	return r.update(actor, AuditRoleChange, id, func(tx *sqlx.Tx, user *models.User) error {
+		return tx.Get(user, query, role, time.Now(), id)
+	})
+}
+
+func (r *postgresUsers) SetActive(actor Actor, id int, active bool) (models.User, error) {
+	query := `
+		UPDATE users
+		SET is_active = $1, updated_at = $2
+		WHERE id = $3
+		RETURNING ` + userColumns
+
+	action := AuditReactivate
+	if !active {
+		action = AuditDeactivate
+	}
+	return r.update(actor, action, id, func(tx *sqlx.Tx, user *models.User) error {
+		if err := tx.Get(user, query, active, time.Now(), id); err != nil {
+			return err
+		}
+
+		// A deactivated user's sessions can no longer be refreshed
+		if !active {
+			return revokeUserSessions(tx, id)
+		}
+		return nil
+	})
+}
+
+func (r *postgresUsers) ResetMFA(actor Actor, id int) (models.User, error) {
+	return r.update(actor, AuditMFAReset, id, func(tx *sqlx.Tx, user *models.User) error {
+		if err := removeMFA(tx, id); err != nil {
+			return err
+		}
+		return tx.Get(user, `SELECT `+userColumns+` FROM users WHERE id = $1`, id)
+	})
+}
+
+// update changes a user with fn in a transaction that records the change
+// in the audit log
+func (r *postgresUsers) update(actor Actor, action string, id int, fn func(tx *sqlx.Tx, user *models.User) error) (models.User, error) {
+	var user models.User
+
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return user, err
+	}
+	defer tx.Rollback()
+
+	before, err := AuditSnapshot(tx, "users", id, true)
+	if err == sql.ErrNoRows {
+		return user, ErrNotFound
+	}
+	if err != nil {
+		return user, err
+	}
+
+	if err = fn(tx, &user); err != nil {
+		return user, err
+	}
+
+	after, err := AuditSnapshot(tx, "users", id, false)
+	if err != nil {
+		return user, err
+	}
+	if err = RecordAudit(tx, actor, action, "user", id, before, after); err != nil {
+		return user, err
+	}
+
+	// Commit transaction
+	if err = tx.Commit(); err != nil {
+		return user, err
+	}
+	return user, nil
+}
+
+func (r *postgresUsers) Unlock(actor Actor, id int) error {
+	// Start transaction
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var username string
+	err = tx.QueryRow(`SELECT username FROM users WHERE id = $1`, id).Scan(&username)
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = clearLoginFailures(tx, username); err != nil {
+		return err
+	}
+
+	if err = RecordAudit(tx, actor, AuditUnlock, "user", id, nil, nil); err != nil {
+		return err
+	}
+
+	// Commit transaction
+	return tx.Commit()
+}
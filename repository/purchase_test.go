@@ -0,0 +1,109 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestVoidPurchase(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, purchases := seedStock(t, repos, actor, 5, time.Now().AddDate(1, 0, 0), time.Now().AddDate(0, 1, 0))
+
+		// Stock from the second purchase has been sold
+		_, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 2}},
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+		var stockLeft *StockLeftError
+		if _, err = repos.Purchases.Void(actor, purchases[1].ID, "Wrong delivery"); !errors.As(err, &stockLeft) || stockLeft.Left != 2 {
+			t.Errorf("void of a sold purchase: %v", err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 8 {
+			t.Errorf("quantity after refused void = %d, want 8", got)
+		}
+
+		purchase, err := repos.Purchases.Void(actor, purchases[0].ID, "Wrong delivery")
+		if err != nil {
+			t.Fatalf("void: %v", err)
+		}
+		if purchase.VoidedAt == nil || purchase.VoidedBy == nil || *purchase.VoidedBy != *actor.UserID ||
+			purchase.VoidReason == nil || *purchase.VoidReason != "Wrong delivery" {
+			t.Errorf("voided purchase = %+v", purchase)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 3 {
+			t.Errorf("quantity = %d, want 3", got)
+		}
+		if _, err = repos.Purchases.Void(actor, purchases[0].ID, "Again"); err != ErrAlreadyVoided {
+			t.Errorf("second void: %v", err)
+		}
+		if _, err = repos.Purchases.Void(actor, 9999, "Wrong delivery"); err != ErrNotFound {
+			t.Errorf("void of an unknown purchase: %v", err)
+		}
+
+		// The voided purchase is kept as received
+		stored, err := repos.Purchases.Get(purchases[0].ID)
+		if err != nil {
+			t.Fatalf("get purchase: %v", err)
+		}
+		if stored.Quantity != 5 || stored.TotalPrice != purchases[0].TotalPrice || stored.VoidedAt == nil {
+			t.Errorf("stored purchase = %+v", stored)
+		}
+	})
+}
+
+func TestSupplierWithPurchasesIsKept(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		_, purchases := seedStock(t, repos, actor, 5, time.Now().AddDate(1, 0, 0))
+
+		if err := repos.Suppliers.Delete(actor, purchases[0].SupplierID, 0); err != ErrInUse {
+			t.Fatalf("delete of a supplier with purchases: %v", err)
+		}
+		if _, err := repos.Purchases.Get(purchases[0].ID); err != nil {
+			t.Errorf("get purchase: %v", err)
+		}
+
+		unused, err := repos.Suppliers.Create(actor, models.CreateSupplierRequest{Name: "Other Co"})
+		if err != nil {
+			t.Fatalf("create supplier: %v", err)
+		}
+		if err = repos.Suppliers.Delete(actor, unused.ID, 0); err != nil {
+			t.Errorf("delete of a supplier without purchases: %v", err)
+		}
+	})
+}
+
+func TestPurchaseOfUnknownMedicineOrSupplier(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		_, purchases := seedStock(t, repos, actor, 5, time.Now().AddDate(1, 0, 0))
+		req := models.CreatePurchaseRequest{
+			MedicineID:  9999,
+			SupplierID:  purchases[0].SupplierID,
+			Quantity:    1,
+			UnitPrice:   100,
+			BatchNumber: "LOT-X",
+			ExpiryDate:  time.Now().AddDate(1, 0, 0),
+		}
+
+		_, err := repos.Purchases.Create(actor, req)
+		var medicineErr *MedicineError
+		if !errors.As(err, &medicineErr) || medicineErr.MedicineID != 9999 || medicineErr.Err != ErrNotFound {
+			t.Errorf("purchase of an unknown medicine: %v", err)
+		}
+
+		req.MedicineID, req.SupplierID = purchases[0].MedicineID, 9999
+		if _, err = repos.Purchases.Create(actor, req); err != ErrSupplierNotFound {
+			t.Errorf("purchase from an unknown supplier: %v", err)
+		}
+		if got := quantity(t, repos, purchases[0].MedicineID); got != 5 {
+			t.Errorf("quantity = %d, want 5", got)
+		}
+	})
+}
@@ -0,0 +1,449 @@
+// Package repository stores the aggregates of the pharmacy: medicines,
+// suppliers, purchases, sales, stock, stock takes, users and API keys, along
+// with what users log in with and the audit log of their changes.
+//
+// Handlers and middleware depend on the interfaces of this package rather
+// than on the database. NewPostgres returns the repositories the app runs
+// with; NewMemory returns repositories that keep everything in memory, so
+// handlers can be tested without a database.
+//
+// Every change is made atomically together with its stock ledger entries and
+// its audit entry.
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/alfinkly/hci-golang-back/oidc"
+)
+
+var (
+	// ErrNotFound is returned when the entity asked for does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrInsufficientStock is returned when unexpired batches cannot cover a
+	// quantity
+	ErrInsufficientStock = errors.New("insufficient unexpired stock")
+	// ErrAlreadyVoided is returned when voiding a purchase twice
+	ErrAlreadyVoided = errors.New("purchase is already voided")
+	// ErrPurchaseBatchGone is returned when voiding a purchase whose batch was
+	// deleted
+	ErrPurchaseBatchGone = errors.New("the batch received with this purchase no longer exists")
+	// ErrVersionMismatch is returned when changing an entity on condition
+	// that it is at a version it is no longer at
+	ErrVersionMismatch = errors.New("the entity has been changed since that version")
+	// ErrDiscountTooLarge is returned when the discount of a sale is more
+	// than its subtotal
+	ErrDiscountTooLarge = errors.New("discount cannot exceed the subtotal")
+	// ErrBatchNotFound is returned when a batch does not exist or belongs to
+	// another medicine
+	ErrBatchNotFound = errors.New("batch not found for this medicine")
+	// ErrSupplierNotFound is returned when a purchase names a supplier that
+	// does not exist
+	ErrSupplierNotFound = errors.New("supplier not found")
+	// ErrNoCounts is returned when posting a stock take nothing was counted in
+	ErrNoCounts = errors.New("stock take has no counts")
+	// ErrInUse is returned when deleting an entity that history such as
+	// batches, the stock ledger, purchases or sales refers to
+	ErrInUse = errors.New("the entity is referred to by its history")
+	// ErrUsernameTaken is returned when creating a user with the username of
+	// another user
+	ErrUsernameTaken = errors.New("username is already taken")
+	// ErrConflict is returned when creating a user with the username or email
+	// of another user
+	ErrConflict = errors.New("username or email is already taken")
+	// ErrInvalidToken is returned when a refresh token, password reset token
+	// or login state is unknown, used or expired
+	ErrInvalidToken = errors.New("invalid or expired token")
+	// ErrTokenReused is returned when a refresh token is presented again
+	// after it was rotated
+	ErrTokenReused = errors.New("refresh token has already been used")
+	// ErrSessionEnded is returned when a session has expired or been revoked,
+	// or the access token of a session has been revoked
+	ErrSessionEnded = errors.New("session has expired or been revoked")
+	// ErrUserInactive is returned when a deactivated user would sign in
+	ErrUserInactive = errors.New("account is deactivated")
+	// ErrMFAEnabled is returned when setting up two-factor authentication
+	// for a user who already has it
+	ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFANotSetUp is returned when enabling two-factor authentication
+	// before a secret was set up
+	ErrMFANotSetUp = errors.New("two-factor authentication has not been set up")
+	// ErrMFANotEnabled is returned when checking a two-factor code of a user
+	// without two-factor authentication
+	ErrMFANotEnabled = errors.New("two-factor authentication is not enabled")
+	// ErrInvalidCode is returned when a two-factor or recovery code is wrong
+	// or has already been used
+	ErrInvalidCode = errors.New("invalid two-factor code")
+)
+
+// MedicineError is an error about one of the medicines of a sale
+type MedicineError struct {
+	MedicineID int
+	Err        error
+}
+
+func (e *MedicineError) Error() string {
+	return fmt.Sprintf("medicine %d: %v", e.MedicineID, e.Err)
+}
+
+func (e *MedicineError) Unwrap() error {
+	return e.Err
+}
+
+// StockLeftError is returned when voiding a purchase some of whose units have
+// already left stock
+type StockLeftError struct {
+	Left     int
+	Received int
+}
+
+func (e *StockLeftError) Error() string {
+	return fmt.Sprintf("Cannot void purchase: %d of %d received units have already left stock", e.Left, e.Received)
+}
+
+// ReturnError is a line of a return that cannot be returned
+type ReturnError struct {
+	SaleItemID int
+	// Returnable is how much of the line can still be returned, or -1 if the
+	// line is not part of the sale
+	Returnable int
+}
+
+func (e *ReturnError) Error() string {
+	if e.Returnable < 0 {
+		return fmt.Sprintf("Sale item %d does not belong to this sale", e.SaleItemID)
+	}
+	return fmt.Sprintf("Only %d of sale item %d can be returned", e.Returnable, e.SaleItemID)
+}
+
+// StockTakeStatusError is returned when changing a stock take that is no
+// longer open
+type StockTakeStatusError struct {
+	Status string
+}
+
+func (e *StockTakeStatusError) Error() string {
+	return "Stock take is " + e.Status
+}
+
+// CountError is a count that cannot be recorded in a stock take
+type CountError struct {
+	MedicineID int
+	// BatchID is the counted batch if it does not belong to the medicine. It
+	// is nil if the medicine is counted both as a whole and by batch.
+	BatchID *int
+}
+
+func (e *CountError) Error() string {
+	if e.BatchID != nil {
+		return fmt.Sprintf("Batch %d does not belong to medicine %d", *e.BatchID, e.MedicineID)
+	}
+	return fmt.Sprintf("Medicine %d cannot be counted both as a whole and by batch", e.MedicineID)
+}
+
+// Actor is who makes a change, as recorded in the audit log
+type Actor struct {
+	UserID    *int
+	Username  string
+	APIKeyID  *int
+	IP        string
+	RequestID string
+}
+
+// MedicineRepository stores medicines. Their quantity is derived from their
+// batches, so it cannot be set directly.
+type MedicineRepository interface {
+	List(q ListQuery) (models.Page[models.Medicine], error)
+	// Search returns the medicines matching every word of a search, most
+	// relevant first. The search must have words, see SearchWords.
+	Search(search string, limit int) ([]models.MedicineSearchResult, error)
+	Get(id int) (models.Medicine, error)
+	// Create adds a medicine, with its opening stock as a batch
+	Create(actor Actor, req models.CreateMedicineRequest) (models.Medicine, error)
+	// Update changes the fields of a medicine that are set in req. Unless
+	// version is 0, the medicine must still be at that version.
+	Update(actor Actor, id, version int, req models.UpdateMedicineRequest) (models.Medicine, error)
+	// Delete removes a medicine. Unless version is 0, the medicine must still
+	// be at that version.
+	Delete(actor Actor, id, version int) error
+}
+
+// SupplierRepository stores suppliers
+type SupplierRepository interface {
+	List(q ListQuery) (models.Page[models.Supplier], error)
+	Get(id int) (models.Supplier, error)
+	Create(actor Actor, req models.CreateSupplierRequest) (models.Supplier, error)
+	// Update changes the fields of a supplier that are set in req. Unless
+	// version is 0, the supplier must still be at that version.
+	Update(actor Actor, id, version int, req models.UpdateSupplierRequest) (models.Supplier, error)
+	// Delete removes a supplier. Unless version is 0, the supplier must still
+	// be at that version.
+	Delete(actor Actor, id, version int) error
+}
+
+// PurchaseRepository stores purchases and receives them into stock
+type PurchaseRepository interface {
+	List(q ListQuery) (models.Page[models.Purchase], error)
+	// Get returns a purchase with the batch received with it, if it still
+	// exists
+	Get(id int) (models.Purchase, error)
+	// Create records a purchase and receives it as a new batch
+	Create(actor Actor, req models.CreatePurchaseRequest) (models.Purchase, error)
+	// Void takes the received quantity back out of the purchase's batch and
+	// marks the purchase as voided
+	Void(actor Actor, id int, reason string) (models.Purchase, error)
+}
+
+// SaleRepository stores sales and their returns
+type SaleRepository interface {
+	// List returns sale headers without their line items
+	List(q ListQuery) (models.Page[models.Sale], error)
+	// Get returns a sale with its line items and the batches they were
+	// dispensed from
+	Get(id int) (models.Sale, error)
+	// Create records a sale, taking stock from batches first-expiry-first-out.
+	// The actor must be a user.
+	Create(actor Actor, req models.CreateSaleRequest) (models.Sale, error)
+	// Returns lists the returns recorded against a sale, oldest first. It
+	// returns ErrNotFound if the sale does not exist.
+	Returns(saleID int) ([]models.SaleReturn, error)
+	// CreateReturn puts returned stock back into the batches it was sold
+	// from, or writes it off if damaged. The actor must be a user.
+	CreateReturn(actor Actor, saleID int, req models.CreateSaleReturnRequest) (models.SaleReturn, error)
+}
+
+// StockRepository stores the batches of medicines, the stock ledger and
+// stock adjustments
+type StockRepository interface {
+	// Batches returns a page of batches
+	Batches(q ListQuery) (models.Page[models.MedicineBatch], error)
+	Batch(id int) (models.MedicineBatch, error)
+	// Movements returns a page of the stock ledger
+	Movements(q ListQuery) (models.Page[models.StockMovement], error)
+	// Adjustments returns a page of stock adjustments
+	Adjustments(q ListQuery) (models.Page[models.StockAdjustment], error)
+	// Reconcile returns the medicines whose quantity does not match the sum
+	// of their ledger
+	Reconcile() ([]models.StockDiscrepancy, error)
+	// Adjust applies a signed change to the stock of a medicine, to a batch
+	// if one is given. Increases without a batch are received into a new
+	// batch; decreases are taken from batches in expiry order, expired
+	// batches included. Count corrections are ledgered as adjustments and
+	// every other reason as a write-off. The actor must be a user.
+	Adjust(actor Actor, medicineID int, req models.CreateStockAdjustmentRequest) (models.StockAdjustment, error)
+}
+
+// StockTakeRepository stores physical inventory count sessions
+type StockTakeRepository interface {
+	// List returns a page of sessions without their lines
+	List(q ListQuery) (models.Page[models.StockTake], error)
+	// Get returns a session with its lines and their variances
+	Get(id int) (models.StockTake, error)
+	// Create opens a session. The actor must be a user.
+	Create(actor Actor, note string) (models.StockTake, error)
+	// SubmitCounts records counts in an open session. Counting a medicine or
+	// batch again replaces its earlier count. The actor must be a user.
+	SubmitCounts(actor Actor, id int, counts []models.StockCountRequest) (models.StockTake, error)
+	// Post applies the variances of an open session as count corrections
+	// and closes it. The actor must be a user.
+	Post(actor Actor, id int) (models.StockTake, error)
+	// Cancel closes an open session without changing stock
+	Cancel(actor Actor, id int) (models.StockTake, error)
+}
+
+// UserRepository stores users administered by admins
+type UserRepository interface {
+	List(q ListQuery) (models.Page[models.User], error)
+	Get(id int) (models.User, error)
+	// Invite adds an active user without a password, with a single-use
+	// token, stored by its hash, that sets the password like a password reset
+	// token until expiresAt. A username or email another user has returns
+	// ErrConflict.
+	Invite(actor Actor, username, email, role, tokenHash string, expiresAt time.Time) (models.User, error)
+	UpdateRole(actor Actor, id int, role string) (models.User, error)
+	// SetActive activates or deactivates a user. Deactivating a user
+	// revokes their sessions.
+	SetActive(actor Actor, id int, active bool) (models.User, error)
+	// Unlock lifts a login lockout of a user
+	Unlock(actor Actor, id int) error
+	// ResetMFA removes two-factor authentication from a user
+	ResetMFA(actor Actor, id int) (models.User, error)
+}
+
+// APIKeyRepository stores the API keys of machine clients
+type APIKeyRepository interface {
+	List(q ListQuery) (models.Page[models.APIKey], error)
+	// Create stores a key by its hash. The name, prefix, user, scopes and
+	// expiry are taken from key.
+	Create(actor Actor, key models.APIKey, keyHash string) (models.APIKey, error)
+	// Revoke stops a key from being accepted. Revoking a revoked key keeps
+	// the original revocation time.
+	Revoke(actor Actor, id int) (models.APIKey, error)
+}
+
+// OIDCState is a login at the identity provider that has not come back yet
+type OIDCState struct {
+	Nonce        string
+	CodeVerifier string
+	ExpiresAt    time.Time
+}
+
+// APIKeyCredentials are an API key, the hash it is checked against and the
+// user it acts as
+type APIKeyCredentials struct {
+	Key     models.APIKey
+	KeyHash string
+	User    models.User
+}
+
+// AuthRepository stores what users sign in with: passwords, failed logins,
+// sessions and their refresh tokens, revoked access tokens, password reset
+// tokens, two-factor secrets and recovery codes, and identity provider
+// logins. Tokens and codes are stored by their hash.
+type AuthRepository interface {
+	// User returns a user with their password hash
+	User(id int) (models.User, error)
+	// UserByUsername returns a user with their password hash
+	UserByUsername(username string) (models.User, error)
+	// Register adds an active user with a password. The user is recorded as
+	// the actor of their own registration. A username or email another
+	// user has returns ErrConflict.
+	Register(actor Actor, username, email, passwordHash, role string) (models.User, error)
+
+	// LoginLockedUntil returns when the lockout of a username or client IP
+	// ends, or the zero time if neither is locked out
+	LoginLockedUntil(username, ip string) (time.Time, error)
+	// RecordLoginFailure counts a failed login against a username or IP
+	// counter, see LoginFailureUsername, and returns how many failures it
+	// has. Failures before since are forgotten.
+	RecordLoginFailure(kind, key string, since time.Time) (int, error)
+	// LockLogin locks out a username or IP counter until a time
+	LockLogin(kind, key string, until time.Time) error
+	// ClearLoginFailures forgets the failed logins of a username
+	ClearLoginFailures(username string) error
+
+	// StartSession opens a session of a user until expiresAt with its first
+	// refresh token, and returns the session ID
+	StartSession(userID int, userAgent, ip string, expiresAt time.Time, refreshTokenHash string) (int, error)
+	// Refresh replaces a refresh token with a new one and returns the user
+	// and session it is for. Presenting a replaced token again revokes its
+	// session, with the user recorded as the actor, and returns
+	// ErrTokenReused.
+	Refresh(actor Actor, tokenHash, newTokenHash string) (models.User, int, error)
+	// Session returns the user of a session an access token was issued for,
+	// with their current role and status. It returns ErrSessionEnded if the
+	// session or the token has been revoked.
+	Session(userID, sessionID int, tokenID string) (models.User, error)
+	// Logout revokes an access token until it expires and ends its session
+	Logout(actor Actor, sessionID int, tokenID string, tokenExpiresAt time.Time) error
+	// LogoutAll revokes an access token until it expires and ends every
+	// session of the actor
+	LogoutAll(actor Actor, tokenID string, tokenExpiresAt time.Time) error
+
+	// ChangePassword sets the password hash of a user and ends their sessions
+	// other than keepSessionID
+	ChangePassword(actor Actor, userID, keepSessionID int, passwordHash string) error
+	// PasswordResetUser returns the active user with an email who has a
+	// local password to reset
+	PasswordResetUser(email string) (models.User, error)
+	// CreateResetToken gives a user a password reset token valid until
+	// expiresAt, in place of any earlier one
+	CreateResetToken(userID int, tokenHash string, expiresAt time.Time) error
+	// ResetTokenUser returns the active user a valid password reset token is
+	// for
+	ResetTokenUser(tokenHash string) (models.User, error)
+	// ResetPassword uses up a password reset token to set the password hash
+	// of its user, ends their sessions and lifts a lockout of their username.
+	// The user is recorded as the actor.
+	ResetPassword(actor Actor, tokenHash, passwordHash string) (models.User, error)
+
+	// SetMFASecret stores a new TOTP secret of a user, which is not used
+	// until EnableMFA
+	SetMFASecret(userID int, secret string) error
+	// EnableMFA turns on two-factor authentication of a user if code is valid
+	// for their secret, and replaces their recovery codes
+	EnableMFA(actor Actor, userID int, code string, recoveryCodeHashes []string) (models.User, error)
+	// UseMFACode checks a TOTP code of a user. A code is accepted only once:
+	// its time step must be newer than the last one used.
+	UseMFACode(userID int, code string) error
+	// UseRecoveryCode uses up a recovery code of a user
+	UseRecoveryCode(userID int, codeHash string) error
+	// ReplaceRecoveryCodes replaces the recovery codes of a user if code is a
+	// valid TOTP code
+	ReplaceRecoveryCodes(actor Actor, userID int, code string, recoveryCodeHashes []string) error
+	// DisableMFA turns off two-factor authentication of a user if code is a
+	// valid TOTP code
+	DisableMFA(actor Actor, userID int, code string) error
+
+	// SaveOIDCState keeps a login at the identity provider by the hash of
+	// its state, and forgets expired ones
+	SaveOIDCState(stateHash string, state OIDCState) error
+	// TakeOIDCState returns and forgets a login at the identity provider, so
+	// its state can be used once
+	TakeOIDCState(stateHash string) (OIDCState, error)
+	// LinkOIDCUser returns the local user of an identity provider user. An
+	// existing user with the same verified email is linked and keeps their
+	// role; otherwise a user without a local password is created with role,
+	// and their role is brought up to date at later logins. Creating, linking
+	// and changing the role are recorded in the audit log as made by the user.
+	LinkOIDCUser(actor Actor, identity oidc.Identity, role string) (models.User, error)
+
+	// APIKey returns the API key with a prefix
+	APIKey(prefix string) (APIKeyCredentials, error)
+	// RecordAPIKeyUse records that a key was used at a time, unless its use
+	// was already recorded after since
+	RecordAPIKeyUse(id int, at, since time.Time) error
+}
+
+// AuditRepository reads the audit log
+type AuditRepository interface {
+	List(q ListQuery) (models.Page[models.AuditEntry], error)
+}
+
+// IdempotentResponse is the stored response to a request made with an
+// idempotency key
+type IdempotentResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// IdempotencyClaim is a claim on an idempotency key by an earlier request
+type IdempotencyClaim struct {
+	// RequestHash identifies the request the key was first used for
+	RequestHash string
+	// Response is nil while the request is still being processed
+	Response *IdempotentResponse
+}
+
+// IdempotencyRepository stores the responses to requests made with an
+// idempotency key, per key and user
+type IdempotencyRepository interface {
+	// Claim claims a key for a request until expiresAt. If an earlier request
+	// holds an unexpired claim on the key, the key is not claimed and that
+	// claim is returned instead.
+	Claim(userID int, key, requestHash string, expiresAt time.Time) (*IdempotencyClaim, error)
+	// Complete stores the response to the request that claimed a key
+	Complete(userID int, key string, response IdempotentResponse) error
+	// Release gives up a claim without a response, so the request can be
+	// retried
+	Release(userID int, key string) error
+}
+
+// Repositories are the repositories of every aggregate
+type Repositories struct {
+	Medicines   MedicineRepository
+	Suppliers   SupplierRepository
+	Purchases   PurchaseRepository
+	Sales       SaleRepository
+	Stock       StockRepository
+	StockTakes  StockTakeRepository
+	Users       UserRepository
+	Auth        AuthRepository
+	APIKeys     APIKeyRepository
+	Audit       AuditRepository
+	Idempotency IdempotencyRepository
+}
@@ -0,0 +1,137 @@
+package repository
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/database"
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/jmoiron/sqlx"
+)
+
+// eachRepository runs a test against the in-memory repositories and, when
+// TEST_DATABASE_URL names a scratch PostgreSQL database, against PostgreSQL.
+// The database is migrated and emptied first, and user 1 is created for
+// testActor.
+func eachRepository(t *testing.T, test func(t *testing.T, repos Repositories)) {
+	t.Run("memory", func(t *testing.T) {
+		test(t, NewMemory())
+	})
+	t.Run("postgres", func(t *testing.T) {
+		test(t, NewPostgres(postgresTestDatabase(t)))
+	})
+}
+
+// postgresTestDatabase returns the empty scratch database named by
+// TEST_DATABASE_URL, and skips the test if there is none
+func postgresTestDatabase(t *testing.T) *sqlx.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+	return emptyTestDatabase(t, url)
+}
+
+// emptyTestDatabase connects to a test database, migrates it and deletes
+// every row
+func emptyTestDatabase(t *testing.T, url string) *sqlx.DB {
+	t.Helper()
+
+	db, err := sqlx.Connect("postgres", url)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	database.DB = db
+	if _, err = database.MigrateUp(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var tables []string
+	query := `SELECT tablename FROM pg_tables WHERE schemaname = current_schema() AND tablename <> 'schema_migrations'`
+	if err = db.Select(&tables, query); err != nil {
+		t.Fatalf("list tables: %v", err)
+	}
+	if _, err = db.Exec(`TRUNCATE ` + strings.Join(tables, ", ") + ` RESTART IDENTITY CASCADE`); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	insertQuery := `
+		INSERT INTO users (username, email, password_hash, role, is_active, created_at, updated_at)
+		VALUES ('admin', 'admin@example.com', '-', 'admin', TRUE, NOW(), NOW())
+	`
+	if _, err = db.Exec(insertQuery); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return db
+}
+
+// seedStock creates a medicine and a supplier, and receives a purchase for
+// each expiry date of quantity units each
+func seedStock(t *testing.T, repos Repositories, actor Actor, quantity int, expiries ...time.Time) (models.Medicine, []models.Purchase) {
+	t.Helper()
+
+	medicine, err := repos.Medicines.Create(actor, models.CreateMedicineRequest{Name: "Aspirin", Price: 250})
+	if err != nil {
+		t.Fatalf("create medicine: %v", err)
+	}
+	supplier, err := repos.Suppliers.Create(actor, models.CreateSupplierRequest{Name: "Pharma Co"})
+	if err != nil {
+		t.Fatalf("create supplier: %v", err)
+	}
+
+	var purchases []models.Purchase
+	for i, expiry := range expiries {
+		purchase, err := repos.Purchases.Create(actor, models.CreatePurchaseRequest{
+			MedicineID:  medicine.ID,
+			SupplierID:  supplier.ID,
+			Quantity:    quantity,
+			UnitPrice:   100,
+			BatchNumber: "LOT-" + string(rune('A'+i)),
+			ExpiryDate:  expiry,
+		})
+		if err != nil {
+			t.Fatalf("create purchase: %v", err)
+		}
+		purchases = append(purchases, purchase)
+	}
+
+	medicine, err = repos.Medicines.Get(medicine.ID)
+	if err != nil {
+		t.Fatalf("get medicine: %v", err)
+	}
+	return medicine, purchases
+}
+
+func testActor() Actor {
+	userID := 1
+	return Actor{UserID: &userID, Username: "admin"}
+}
+
+// sell sells quantity units of a medicine
+func sell(t *testing.T, repos Repositories, actor Actor, medicineID, quantity int) {
+	t.Helper()
+
+	_, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+		Items: []models.CreateSaleItemRequest{{MedicineID: medicineID, Quantity: quantity}},
+	})
+	if err != nil {
+		t.Fatalf("create sale: %v", err)
+	}
+}
+
+// quantity returns the quantity on hand of a medicine
+func quantity(t *testing.T, repos Repositories, medicineID int) int {
+	t.Helper()
+
+	medicine, err := repos.Medicines.Get(medicineID)
+	if err != nil {
+		t.Fatalf("get medicine: %v", err)
+	}
+	return medicine.Quantity
+}
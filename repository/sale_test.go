@@ -0,0 +1,322 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestSaleTakesStockFirstExpiryFirstOut(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		now := time.Now()
+		later, sooner, expired := now.AddDate(1, 0, 0), now.AddDate(0, 1, 0), now.AddDate(0, 0, -2)
+		medicine, purchases := seedStock(t, repos, actor, 5, later, sooner, expired)
+		if medicine.Quantity != 15 {
+			t.Fatalf("quantity = %d, want 15", medicine.Quantity)
+		}
+
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items:    []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 7}},
+			Discount: 50,
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+		if sale.Subtotal != 1750 || sale.Total != 1700 {
+			t.Errorf("subtotal, total = %v, %v", sale.Subtotal, sale.Total)
+		}
+
+		// The batch expiring soonest goes first and the line is split across
+		// batches; the expired one is skipped
+		batches := sale.Items[0].Batches
+		if len(batches) != 2 || batches[0].BatchNumber != purchases[1].BatchNumber || batches[0].Quantity != 5 ||
+			batches[1].BatchNumber != purchases[0].BatchNumber || batches[1].Quantity != 2 {
+			t.Errorf("batches = %+v", batches)
+		}
+
+		// The batches are kept with the sale
+		if sale, err = repos.Sales.Get(sale.ID); err != nil {
+			t.Fatalf("get sale: %v", err)
+		}
+		if got := sale.Items[0].Batches; len(got) != 2 || got[0].Quantity != 5 || got[1].Quantity != 2 {
+			t.Errorf("stored batches = %+v", got)
+		}
+
+		// Only the expired batch is left, so the sale fails without changing stock
+		_, err = repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 4}},
+		})
+		var medicineErr *MedicineError
+		if !errors.As(err, &medicineErr) || medicineErr.MedicineID != medicine.ID || medicineErr.Err != ErrInsufficientStock {
+			t.Fatalf("sale beyond stock: %v", err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 8 {
+			t.Errorf("quantity = %d, want 8", got)
+		}
+
+		expiredBatch, err := repos.Stock.Batch(purchases[2].Batch.ID)
+		if err != nil {
+			t.Fatalf("get batch: %v", err)
+		}
+		if expiredBatch.Quantity != 5 {
+			t.Errorf("expired batch quantity = %d, want 5", expiredBatch.Quantity)
+		}
+	})
+}
+
+func TestFailedSaleChangesNoStock(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, purchases := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+		empty, err := repos.Medicines.Create(actor, models.CreateMedicineRequest{Name: "Ibuprofen", Price: 300})
+		if err != nil {
+			t.Fatalf("create medicine: %v", err)
+		}
+
+		// The first line could be sold, but the second cannot, so neither is
+		_, err = repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{
+				{MedicineID: medicine.ID, Quantity: 3},
+				{MedicineID: empty.ID, Quantity: 1},
+			},
+		})
+		var medicineErr *MedicineError
+		if !errors.As(err, &medicineErr) || medicineErr.MedicineID != empty.ID || medicineErr.Err != ErrInsufficientStock {
+			t.Fatalf("sale of a medicine without stock: %v", err)
+		}
+
+		_, err = repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: 9999, Quantity: 1}},
+		})
+		if !errors.As(err, &medicineErr) || medicineErr.Err != ErrNotFound {
+			t.Errorf("sale of an unknown medicine: %v", err)
+		}
+
+		if got := quantity(t, repos, medicine.ID); got != 10 {
+			t.Errorf("quantity = %d, want 10", got)
+		}
+		batch, err := repos.Stock.Batch(purchases[0].Batch.ID)
+		if err != nil || batch.Quantity != 10 {
+			t.Errorf("batch = %+v, %v", batch, err)
+		}
+		sales, err := repos.Sales.List(ListQuery{Limit: 10, Sort: []SortField{{Field: "created_at"}}})
+		if err != nil || sales.Total != 0 {
+			t.Errorf("sales = %+v, %v", sales, err)
+		}
+	})
+}
+
+func TestSaleReturn(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items:    []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 4}},
+			Discount: 100,
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+		itemID := sale.Items[0].ID
+
+		// Refunds are reduced in proportion to the discount: 2 x 2.50 x 9/10
+		saleReturn, err := repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: itemID, Quantity: 2, Disposition: models.ReturnRestock}},
+		})
+		if err != nil {
+			t.Fatalf("create return: %v", err)
+		}
+		if saleReturn.RefundAmount != 450 {
+			t.Errorf("refund = %v, want 4.50", saleReturn.RefundAmount)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 8 {
+			t.Errorf("quantity after restock = %d, want 8", got)
+		}
+
+		var returnErr *ReturnError
+		_, err = repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: itemID, Quantity: 3, Disposition: models.ReturnRestock}},
+		})
+		if !errors.As(err, &returnErr) || returnErr.Returnable != 2 {
+			t.Errorf("over-return: %v", err)
+		}
+		_, err = repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: 9999, Quantity: 1, Disposition: models.ReturnRestock}},
+		})
+		if !errors.As(err, &returnErr) || returnErr.Returnable != -1 {
+			t.Errorf("return of a line from another sale: %v", err)
+		}
+		if _, err = repos.Sales.CreateReturn(actor, 9999, models.CreateSaleReturnRequest{Reason: "Not needed"}); err != ErrNotFound {
+			t.Errorf("return of an unknown sale: %v", err)
+		}
+
+		// Damaged stock is written off, so the quantity does not change
+		if _, err = repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Broken",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: itemID, Disposition: models.ReturnDamaged}},
+		}); err != nil {
+			t.Fatalf("damaged return: %v", err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 8 {
+			t.Errorf("quantity after write-off = %d, want 8", got)
+		}
+
+		returns, err := repos.Sales.Returns(sale.ID)
+		if err != nil || len(returns) != 2 {
+			t.Errorf("returns = %d, %v", len(returns), err)
+		}
+
+		// The sale itself is kept as it was
+		stored, err := repos.Sales.Get(sale.ID)
+		if err != nil {
+			t.Fatalf("get sale: %v", err)
+		}
+		if stored.Total != sale.Total || len(stored.Items) != 1 || stored.Items[0].Quantity != 4 {
+			t.Errorf("sale after returns = %+v", stored)
+		}
+	})
+}
+
+func TestPartialReturnsRefundExactlyWhatWasPaid(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		// 3 x 2.50 less 1.00 is 6.50, which does not split evenly over 3 units
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items:    []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 3}},
+			Discount: 100,
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+
+		var refunds []models.Money
+		var refunded models.Money
+		for range 3 {
+			saleReturn, err := repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+				Reason: "Not needed",
+				Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID, Quantity: 1, Disposition: models.ReturnRestock}},
+			})
+			if err != nil {
+				t.Fatalf("create return: %v", err)
+			}
+			refunds = append(refunds, saleReturn.RefundAmount)
+			refunded += saleReturn.RefundAmount
+		}
+		// Rounding each unit on its own would refund 2.17 three times
+		if refunded != sale.Total || refunds[0] != 217 || refunds[1] != 216 || refunds[2] != 217 {
+			t.Errorf("refunds = %v, total %v, want 6.50", refunds, refunded)
+		}
+	})
+}
+
+func TestPaidSharesAddUpToTotal(t *testing.T) {
+	// 10.00 paid for lines of 3.33, 3.33 and 3.34 plus a free line
+	lineTotals := []models.Money{333, 333, 334, 0}
+	var sum models.Money
+	for i := range lineTotals {
+		sum += paidShare(lineTotals, i, 1000)
+	}
+	if sum != 1000 || paidShare(lineTotals, 3, 1000) != 0 {
+		t.Errorf("shares add up to %v", sum)
+	}
+
+	// However a line of 7 is returned, its refunds add up to its share
+	for _, split := range [][]int{{7}, {1, 1, 1, 1, 1, 1, 1}, {3, 4}, {6, 1}} {
+		var refunded models.Money
+		returned := 0
+		for _, quantity := range split {
+			refunded += refundAmount(1000, 7, returned, quantity)
+			returned += quantity
+		}
+		if refunded != 1000 {
+			t.Errorf("returning %v refunds %v, want 10.00", split, refunded)
+		}
+	}
+}
+
+func TestReturnsOfUnknownSale(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		if _, err := repos.Sales.Returns(9999); err != ErrNotFound {
+			t.Errorf("returns of an unknown sale: %v", err)
+		}
+	})
+}
+
+func TestSaleReturnRestocksFreshestBatchFirst(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		now := time.Now()
+		medicine, purchases := seedStock(t, repos, actor, 5, now.AddDate(1, 0, 0), now.AddDate(0, 1, 0))
+		later, sooner := purchases[0].Batch.ID, purchases[1].Batch.ID
+
+		// 5 units come from the batch expiring sooner and 2 from the later one
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 7}},
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+
+		saleReturn, err := repos.Sales.CreateReturn(actor, sale.ID, models.CreateSaleReturnRequest{
+			Reason: "Not needed",
+			Items:  []models.CreateSaleReturnItemRequest{{SaleItemID: sale.Items[0].ID, Quantity: 3, Disposition: models.ReturnRestock}},
+		})
+		if err != nil {
+			t.Fatalf("create return: %v", err)
+		}
+		if len(saleReturn.Items) != 2 {
+			t.Fatalf("return items = %+v", saleReturn.Items)
+		}
+
+		for batchID, want := range map[int]int{later: 5, sooner: 1} {
+			batch, err := repos.Stock.Batch(batchID)
+			if err != nil {
+				t.Fatalf("get batch: %v", err)
+			}
+			if batch.Quantity != want {
+				t.Errorf("batch %s quantity = %d, want %d", batch.BatchNumber, batch.Quantity, want)
+			}
+		}
+	})
+}
+
+func TestSaleKeepsMedicineAsSold(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 2}},
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+		if item := sale.Items[0]; item.MedicineName != "Aspirin" || item.UnitPrice != 250 {
+			t.Errorf("item = %+v", item)
+		}
+
+		name, price := "Aspirin 500mg", models.Money(300)
+		if _, err = repos.Medicines.Update(actor, medicine.ID, 0, models.UpdateMedicineRequest{Name: &name, Price: &price}); err != nil {
+			t.Fatalf("update medicine: %v", err)
+		}
+		if err = repos.Medicines.Delete(actor, medicine.ID, 0); err != ErrInUse {
+			t.Errorf("delete of a sold medicine: %v", err)
+		}
+
+		// The receipt still reads as it did at the till
+		if sale, err = repos.Sales.Get(sale.ID); err != nil {
+			t.Fatalf("get sale: %v", err)
+		}
+		if item := sale.Items[0]; item.MedicineName != "Aspirin" || item.UnitPrice != 250 || item.TotalPrice != 500 || sale.Total != 500 {
+			t.Errorf("sale = %+v", sale)
+		}
+	})
+}
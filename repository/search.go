@@ -0,0 +1,45 @@
+package repository
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Markers ts_headline puts around matches. They are private use characters
+// so the text can be HTML-escaped before they become <mark> tags.
+const (
+	highlightStart = "\ue000"
+	highlightStop  = "\ue001"
+)
+
+var searchWord = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// SearchWords returns the lower-cased words of a search. A search without
+// words matches nothing.
+func SearchWords(search string) []string {
+	return searchWord.FindAllString(strings.ToLower(search), -1)
+}
+
+// searchTSQuery returns a tsquery matching documents with every word of a
+// search, the last word as a prefix so results show up while typing. It is
+// empty if the search has no words.
+func searchTSQuery(q string) string {
+	words := SearchWords(q)
+	if len(words) == 0 {
+		return ""
+	}
+	words[len(words)-1] += ":*"
+	return strings.Join(words, " & ")
+}
+
+// highlight turns the match markers of a ts_headline fragment into <mark>
+// tags, escaping the rest of the text. It is empty if nothing matched.
+func highlight(fragment string) string {
+	if !strings.Contains(fragment, highlightStart) {
+		return ""
+	}
+	escaped := html.EscapeString(fragment)
+	escaped = strings.ReplaceAll(escaped, highlightStart, "<mark>")
+	return strings.ReplaceAll(escaped, highlightStop, "</mark>")
+}
@@ -0,0 +1,36 @@
+package repository
+
+import "testing"
+
+func TestSearchTSQuery(t *testing.T) {
+	tests := []struct {
+		q    string
+		want string
+	}{
+		{"amoxicilin", "amoxicilin:*"},
+		{"Ibuprofen 200", "ibuprofen & 200:*"},
+		{"  парацетамол  таб ", "парацетамол & таб:*"},
+		// Operators and punctuation cannot reach the tsquery
+		{"aspirin & !(bayer) | 'x':*", "aspirin & bayer & x:*"},
+		{"", ""},
+		{"&|!()", ""},
+	}
+
+	for _, tt := range tests {
+		if got := searchTSQuery(tt.q); got != tt.want {
+			t.Errorf("searchTSQuery(%q) = %q, want %q", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestHighlight(t *testing.T) {
+	fragment := highlightStart + "Amoxicillin" + highlightStop + " <500 mg> & clavulanate"
+	want := "<mark>Amoxicillin</mark> &lt;500 mg&gt; &amp; clavulanate"
+	if got := highlight(fragment); got != want {
+		t.Errorf("highlight = %q, want %q", got, want)
+	}
+
+	if got := highlight("no match here"); got != "" {
+		t.Errorf("highlight of a fragment without matches = %q, want empty", got)
+	}
+}
@@ -0,0 +1,277 @@
+package repository
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// The stock ledger primitives below run inside a transaction of the Postgres
+// repositories.
+
+// batchColumns are the columns of medicine_batches, in the order of
+// models.MedicineBatch
+const batchColumns = `id, medicine_id, supplier_id, purchase_id, batch_number, expiry_date,
+		       quantity, received_at, created_at, updated_at`
+
+// createBatch inserts a new batch inside an existing transaction
+func createBatch(tx *sql.Tx, batch *models.MedicineBatch) error {
+	query := `
+		INSERT INTO medicine_batches (medicine_id, supplier_id, purchase_id, batch_number, expiry_date,
+		                              quantity, received_at, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING ` + batchColumns
+
+	now := time.Now()
+	return tx.QueryRow(
+		query,
+		batch.MedicineID,
+		batch.SupplierID,
+		batch.PurchaseID,
+		batch.BatchNumber,
+		batch.ExpiryDate,
+		batch.Quantity,
+		now,
+		now,
+		now,
+	).Scan(
+		&batch.ID,
+		&batch.MedicineID,
+		&batch.SupplierID,
+		&batch.PurchaseID,
+		&batch.BatchNumber,
+		&batch.ExpiryDate,
+		&batch.Quantity,
+		&batch.ReceivedAt,
+		&batch.CreatedAt,
+		&batch.UpdatedAt,
+	)
+}
+
+// syncMedicineStock recalculates the derived quantity and nearest expiry date
+// of a medicine from its batches. The version is left alone: it guards the
+// fields users edit, and stock moving must not fail their If-Match updates.
+func syncMedicineStock(tx *sql.Tx, medicineID int) error {
+	query := `
+		UPDATE medicines m
+		SET quantity = COALESCE(b.total, 0),
+		    expiry_date = COALESCE(b.nearest_expiry, m.expiry_date),
+		    updated_at = $2
+		FROM (
+			SELECT SUM(quantity) AS total,
+			       MIN(expiry_date) FILTER (WHERE quantity > 0) AS nearest_expiry
+			FROM medicine_batches
+			WHERE medicine_id = $1
+		) b
+		WHERE m.id = $1
+	`
+	_, err := tx.Exec(query, medicineID, time.Now())
+	return err
+}
+
+// BatchAllocation is the quantity taken from a single batch
+type BatchAllocation struct {
+	BatchID     int
+	BatchNumber string
+	ExpiryDate  *time.Time
+	Quantity    int
+}
+
+// consumeFEFO takes quantity from the unexpired batches of a medicine that
+// expire soonest (first-expiry-first-out), splitting across batches as needed.
+// The batches stay locked until the transaction ends.
+func consumeFEFO(tx *sql.Tx, medicineID, quantity int) ([]BatchAllocation, error) {
+	query := `
+		SELECT id, batch_number, expiry_date, quantity
+		FROM medicine_batches
+		WHERE medicine_id = $1
+		  AND quantity > 0
+		  AND (expiry_date IS NULL OR expiry_date >= CURRENT_DATE)
+		ORDER BY expiry_date ASC NULLS LAST, id ASC
+		FOR UPDATE
+	`
+	rows, err := tx.Query(query, medicineID)
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []BatchAllocation
+	remaining := quantity
+	for remaining > 0 && rows.Next() {
+		var a BatchAllocation
+		var available int
+		if err := rows.Scan(&a.BatchID, &a.BatchNumber, &a.ExpiryDate, &available); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		a.Quantity = min(available, remaining)
+		remaining -= a.Quantity
+		allocations = append(allocations, a)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	if remaining > 0 {
+		return nil, ErrInsufficientStock
+	}
+
+	updateQuery := `
+		UPDATE medicine_batches
+		SET quantity = quantity - $1, updated_at = $2
+		WHERE id = $3
+	`
+	for _, a := range allocations {
+		if _, err := tx.Exec(updateQuery, a.Quantity, time.Now(), a.BatchID); err != nil {
+			return nil, err
+		}
+	}
+
+	return allocations, nil
+}
+
+// adjustStock applies a signed quantity change to the stock of a medicine and
+// returns the change made to each batch. With a batch ID the whole change goes
+// to that batch. Without one, increases are received into a new batch and
+// decreases are taken from batches in expiry order, expired batches included.
+func adjustStock(tx *sql.Tx, medicineID int, batchID *int, delta int) ([]BatchAllocation, error) {
+	if delta == 0 {
+		return nil, nil
+	}
+
+	updateQuery := `
+		UPDATE medicine_batches
+		SET quantity = quantity + $1, updated_at = $2
+		WHERE id = $3
+	`
+
+	if batchID != nil {
+		var a BatchAllocation
+		var available int
+		query := `
+			SELECT id, batch_number, expiry_date, quantity
+			FROM medicine_batches
+			WHERE id = $1 AND medicine_id = $2
+			FOR UPDATE
+		`
+		err := tx.QueryRow(query, *batchID, medicineID).Scan(&a.BatchID, &a.BatchNumber, &a.ExpiryDate, &available)
+		if err != nil {
+			return nil, err
+		}
+		if available+delta < 0 {
+			return nil, ErrInsufficientStock
+		}
+		if _, err = tx.Exec(updateQuery, delta, time.Now(), a.BatchID); err != nil {
+			return nil, err
+		}
+		a.Quantity = delta
+		return []BatchAllocation{a}, nil
+	}
+
+	if delta > 0 {
+		batch := models.MedicineBatch{
+			MedicineID:  medicineID,
+			BatchNumber: "ADJ-" + strconv.Itoa(medicineID) + "-" + time.Now().Format("20060102150405"),
+			Quantity:    delta,
+		}
+		if err := createBatch(tx, &batch); err != nil {
+			return nil, err
+		}
+		return []BatchAllocation{{
+			BatchID:     batch.ID,
+			BatchNumber: batch.BatchNumber,
+			Quantity:    delta,
+		}}, nil
+	}
+
+	query := `
+		SELECT id, batch_number, expiry_date, quantity
+		FROM medicine_batches
+		WHERE medicine_id = $1 AND quantity > 0
+		ORDER BY expiry_date ASC NULLS LAST, id ASC
+		FOR UPDATE
+	`
+	rows, err := tx.Query(query, medicineID)
+	if err != nil {
+		return nil, err
+	}
+
+	var allocations []BatchAllocation
+	remaining := -delta
+	for remaining > 0 && rows.Next() {
+		var a BatchAllocation
+		var available int
+		if err := rows.Scan(&a.BatchID, &a.BatchNumber, &a.ExpiryDate, &available); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		take := min(available, remaining)
+		remaining -= take
+		a.Quantity = -take
+		allocations = append(allocations, a)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, err
+	}
+	rows.Close()
+
+	if remaining > 0 {
+		return nil, ErrInsufficientStock
+	}
+
+	for _, a := range allocations {
+		if _, err := tx.Exec(updateQuery, a.Quantity, time.Now(), a.BatchID); err != nil {
+			return nil, err
+		}
+	}
+
+	return allocations, nil
+}
+
+// recordMovements writes one ledger entry per batch change, using movement
+// as a template for the type, user, reason and reference. It must run after
+// the batches have been updated so the running balance can be derived from
+// them.
+func recordMovements(tx *sql.Tx, movement models.StockMovement, changes []BatchAllocation) error {
+	var balance, total int
+	balanceQuery := `SELECT COALESCE(SUM(quantity), 0) FROM medicine_batches WHERE medicine_id = $1`
+	if err := tx.QueryRow(balanceQuery, movement.MedicineID).Scan(&balance); err != nil {
+		return err
+	}
+	for _, change := range changes {
+		total += change.Quantity
+	}
+	balance -= total
+
+	query := `
+		INSERT INTO stock_movements (medicine_id, batch_id, movement_type, quantity, balance_after,
+		                             user_id, reason, reference_type, reference_id, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	`
+	for _, change := range changes {
+		balance += change.Quantity
+		_, err := tx.Exec(
+			query,
+			movement.MedicineID,
+			change.BatchID,
+			movement.MovementType,
+			change.Quantity,
+			balance,
+			movement.UserID,
+			movement.Reason,
+			movement.ReferenceType,
+			movement.ReferenceID,
+			time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
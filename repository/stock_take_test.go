@@ -0,0 +1,257 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestStockTakeComparesCountWithStockWhenCounted(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		stockTake, err := repos.StockTakes.Create(actor, "Monthly count")
+		if err != nil {
+			t.Fatalf("create stock take: %v", err)
+		}
+		if stockTake.Status != models.StockTakeOpen {
+			t.Errorf("status = %q", stockTake.Status)
+		}
+
+		// The shelf holds 9 of the 10 units on record
+		stockTake, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 9},
+		})
+		if err != nil {
+			t.Fatalf("submit counts: %v", err)
+		}
+		if len(stockTake.Lines) != 1 || stockTake.Lines[0].ExpectedQuantity != 10 || stockTake.Lines[0].Variance != -1 {
+			t.Fatalf("lines = %+v", stockTake.Lines)
+		}
+
+		// Selling before posting changes neither the expected quantity nor the
+		// variance
+		sell(t, repos, actor, medicine.ID, 2)
+		if stockTake, err = repos.StockTakes.Get(stockTake.ID); err != nil {
+			t.Fatalf("get stock take: %v", err)
+		}
+		if line := stockTake.Lines[0]; line.ExpectedQuantity != 10 || line.Variance != -1 {
+			t.Errorf("line after sale = %+v", line)
+		}
+
+		stockTake, err = repos.StockTakes.Post(actor, stockTake.ID)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		if stockTake.Status != models.StockTakePosted || stockTake.PostedBy == nil || stockTake.PostedAt == nil {
+			t.Errorf("posted stock take = %+v", stockTake)
+		}
+		line := stockTake.Lines[0]
+		if line.ExpectedQuantity != 10 || line.Variance != -1 || line.AdjustmentID == nil {
+			t.Errorf("posted line = %+v", line)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 7 {
+			t.Errorf("quantity = %d, want 7", got)
+		}
+
+		adjustments, err := repos.Stock.Adjustments(ListQuery{Limit: 10, Sort: []SortField{{Field: "created_at"}}})
+		if err != nil {
+			t.Fatalf("adjustments: %v", err)
+		}
+		if len(adjustments.Data) != 1 || adjustments.Data[0].Delta != -1 ||
+			adjustments.Data[0].ReasonCode != models.AdjustmentCountCorrection {
+			t.Errorf("adjustments = %+v", adjustments.Data)
+		}
+	})
+}
+
+func TestStockTakeWithoutVarianceKeepsSales(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		stockTake, err := repos.StockTakes.Create(actor, "")
+		if err != nil {
+			t.Fatalf("create stock take: %v", err)
+		}
+		if _, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 10},
+		}); err != nil {
+			t.Fatalf("submit counts: %v", err)
+		}
+		sell(t, repos, actor, medicine.ID, 2)
+
+		stockTake, err = repos.StockTakes.Post(actor, stockTake.ID)
+		if err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		if line := stockTake.Lines[0]; line.Variance != 0 || line.AdjustmentID != nil {
+			t.Errorf("posted line = %+v", line)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 8 {
+			t.Errorf("quantity = %d, want 8", got)
+		}
+	})
+}
+
+func TestStockTakeCountsBatches(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		now := time.Now()
+		medicine, purchases := seedStock(t, repos, actor, 5, now.AddDate(1, 0, 0), now.AddDate(0, 6, 0))
+		first, second := purchases[0].Batch.ID, purchases[1].Batch.ID
+		other, err := repos.Medicines.Create(actor, models.CreateMedicineRequest{Name: "Ibuprofen", Price: 300})
+		if err != nil {
+			t.Fatalf("create medicine: %v", err)
+		}
+
+		stockTake, err := repos.StockTakes.Create(actor, "")
+		if err != nil {
+			t.Fatalf("create stock take: %v", err)
+		}
+		stockTake, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, BatchID: &first, CountedQuantity: 3},
+			{MedicineID: medicine.ID, BatchID: &second, CountedQuantity: 6},
+		})
+		if err != nil {
+			t.Fatalf("submit counts: %v", err)
+		}
+		if len(stockTake.Lines) != 2 || stockTake.Lines[0].ExpectedQuantity != 5 || stockTake.Lines[1].ExpectedQuantity != 5 {
+			t.Fatalf("lines = %+v", stockTake.Lines)
+		}
+
+		// Counting a batch again replaces the earlier count
+		stockTake, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, BatchID: &first, CountedQuantity: 4},
+		})
+		if err != nil {
+			t.Fatalf("recount: %v", err)
+		}
+		if len(stockTake.Lines) != 2 || stockTake.Lines[0].CountedQuantity != 4 {
+			t.Fatalf("lines after recount = %+v", stockTake.Lines)
+		}
+
+		// A medicine counted by batch cannot also be counted as a whole
+		_, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 9},
+		})
+		var countErr *CountError
+		if !errors.As(err, &countErr) || countErr.MedicineID != medicine.ID || countErr.BatchID != nil {
+			t.Errorf("whole count of a medicine counted by batch: %v", err)
+		}
+
+		// A batch is counted under its own medicine
+		_, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: other.ID, BatchID: &first, CountedQuantity: 1},
+		})
+		if !errors.As(err, &countErr) || countErr.BatchID == nil || *countErr.BatchID != first {
+			t.Errorf("batch of another medicine: %v", err)
+		}
+
+		_, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: 9999, CountedQuantity: 1},
+		})
+		var medicineErr *MedicineError
+		if !errors.As(err, &medicineErr) || medicineErr.Err != ErrNotFound {
+			t.Errorf("unknown medicine: %v", err)
+		}
+
+		if _, err = repos.StockTakes.Post(actor, stockTake.ID); err != nil {
+			t.Fatalf("post: %v", err)
+		}
+		batches, err := repos.Stock.Batches(ListQuery{
+			Limit:   10,
+			Filters: []FilterValue{{Param: "medicine_id", Value: medicine.ID}},
+			Sort:    []SortField{{Field: "expiry_date"}},
+		})
+		if err != nil {
+			t.Fatalf("batches: %v", err)
+		}
+		// Sorted by expiry, the second batch comes first
+		if len(batches.Data) != 2 || batches.Data[0].Quantity != 6 || batches.Data[1].Quantity != 4 {
+			t.Errorf("batches = %+v", batches.Data)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 10 {
+			t.Errorf("quantity = %d, want 10", got)
+		}
+	})
+}
+
+func TestStockTakeIsPostedOnce(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		stockTake, err := repos.StockTakes.Create(actor, "")
+		if err != nil {
+			t.Fatalf("create stock take: %v", err)
+		}
+		if _, err = repos.StockTakes.Post(actor, stockTake.ID); err != ErrNoCounts {
+			t.Errorf("post without counts: %v", err)
+		}
+		if _, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 12},
+		}); err != nil {
+			t.Fatalf("submit counts: %v", err)
+		}
+		if _, err = repos.StockTakes.Post(actor, stockTake.ID); err != nil {
+			t.Fatalf("post: %v", err)
+		}
+
+		// A second post, a late count or a cancel finds the session posted and
+		// leaves stock alone
+		var statusErr *StockTakeStatusError
+		if _, err = repos.StockTakes.Post(actor, stockTake.ID); !errors.As(err, &statusErr) || statusErr.Status != models.StockTakePosted {
+			t.Errorf("second post: %v", err)
+		}
+		if _, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 1},
+		}); !errors.As(err, &statusErr) {
+			t.Errorf("count after posting: %v", err)
+		}
+		if _, err = repos.StockTakes.Cancel(actor, stockTake.ID); !errors.As(err, &statusErr) {
+			t.Errorf("cancel after posting: %v", err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 12 {
+			t.Errorf("quantity = %d, want 12", got)
+		}
+
+		if _, err = repos.StockTakes.Post(actor, 9999); err != ErrNotFound {
+			t.Errorf("post unknown stock take: %v", err)
+		}
+	})
+}
+
+func TestStockTakePostFailsWhenStockFellBelowVariance(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+
+		stockTake, err := repos.StockTakes.Create(actor, "")
+		if err != nil {
+			t.Fatalf("create stock take: %v", err)
+		}
+		if _, err = repos.StockTakes.SubmitCounts(actor, stockTake.ID, []models.StockCountRequest{
+			{MedicineID: medicine.ID, CountedQuantity: 2},
+		}); err != nil {
+			t.Fatalf("submit counts: %v", err)
+		}
+		// 8 units are missing by the count, but only 5 remain after the sale
+		sell(t, repos, actor, medicine.ID, 5)
+
+		_, err = repos.StockTakes.Post(actor, stockTake.ID)
+		var medicineErr *MedicineError
+		if !errors.As(err, &medicineErr) || medicineErr.Err != ErrInsufficientStock {
+			t.Fatalf("post: %v", err)
+		}
+		if stockTake, err = repos.StockTakes.Get(stockTake.ID); err != nil || stockTake.Status != models.StockTakeOpen {
+			t.Errorf("stock take after failed post = %+v, %v", stockTake, err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 5 {
+			t.Errorf("quantity = %d, want 5", got)
+		}
+	})
+}
@@ -0,0 +1,259 @@
+package repository
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+// overwriteQuantity sets the quantity of a medicine behind the ledger's back,
+// as a manual UPDATE would
+func overwriteQuantity(t *testing.T, repos Repositories, medicineID, quantity int) {
+	t.Helper()
+
+	switch r := repos.Medicines.(type) {
+	case *memoryMedicines:
+		r.s.mu.Lock()
+		defer r.s.mu.Unlock()
+		m := r.s.medicines[medicineID]
+		m.Quantity = quantity
+		r.s.medicines[medicineID] = m
+	case *postgresMedicines:
+		if _, err := r.db.Exec(`UPDATE medicines SET quantity = $1 WHERE id = $2`, quantity, medicineID); err != nil {
+			t.Fatalf("overwrite quantity: %v", err)
+		}
+	default:
+		t.Fatalf("unknown medicine repository %T", r)
+	}
+}
+
+func TestLedgerRecordsEveryStockChange(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		now := time.Now()
+		later, sooner := now.AddDate(1, 0, 0), now.AddDate(0, 1, 0)
+		medicine, purchases := seedStock(t, repos, actor, 5, later, sooner)
+
+		sale, err := repos.Sales.Create(actor, models.CreateSaleRequest{
+			Items: []models.CreateSaleItemRequest{{MedicineID: medicine.ID, Quantity: 7}},
+		})
+		if err != nil {
+			t.Fatalf("create sale: %v", err)
+		}
+		if _, err = repos.Stock.Adjust(actor, medicine.ID, models.CreateStockAdjustmentRequest{
+			Delta:      -1,
+			ReasonCode: models.AdjustmentDamaged,
+		}); err != nil {
+			t.Fatalf("adjust: %v", err)
+		}
+
+		movements, err := repos.Stock.Movements(ListQuery{
+			Limit:   50,
+			Filters: []FilterValue{{Param: "medicine_id", Value: medicine.ID}},
+			Sort:    []SortField{{Field: "id"}},
+		})
+		if err != nil {
+			t.Fatalf("movements: %v", err)
+		}
+		want := []struct {
+			movementType string
+			batchID      int
+			quantity     int
+			balance      int
+		}{
+			{models.MovementInbound, purchases[0].Batch.ID, 5, 5},
+			{models.MovementInbound, purchases[1].Batch.ID, 5, 10},
+			{models.MovementOutbound, purchases[1].Batch.ID, -5, 5},
+			{models.MovementOutbound, purchases[0].Batch.ID, -2, 3},
+			{models.MovementWriteOff, purchases[0].Batch.ID, -1, 2},
+		}
+		if movements.Total != len(want) {
+			t.Fatalf("movements = %+v", movements.Data)
+		}
+		for i, w := range want {
+			m := movements.Data[i]
+			if m.MovementType != w.movementType || m.BatchID == nil || *m.BatchID != w.batchID ||
+				m.Quantity != w.quantity || m.BalanceAfter != w.balance {
+				t.Errorf("movement %d = %+v, want %+v", i, m, w)
+			}
+		}
+		if m := movements.Data[2]; m.ReferenceType != "sale" || m.ReferenceID == nil || *m.ReferenceID != sale.ID {
+			t.Errorf("sale movement reference = %q %v", m.ReferenceType, m.ReferenceID)
+		}
+
+		// The medicine's quantity and nearest expiry are derived from its
+		// batches; the batch expiring sooner is empty now
+		medicine, err = repos.Medicines.Get(medicine.ID)
+		if err != nil {
+			t.Fatalf("get medicine: %v", err)
+		}
+		if medicine.Quantity != 2 || !medicine.ExpiryDate.After(sooner.AddDate(0, 1, 0)) {
+			t.Errorf("medicine quantity, expiry = %d, %v", medicine.Quantity, medicine.ExpiryDate)
+		}
+	})
+}
+
+func TestReconcileFindsQuantityOffLedger(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+		sell(t, repos, actor, medicine.ID, 3)
+
+		discrepancies, err := repos.Stock.Reconcile()
+		if err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		if len(discrepancies) != 0 {
+			t.Errorf("discrepancies = %+v", discrepancies)
+		}
+
+		overwriteQuantity(t, repos, medicine.ID, 12)
+		discrepancies, err = repos.Stock.Reconcile()
+		if err != nil {
+			t.Fatalf("reconcile: %v", err)
+		}
+		want := models.StockDiscrepancy{MedicineID: medicine.ID, Name: medicine.Name, Quantity: 12, LedgerQuantity: 7}
+		if len(discrepancies) != 1 || discrepancies[0] != want {
+			t.Errorf("discrepancies = %+v, want %+v", discrepancies, want)
+		}
+
+		// The next stock change recalculates the quantity from the batches
+		sell(t, repos, actor, medicine.ID, 1)
+		if discrepancies, err = repos.Stock.Reconcile(); err != nil || len(discrepancies) != 0 {
+			t.Errorf("discrepancies after a sale = %+v, %v", discrepancies, err)
+		}
+	})
+}
+
+func TestAdjustStock(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		now := time.Now()
+		medicine, purchases := seedStock(t, repos, actor, 5, now.AddDate(1, 0, 0), now.AddDate(0, 1, 0))
+		later, sooner := purchases[0].Batch.ID, purchases[1].Batch.ID
+		other, err := repos.Medicines.Create(actor, models.CreateMedicineRequest{Name: "Ibuprofen", Price: 300})
+		if err != nil {
+			t.Fatalf("create medicine: %v", err)
+		}
+
+		// Stock cannot go below zero, for the medicine or for a batch
+		for _, req := range []models.CreateStockAdjustmentRequest{
+			{Delta: -11, ReasonCode: models.AdjustmentTheft},
+			{BatchID: &sooner, Delta: -6, ReasonCode: models.AdjustmentDamaged},
+		} {
+			if _, err = repos.Stock.Adjust(actor, medicine.ID, req); err != ErrInsufficientStock {
+				t.Errorf("adjust %+v: %v", req, err)
+			}
+		}
+		if _, err = repos.Stock.Adjust(actor, other.ID, models.CreateStockAdjustmentRequest{
+			BatchID: &sooner, Delta: -1, ReasonCode: models.AdjustmentDamaged,
+		}); err != ErrBatchNotFound {
+			t.Errorf("adjust a batch of another medicine: %v", err)
+		}
+		if _, err = repos.Stock.Adjust(actor, 9999, models.CreateStockAdjustmentRequest{
+			Delta: -1, ReasonCode: models.AdjustmentDamaged,
+		}); err != ErrNotFound {
+			t.Errorf("adjust an unknown medicine: %v", err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 10 {
+			t.Fatalf("quantity after refused adjustments = %d, want 10", got)
+		}
+
+		// A decrease without a batch is taken in expiry order
+		adjustment, err := repos.Stock.Adjust(actor, medicine.ID, models.CreateStockAdjustmentRequest{
+			Delta: -7, ReasonCode: models.AdjustmentExpired, Note: "Shelf check",
+		})
+		if err != nil {
+			t.Fatalf("adjust: %v", err)
+		}
+		if adjustment.Delta != -7 || adjustment.BatchID != nil || adjustment.UserID != *actor.UserID {
+			t.Errorf("adjustment = %+v", adjustment)
+		}
+		for batchID, want := range map[int]int{later: 3, sooner: 0} {
+			if batch, err := repos.Stock.Batch(batchID); err != nil || batch.Quantity != want {
+				t.Errorf("batch %d = %+v, %v, want quantity %d", batchID, batch, err, want)
+			}
+		}
+
+		// An increase without a batch is received into a new batch
+		adjustment, err = repos.Stock.Adjust(actor, medicine.ID, models.CreateStockAdjustmentRequest{
+			Delta: 4, ReasonCode: models.AdjustmentCountCorrection,
+		})
+		if err != nil {
+			t.Fatalf("adjust: %v", err)
+		}
+		if adjustment.BatchID == nil || *adjustment.BatchID == later || *adjustment.BatchID == sooner {
+			t.Fatalf("count correction batch = %v", adjustment.BatchID)
+		}
+		if batch, err := repos.Stock.Batch(*adjustment.BatchID); err != nil || batch.Quantity != 4 {
+			t.Errorf("new batch = %+v, %v", batch, err)
+		}
+		if got := quantity(t, repos, medicine.ID); got != 7 {
+			t.Errorf("quantity = %d, want 7", got)
+		}
+
+		adjustments, err := repos.Stock.Adjustments(ListQuery{
+			Limit:   10,
+			Filters: []FilterValue{{Param: "medicine_id", Value: medicine.ID}},
+			Sort:    []SortField{{Field: "created_at"}},
+		})
+		if err != nil {
+			t.Fatalf("adjustments: %v", err)
+		}
+		if adjustments.Total != 2 || adjustments.Data[0].ReasonCode != models.AdjustmentExpired ||
+			adjustments.Data[1].ReasonCode != models.AdjustmentCountCorrection {
+			t.Errorf("adjustments = %+v", adjustments.Data)
+		}
+
+		// Count corrections are ledgered as adjustments, the rest as write-offs
+		movements, err := repos.Stock.Movements(ListQuery{
+			Limit:   50,
+			Filters: []FilterValue{{Param: "reference_type", Value: "stock_adjustment"}},
+			Sort:    []SortField{{Field: "id"}},
+		})
+		if err != nil {
+			t.Fatalf("movements: %v", err)
+		}
+		var types []string
+		for _, m := range movements.Data {
+			types = append(types, m.MovementType)
+		}
+		if want := []string{models.MovementWriteOff, models.MovementWriteOff, models.MovementAdjustment}; !slices.Equal(types, want) {
+			t.Errorf("movement types = %q, want %q", types, want)
+		}
+	})
+}
+
+func TestMedicineWithStockHistoryIsKept(t *testing.T) {
+	eachRepository(t, func(t *testing.T, repos Repositories) {
+		actor := testActor()
+		medicine, _ := seedStock(t, repos, actor, 10, time.Now().AddDate(1, 0, 0))
+		sell(t, repos, actor, medicine.ID, 10)
+
+		// Even with no stock left, the batch and ledger keep the medicine
+		if err := repos.Medicines.Delete(actor, medicine.ID, 0); err != ErrInUse {
+			t.Fatalf("delete of a medicine with history: %v", err)
+		}
+		movements, err := repos.Stock.Movements(ListQuery{
+			Limit:   10,
+			Filters: []FilterValue{{Param: "medicine_id", Value: medicine.ID}},
+			Sort:    []SortField{{Field: "id"}},
+		})
+		if err != nil || movements.Total != 2 {
+			t.Errorf("movements = %+v, %v", movements, err)
+		}
+
+		unused, err := repos.Medicines.Create(actor, models.CreateMedicineRequest{Name: "Ibuprofen", Price: 300})
+		if err != nil {
+			t.Fatalf("create medicine: %v", err)
+		}
+		if err = repos.Medicines.Delete(actor, unused.ID, 0); err != nil {
+			t.Errorf("delete of a medicine without history: %v", err)
+		}
+		if _, err = repos.Medicines.Get(unused.ID); err != ErrNotFound {
+			t.Errorf("get deleted medicine: %v", err)
+		}
+	})
+}
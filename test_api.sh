@@ -4,6 +4,11 @@
 # This script tests the main endpoints of the API
 
 API_URL="${API_URL:-http://localhost:8080}"
+# The admin account is created at server startup from ADMIN_USERNAME/ADMIN_PASSWORD.
+# Start the server with MFA_REQUIRED_ROLES=none, otherwise the admin login
+# returns a two-factor challenge instead of a token.
+ADMIN_USERNAME="${ADMIN_USERNAME:-admin}"
+ADMIN_PASSWORD="${ADMIN_PASSWORD:-admin123}"
 
 echo "=== Pharmacy Backend API Testing ==="
 echo "API URL: $API_URL"
@@ -14,31 +19,36 @@ echo "1. Testing Health Endpoint..."
 curl -s "$API_URL/health" | jq .
 echo ""
 
-# Register a new user
+# Register a new user (always gets the cashier role)
 echo "2. Registering a new user..."
 REGISTER_RESPONSE=$(curl -s -X POST "$API_URL/api/auth/register" \
   -H "Content-Type: application/json" \
   -d '{
-    "username": "admin",
-    "email": "admin@pharmacy.com",
-    "password": "admin123",
-    "role": "admin"
+    "username": "cashier",
+    "email": "cashier@pharmacy.com",
+    "password": "till-pass-2024"
   }')
 echo "$REGISTER_RESPONSE" | jq .
 echo ""
 
 # Login
-echo "3. Logging in..."
+echo "3. Logging in as admin..."
 LOGIN_RESPONSE=$(curl -s -X POST "$API_URL/api/auth/login" \
   -H "Content-Type: application/json" \
-  -d '{
-    "username": "admin",
-    "password": "admin123"
-  }')
+  -d "{
+    \"username\": \"$ADMIN_USERNAME\",
+    \"password\": \"$ADMIN_PASSWORD\"
+  }")
 echo "$LOGIN_RESPONSE" | jq .
 
-# Extract token
+if [ "$(echo "$LOGIN_RESPONSE" | jq -r '.mfa_required')" = "true" ]; then
+  echo "Login requires two-factor authentication; restart the server with MFA_REQUIRED_ROLES=none"
+  exit 1
+fi
+
+# Extract tokens
 TOKEN=$(echo "$LOGIN_RESPONSE" | jq -r '.token')
+REFRESH_TOKEN=$(echo "$LOGIN_RESPONSE" | jq -r '.refresh_token')
 echo "Token: ${TOKEN:0:50}..."
 echo ""
 
@@ -69,7 +79,7 @@ echo ""
 
 # Get all medicines
 echo "6. Getting all medicines..."
-curl -s "$API_URL/api/medicines" \
+curl -s "$API_URL/api/medicines?sort=name&limit=10" \
   -H "Authorization: Bearer $TOKEN" | jq .
 echo ""
 
@@ -99,7 +109,9 @@ if [ "$MEDICINE_ID" != "null" ] && [ "$SUPPLIER_ID" != "null" ]; then
       \"medicine_id\": $MEDICINE_ID,
       \"supplier_id\": $SUPPLIER_ID,
       \"quantity\": 50,
-      \"unit_price\": 120.00
+      \"unit_price\": 120.00,
+      \"batch_number\": \"LOT-2024-001\",
+      \"expiry_date\": \"2026-06-30T00:00:00Z\"
     }" | jq .
   echo ""
 fi
@@ -110,9 +122,11 @@ if [ "$MEDICINE_ID" != "null" ]; then
   curl -s -X POST "$API_URL/api/sales" \
     -H "Content-Type: application/json" \
     -H "Authorization: Bearer $TOKEN" \
+    -H "Idempotency-Key: test-sale-$(date +%s)" \
     -d "{
-      \"medicine_id\": $MEDICINE_ID,
-      \"quantity\": 2
+      \"items\": [
+        {\"medicine_id\": $MEDICINE_ID, \"quantity\": 2}
+      ]
     }" | jq .
   echo ""
 fi
@@ -123,4 +137,41 @@ curl -s "$API_URL/api/sales" \
   -H "Authorization: Bearer $TOKEN" | jq .
 echo ""
 
+# Create an API key for the cashier, as used by a POS terminal
+CASHIER_ID=$(echo "$REGISTER_RESPONSE" | jq -r '.user.id')
+if [ "$CASHIER_ID" != "null" ]; then
+  echo "11. Creating an API key for the cashier..."
+  API_KEY_RESPONSE=$(curl -s -X POST "$API_URL/api/api-keys" \
+    -H "Content-Type: application/json" \
+    -H "Authorization: Bearer $TOKEN" \
+    -d "{
+      \"name\": \"Till 1\",
+      \"user_id\": $CASHIER_ID,
+      \"scopes\": [\"medicines:read\", \"sales:create\"]
+    }")
+  echo "$API_KEY_RESPONSE" | jq .
+  API_KEY=$(echo "$API_KEY_RESPONSE" | jq -r '.key')
+  echo ""
+
+  echo "12. Getting medicines with the API key..."
+  curl -s "$API_URL/api/medicines" \
+    -H "Authorization: Bearer $API_KEY" | jq .
+  echo ""
+fi
+
+# Refresh the access token
+echo "13. Refreshing the access token..."
+REFRESH_RESPONSE=$(curl -s -X POST "$API_URL/api/auth/refresh" \
+  -H "Content-Type: application/json" \
+  -d "{\"refresh_token\": \"$REFRESH_TOKEN\"}")
+echo "$REFRESH_RESPONSE" | jq .
+TOKEN=$(echo "$REFRESH_RESPONSE" | jq -r '.token')
+echo ""
+
+# Logout
+echo "14. Logging out..."
+curl -s -o /dev/null -w "%{http_code}\n" -X POST "$API_URL/api/auth/logout" \
+  -H "Authorization: Bearer $TOKEN"
+echo ""
+
 echo "=== Testing Complete ==="
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, so keys are recognisable in headers,
+// logs and secret scanners
+const APIKeyPrefix = "phk_"
+
+// apiKeyIDLength is the length of the hex ID after APIKeyPrefix that
+// identifies a key without revealing its secret part
+const apiKeyIDLength = 8
+
+// GenerateAPIKey generates an API key of the form phk_<id>_<secret> and
+// returns it together with its public prefix (phk_<id>)
+func GenerateAPIKey() (key, prefix string, err error) {
+	id := make([]byte, apiKeyIDLength/2)
+	if _, err = rand.Read(id); err != nil {
+		return "", "", err
+	}
+	secret, err := GenerateRandomString(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	prefix = APIKeyPrefix + hex.EncodeToString(id)
+	return prefix + "_" + secret, prefix, nil
+}
+
+// ParseAPIKey returns the public prefix of an API key, or false if the key is
+// malformed
+func ParseAPIKey(key string) (string, bool) {
+	n := len(APIKeyPrefix) + apiKeyIDLength
+	if !strings.HasPrefix(key, APIKeyPrefix) || len(key) <= n+1 || key[n] != '_' {
+		return "", false
+	}
+	if _, err := hex.DecodeString(key[len(APIKeyPrefix):n]); err != nil {
+		return "", false
+	}
+	return key[:n], true
+}
@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, prefix, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey: %v", err)
+	}
+	if !strings.HasPrefix(key, prefix+"_") {
+		t.Errorf("key %q does not start with its prefix %q", key, prefix)
+	}
+
+	parsed, ok := ParseAPIKey(key)
+	if !ok || parsed != prefix {
+		t.Errorf("ParseAPIKey(%q) = %q, %v, want %q, true", key, parsed, ok, prefix)
+	}
+
+	other, otherPrefix, err := GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey: %v", err)
+	}
+	if other == key || otherPrefix == prefix {
+		t.Error("two keys are the same")
+	}
+}
+
+func TestParseAPIKeyRejectsMalformed(t *testing.T) {
+	for _, key := range []string{
+		"",
+		"phk_",
+		"phk_0123abcd",
+		"phk_0123abcd_",
+		"phk_0123abcdX secret",
+		"phk_0123abcz_secret",
+		"xyz_0123abcd_secret",
+		"eyJhbGciOiJIUzI1NiJ9.e30.sig",
+	} {
+		if prefix, ok := ParseAPIKey(key); ok {
+			t.Errorf("ParseAPIKey(%q) = %q, true, want false", key, prefix)
+		}
+	}
+}
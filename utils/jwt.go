@@ -9,10 +9,27 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// Purposes of restricted tokens. Such tokens only prove the password step of
+// a login and are never accepted as access tokens.
+const (
+	TokenPurposeMFA      = "mfa"
+	TokenPurposeMFAEnrol = "mfa_enrol"
+)
+
+// Token types, sent as the typ header. Access tokens are typed as in RFC 9068
+// so services verifying them with the published keys can tell them apart from
+// purpose tokens, which are only meant for this API.
+const (
+	accessTokenType  = "at+jwt"
+	purposeTokenType = "purpose+jwt"
+)
+
 type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
+	UserID    int    `json:"user_id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	SessionID int    `json:"sid,omitempty"`
+	Purpose   string `json:"purpose,omitempty"`
 	jwt.RegisteredClaims
 }
 
@@ -28,36 +45,85 @@ func CheckPasswordHash(password, hash string) bool {
 	return err == nil
 }
 
-// GenerateToken generates a JWT token for a user
-func GenerateToken(user *models.User, secret string, expiration time.Duration) (string, error) {
+// IsPasswordHash reports whether hash is a bcrypt hash. Users without a local
+// password, such as invited users and users of the identity provider, have
+// none.
+func IsPasswordHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+// GenerateToken generates a JWT access token for a user's session. Every
+// token gets a unique ID (jti) so it can be revoked individually.
+func GenerateToken(user *models.User, sessionID int, keys *KeySet, expiration time.Duration) (string, error) {
+	jti, err := GenerateRandomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			Issuer:    keys.issuer,
+			Audience:  jwt.ClaimStrings{keys.audience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+
+	return keys.Sign(accessTokenType, claims)
+}
+
+// purposeAudience is the audience of purpose tokens, which is never the
+// audience of access tokens
+func purposeAudience(keys *KeySet, purpose string) string {
+	return keys.audience + "/" + purpose
+}
+
+// GeneratePurposeToken generates a short-lived token restricted to a purpose,
+// such as completing a two-factor login. Its type and audience differ from
+// those of access tokens, so it is not accepted as one.
+func GeneratePurposeToken(user *models.User, purpose string, keys *KeySet, expiration time.Duration) (string, error) {
 	claims := &Claims{
 		UserID:   user.ID,
 		Username: user.Username,
 		Role:     user.Role,
+		Purpose:  purpose,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    keys.issuer,
+			Audience:  jwt.ClaimStrings{purposeAudience(keys, purpose)},
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(secret))
+	return keys.Sign(purposeTokenType, claims)
 }
 
-// ValidateToken validates a JWT token and returns the claims
-func ValidateToken(tokenString, secret string) (*Claims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return []byte(secret), nil
-	})
+// ValidateToken validates a JWT access token against the key set and returns
+// the claims. Purpose tokens are rejected.
+func ValidateToken(tokenString string, keys *KeySet) (*Claims, error) {
+	return validate(tokenString, keys, accessTokenType, keys.audience, "")
+}
+
+// ValidatePurposeToken validates a token restricted to a purpose against the
+// key set and returns the claims. Access tokens and tokens for other
+// purposes are rejected.
+func ValidatePurposeToken(tokenString, purpose string, keys *KeySet) (*Claims, error) {
+	return validate(tokenString, keys, purposeTokenType, purposeAudience(keys, purpose), purpose)
+}
 
+func validate(tokenString string, keys *KeySet, typ, audience, purpose string) (*Claims, error) {
+	token, err := keys.Parse(tokenString, typ, audience, &Claims{})
 	if err != nil {
 		return nil, err
 	}
 
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, ok := token.Claims.(*Claims); ok && token.Valid && claims.Purpose == purpose {
 		return claims, nil
 	}
 
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+)
+
+func TestGenerateAndValidateToken(t *testing.T) {
+	user := &models.User{ID: 7, Username: "alice", Role: models.RolePharmacist}
+	keys := NewHMACKeySet("secret")
+
+	first, err := GenerateToken(user, 42, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	second, err := GenerateToken(user, 42, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+
+	claims, err := ValidateToken(first, keys)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.UserID != 7 || claims.Username != "alice" || claims.Role != models.RolePharmacist {
+		t.Errorf("unexpected user claims: %+v", claims)
+	}
+	if claims.SessionID != 42 {
+		t.Errorf("SessionID = %d, want 42", claims.SessionID)
+	}
+	if claims.ID == "" {
+		t.Error("token has no jti")
+	}
+
+	other, err := ValidateToken(second, keys)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.ID == other.ID {
+		t.Error("two tokens share the same jti")
+	}
+
+	if _, err := ValidateToken(first, NewHMACKeySet("wrong-secret")); err == nil {
+		t.Error("token accepted with the wrong secret")
+	}
+
+	expired, err := GenerateToken(user, 42, keys, -time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if _, err := ValidateToken(expired, keys); err == nil {
+		t.Error("expired token accepted")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	token, err := GenerateRandomString(32)
+	if err != nil {
+		t.Fatalf("GenerateRandomString: %v", err)
+	}
+	if HashToken(token) != HashToken(token) {
+		t.Error("HashToken is not deterministic")
+	}
+	if HashToken(token) == token {
+		t.Error("HashToken returned the token itself")
+	}
+	if len(HashToken(token)) != 64 {
+		t.Errorf("len(HashToken) = %d, want 64", len(HashToken(token)))
+	}
+}
+
+func TestIsPasswordHash(t *testing.T) {
+	hash, err := HashPassword("secret12")
+	if err != nil {
+		t.Fatalf("HashPassword: %v", err)
+	}
+	if !IsPasswordHash(hash) {
+		t.Errorf("IsPasswordHash(%q) = false", hash)
+	}
+	for _, hash := range []string{"", "-", "not a bcrypt hash"} {
+		if IsPasswordHash(hash) {
+			t.Errorf("IsPasswordHash(%q) = true", hash)
+		}
+	}
+}
+
+func TestTokenAudiences(t *testing.T) {
+	user := &models.User{ID: 7, Username: "alice", Role: models.RolePharmacist}
+	keys := NewHMACKeySet("secret")
+	keys.SetIssuer("https://pharmacy.example.com", "pharmacy")
+
+	access, err := GenerateToken(user, 42, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	claims, err := ValidateToken(access, keys)
+	if err != nil {
+		t.Fatalf("ValidateToken: %v", err)
+	}
+	if claims.Issuer != "https://pharmacy.example.com" || len(claims.Audience) != 1 || claims.Audience[0] != "pharmacy" {
+		t.Errorf("iss = %q, aud = %v", claims.Issuer, claims.Audience)
+	}
+	if _, err := ValidatePurposeToken(access, TokenPurposeMFA, keys); err == nil {
+		t.Error("access token accepted as a challenge token")
+	}
+
+	// A challenge token only proves the password, so it is not an access
+	// token, nor an enrolment token
+	challenge, err := GeneratePurposeToken(user, TokenPurposeMFA, keys, time.Minute)
+	if err != nil {
+		t.Fatalf("GeneratePurposeToken: %v", err)
+	}
+	if _, err := ValidateToken(challenge, keys); err == nil {
+		t.Error("challenge token accepted as an access token")
+	}
+	if _, err := ValidatePurposeToken(challenge, TokenPurposeMFAEnrol, keys); err == nil {
+		t.Error("challenge token accepted as an enrolment token")
+	}
+	claims, err = ValidatePurposeToken(challenge, TokenPurposeMFA, keys)
+	if err != nil {
+		t.Fatalf("ValidatePurposeToken: %v", err)
+	}
+	if claims.UserID != 7 || claims.Purpose != TokenPurposeMFA {
+		t.Errorf("unexpected challenge claims: %+v", claims)
+	}
+
+	// Tokens of another issuer or for another audience are refused
+	other := NewHMACKeySet("secret")
+	if _, err := ValidateToken(access, other); err == nil {
+		t.Error("token accepted from another issuer")
+	}
+	other.SetIssuer("https://pharmacy.example.com", "inventory")
+	if _, err := ValidateToken(access, other); err == nil {
+		t.Error("token accepted for another audience")
+	}
+}
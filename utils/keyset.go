@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// hmacKeyID is the kid of the shared-secret key used when no key files are
+// configured
+const hmacKeyID = "hs256"
+
+// DefaultTokenAudience is the issuer and audience of tokens unless SetIssuer
+// names others
+const DefaultTokenAudience = "pharmacy-api"
+
+// signingKey is a key that can verify tokens, and sign them if the private
+// key is known
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private any
+	public  any
+}
+
+// KeySet holds the key tokens are signed with and every key tokens are
+// accepted from. Keys are identified by the kid header, so a new signing key
+// can be introduced while tokens signed with the previous one stay valid.
+// Tokens are issued by issuer, for audience.
+type KeySet struct {
+	signing  *signingKey
+	verify   map[string]*signingKey
+	issuer   string
+	audience string
+}
+
+// NewHMACKeySet returns a key set that signs and verifies with a shared
+// secret (HS256). It is meant for local development; other services cannot
+// verify such tokens without knowing the secret.
+func NewHMACKeySet(secret string) *KeySet {
+	key := &signingKey{
+		id:      hmacKeyID,
+		method:  jwt.SigningMethodHS256,
+		private: []byte(secret),
+		public:  []byte(secret),
+	}
+	return &KeySet{
+		signing:  key,
+		verify:   map[string]*signingKey{key.id: key},
+		issuer:   DefaultTokenAudience,
+		audience: DefaultTokenAudience,
+	}
+}
+
+// LoadKeySet reads the PEM-encoded RSA (RS256) or Ed25519 (EdDSA) private key
+// tokens are signed with, plus any older keys (public or private) that tokens
+// are still accepted from during a rotation. Each key's kid is its RFC 7638
+// thumbprint.
+func LoadKeySet(signingKeyFile string, verifyKeyFiles []string) (*KeySet, error) {
+	signing, err := loadKeyFile(signingKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if signing.private == nil {
+		return nil, fmt.Errorf("%s: signing key must be a private key", signingKeyFile)
+	}
+
+	ks := &KeySet{
+		signing:  signing,
+		verify:   map[string]*signingKey{signing.id: signing},
+		issuer:   DefaultTokenAudience,
+		audience: DefaultTokenAudience,
+	}
+	for _, file := range verifyKeyFiles {
+		key, err := loadKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		ks.verify[key.id] = key
+	}
+
+	return ks, nil
+}
+
+// SetIssuer sets the iss claim of the tokens signed and the aud claim of
+// access tokens, which tokens must carry to be accepted
+func (ks *KeySet) SetIssuer(issuer, audience string) {
+	ks.issuer = issuer
+	ks.audience = audience
+}
+
+// Sign signs claims with the current signing key, as a token of type typ
+func (ks *KeySet) Sign(typ string, claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signing.method, claims)
+	token.Header["kid"] = ks.signing.id
+	token.Header["typ"] = typ
+	return token.SignedString(ks.signing.private)
+}
+
+// Parse verifies a token of type typ against the key named by its kid header
+// and decodes its claims. The algorithm must match the key, so a token cannot
+// pick a weaker algorithm than the key was made for. The token must be issued
+// by this key set's issuer for audience.
+func (ks *KeySet) Parse(tokenString, typ, audience string, claims jwt.Claims) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		if got, _ := token.Header["typ"].(string); !strings.EqualFold(got, typ) {
+			return nil, errors.New("unexpected token type")
+		}
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" && ks.signing.id == hmacKeyID {
+			kid = hmacKeyID
+		}
+		key, ok := ks.verify[kid]
+		if !ok {
+			return nil, errors.New("unknown signing key")
+		}
+		if token.Method.Alg() != key.method.Alg() {
+			return nil, errors.New("unexpected signing method")
+		}
+		return key.public, nil
+	}, jwt.WithExpirationRequired(), jwt.WithIssuer(ks.issuer), jwt.WithAudience(audience))
+}
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys tokens are accepted from, for other services
+// to verify tokens with. Shared-secret keys are never published.
+func (ks *KeySet) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range ks.verify {
+		if jwk, ok := toJWK(key.id, key.public); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+func loadKeyFile(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	key := &signingKey{}
+	if signer, ok := parsed.(crypto.Signer); ok {
+		key.private = signer
+		key.public = signer.Public()
+	} else {
+		key.public = parsed
+	}
+
+	switch pub := key.public.(type) {
+	case *rsa.PublicKey:
+		key.method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("%s: unsupported key type %T, use RSA or Ed25519", path, pub)
+	}
+
+	jwk, _ := toJWK("", key.public)
+	key.id = jwkThumbprint(jwk)
+	return key, nil
+}
+
+func toJWK(kid string, public any) (JWK, bool) {
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		return JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			N:   b64(pub.N.Bytes()),
+			E:   b64(big.NewInt(int64(pub.E)).Bytes()),
+		}, true
+	case ed25519.PublicKey:
+		return JWK{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Alg: jwt.SigningMethodEdDSA.Alg(),
+			Crv: "Ed25519",
+			X:   b64(pub),
+		}, true
+	}
+	return JWK{}, false
+}
+
+// jwkThumbprint computes the RFC 7638 thumbprint of a key: the SHA-256 of its
+// required members in lexicographic order
+func jwkThumbprint(jwk JWK) string {
+	var members any
+	if jwk.Kty == "RSA" {
+		members = struct {
+			E   string `json:"e"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+		}{jwk.E, jwk.Kty, jwk.N}
+	} else {
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	}
+
+	data, _ := json.Marshal(members)
+	sum := sha256.Sum256(data)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
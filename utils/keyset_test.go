@@ -0,0 +1,220 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alfinkly/hci-golang-back/models"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeKey writes a PEM key to a temporary file and returns its path
+func writeKey(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return path
+}
+
+func writePrivateKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey: %v", err)
+	}
+	return writeKey(t, "PRIVATE KEY", der)
+}
+
+func writePublicKey(t *testing.T, key any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	return writeKey(t, "PUBLIC KEY", der)
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	return key
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey: %v", err)
+	}
+	return key
+}
+
+func TestKeySetSignsWithKeyType(t *testing.T) {
+	user := &models.User{ID: 7, Username: "alice", Role: models.RoleAdmin}
+
+	tests := []struct {
+		name string
+		key  any
+		alg  string
+		kty  string
+	}{
+		{"rsa", newRSAKey(t), "RS256", "RSA"},
+		{"ed25519", newEd25519Key(t), "EdDSA", "OKP"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := LoadKeySet(writePrivateKey(t, tt.key), nil)
+			if err != nil {
+				t.Fatalf("LoadKeySet: %v", err)
+			}
+
+			token, err := GenerateToken(user, 1, keys, time.Minute)
+			if err != nil {
+				t.Fatalf("GenerateToken: %v", err)
+			}
+
+			parsed, _, err := jwt.NewParser().ParseUnverified(token, &Claims{})
+			if err != nil {
+				t.Fatalf("ParseUnverified: %v", err)
+			}
+			if parsed.Method.Alg() != tt.alg {
+				t.Errorf("alg = %s, want %s", parsed.Method.Alg(), tt.alg)
+			}
+
+			jwks := keys.JWKS()
+			if len(jwks.Keys) != 1 {
+				t.Fatalf("JWKS has %d keys, want 1", len(jwks.Keys))
+			}
+			jwk := jwks.Keys[0]
+			if jwk.Kty != tt.kty || jwk.Alg != tt.alg || jwk.Use != "sig" {
+				t.Errorf("unexpected JWK: %+v", jwk)
+			}
+			if parsed.Header["kid"] != jwk.Kid {
+				t.Errorf("kid = %v, want %s", parsed.Header["kid"], jwk.Kid)
+			}
+
+			claims, err := ValidateToken(token, keys)
+			if err != nil {
+				t.Fatalf("ValidateToken: %v", err)
+			}
+			if claims.UserID != 7 {
+				t.Errorf("UserID = %d, want 7", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	user := &models.User{ID: 7, Username: "alice", Role: models.RoleAdmin}
+	oldKey := newRSAKey(t)
+	newKey := newEd25519Key(t)
+
+	oldKeys, err := LoadKeySet(writePrivateKey(t, oldKey), nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	oldToken, err := GenerateToken(user, 1, oldKeys, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+
+	// The old key stays trusted by its public half while it is rotated out
+	rotated, err := LoadKeySet(writePrivateKey(t, newKey), []string{writePublicKey(t, &oldKey.PublicKey)})
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	if _, err := ValidateToken(oldToken, rotated); err != nil {
+		t.Errorf("token of the old key rejected during rotation: %v", err)
+	}
+	if len(rotated.JWKS().Keys) != 2 {
+		t.Errorf("JWKS has %d keys, want 2", len(rotated.JWKS().Keys))
+	}
+
+	newToken, err := GenerateToken(user, 1, rotated, time.Minute)
+	if err != nil {
+		t.Fatalf("GenerateToken: %v", err)
+	}
+	if _, err := ValidateToken(newToken, oldKeys); err == nil {
+		t.Error("token accepted by a key set without its key")
+	}
+
+	// Once the old key is dropped its tokens are rejected
+	retired, err := LoadKeySet(writePrivateKey(t, newKey), nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	if _, err := ValidateToken(oldToken, retired); err == nil {
+		t.Error("token of a retired key accepted")
+	}
+	if _, err := ValidateToken(newToken, retired); err != nil {
+		t.Errorf("ValidateToken: %v", err)
+	}
+}
+
+func TestKeySetRejectsAlgorithmConfusion(t *testing.T) {
+	key := newRSAKey(t)
+	keys, err := LoadKeySet(writePrivateKey(t, key), nil)
+	if err != nil {
+		t.Fatalf("LoadKeySet: %v", err)
+	}
+	kid := keys.JWKS().Keys[0].Kid
+
+	// An HS256 token whose secret is the public key, naming the RSA key
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("MarshalPKIXPublicKey: %v", err)
+	}
+	claims := &Claims{
+		UserID: 1,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+		},
+	}
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	forged.Header["kid"] = kid
+	token, err := forged.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	if _, err := ValidateToken(token, keys); err == nil {
+		t.Error("HS256 token accepted for an RSA key")
+	}
+
+	// Unsigned tokens are never accepted
+	unsigned := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+	unsigned.Header["kid"] = kid
+	token, err = unsigned.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatalf("SignedString: %v", err)
+	}
+	if _, err := ValidateToken(token, keys); err == nil {
+		t.Error("unsigned token accepted")
+	}
+}
+
+func TestLoadKeySetRejectsPublicSigningKey(t *testing.T) {
+	key := newEd25519Key(t)
+	if _, err := LoadKeySet(writePublicKey(t, key.Public()), nil); err == nil {
+		t.Error("public key accepted as signing key")
+	}
+}
+
+func TestHMACKeySetPublishesNoKeys(t *testing.T) {
+	if n := len(NewHMACKeySet("secret").JWKS().Keys); n != 0 {
+		t.Errorf("JWKS has %d keys, want 0", n)
+	}
+}
@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// Password policy limits. bcrypt ignores everything after 72 bytes, so longer
+// passwords are rejected rather than silently truncated.
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+// ValidatePassword checks a new password against the password policy
+func ValidatePassword(password, username string) error {
+	if len(password) < MinPasswordLength {
+		return errors.New("password must be at least 8 characters long")
+	}
+	if len(password) > MaxPasswordLength {
+		return errors.New("password must be at most 72 bytes long")
+	}
+
+	var hasLetter, hasDigit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			hasLetter = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		}
+	}
+	if !hasLetter || !hasDigit {
+		return errors.New("password must contain at least one letter and one digit")
+	}
+
+	if username != "" && strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidatePassword(t *testing.T) {
+	tests := []struct {
+		password string
+		username string
+		valid    bool
+	}{
+		{"secret12", "alice", true},
+		{"Пароль2024", "alice", true},
+		{"short1", "alice", false},
+		{"onlyletters", "alice", false},
+		{"1234567890", "alice", false},
+		{"Alice2024!", "alice", false},
+		{strings.Repeat("a1", 36), "alice", true},
+		{strings.Repeat("a1", 36) + "b", "alice", false},
+	}
+
+	for _, tt := range tests {
+		err := ValidatePassword(tt.password, tt.username)
+		if (err == nil) != tt.valid {
+			t.Errorf("ValidatePassword(%q, %q) = %v, want valid=%v", tt.password, tt.username, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 4226 appendix D and RFC 6238 appendix B (SHA-1)
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTPRFC4226(t *testing.T) {
+	want := []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	}
+	for counter, code := range want {
+		if got := hotp(rfcKey, uint64(counter), 6); got != code {
+			t.Errorf("hotp(counter=%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestTOTPRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		if got := hotp(rfcKey, totpStep(time.Unix(tt.unix, 0)), 8); got != tt.code {
+			t.Errorf("TOTP at %d = %s, want %s", tt.unix, got, tt.code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1111111109, 0)
+
+	code, err := TOTPCode(secret, now)
+	if err != nil {
+		t.Fatalf("TOTPCode: %v", err)
+	}
+	if code != "081804" {
+		t.Errorf("TOTPCode = %s, want 081804", code)
+	}
+
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != int64(totpStep(now)) {
+		t.Errorf("ValidateTOTP(current) = %d, %v", step, ok)
+	}
+	if _, ok := ValidateTOTP(secret, code, now.Add(TOTPPeriod)); !ok {
+		t.Error("code from the previous period rejected")
+	}
+	if _, ok := ValidateTOTP(secret, code, now.Add(3*TOTPPeriod)); ok {
+		t.Error("code from three periods ago accepted")
+	}
+	if _, ok := ValidateTOTP(secret, "000000", now); ok {
+		t.Error("wrong code accepted")
+	}
+	if _, ok := ValidateTOTP("not base32!", code, now); ok {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestGenerateTOTPSecret(t *testing.T) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("GenerateTOTPSecret: %v", err)
+	}
+	if _, err := TOTPCode(secret, time.Now()); err != nil {
+		t.Errorf("generated secret %q is not usable: %v", secret, err)
+	}
+
+	uri := TOTPProvisioningURI("Pharmacy", "alice", secret)
+	for _, want := range []string{"otpauth://totp/Pharmacy:alice?", "secret=" + secret, "issuer=Pharmacy", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("provisioning URI %q is missing %q", uri, want)
+		}
+	}
+}